@@ -21,6 +21,8 @@ export default function AuthenticationPage({
   const [email, setEmail] = useState("");
   const [password, setPassword] = useState("");
   const [emailError, setEmailError] = useState("");
+  const [mfaToken, setMfaToken] = useState<string | null>(null);
+  const [code, setCode] = useState("");
   const [redirectUrl, setRedirectUrl] = useState<string | null>(null);
 
   const { toast } = useToast();
@@ -43,8 +45,24 @@ export default function AuthenticationPage({
     }
   }, [searchParams, router, token]);
 
-  const redirect = (url: string, token: string) => {
-    if (url.startsWith("/")) return router.push(url);
+  const redirect = async (url: string, token: string) => {
+    if (url.startsWith("/") && !url.startsWith("//")) return router.push(url);
+
+    // Only registered client redirect URIs and our own authorize endpoint are allowed.
+    try {
+      await axios.get(
+        `${process.env.NEXT_PUBLIC_BACKEND_URL!}/api/auth/validate-redirect`,
+        { params: { redirect: url } }
+      );
+    } catch {
+      return router.push("/");
+    }
+
+    // OIDC authorize requests pick up the session cookie on their own.
+    if (url.startsWith(`${process.env.NEXT_PUBLIC_BACKEND_URL!}/authorize`)) {
+      window.location.href = url;
+      return;
+    }
     window.location.href = `${url}?token=${token}`;
   };
 
@@ -63,6 +81,47 @@ export default function AuthenticationPage({
     );
   };
 
+  // Passkeys sign in on their own, or act as the second factor after a password.
+  const handlePasskey = async () => {
+    const backend = process.env.NEXT_PUBLIC_BACKEND_URL!;
+    setIsLoading(true);
+
+    try {
+      const begin = await axios.post(`${backend}/api/auth/passkey/begin`, {
+        mfaToken: mfaToken || "",
+      });
+      const credential = (await navigator.credentials.get({
+        publicKey: (PublicKeyCredential as any).parseRequestOptionsFromJSON(
+          begin.data.publicKey
+        ),
+      })) as any;
+      const passkey = {
+        challengeId: begin.data.challengeId,
+        credential: credential.toJSON(),
+      };
+
+      const response = mfaToken
+        ? await axios.post(
+            `${backend}/api/auth/login/mfa`,
+            { mfaToken, passkey },
+            { withCredentials: true }
+          )
+        : await axios.post(`${backend}/api/auth/passkey/finish`, passkey, {
+            withCredentials: true,
+          });
+      redirect(redirectUrl || "/", response.data.token);
+    } catch (error) {
+      console.error("Passkey error:", error);
+      toast({
+        title: "Passkey Error",
+        description: "Signing in with a passkey failed. Please try again.",
+        variant: "destructive",
+      });
+    } finally {
+      setIsLoading(false);
+    }
+  };
+
   const handleSubmit = async (e: React.FormEvent) => {
     e.preventDefault();
     if (!validateEmail(email)) {
@@ -72,6 +131,19 @@ export default function AuthenticationPage({
     setIsLoading(true);
 
     try {
+      if (mfaToken) {
+        // Recovery codes are written as two dash-separated groups.
+        const response = await axios.post(
+          `${process.env.NEXT_PUBLIC_BACKEND_URL!}/api/auth/login/mfa`,
+          code.includes("-")
+            ? { mfaToken, recoveryCode: code }
+            : { mfaToken, code },
+          { withCredentials: true }
+        );
+        redirect(redirectUrl || "/", response.data.token);
+        return;
+      }
+
       const response = await axios.post(
         `${process.env.NEXT_PUBLIC_BACKEND_URL!}/api/auth/login`,
         {
@@ -79,10 +151,13 @@ export default function AuthenticationPage({
           email,
           password,
           credentials: "include",
-        }
+        },
+        { withCredentials: true }
       );
 
-      if (response.status === 200) {
+      if (response.status === 200 && response.data.status === "mfa_required") {
+        setMfaToken(response.data.mfaToken);
+      } else if (response.status === 200) {
         redirect(redirectUrl || "/", response.data.token);
       } else if (response.status === 401) {
         toast({
@@ -94,7 +169,30 @@ export default function AuthenticationPage({
       } else {
         throw new Error("Login failed");
       }
-    } catch (error) {
+    } catch (error: any) {
+      if (error?.response?.data?.status === "email_unverified") {
+        await axios
+          .post(
+            `${process.env.NEXT_PUBLIC_BACKEND_URL!}/api/auth/email/verify/resend`,
+            { email }
+          )
+          .catch(() => {});
+        toast({
+          title: "Email not verified",
+          description: "Check your inbox for a verification link.",
+          variant: "destructive",
+        });
+        return;
+      }
+      if (error?.response?.status === 429) {
+        toast({
+          title: "Too many attempts",
+          description: error.response.data.error,
+          variant: "destructive",
+        });
+        setPassword("");
+        return;
+      }
       console.error("Login error:", error);
       toast({
         title: "Login Error",
@@ -128,31 +226,46 @@ export default function AuthenticationPage({
                 onSubmit={handleSubmit}
                 className="flex flex-col text-left mt-10 gap-3 items-center"
               >
-                <div className="w-[90%]">
+                {mfaToken ? (
                   <Input
-                    type="email"
-                    id="email"
-                    placeholder="Email"
-                    className={`border-[0.6px] w-full ${
-                      emailError ? "border-red-500" : ""
-                    }`}
-                    onChange={handleEmailChange}
-                    value={email}
+                    type="text"
+                    id="code"
+                    placeholder="Authenticator or recovery code"
+                    autoComplete="one-time-code"
+                    className="border-[0.6px] w-[90%]"
+                    onChange={(e) => setCode(e.target.value)}
+                    value={code}
                     required
                   />
-                  {emailError && (
-                    <p className="text-red-500 text-sm mt-1">{emailError}</p>
-                  )}
-                </div>
-                <Input
-                  type="password"
-                  id="password"
-                  placeholder="Password"
-                  className="border-[0.6px] w-[90%]"
-                  onChange={(e) => setPassword(e.target.value)}
-                  value={password}
-                  required
-                />
+                ) : (
+                  <>
+                    <div className="w-[90%]">
+                      <Input
+                        type="email"
+                        id="email"
+                        placeholder="Email"
+                        className={`border-[0.6px] w-full ${
+                          emailError ? "border-red-500" : ""
+                        }`}
+                        onChange={handleEmailChange}
+                        value={email}
+                        required
+                      />
+                      {emailError && (
+                        <p className="text-red-500 text-sm mt-1">{emailError}</p>
+                      )}
+                    </div>
+                    <Input
+                      type="password"
+                      id="password"
+                      placeholder="Password"
+                      className="border-[0.6px] w-[90%]"
+                      onChange={(e) => setPassword(e.target.value)}
+                      value={password}
+                      required
+                    />
+                  </>
+                )}
                 <Button
                   type="submit"
                   className="dark:bg-white bg-black text-white dark:text-black w-[50%]"
@@ -165,6 +278,21 @@ export default function AuthenticationPage({
                   )}
                   Login
                 </Button>
+                <Button
+                  type="button"
+                  variant="outline"
+                  className="w-[50%]"
+                  onClick={handlePasskey}
+                  disabled={isLoading}
+                >
+                  Use a passkey
+                </Button>
+                <Link
+                  href="/reset-password"
+                  className="text-sm underline text-zinc-400 dark:text-gray-400"
+                >
+                  Forgot your password?
+                </Link>
                 <hr className="w-[70%] mt-3" />
                 <p className="text-zinc-400 dark:text-gray-400 text-sm">
                   By continuing, you agree to the{" "}
@@ -0,0 +1,67 @@
+"use client";
+import { useEffect, useRef, useState } from "react";
+import { useSearchParams } from "next/navigation";
+import Image from "next/legacy/image";
+import Link from "next/link";
+import axios from "axios";
+import ThemeSwitcher from "@/components/theme/theme-switcher";
+
+export default function ChangeEmailPage() {
+  const searchParams = useSearchParams();
+  const token = searchParams.get("token");
+  const cancel = searchParams.get("action") === "cancel";
+  const [status, setStatus] = useState<"pending" | "done" | "failed">(
+    "pending"
+  );
+  const [message, setMessage] = useState("");
+  const sent = useRef(false);
+
+  useEffect(() => {
+    // Links work once, so guard against the effect running twice.
+    if (!token || sent.current) return;
+    sent.current = true;
+
+    axios
+      .post(
+        `${process.env.NEXT_PUBLIC_BACKEND_URL!}/api/auth/email/change/${
+          cancel ? "cancel" : "confirm"
+        }`,
+        { token }
+      )
+      .then((response) => {
+        setMessage(response.data.message);
+        setStatus("done");
+      })
+      .catch((error) => {
+        setMessage(error?.response?.data?.error || "");
+        setStatus("failed");
+      });
+  }, [token, cancel]);
+
+  return (
+    <div className="w-screen h-screen flex items-center justify-center flex-col">
+      <div className="absolute top-4 right-4">
+        <ThemeSwitcher />
+      </div>
+      <div className="mx-auto flex w-full flex-col justify-center space-y-6 sm:w-[350px]">
+        <div className="flex justify-center items-center gap-3">
+          <Image src="/logo.svg" width={80} height={80} alt="pragma logo" />
+          <h1 className="text-3xl font-bold">PRAGMA</h1>
+        </div>
+        <div className="flex flex-col space-y-2 text-center border-[0.5px] rounded-lg py-[5rem] px-3">
+          <h1 className="text-2xl font-semibold tracking-tight">
+            {cancel ? "Cancel email change" : "Confirm email change"}
+          </h1>
+          {status === "pending" && token && <p>Updating your account...</p>}
+          {status === "done" && <p>{message}.</p>}
+          {(status === "failed" || !token) && (
+            <p>{message || "This link is invalid or has expired."}</p>
+          )}
+          <Link href="/auth" className="underline text-sm">
+            Continue to sign in
+          </Link>
+        </div>
+      </div>
+    </div>
+  );
+}
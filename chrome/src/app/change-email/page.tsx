@@ -0,0 +1,5 @@
+import ChangeEmailPage from "./change";
+
+export default function ChangePage() {
+  return <ChangeEmailPage />;
+}
@@ -0,0 +1,5 @@
+import ResetPasswordPage from "./reset";
+
+export default function ResetPage() {
+  return <ResetPasswordPage />;
+}
@@ -0,0 +1,131 @@
+"use client";
+import { useState } from "react";
+import { useRouter, useSearchParams } from "next/navigation";
+import Image from "next/legacy/image";
+import axios from "axios";
+import { FaSpinner } from "react-icons/fa6";
+import { Input } from "@/components/ui/input";
+import { Button } from "@/components/ui/button";
+import ThemeSwitcher from "@/components/theme/theme-switcher";
+import { useToast } from "@/components/ui/use-toast";
+
+// Without a token the page asks for an email address to send a reset link to;
+// with one (from that link) it asks for the new password.
+export default function ResetPasswordPage() {
+  const token = useSearchParams().get("token");
+  const router = useRouter();
+  const { toast } = useToast();
+  const [isLoading, setIsLoading] = useState(false);
+  const [email, setEmail] = useState("");
+  const [password, setPassword] = useState("");
+  const [confirmPassword, setConfirmPassword] = useState("");
+  const [sent, setSent] = useState(false);
+
+  const handleSubmit = async (e: React.FormEvent) => {
+    e.preventDefault();
+    const backend = process.env.NEXT_PUBLIC_BACKEND_URL!;
+
+    if (token && password !== confirmPassword) {
+      toast({
+        title: "Passwords do not match",
+        variant: "destructive",
+      });
+      return;
+    }
+    setIsLoading(true);
+
+    try {
+      if (token) {
+        await axios.post(`${backend}/api/auth/password/reset`, {
+          token,
+          password,
+        });
+        toast({ title: "Password changed", description: "Please sign in." });
+        router.push("/auth");
+      } else {
+        await axios.post(`${backend}/api/auth/password/forgot`, { email });
+        setSent(true);
+      }
+    } catch (error: any) {
+      toast({
+        title: "Reset failed",
+        description:
+          error?.response?.data?.reasons
+            ?.map((r: { message: string }) => r.message)
+            .join(". ") ||
+          error?.response?.data?.error ||
+          "Please try again later.",
+        variant: "destructive",
+      });
+    } finally {
+      setIsLoading(false);
+    }
+  };
+
+  return (
+    <div className="w-screen h-screen flex items-center justify-center flex-col">
+      <div className="absolute top-4 right-4">
+        <ThemeSwitcher />
+      </div>
+      <div className="mx-auto flex w-full flex-col justify-center space-y-6 sm:w-[350px]">
+        <div className="flex justify-center items-center gap-3">
+          <Image src="/logo.svg" width={80} height={80} alt="pragma logo" />
+          <h1 className="text-3xl font-bold">PRAGMA</h1>
+        </div>
+        <div className="flex flex-col space-y-2 text-center border-[0.5px] rounded-lg py-[5rem] px-3">
+          <h1 className="text-2xl font-semibold tracking-tight">
+            Reset password
+          </h1>
+          {sent ? (
+            <p>If an account exists for that address, a reset link is on its way.</p>
+          ) : (
+            <form
+              onSubmit={handleSubmit}
+              className="flex flex-col text-left mt-10 gap-3 items-center"
+            >
+              {token ? (
+                <>
+                  <Input
+                    type="password"
+                    placeholder="New password"
+                    autoComplete="new-password"
+                    className="border-[0.6px] w-[90%]"
+                    onChange={(e) => setPassword(e.target.value)}
+                    value={password}
+                    required
+                  />
+                  <Input
+                    type="password"
+                    placeholder="Confirm new password"
+                    autoComplete="new-password"
+                    className="border-[0.6px] w-[90%]"
+                    onChange={(e) => setConfirmPassword(e.target.value)}
+                    value={confirmPassword}
+                    required
+                  />
+                </>
+              ) : (
+                <Input
+                  type="email"
+                  placeholder="Email"
+                  className="border-[0.6px] w-[90%]"
+                  onChange={(e) => setEmail(e.target.value)}
+                  value={email}
+                  required
+                />
+              )}
+              <Button
+                type="submit"
+                className="dark:bg-white bg-black text-white dark:text-black w-[50%]"
+                disabled={isLoading}
+              >
+                {isLoading && <FaSpinner className="mr-2 h-4 w-4 animate-spin" />}
+                {token ? "Set password" : "Send link"}
+              </Button>
+            </form>
+          )}
+        </div>
+      </div>
+    </div>
+  );
+}
@@ -51,10 +51,14 @@ export default function SignupPage({ token }: { token: string }) {
           );
           router.replace("/");
         }
-        await axios.get(
+        const invite = await axios.get(
           `${process.env
             .NEXT_PUBLIC_BACKEND_URL!}/api/auth/validate-invite/${inviteCode}`
         );
+        // Invites bound to an address can only be used with that address.
+        if (invite.data.email) {
+          setFormData((prev) => ({ ...prev, email: invite.data.email }));
+        }
         setLoaded(true);
       } catch (error) {
         if (token) {
@@ -136,6 +140,20 @@ export default function SignupPage({ token }: { token: string }) {
           ...prev,
           email: "Email already in use",
         }));
+      } else if (error.response?.data?.reason) {
+        toast({
+          title: "Invite not accepted",
+          description: error.response.data.error,
+          variant: "destructive",
+        });
+      } else if (error.response?.data?.reasons) {
+        // The server lists every password rule that was broken.
+        setErrors((prev) => ({
+          ...prev,
+          password: error.response.data.reasons
+            .map((r: { message: string }) => r.message)
+            .join(". "),
+        }));
       } else {
         toast({
           title: "An error occurred",
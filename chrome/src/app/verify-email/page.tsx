@@ -0,0 +1,5 @@
+import VerifyEmailPage from "./verify";
+
+export default function VerifyPage() {
+  return <VerifyEmailPage />;
+}
@@ -0,0 +1,55 @@
+"use client";
+import { useEffect, useRef, useState } from "react";
+import { useSearchParams } from "next/navigation";
+import Image from "next/legacy/image";
+import Link from "next/link";
+import axios from "axios";
+import ThemeSwitcher from "@/components/theme/theme-switcher";
+
+export default function VerifyEmailPage() {
+  const token = useSearchParams().get("token");
+  const [status, setStatus] = useState<"pending" | "verified" | "failed">(
+    "pending"
+  );
+  const sent = useRef(false);
+
+  useEffect(() => {
+    // Verification links work once, so guard against the effect running twice.
+    if (!token || sent.current) return;
+    sent.current = true;
+
+    axios
+      .post(`${process.env.NEXT_PUBLIC_BACKEND_URL!}/api/auth/email/verify`, {
+        token,
+      })
+      .then(() => setStatus("verified"))
+      .catch(() => setStatus("failed"));
+  }, [token]);
+
+  return (
+    <div className="w-screen h-screen flex items-center justify-center flex-col">
+      <div className="absolute top-4 right-4">
+        <ThemeSwitcher />
+      </div>
+      <div className="mx-auto flex w-full flex-col justify-center space-y-6 sm:w-[350px]">
+        <div className="flex justify-center items-center gap-3">
+          <Image src="/logo.svg" width={80} height={80} alt="pragma logo" />
+          <h1 className="text-3xl font-bold">PRAGMA</h1>
+        </div>
+        <div className="flex flex-col space-y-2 text-center border-[0.5px] rounded-lg py-[5rem] px-3">
+          <h1 className="text-2xl font-semibold tracking-tight">
+            Email verification
+          </h1>
+          {status === "pending" && token && <p>Verifying your address...</p>}
+          {status === "verified" && <p>Your email address is verified.</p>}
+          {(status === "failed" || !token) && (
+            <p>This link is invalid or has expired.</p>
+          )}
+          <Link href="/auth" className="underline text-sm">
+            Continue to sign in
+          </Link>
+        </div>
+      </div>
+    </div>
+  );
+}
@@ -0,0 +1,54 @@
+package database
+
+import (
+	"errors"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+)
+
+// ErrLastAdmin is returned by changes that would leave no enabled admin.
+var ErrLastAdmin = errors.New("the last admin cannot be removed")
+
+// adminLockKey is the advisory lock taken by KeepAnAdmin.
+const adminLockKey = 0x61646d696e
+
+// KeepAnAdmin runs fn in a transaction and undoes it with ErrLastAdmin if there
+// was an enabled user holding PermAdminister before and none after. Changes made
+// through it run one at a time, so two admins cannot demote each other at once.
+func KeepAnAdmin(db *pg.DB, fn func(tx *pg.Tx) error) error {
+	return db.RunInTransaction(db.Context(), func(tx *pg.Tx) error {
+		if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(?)`, adminLockKey); err != nil {
+			return err
+		}
+		before, err := CountAdmins(tx)
+		if err != nil {
+			return err
+		}
+
+		if err := fn(tx); err != nil {
+			return err
+		}
+
+		after, err := CountAdmins(tx)
+		if err != nil {
+			return err
+		}
+		if before > 0 && after == 0 {
+			return ErrLastAdmin
+		}
+		return nil
+	})
+}
+
+// CountAdmins returns how many enabled users hold PermAdminister through a role
+// of their own or of one of their groups.
+func CountAdmins(db orm.DB) (int, error) {
+	return db.Model((*User)(nil)).
+		Where(`"user".disabled_at IS NULL`).
+		Where(`EXISTS (SELECT 1 FROM roles AS r
+			WHERE r.client_id IS NULL AND ? = ANY(r.permissions) AND (
+				r.id IN (SELECT role_id FROM user_roles WHERE user_id = "user".id)
+				OR r.id IN (SELECT role_id FROM group_roles WHERE group_id IN (`+memberGroupsOf(`"user".id`)+`))))`, PermAdminister).
+		Count()
+}
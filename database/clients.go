@@ -0,0 +1,110 @@
+package database
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+)
+
+// Client is a relying party registered to sign users in through the SSO. Public
+// clients (single page and native apps) have no secret and rely on PKCE alone.
+type Client struct {
+	Id           string     `pg:"id,pk"`
+	Name         string     `pg:"name"`
+	LogoURL      string     `pg:"logo_url"`
+	SecretHash   string     `pg:"secret_hash"`
+	Public       bool       `pg:"public,use_zero"`
+	RedirectURIs []string   `pg:"redirect_uris,array"`
+	Scopes       []string   `pg:"scopes,array"`
+	CreatedBy    string     `pg:"created_by"`
+	CreatedAt    time.Time  `pg:"created_at"`
+	UpdatedAt    time.Time  `pg:"updated_at"`
+	DisabledAt   *time.Time `pg:"disabled_at"`
+}
+
+func (c Client) String() string {
+	return fmt.Sprintf("Client<%s, %s>", c.Id, c.Name)
+}
+
+func (c *Client) Create(db *DB) error {
+	_, err := db.Model(c).Insert()
+	return err
+}
+
+func (c *Client) Read(db *DB) error {
+	return db.Model(c).WherePK().Select()
+}
+
+func (c *Client) Update(db *DB) error {
+	c.UpdatedAt = time.Now()
+	_, err := db.Model(c).WherePK().Update()
+	return err
+}
+
+func (c *Client) Delete(db *DB) error {
+	_, err := db.Model(c).WherePK().Delete()
+	return err
+}
+
+func (c *Client) IsDisabled() bool {
+	return c.DisabledAt != nil
+}
+
+// AllowsRedirectURI reports whether uri exactly matches one of the registered
+// redirect URIs. No prefix or wildcard matching is done on purpose.
+func (c *Client) AllowsRedirectURI(uri string) bool {
+	return slices.Contains(c.RedirectURIs, uri)
+}
+
+// AllowsScopes reports whether every requested scope is registered for the client.
+func (c *Client) AllowsScopes(scopes []string) bool {
+	for _, scope := range scopes {
+		if !slices.Contains(c.Scopes, scope) {
+			return false
+		}
+	}
+	return true
+}
+
+func GetClient(db *DB, id string) (*Client, error) {
+	client := &Client{}
+	err := db.Model(client).
+		Where("id = ?", id).
+		Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return client, nil
+}
+
+func GetClients(db *DB) ([]*Client, error) {
+	var clients []*Client
+	err := db.Model(&clients).
+		Order("created_at ASC").
+		Select()
+	if err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
+
+// GetClientByRedirectURI returns the enabled client that registered uri, if any.
+func GetClientByRedirectURI(db *DB, uri string) (*Client, error) {
+	client := &Client{}
+	err := db.Model(client).
+		Where("? = ANY(redirect_uris)", uri).
+		Where("disabled_at IS NULL").
+		First()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return client, nil
+}
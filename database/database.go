@@ -45,6 +45,26 @@ func createSchema(db *DB) error {
 		(*UserProfile)(nil),
 		(*Socials)(nil),
 		(*InviteCode)(nil),
+		(*AuthorizationCode)(nil),
+		(*SigningKey)(nil),
+		(*Client)(nil),
+		(*RefreshToken)(nil),
+		(*Session)(nil),
+		(*TOTPDevice)(nil),
+		(*RecoveryCode)(nil),
+		(*Passkey)(nil),
+		(*WebAuthnChallenge)(nil),
+		(*PasswordResetToken)(nil),
+		(*OutboxEmail)(nil),
+		(*EmailChange)(nil),
+		(*LoginThrottle)(nil),
+		(*RateLimitBucket)(nil),
+		(*Group)(nil),
+		(*GroupMember)(nil),
+		(*GroupRole)(nil),
+		(*Permission)(nil),
+		(*Role)(nil),
+		(*UserRole)(nil),
 	}
 
 	_, err := db.Exec(`SET search_path TO public`)
@@ -61,5 +81,56 @@ func createSchema(db *DB) error {
 		}
 	}
 
+	for _, migration := range migrations {
+		_, err := db.Exec(migration)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = seedRoles(db)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
+
+// migrations bring tables created by older versions up to date, since CreateTable
+// never alters an existing table. Every statement must be safe to run repeatedly.
+var migrations = []string{
+	`ALTER TABLE authorization_codes ADD COLUMN IF NOT EXISTS session_id text`,
+	`ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS session_id text`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified_at timestamptz`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS verification_sent_at timestamptz`,
+	`ALTER TABLE invite_codes ADD COLUMN IF NOT EXISTS expires_at timestamptz`,
+	`ALTER TABLE invite_codes ADD COLUMN IF NOT EXISTS max_uses bigint NOT NULL DEFAULT 1`,
+	`ALTER TABLE invite_codes ADD COLUMN IF NOT EXISTS uses bigint NOT NULL DEFAULT 0`,
+	`ALTER TABLE invite_codes ADD COLUMN IF NOT EXISTS email text`,
+	`ALTER TABLE invite_codes ADD COLUMN IF NOT EXISTS note text`,
+	`ALTER TABLE invite_codes ADD COLUMN IF NOT EXISTS revoked_at timestamptz`,
+	`UPDATE invite_codes SET uses = 1 WHERE used_by <> '' AND uses = 0`,
+	`ALTER TABLE invite_codes ADD COLUMN IF NOT EXISTS permissions bigint NOT NULL DEFAULT 0`,
+	`ALTER TABLE invite_codes ADD COLUMN IF NOT EXISTS group_ids text[]`,
+	// The permission mask became roles. Bits are copied to the built-in roles once,
+	// and the column is kept as legacy_permissions in case it is needed. Every
+	// existing user gets the user role, since accounts used to be created with an
+	// empty mask and could still sign in to applications.
+	`DO $$
+	BEGIN
+		IF EXISTS (SELECT 1 FROM information_schema.columns
+			WHERE table_schema = 'public' AND table_name = 'users' AND column_name = 'permissions') THEN
+			INSERT INTO user_roles (user_id, role_id, created_at)
+				SELECT id, 'user', now() FROM users
+				UNION ALL SELECT id, 'editor', now() FROM users WHERE permissions & 2 <> 0
+				UNION ALL SELECT id, 'admin', now() FROM users WHERE permissions & 4 <> 0
+				ON CONFLICT DO NOTHING;
+			ALTER TABLE users RENAME COLUMN permissions TO legacy_permissions;
+		END IF;
+	END $$`,
+	`ALTER TABLE roles ADD COLUMN IF NOT EXISTS client_id text`,
+	`DROP INDEX IF EXISTS roles_name_key`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS roles_client_name_key ON roles (COALESCE(client_id, ''), name)`,
+	`ALTER TABLE groups ADD COLUMN IF NOT EXISTS parent_id text`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled_at timestamptz`,
+}
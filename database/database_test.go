@@ -1,8 +1,10 @@
 package database
 
 import (
+	"errors"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/go-pg/pg/v10"
 	"github.com/google/uuid"
@@ -105,3 +107,402 @@ func TestGetUserByEmail(t *testing.T) {
 	err = user.Delete(testDB)
 	assert.NoError(t, err)
 }
+
+func TestProcessOutbox(t *testing.T) {
+	// Queue a test email
+	now := time.Now()
+	email := &OutboxEmail{
+		Id:            uuid.New().String(),
+		Recipient:     "outbox@example.com",
+		Subject:       "Hello",
+		Text:          "Hi",
+		CreatedAt:     now,
+		NextAttemptAt: now,
+	}
+	err := email.Create(testDB)
+	assert.NoError(t, err)
+
+	// A failed attempt is retried later rather than lost
+	sent, err := ProcessOutbox(testDB, 10, func(*OutboxEmail) error { return errors.New("connection refused") })
+	assert.NoError(t, err)
+	assert.Equal(t, 0, sent)
+
+	stored := &OutboxEmail{Id: email.Id}
+	err = testDB.Model(stored).WherePK().Select()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, stored.Attempts)
+	assert.Equal(t, "connection refused", stored.LastError)
+	assert.True(t, stored.NextAttemptAt.After(now))
+	assert.Nil(t, stored.SentAt)
+
+	// Once due again it is sent exactly once
+	_, err = testDB.Model(stored).Set("next_attempt_at = ?", now).WherePK().Update()
+	assert.NoError(t, err)
+	var delivered []string
+	send := func(e *OutboxEmail) error {
+		delivered = append(delivered, e.Id)
+		return nil
+	}
+	_, err = ProcessOutbox(testDB, 10, send)
+	assert.NoError(t, err)
+	_, err = ProcessOutbox(testDB, 10, send)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{email.Id}, delivered)
+
+	// The body is cleared once sent, and the row pruned later
+	err = testDB.Model(stored).WherePK().Select()
+	assert.NoError(t, err)
+	assert.NotNil(t, stored.SentAt)
+	assert.Empty(t, stored.Text)
+	err = PruneOutbox(testDB, time.Now())
+	assert.NoError(t, err)
+	exists, err := testDB.Model(stored).WherePK().Exists()
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	assert.Equal(t, time.Minute, outboxBackoff(1))
+	assert.Equal(t, 2*time.Minute, outboxBackoff(2))
+	assert.Equal(t, 8*time.Minute, outboxBackoff(4))
+	assert.Equal(t, outboxMaxBackoff, outboxBackoff(OutboxMaxAttempts))
+}
+
+func TestInviteCheck(t *testing.T) {
+	now := time.Now()
+	past := now.Add(-time.Hour)
+
+	assert.NoError(t, (&InviteCode{MaxUses: 1}).Check("a@example.com", now))
+	assert.NoError(t, (&InviteCode{MaxUses: 0, Uses: 50}).Check("", now))
+	assert.Equal(t, ErrInviteRevoked, (&InviteCode{RevokedAt: &past}).Check("", now))
+	assert.Equal(t, ErrInviteExpired, (&InviteCode{ExpiresAt: &past}).Check("", now))
+	assert.Equal(t, ErrInviteExhausted, (&InviteCode{MaxUses: 2, Uses: 2}).Check("", now))
+
+	bound := &InviteCode{Email: "new@example.com"}
+	assert.NoError(t, bound.Check("New@Example.com", now))
+	assert.NoError(t, bound.Check("", now))
+	assert.Equal(t, ErrInviteWrongEmail, bound.Check("other@example.com", now))
+}
+
+func TestInviteUse(t *testing.T) {
+	invite := &InviteCode{Id: uuid.New().String(), CreatedAt: time.Now(), MaxUses: 2}
+	err := invite.Create(testDB)
+	assert.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		var used bool
+		err = testDB.RunInTransaction(testDB.Context(), func(tx *pg.Tx) error {
+			var err error
+			used, err = invite.Use(tx, uuid.New().String(), time.Now())
+			return err
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, i < 2, used)
+	}
+
+	invite, err = GetInviteCode(testDB, invite.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, invite.Uses)
+
+	// Clean up
+	_, err = testDB.Model(invite).WherePK().Delete()
+	assert.NoError(t, err)
+}
+
+func TestListInvites(t *testing.T) {
+	// Create a test user with one invite in each status
+	user := &User{Id: uuid.New().String(), Email: "inviter@example.com"}
+	err := user.Create(testDB)
+	assert.NoError(t, err)
+
+	now := time.Now()
+	past := now.Add(-time.Hour)
+	invites := map[string]*InviteCode{
+		InviteActive:    {MaxUses: 1},
+		InviteRevoked:   {MaxUses: 1, RevokedAt: &past},
+		InviteExpired:   {MaxUses: 1, ExpiresAt: &past},
+		InviteExhausted: {MaxUses: 1, Uses: 1},
+	}
+	for _, invite := range invites {
+		invite.Id = uuid.New().String()
+		invite.GeneratedBy = user.Id
+		invite.CreatedAt = now
+		err = invite.Create(testDB)
+		assert.NoError(t, err)
+	}
+
+	for status, invite := range invites {
+		assert.Equal(t, status, invite.Status(now))
+		found, total, err := ListInvites(testDB, InviteFilter{GeneratedBy: user.Id, Status: status}, now)
+		assert.NoError(t, err)
+		if assert.Equal(t, 1, total) {
+			assert.Equal(t, invite.Id, found[0].Id)
+		}
+	}
+
+	_, total, err := ListInvites(testDB, InviteFilter{GeneratedBy: user.Id, CreatedAfter: now.Add(time.Minute)}, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, total)
+
+	err = user.GetUserWithInvites(testDB)
+	assert.NoError(t, err)
+	assert.Len(t, user.GeneratedInvites, 4)
+
+	// Only the active invite counts against the quota
+	extra := &InviteCode{Id: uuid.New().String(), GeneratedBy: user.Id, CreatedAt: now, MaxUses: 1}
+	created, err := extra.CreateWithinQuota(testDB, 1)
+	assert.NoError(t, err)
+	assert.False(t, created)
+	created, err = extra.CreateWithinQuota(testDB, 2)
+	assert.NoError(t, err)
+	assert.True(t, created)
+
+	// Clean up
+	_, err = testDB.Model((*InviteCode)(nil)).Where("generated_by = ?", user.Id).Delete()
+	assert.NoError(t, err)
+	err = user.Delete(testDB)
+	assert.NoError(t, err)
+}
+
+func TestRoles(t *testing.T) {
+	// Keep another admin around so the test user can be demoted
+	keeper := &User{Id: uuid.New().String(), Email: "roles-keeper@example.com", Permissions: PermissionAdmin}
+	err := keeper.Create(testDB)
+	assert.NoError(t, err)
+
+	// Create a test user with the old user and admin bits
+	user := &User{
+		Id:          uuid.New().String(),
+		Email:       "roles@example.com",
+		Permissions: PermissionUser | PermissionAdmin,
+	}
+	err = user.Create(testDB)
+	assert.NoError(t, err)
+
+	readUser := &User{Id: user.Id}
+	err = readUser.Read(testDB)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{RoleUser, RoleAdmin}, readUser.RoleIds())
+	assert.True(t, readUser.IsAdmin())
+	assert.False(t, readUser.IsEditor())
+	assert.True(t, readUser.HasPermission(PermManageUsers))
+
+	// The bits still work for taking roles away
+	readUser.RemoveAdmin()
+	err = readUser.UpdatePermissions(testDB.DB)
+	assert.NoError(t, err)
+	assert.False(t, readUser.IsAdmin())
+	assert.Equal(t, []string{RoleUser}, readUser.RoleIds())
+
+	// Custom roles count towards the compatibility helpers
+	role := &Role{Id: uuid.New().String(), Name: "Support", Permissions: []string{PermAdminister}, CreatedAt: time.Now()}
+	err = role.Create(testDB)
+	assert.NoError(t, err)
+	duplicate := &Role{Id: uuid.New().String(), Name: "Support", CreatedAt: time.Now()}
+	assert.Equal(t, ErrRoleNameTaken, duplicate.Create(testDB))
+	err = AssignRole(testDB, user.Id, role.Id)
+	assert.NoError(t, err)
+	err = readUser.Read(testDB)
+	assert.NoError(t, err)
+	assert.True(t, readUser.IsAdmin())
+
+	// Listing every role puts the built-in ones first
+	roles, err := GetRoles(testDB)
+	assert.NoError(t, err)
+	if assert.GreaterOrEqual(t, len(roles), 4) {
+		assert.True(t, roles[0].BuiltIn)
+		assert.Contains(t, []string{roles[0].Id, roles[1].Id, roles[2].Id}, RoleAdmin)
+		assert.False(t, roles[len(roles)-1].BuiltIn)
+	}
+
+	builtIn, err := GetRole(testDB, RoleAdmin)
+	assert.NoError(t, err)
+	assert.Equal(t, ErrBuiltInRole, builtIn.Delete(testDB))
+
+	// Clean up
+	err = role.Delete(testDB)
+	assert.NoError(t, err)
+	err = user.Delete(testDB)
+	assert.NoError(t, err)
+	err = UnassignRole(testDB, keeper.Id, RoleAdmin)
+	assert.NoError(t, err)
+	err = keeper.Delete(testDB)
+	assert.NoError(t, err)
+}
+
+func TestLastAdmin(t *testing.T) {
+	// Create a test user who is the only admin
+	admin := &User{Id: uuid.New().String(), Email: "last-admin@example.com", Permissions: PermissionUser | PermissionAdmin}
+	err := admin.Create(testDB)
+	assert.NoError(t, err)
+	count, err := CountAdmins(testDB)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	// The last admin cannot be demoted, disabled or deleted
+	admin.RemoveAdmin()
+	assert.Equal(t, ErrLastAdmin, admin.UpdatePermissions(testDB.DB))
+	assert.Equal(t, ErrLastAdmin, admin.SetDisabled(testDB, true))
+	assert.False(t, admin.IsDisabled())
+	assert.Equal(t, ErrLastAdmin, admin.Delete(testDB))
+	err = admin.Read(testDB)
+	assert.NoError(t, err)
+	assert.True(t, admin.IsAdmin())
+
+	// Admin through a group counts too
+	group := &Group{Id: uuid.New().String(), Name: "Operators", CreatedAt: time.Now()}
+	err = group.Create(testDB)
+	assert.NoError(t, err)
+	err = AssignGroupRole(testDB, group.Id, RoleAdmin)
+	assert.NoError(t, err)
+	other := &User{Id: uuid.New().String(), Email: "other-admin@example.com"}
+	err = other.Create(testDB)
+	assert.NoError(t, err)
+	err = AddGroupMember(testDB, group.Id, other.Id)
+	assert.NoError(t, err)
+
+	err = admin.SetDisabled(testDB, true)
+	assert.NoError(t, err)
+	assert.True(t, admin.IsDisabled())
+	assert.Equal(t, ErrLastAdmin, group.Delete(testDB))
+
+	// Moving a group out of the one holding the role counts as taking it away
+	child := &Group{Id: uuid.New().String(), Name: "On call", ParentId: group.Id, CreatedAt: time.Now()}
+	err = child.Create(testDB)
+	assert.NoError(t, err)
+	err = AddGroupMember(testDB, child.Id, other.Id)
+	assert.NoError(t, err)
+	err = RemoveGroupMember(testDB, group.Id, other.Id)
+	assert.NoError(t, err)
+	child.ParentId = ""
+	assert.Equal(t, ErrLastAdmin, child.Update(testDB))
+	err = admin.SetDisabled(testDB, false)
+	assert.NoError(t, err)
+	err = admin.UpdatePermissions(testDB.DB)
+	assert.NoError(t, err)
+	assert.False(t, admin.IsAdmin())
+
+	// Clean up
+	err = admin.Delete(testDB)
+	assert.NoError(t, err)
+	err = UnassignGroupRole(testDB, group.Id, RoleAdmin)
+	assert.NoError(t, err)
+	for _, g := range []*Group{child, group} {
+		err = g.Delete(testDB)
+		assert.NoError(t, err)
+	}
+	err = other.Delete(testDB)
+	assert.NoError(t, err)
+}
+
+func TestDeleteUser(t *testing.T) {
+	// Create a test user with a row in every table that refers to users
+	user := &User{Id: uuid.New().String(), Email: "deleted@example.com", Permissions: PermissionUser}
+	err := user.Create(testDB)
+	assert.NoError(t, err)
+	group := &Group{Id: uuid.New().String(), Name: "Leavers", CreatedAt: time.Now()}
+	err = group.Create(testDB)
+	assert.NoError(t, err)
+	err = AddGroupMember(testDB, group.Id, user.Id)
+	assert.NoError(t, err)
+
+	now := time.Now()
+	profile := &UserProfile{UserId: user.Id, Name: "Deleted"}
+	_, err = testDB.Model(profile).Insert()
+	assert.NoError(t, err)
+	rows := []interface{}{
+		&Socials{UserProfileId: profile.Id, Url: "https://example.com", LinkName: "Site"},
+		&Passkey{Id: uuid.New().String(), UserId: user.Id, CreatedAt: now},
+		&WebAuthnChallenge{Id: uuid.New().String(), UserId: user.Id, CreatedAt: now, ExpiresAt: now},
+		&TOTPDevice{UserId: user.Id, CreatedAt: now},
+		&RecoveryCode{Id: uuid.New().String(), UserId: user.Id, CreatedAt: now},
+		&PasswordResetToken{Id: uuid.New().String(), UserId: user.Id, CreatedAt: now, ExpiresAt: now},
+		&EmailChange{Id: uuid.New().String(), UserId: user.Id, ConfirmHash: uuid.New().String(), CancelHash: uuid.New().String(), CreatedAt: now, ExpiresAt: now},
+		&RefreshToken{Id: uuid.New().String(), FamilyId: uuid.New().String(), UserId: user.Id, CreatedAt: now, ExpiresAt: now},
+		&AuthorizationCode{Id: uuid.New().String(), UserId: user.Id, CreatedAt: now, ExpiresAt: now},
+		&Session{Id: uuid.New().String(), UserId: user.Id, CreatedAt: now, LastSeenAt: now, ExpiresAt: now},
+		&InviteCode{Id: uuid.New().String(), GeneratedBy: user.Id, CreatedAt: now, MaxUses: 1},
+	}
+	for _, row := range rows {
+		_, err = testDB.Model(row).Insert()
+		assert.NoError(t, err)
+	}
+
+	err = user.Delete(testDB)
+	assert.NoError(t, err)
+
+	// Nothing that belonged to the user is left behind
+	for _, row := range append(rows, profile, user) {
+		exists, err := testDB.Model(row).WherePK().Exists()
+		assert.NoError(t, err)
+		assert.False(t, exists, "%T", row)
+	}
+	for _, model := range []interface{}{(*UserRole)(nil), (*GroupMember)(nil)} {
+		exists, err := testDB.Model(model).Where("user_id = ?", user.Id).Exists()
+		assert.NoError(t, err)
+		assert.False(t, exists, "%T", model)
+	}
+
+	// Clean up
+	err = group.Delete(testDB)
+	assert.NoError(t, err)
+}
+
+func TestGroups(t *testing.T) {
+	// Create a test user in a team nested inside a department
+	user := &User{Id: uuid.New().String(), Email: "groups@example.com"}
+	err := user.Create(testDB)
+	assert.NoError(t, err)
+
+	department := &Group{Id: uuid.New().String(), Name: "Engineering", CreatedAt: time.Now()}
+	team := &Group{Id: uuid.New().String(), Name: "Docs", ParentId: department.Id, CreatedAt: time.Now()}
+	for _, group := range []*Group{department, team} {
+		err = group.Create(testDB)
+		assert.NoError(t, err)
+	}
+	err = AddGroupMember(testDB, team.Id, user.Id)
+	assert.NoError(t, err)
+
+	groups, err := GetUserGroups(testDB, user.Id)
+	assert.NoError(t, err)
+	if assert.Len(t, groups, 2) {
+		assert.Equal(t, "Docs", groups[0].Name)
+		assert.Equal(t, "Engineering", groups[1].Name)
+	}
+
+	// Roles given to a parent group reach members of nested groups
+	grants, err := GroupGrantsRoles(testDB, team.Id)
+	assert.NoError(t, err)
+	assert.False(t, grants)
+	err = AssignGroupRole(testDB, department.Id, RoleEditor)
+	assert.NoError(t, err)
+	grants, err = GroupGrantsRoles(testDB, team.Id)
+	assert.NoError(t, err)
+	assert.True(t, grants)
+	err = user.Read(testDB)
+	assert.NoError(t, err)
+	assert.True(t, user.IsEditor())
+
+	// A group cannot be moved inside itself or its own subgroup
+	department.ParentId = team.Id
+	assert.Equal(t, ErrGroupCycle, department.Update(testDB))
+	department.ParentId = department.Id
+	assert.Equal(t, ErrGroupCycle, department.Update(testDB))
+
+	// Deleting the department moves the team to the top level
+	department.ParentId = ""
+	err = department.Delete(testDB)
+	assert.NoError(t, err)
+	team, err = GetGroup(testDB, team.Id)
+	assert.NoError(t, err)
+	assert.Empty(t, team.ParentId)
+	err = user.Read(testDB)
+	assert.NoError(t, err)
+	assert.False(t, user.IsEditor())
+
+	// Clean up
+	err = team.Delete(testDB)
+	assert.NoError(t, err)
+	err = user.Delete(testDB)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,166 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+)
+
+var (
+	// ErrEmailTaken is returned when an address is already used by another account.
+	ErrEmailTaken = errors.New("email address already in use")
+
+	// errEmailChangeClosed rolls back a confirmation or cancellation that lost a
+	// race with another one.
+	errEmailChangeClosed = errors.New("email change no longer applies")
+)
+
+// EmailChange is a user's request to move their account to a new address. The
+// new address receives a confirmation link and the old one a notice with a link
+// to cancel, which also undoes the change if it was already confirmed. Only the
+// SHA-256 hashes of both link tokens are stored.
+type EmailChange struct {
+	Id          string     `pg:"id,pk"`
+	UserId      string     `pg:"user_id"`
+	OldEmail    string     `pg:"old_email"`
+	NewEmail    string     `pg:"new_email"`
+	ConfirmHash string     `pg:"confirm_hash,unique"`
+	CancelHash  string     `pg:"cancel_hash,unique"`
+	CreatedAt   time.Time  `pg:"created_at"`
+	ExpiresAt   time.Time  `pg:"expires_at"`
+	ConfirmedAt *time.Time `pg:"confirmed_at"`
+	CancelledAt *time.Time `pg:"cancelled_at"`
+}
+
+func (e *EmailChange) Create(db *DB) error {
+	_, err := db.Model(e).Insert()
+	return err
+}
+
+func (e *EmailChange) IsPending() bool {
+	return e.ConfirmedAt == nil && e.CancelledAt == nil && time.Now().Before(e.ExpiresAt)
+}
+
+// Confirm moves the user to the new address, marks it verified and updates the
+// profile email to match. It reports false if the change is no longer pending or
+// the user's address changed in the meantime.
+func (e *EmailChange) Confirm(db *DB) (bool, error) {
+	now := time.Now()
+	err := db.RunInTransaction(db.Context(), func(tx *pg.Tx) error {
+		res, err := tx.Model(e).
+			Set("confirmed_at = ?", now).
+			WherePK().
+			Where("confirmed_at IS NULL").
+			Where("cancelled_at IS NULL").
+			Update()
+		if err != nil {
+			return err
+		}
+		if res.RowsAffected() == 0 {
+			return errEmailChangeClosed
+		}
+		return swapEmail(tx, e.UserId, e.OldEmail, e.NewEmail, now)
+	})
+	if err == errEmailChangeClosed {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	e.ConfirmedAt = &now
+	return true, nil
+}
+
+// Cancel withdraws the change. If it was already confirmed the user is moved back
+// to the old address, which Cancel reports as reverted.
+func (e *EmailChange) Cancel(db *DB) (reverted bool, err error) {
+	now := time.Now()
+	err = db.RunInTransaction(db.Context(), func(tx *pg.Tx) error {
+		res, err := tx.Model(e).
+			Set("cancelled_at = ?", now).
+			WherePK().
+			Where("cancelled_at IS NULL").
+			Update()
+		if err != nil {
+			return err
+		}
+		if res.RowsAffected() == 0 {
+			return errEmailChangeClosed
+		}
+		if e.ConfirmedAt == nil {
+			return nil
+		}
+
+		reverted = true
+		return swapEmail(tx, e.UserId, e.NewEmail, e.OldEmail, now)
+	})
+	if err == errEmailChangeClosed {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	e.CancelledAt = &now
+	return reverted, nil
+}
+
+// swapEmail changes the user's address from one to another, treating the new one
+// as verified since the user just followed a link sent to it.
+func swapEmail(tx *pg.Tx, userID, from, to string, now time.Time) error {
+	res, err := tx.Model((*User)(nil)).
+		Set("email = ?", to).
+		Set("email_verified_at = ?", now).
+		Where("id = ?", userID).
+		Where("email = ?", from).
+		Update()
+	if err != nil {
+		if pgErr, ok := err.(pg.Error); ok && pgErr.Field('C') == "23505" {
+			return ErrEmailTaken
+		}
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return errEmailChangeClosed
+	}
+
+	_, err = tx.Model((*UserProfile)(nil)).
+		Set("email = ?", to).
+		Where("user_id = ?", userID).
+		Update()
+	return err
+}
+
+func GetEmailChangeByConfirmHash(db *DB, hash string) (*EmailChange, error) {
+	return getEmailChange(db, "confirm_hash", hash)
+}
+
+func GetEmailChangeByCancelHash(db *DB, hash string) (*EmailChange, error) {
+	return getEmailChange(db, "cancel_hash", hash)
+}
+
+func getEmailChange(db *DB, column, hash string) (*EmailChange, error) {
+	change := &EmailChange{}
+	err := db.Model(change).
+		Where("? = ?", pg.Ident(column), hash).
+		Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return change, nil
+}
+
+// CancelPendingEmailChanges withdraws the user's unconfirmed changes, so only the
+// most recent request can be confirmed.
+func CancelPendingEmailChanges(db *DB, userID string) error {
+	_, err := db.Model((*EmailChange)(nil)).
+		Set("cancelled_at = ?", time.Now()).
+		Where("user_id = ?", userID).
+		Where("confirmed_at IS NULL").
+		Where("cancelled_at IS NULL").
+		Update()
+	return err
+}
@@ -0,0 +1,269 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+)
+
+var (
+	// ErrGroupCycle is returned when a group would end up inside itself.
+	ErrGroupCycle = errors.New("a group cannot be nested inside itself")
+	// ErrGroupNameTaken is returned when another group already has the name.
+	ErrGroupNameTaken = errors.New("group name already in use")
+)
+
+// memberGroupsQuery selects the ids of the groups the user with the id given as
+// its parameter is in.
+var memberGroupsQuery = memberGroupsOf("?")
+
+// memberGroupsOf selects the ids of the groups the user whose id is the SQL
+// expression userID is in, directly or because a group they are in is nested
+// inside them. UNION stops at groups already seen, so it terminates even if a
+// cycle slipped in.
+func memberGroupsOf(userID string) string {
+	return `WITH RECURSIVE member_groups (id) AS (
+		SELECT group_id FROM group_members WHERE user_id = ` + userID + `
+		UNION
+		SELECT g.parent_id FROM groups AS g JOIN member_groups AS mg ON g.id = mg.id
+		WHERE g.parent_id IS NOT NULL
+	) SELECT id FROM member_groups`
+}
+
+// Group collects users so they can be managed together, such as a team. Groups
+// may be nested inside a parent: members of a group are members of its parent
+// too, and receive the roles given to either.
+type Group struct {
+	Id          string    `pg:"id,pk"`
+	ParentId    string    `pg:"parent_id"`
+	Name        string    `pg:"name,unique"`
+	Description string    `pg:"description"`
+	CreatedAt   time.Time `pg:"created_at"`
+}
+
+// GroupMember puts a user in a group.
+type GroupMember struct {
+	GroupId   string    `pg:"group_id,pk"`
+	UserId    string    `pg:"user_id,pk"`
+	CreatedAt time.Time `pg:"created_at"`
+}
+
+// GroupRole gives everyone in a group, including its nested groups, a role.
+type GroupRole struct {
+	GroupId   string    `pg:"group_id,pk"`
+	RoleId    string    `pg:"role_id,pk"`
+	CreatedAt time.Time `pg:"created_at"`
+}
+
+func (g *Group) Create(db *DB) error {
+	_, err := db.Model(g).Insert()
+	return groupError(err)
+}
+
+// Update saves the group's name, description and parent. It returns
+// ErrGroupCycle if the new parent is the group itself or nested inside it. The
+// groups table is locked while checking, so two moves cannot make a cycle
+// together. Moving a group changes the roles its members inherit, so it returns
+// ErrLastAdmin if that would leave no enabled admin.
+func (g *Group) Update(db *DB) error {
+	err := KeepAnAdmin(db.DB, func(tx *pg.Tx) error {
+		if g.ParentId != "" {
+			if _, err := tx.Exec(`LOCK TABLE groups IN SHARE ROW EXCLUSIVE MODE`); err != nil {
+				return err
+			}
+			var cycle bool
+			_, err := tx.QueryOne(pg.Scan(&cycle), `WITH RECURSIVE ancestors (id, parent_id) AS (
+					SELECT id, parent_id FROM groups WHERE id = ?
+					UNION
+					SELECT g.id, g.parent_id FROM groups AS g JOIN ancestors AS a ON g.id = a.parent_id
+				) SELECT EXISTS (SELECT 1 FROM ancestors WHERE id = ?)`, g.ParentId, g.Id)
+			if err != nil {
+				return err
+			}
+			if cycle {
+				return ErrGroupCycle
+			}
+		}
+
+		_, err := tx.Model(g).
+			Column("name", "description", "parent_id").
+			WherePK().
+			Update()
+		return err
+	})
+	return groupError(err)
+}
+
+// Delete removes the group along with its memberships and roles. Groups nested
+// inside it move up to its parent. It returns ErrLastAdmin if that would leave
+// no enabled admin.
+func (g *Group) Delete(db *DB) error {
+	return KeepAnAdmin(db.DB, func(tx *pg.Tx) error {
+		for _, model := range []interface{}{(*GroupMember)(nil), (*GroupRole)(nil)} {
+			_, err := tx.Model(model).Where("group_id = ?", g.Id).Delete()
+			if err != nil {
+				return err
+			}
+		}
+		_, err := tx.Model((*Group)(nil)).
+			Set("parent_id = NULLIF(?, '')", g.ParentId).
+			Where("parent_id = ?", g.Id).
+			Update()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Model(g).WherePK().Delete()
+		return err
+	})
+}
+
+func groupError(err error) error {
+	if pgErr, ok := err.(pg.Error); ok && pgErr.Field('C') == "23505" {
+		return ErrGroupNameTaken
+	}
+	return err
+}
+
+func GetGroup(db *DB, id string) (*Group, error) {
+	group := &Group{}
+	err := db.Model(group).
+		Where("id = ?", id).
+		Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return group, nil
+}
+
+// GetGroups returns every group by name.
+func GetGroups(db *DB) ([]*Group, error) {
+	var groups []*Group
+	err := db.Model(&groups).
+		Order("name ASC").
+		Select()
+	if err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// GetUserGroups returns the groups userID is in, including the groups those are
+// nested inside.
+func GetUserGroups(db *DB, userID string) ([]*Group, error) {
+	var groups []*Group
+	err := db.Model(&groups).
+		Where("id IN ("+memberGroupsQuery+")", userID).
+		Order("name ASC").
+		Select()
+	if err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// GetGroupMembers returns the users put in the group directly.
+func GetGroupMembers(db *DB, groupID string) ([]*User, error) {
+	var users []*User
+	err := db.Model(&users).
+		Join("JOIN group_members AS gm ON gm.user_id = \"user\".id").
+		Where("gm.group_id = ?", groupID).
+		Order("email ASC").
+		Select()
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// GetGroupRoles returns the roles given to the group directly.
+func GetGroupRoles(db *DB, groupID string) ([]*Role, error) {
+	var roles []*Role
+	err := db.Model(&roles).
+		Join("JOIN group_roles AS gr ON gr.role_id = role.id").
+		Where("gr.group_id = ?", groupID).
+		Order("role.name ASC").
+		Select()
+	if err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// grantsRolesOf is true if the group whose id is the SQL expression groupID, or a
+// group it is nested inside, has been given any roles.
+func grantsRolesOf(groupID string) string {
+	return `EXISTS (WITH RECURSIVE ancestors (id, parent_id) AS (
+		SELECT id, parent_id FROM groups WHERE id = ` + groupID + `
+		UNION
+		SELECT g.id, g.parent_id FROM groups AS g JOIN ancestors AS a ON g.id = a.parent_id
+	) SELECT 1 FROM group_roles WHERE group_id IN (SELECT id FROM ancestors))`
+}
+
+// GroupGrantsRoles reports whether members of the group receive any roles, given
+// to it or to a group it is nested inside.
+func GroupGrantsRoles(db *DB, groupID string) (bool, error) {
+	var grants bool
+	_, err := db.QueryOne(pg.Scan(&grants), `SELECT `+grantsRolesOf("?"), groupID)
+	return grants, err
+}
+
+// AssignGroupRole gives the group a role. Assigning a role twice does nothing.
+func AssignGroupRole(db *DB, groupID, roleID string) error {
+	_, err := db.Model(&GroupRole{GroupId: groupID, RoleId: roleID, CreatedAt: time.Now()}).
+		OnConflict("DO NOTHING").
+		Insert()
+	return err
+}
+
+// UnassignGroupRole takes the role away from the group.
+func UnassignGroupRole(db orm.DB, groupID, roleID string) error {
+	_, err := db.Model((*GroupRole)(nil)).
+		Where("group_id = ?", groupID).
+		Where("role_id = ?", roleID).
+		Delete()
+	return err
+}
+
+// AddGroupMember puts userID in the group. Adding an existing member does nothing.
+func AddGroupMember(db *DB, groupID, userID string) error {
+	_, err := db.Model(&GroupMember{GroupId: groupID, UserId: userID, CreatedAt: time.Now()}).
+		OnConflict("DO NOTHING").
+		Insert()
+	return err
+}
+
+// RemoveGroupMember takes userID out of the group.
+func RemoveGroupMember(db orm.DB, groupID, userID string) error {
+	_, err := db.Model((*GroupMember)(nil)).
+		Where("group_id = ?", groupID).
+		Where("user_id = ?", userID).
+		Delete()
+	return err
+}
+
+// IsGroupMember reports whether userID is in the group.
+func IsGroupMember(db *DB, groupID, userID string) (bool, error) {
+	return db.Model((*GroupMember)(nil)).
+		Where("group_id = ?", groupID).
+		Where("user_id = ?", userID).
+		Exists()
+}
+
+// GetUserGroupIds returns the ids of the groups userID is in.
+func GetUserGroupIds(db *DB, userID string) ([]string, error) {
+	var ids []string
+	err := db.Model((*GroupMember)(nil)).
+		Column("group_id").
+		Where("user_id = ?", userID).
+		Order("group_id ASC").
+		Select(&ids)
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
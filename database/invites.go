@@ -1,18 +1,49 @@
 package database
 
 import (
+	"errors"
+	"strings"
 	"time"
 
 	"github.com/go-pg/pg/v10"
 	"github.com/google/uuid"
 )
 
+// Reasons an invite code cannot be used.
+var (
+	ErrInviteNotFound   = errors.New("invalid invite code")
+	ErrInviteRevoked    = errors.New("invite code has been revoked")
+	ErrInviteExpired    = errors.New("invite code has expired")
+	ErrInviteExhausted  = errors.New("invite code has already been used")
+	ErrInviteWrongEmail = errors.New("invite code is for a different email address")
+)
+
+// Invite statuses, in the order Check looks for them.
+const (
+	InviteActive    = "active"
+	InviteRevoked   = "revoked"
+	InviteExpired   = "expired"
+	InviteExhausted = "exhausted"
+)
+
+// InviteCode lets people register. MaxUses of zero allows any number of uses, and
+// an empty Email lets anyone register with it. UsedBy and UsedAt describe the most
+// recent use. Accounts registered with it receive the built-in roles for the bits
+// in Permissions and join the groups in GroupIds.
 type InviteCode struct {
 	Id          string     `pg:"id,pk"`
 	GeneratedBy string     `pg:"generated_by"`
 	UsedBy      string     `pg:"used_by"`
 	CreatedAt   time.Time  `pg:"created_at"`
 	UsedAt      *time.Time `pg:"used_at"`
+	ExpiresAt   *time.Time `pg:"expires_at"`
+	MaxUses     int        `pg:"max_uses,use_zero"`
+	Uses        int        `pg:"uses,use_zero"`
+	Email       string     `pg:"email"`
+	Note        string     `pg:"note"`
+	RevokedAt   *time.Time `pg:"revoked_at"`
+	Permissions int        `pg:"permissions,use_zero"`
+	GroupIds    []string   `pg:"group_ids,array"`
 }
 
 func (i *InviteCode) Create(db *DB) error {
@@ -20,6 +51,121 @@ func (i *InviteCode) Create(db *DB) error {
 	return err
 }
 
+// Check returns why the invite cannot be used to register email at now, or nil if
+// it can. An empty email skips the bound address check.
+func (i *InviteCode) Check(email string, now time.Time) error {
+	switch {
+	case i.RevokedAt != nil:
+		return ErrInviteRevoked
+	case i.ExpiresAt != nil && !now.Before(*i.ExpiresAt):
+		return ErrInviteExpired
+	case i.MaxUses > 0 && i.Uses >= i.MaxUses:
+		return ErrInviteExhausted
+	case email != "" && i.Email != "" && !strings.EqualFold(strings.TrimSpace(email), i.Email):
+		return ErrInviteWrongEmail
+	}
+	return nil
+}
+
+// Status describes whether the invite can still be used at now.
+func (i *InviteCode) Status(now time.Time) string {
+	switch i.Check("", now) {
+	case ErrInviteRevoked:
+		return InviteRevoked
+	case ErrInviteExpired:
+		return InviteExpired
+	case ErrInviteExhausted:
+		return InviteExhausted
+	}
+	return InviteActive
+}
+
+// Use counts a registration by userID inside tx. It reports false if the invite
+// was revoked, expired or used up since it was checked.
+func (i *InviteCode) Use(tx *pg.Tx, userID string, now time.Time) (bool, error) {
+	res, err := tx.Model(i).
+		Set("uses = uses + 1").
+		Set("used_by = ?", userID).
+		Set("used_at = ?", now).
+		WherePK().
+		Where("revoked_at IS NULL").
+		Where("expires_at IS NULL OR expires_at > ?", now).
+		Where("max_uses = 0 OR uses < max_uses").
+		Returning("*").
+		Update()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+	return res.RowsAffected() > 0, nil
+}
+
+// Grant gives userID the built-in user role and the invite's permissions and
+// group memberships inside tx. The inviter's rights are checked again as they
+// are now, like when the invite was created: permissions they no longer hold are
+// left out, unless they are an admin so are groups they have left, and unless
+// they manage roles so are all permissions beyond the user role and groups that
+// hand out roles. Taking something away from someone therefore also limits the
+// invites they already sent. Groups that were deleted since are skipped.
+func (i *InviteCode) Grant(tx *pg.Tx, userID string, now time.Time) error {
+	permissions := i.Permissions
+	onlyInviterGroups, noRoleGroups := false, false
+	if i.GeneratedBy != "" && (permissions != 0 || len(i.GroupIds) > 0) {
+		// An inviter who was deleted has no roles or groups left to pass on.
+		inviter := &User{Id: i.GeneratedBy}
+		if err := inviter.LoadRoles(tx); err != nil {
+			return err
+		}
+		permissions &= inviter.Permissions
+		onlyInviterGroups = !inviter.IsAdmin()
+		if !inviter.HasPermission(PermManageRoles) {
+			permissions &= PermissionUser
+			noRoleGroups = true
+		}
+	}
+	permissions |= PermissionUser
+
+	if err := syncBuiltInRoles(tx, userID, permissions, false); err != nil {
+		return err
+	}
+
+	if len(i.GroupIds) > 0 {
+		q := tx.Model((*Group)(nil)).
+			ColumnExpr("id, ?, ?", userID, now).
+			Where("id IN (?)", pg.In(i.GroupIds))
+		if onlyInviterGroups {
+			q = q.Where("id IN (SELECT group_id FROM group_members WHERE user_id = ?)", i.GeneratedBy)
+		}
+		if noRoleGroups {
+			q = q.Where("NOT " + grantsRolesOf(`"group"."id"`))
+		}
+		_, err := tx.Exec(`INSERT INTO group_members (group_id, user_id, created_at) ? ON CONFLICT DO NOTHING`, q)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Revoke stops the invite from being used again.
+func (i *InviteCode) Revoke(db *DB) error {
+	now := time.Now()
+	_, err := db.Model(i).
+		Set("revoked_at = ?", now).
+		WherePK().
+		Where("revoked_at IS NULL").
+		Update()
+	if err != nil {
+		return err
+	}
+	if i.RevokedAt == nil {
+		i.RevokedAt = &now
+	}
+	return nil
+}
+
 func GetInviteCode(db *DB, code string) (*InviteCode, error) {
 	inviteCode := &InviteCode{}
 	err := db.Model(inviteCode).
@@ -34,11 +180,13 @@ func GetInviteCode(db *DB, code string) (*InviteCode, error) {
 	return inviteCode, nil
 }
 
+// GenerateInviteCode creates a single-use invite without expiry.
 func GenerateInviteCode(db *DB, generatedBy string) (*InviteCode, error) {
 	inviteCode := &InviteCode{
 		Id:          uuid.New().String(),
 		GeneratedBy: generatedBy,
 		CreatedAt:   time.Now(),
+		MaxUses:     1,
 	}
 	err := inviteCode.Create(db)
 	if err != nil {
@@ -46,3 +194,126 @@ func GenerateInviteCode(db *DB, generatedBy string) (*InviteCode, error) {
 	}
 	return inviteCode, nil
 }
+
+// CreateWithinQuota inserts the invite unless its creator already has quota
+// active invites. The creator's row is locked while counting, so concurrent
+// requests cannot both take the last slot. A negative quota is unlimited.
+func (i *InviteCode) CreateWithinQuota(db *DB, quota int) (bool, error) {
+	created := false
+	err := db.RunInTransaction(db.Context(), func(tx *pg.Tx) error {
+		if quota < 0 {
+			_, err := tx.Model(i).Insert()
+			created = err == nil
+			return err
+		}
+
+		err := tx.Model(&User{Id: i.GeneratedBy}).
+			Column("id").
+			WherePK().
+			For("UPDATE").
+			Select()
+		if err != nil {
+			return err
+		}
+
+		active, err := whereInviteStatus(tx.Model((*InviteCode)(nil)), InviteActive, i.CreatedAt).
+			Where("generated_by = ?", i.GeneratedBy).
+			Count()
+		if err != nil {
+			return err
+		}
+		if active >= quota {
+			return nil
+		}
+
+		if _, err := tx.Model(i).Insert(); err != nil {
+			return err
+		}
+		created = true
+		return nil
+	})
+	return created, err
+}
+
+// CountActiveInvites returns how many of userID's invites can still be used.
+func CountActiveInvites(db *DB, userID string, now time.Time) (int, error) {
+	return whereInviteStatus(db.Model((*InviteCode)(nil)), InviteActive, now).
+		Where("generated_by = ?", userID).
+		Count()
+}
+
+// GetUserWithInvites loads the invites the user generated, newest first.
+func (u *User) GetUserWithInvites(db *DB) error {
+	err := db.Model(u).
+		Relation("GeneratedInvites", func(q *pg.Query) (*pg.Query, error) {
+			return q.Order("created_at DESC"), nil
+		}).
+		WherePK().
+		Select()
+	if err != nil {
+		return err
+	}
+	return u.LoadRoles(db)
+}
+
+// InviteFilter narrows ListInvites. Zero fields match everything.
+type InviteFilter struct {
+	GeneratedBy   string
+	Status        string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	Limit         int
+	Offset        int
+}
+
+// ListInvites returns the invites matching filter, newest first, along with how
+// many match in total. Statuses are evaluated at now.
+func ListInvites(db *DB, filter InviteFilter, now time.Time) ([]*InviteCode, int, error) {
+	var invites []*InviteCode
+	q := db.Model(&invites).Order("created_at DESC")
+	if filter.GeneratedBy != "" {
+		q = q.Where("generated_by = ?", filter.GeneratedBy)
+	}
+	if filter.Status != "" {
+		q = whereInviteStatus(q, filter.Status, now)
+	}
+	if !filter.CreatedAfter.IsZero() {
+		q = q.Where("created_at >= ?", filter.CreatedAfter)
+	}
+	if !filter.CreatedBefore.IsZero() {
+		q = q.Where("created_at < ?", filter.CreatedBefore)
+	}
+	if filter.Limit > 0 {
+		q = q.Limit(filter.Limit)
+	}
+	if filter.Offset > 0 {
+		q = q.Offset(filter.Offset)
+	}
+
+	total, err := q.SelectAndCount()
+	if err != nil {
+		return nil, 0, err
+	}
+	return invites, total, nil
+}
+
+// whereInviteStatus restricts q to invites with status at now, using the same
+// precedence as Check.
+func whereInviteStatus(q *pg.Query, status string, now time.Time) *pg.Query {
+	notExpired := "(expires_at IS NULL OR expires_at > ?)"
+	notExhausted := "(max_uses = 0 OR uses < max_uses)"
+	switch status {
+	case InviteRevoked:
+		return q.Where("revoked_at IS NOT NULL")
+	case InviteExpired:
+		return q.Where("revoked_at IS NULL").
+			Where("expires_at <= ?", now)
+	case InviteExhausted:
+		return q.Where("revoked_at IS NULL").
+			Where(notExpired, now).
+			Where("NOT " + notExhausted)
+	}
+	return q.Where("revoked_at IS NULL").
+		Where(notExpired, now).
+		Where(notExhausted)
+}
@@ -0,0 +1,51 @@
+package database
+
+import (
+	"time"
+)
+
+// Lifecycle states of a SigningKey. A key is published in the JWKS while pending
+// so relying parties pick it up before it signs anything, signs tokens while
+// active, keeps verifying the tokens it signed while superseded, and is dropped
+// entirely once retired.
+const (
+	KeyStatePending    = "pending"
+	KeyStateActive     = "active"
+	KeyStateSuperseded = "superseded"
+	KeyStateRetired    = "retired"
+)
+
+type SigningKey struct {
+	Id          string     `pg:"id,pk"`
+	Algorithm   string     `pg:"algorithm"`
+	PrivateKey  []byte     `pg:"private_key"`
+	State       string     `pg:"state"`
+	CreatedAt   time.Time  `pg:"created_at"`
+	ActivatesAt time.Time  `pg:"activates_at"`
+	ActivatedAt *time.Time `pg:"activated_at"`
+	RetiresAt   *time.Time `pg:"retires_at"`
+	RetiredAt   *time.Time `pg:"retired_at"`
+}
+
+func (k *SigningKey) Create(db *DB) error {
+	_, err := db.Model(k).Insert()
+	return err
+}
+
+func (k *SigningKey) Update(db *DB) error {
+	_, err := db.Model(k).WherePK().Update()
+	return err
+}
+
+// GetSigningKeys returns every key that has not been retired, oldest first.
+func GetSigningKeys(db *DB) ([]*SigningKey, error) {
+	var keys []*SigningKey
+	err := db.Model(&keys).
+		Where("state != ?", KeyStateRetired).
+		Order("created_at ASC").
+		Select()
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
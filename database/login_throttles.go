@@ -0,0 +1,76 @@
+package database
+
+import (
+	"time"
+
+	"github.com/go-pg/pg/v10"
+)
+
+// LoginThrottle counts recent failed sign-in attempts for one key, such as an
+// email address or a client IP. Failures older than the window they were counted
+// in are forgotten.
+type LoginThrottle struct {
+	Key           string     `pg:"key,pk"`
+	Failures      int        `pg:"failures,use_zero"`
+	LastFailureAt time.Time  `pg:"last_failure_at"`
+	LockedUntil   *time.Time `pg:"locked_until"`
+}
+
+// GetLoginThrottle returns the counter for key, or nil if it has none.
+func GetLoginThrottle(db *DB, key string) (*LoginThrottle, error) {
+	throttle := &LoginThrottle{}
+	err := db.Model(throttle).
+		Where("key = ?", key).
+		Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return throttle, nil
+}
+
+// RecordLoginFailure counts a failed attempt in a single statement, so instances
+// sharing the database never lose an increment. The count restarts if the last
+// failure is older than window, and the key is locked for lockFor once it reaches
+// lockAfter failures. A lockAfter of zero never locks.
+func RecordLoginFailure(db *DB, key string, now time.Time, window time.Duration, lockAfter int, lockFor time.Duration) (*LoginThrottle, error) {
+	throttle := &LoginThrottle{Key: key, Failures: 1, LastFailureAt: now}
+	if lockAfter == 1 {
+		until := now.Add(lockFor)
+		throttle.LockedUntil = &until
+	}
+
+	_, err := db.Model(throttle).
+		OnConflict("(key) DO UPDATE").
+		Set("failures = CASE WHEN login_throttle.last_failure_at < ? THEN 1 ELSE login_throttle.failures + 1 END", now.Add(-window)).
+		Set("last_failure_at = EXCLUDED.last_failure_at").
+		Set(`locked_until = CASE
+			WHEN ? > 0 AND login_throttle.last_failure_at >= ? AND login_throttle.failures + 1 >= ? THEN ?::timestamptz
+			ELSE login_throttle.locked_until END`, lockAfter, now.Add(-window), lockAfter, now.Add(lockFor)).
+		Returning("*").
+		Insert()
+	if err != nil {
+		return nil, err
+	}
+	return throttle, nil
+}
+
+// ResetLoginThrottle forgets the failures and any lock for key.
+func ResetLoginThrottle(db *DB, key string) error {
+	_, err := db.Model((*LoginThrottle)(nil)).
+		Where("key = ?", key).
+		Delete()
+	return err
+}
+
+// PruneLoginThrottles deletes counters whose failures and lock are both older
+// than before.
+func PruneLoginThrottles(db *DB, before time.Time) error {
+	_, err := db.Model((*LoginThrottle)(nil)).
+		Where("last_failure_at < ?", before).
+		Where("locked_until IS NULL OR locked_until < ?", before).
+		Delete()
+	return err
+}
@@ -0,0 +1,131 @@
+package database
+
+import (
+	"time"
+
+	"github.com/go-pg/pg/v10"
+)
+
+// TOTPDevice is a user's authenticator app. It only counts as a second factor once
+// ConfirmedAt is set, i.e. after the user proved they can produce codes from it.
+type TOTPDevice struct {
+	UserId      string     `pg:"user_id,pk"`
+	Secret      []byte     `pg:"secret"`
+	LastCounter int64      `pg:"last_counter,use_zero"`
+	CreatedAt   time.Time  `pg:"created_at"`
+	ConfirmedAt *time.Time `pg:"confirmed_at"`
+}
+
+// RecoveryCode is a one-time code that replaces a TOTP code when the device is
+// lost. Only the SHA-256 hash of the code is stored.
+type RecoveryCode struct {
+	Id        string     `pg:"id,pk"`
+	UserId    string     `pg:"user_id"`
+	CreatedAt time.Time  `pg:"created_at"`
+	UsedAt    *time.Time `pg:"used_at"`
+}
+
+func (d *TOTPDevice) IsConfirmed() bool {
+	return d.ConfirmedAt != nil
+}
+
+// Save inserts the device or replaces the user's existing one.
+func (d *TOTPDevice) Save(db *DB) error {
+	_, err := db.Model(d).
+		OnConflict("(user_id) DO UPDATE").
+		Set("secret = EXCLUDED.secret").
+		Set("last_counter = EXCLUDED.last_counter").
+		Set("created_at = EXCLUDED.created_at").
+		Set("confirmed_at = EXCLUDED.confirmed_at").
+		Insert()
+	return err
+}
+
+func (d *TOTPDevice) Update(db *DB) error {
+	_, err := db.Model(d).WherePK().Update()
+	return err
+}
+
+// UseCounter records the time step of an accepted code. It reports false if that
+// step or a later one was already used, so a code cannot be replayed.
+func (d *TOTPDevice) UseCounter(db *DB, counter int64) (bool, error) {
+	res, err := db.Model(d).
+		Set("last_counter = ?", counter).
+		WherePK().
+		Where("last_counter < ?", counter).
+		Update()
+	if err != nil {
+		return false, err
+	}
+	if res.RowsAffected() == 0 {
+		return false, nil
+	}
+	d.LastCounter = counter
+	return true, nil
+}
+
+func GetTOTPDevice(db *DB, userID string) (*TOTPDevice, error) {
+	device := &TOTPDevice{}
+	err := db.Model(device).
+		Where("user_id = ?", userID).
+		Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return device, nil
+}
+
+// DeleteMFA removes the user's TOTP device and recovery codes.
+func DeleteMFA(db *DB, userID string) error {
+	return db.RunInTransaction(db.Context(), func(tx *pg.Tx) error {
+		_, err := tx.Model((*TOTPDevice)(nil)).Where("user_id = ?", userID).Delete()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Model((*RecoveryCode)(nil)).Where("user_id = ?", userID).Delete()
+		return err
+	})
+}
+
+// ReplaceRecoveryCodes discards the user's recovery codes and stores new hashes.
+func ReplaceRecoveryCodes(db *DB, userID string, hashes []string) error {
+	return db.RunInTransaction(db.Context(), func(tx *pg.Tx) error {
+		_, err := tx.Model((*RecoveryCode)(nil)).Where("user_id = ?", userID).Delete()
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		codes := make([]*RecoveryCode, 0, len(hashes))
+		for _, hash := range hashes {
+			codes = append(codes, &RecoveryCode{Id: hash, UserId: userID, CreatedAt: now})
+		}
+		_, err = tx.Model(&codes).Insert()
+		return err
+	})
+}
+
+// UseRecoveryCode redeems the recovery code with the given hash. It reports false
+// if the code does not belong to the user or was already used.
+func UseRecoveryCode(db *DB, userID, hash string) (bool, error) {
+	res, err := db.Model((*RecoveryCode)(nil)).
+		Set("used_at = ?", time.Now()).
+		Where("id = ?", hash).
+		Where("user_id = ?", userID).
+		Where("used_at IS NULL").
+		Update()
+	if err != nil {
+		return false, err
+	}
+	return res.RowsAffected() == 1, nil
+}
+
+func CountRecoveryCodes(db *DB, userID string) (int, error) {
+	return db.Model((*RecoveryCode)(nil)).
+		Where("user_id = ?", userID).
+		Where("used_at IS NULL").
+		Count()
+}
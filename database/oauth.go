@@ -0,0 +1,67 @@
+package database
+
+import (
+	"time"
+
+	"github.com/go-pg/pg/v10"
+)
+
+// AuthorizationCode is a short-lived, single-use code handed to a relying party
+// at the end of the /authorize step. Only the SHA-256 hash of the code is stored.
+type AuthorizationCode struct {
+	Id                  string     `pg:"id,pk"`
+	ClientId            string     `pg:"client_id"`
+	UserId              string     `pg:"user_id"`
+	SessionId           string     `pg:"session_id"`
+	RedirectURI         string     `pg:"redirect_uri"`
+	Scope               string     `pg:"scope"`
+	Nonce               string     `pg:"nonce"`
+	CodeChallenge       string     `pg:"code_challenge"`
+	CodeChallengeMethod string     `pg:"code_challenge_method"`
+	AuthTime            time.Time  `pg:"auth_time"`
+	CreatedAt           time.Time  `pg:"created_at"`
+	ExpiresAt           time.Time  `pg:"expires_at"`
+	UsedAt              *time.Time `pg:"used_at"`
+}
+
+func (a *AuthorizationCode) Create(db *DB) error {
+	_, err := db.Model(a).Insert()
+	return err
+}
+
+func GetAuthorizationCode(db *DB, id string) (*AuthorizationCode, error) {
+	code := &AuthorizationCode{}
+	err := db.Model(code).
+		Where("id = ?", id).
+		Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return code, nil
+}
+
+// Consume marks the code as used. It reports false if the code had already been
+// redeemed, so that a code can never be exchanged twice even under concurrency.
+func (a *AuthorizationCode) Consume(db *DB) (bool, error) {
+	now := time.Now()
+	res, err := db.Model(a).
+		Set("used_at = ?", now).
+		Where("id = ?", a.Id).
+		Where("used_at IS NULL").
+		Update()
+	if err != nil {
+		return false, err
+	}
+	if res.RowsAffected() == 0 {
+		return false, nil
+	}
+	a.UsedAt = &now
+	return true, nil
+}
+
+func (a *AuthorizationCode) IsExpired() bool {
+	return time.Now().After(a.ExpiresAt)
+}
@@ -0,0 +1,110 @@
+package database
+
+import (
+	"time"
+
+	"github.com/go-pg/pg/v10"
+)
+
+const (
+	// OutboxMaxAttempts is how often delivery of an email is tried before it is
+	// given up on. The failed row stays in the table for inspection.
+	OutboxMaxAttempts = 10
+
+	outboxInitialBackoff = time.Minute
+	outboxMaxBackoff     = 6 * time.Hour
+)
+
+// OutboxEmail is an email waiting to be delivered. Handlers insert it, ideally in
+// the same transaction as the change it announces, and a background worker sends
+// it, retrying with exponential backoff while the mail server is unavailable.
+// Bodies often carry working reset or verification links, so they are cleared
+// once the email is sent.
+type OutboxEmail struct {
+	Id            string     `pg:"id,pk"`
+	Recipient     string     `pg:"recipient"`
+	Subject       string     `pg:"subject"`
+	Text          string     `pg:"text"`
+	HTML          string     `pg:"html"`
+	Attempts      int        `pg:"attempts,use_zero"`
+	LastError     string     `pg:"last_error"`
+	CreatedAt     time.Time  `pg:"created_at"`
+	NextAttemptAt time.Time  `pg:"next_attempt_at"`
+	SentAt        *time.Time `pg:"sent_at"`
+}
+
+func (e *OutboxEmail) Create(db *DB) error {
+	_, err := db.Model(e).Insert()
+	return err
+}
+
+// ProcessOutbox passes up to limit due emails to send and records the outcome.
+// Rows are locked while they are processed so several instances can run workers
+// side by side. Delivery is at least once: if the outcome cannot be recorded the
+// email is sent again later.
+func ProcessOutbox(db *DB, limit int, send func(*OutboxEmail) error) (int, error) {
+	sent := 0
+	err := db.RunInTransaction(db.Context(), func(tx *pg.Tx) error {
+		var emails []*OutboxEmail
+		err := tx.Model(&emails).
+			Where("sent_at IS NULL").
+			Where("attempts < ?", OutboxMaxAttempts).
+			Where("next_attempt_at <= ?", time.Now()).
+			Order("next_attempt_at ASC").
+			Limit(limit).
+			For("UPDATE SKIP LOCKED").
+			Select()
+		if err != nil {
+			return err
+		}
+
+		for _, email := range emails {
+			now := time.Now()
+			email.Attempts++
+			if err := send(email); err != nil {
+				email.LastError = err.Error()
+				email.NextAttemptAt = now.Add(outboxBackoff(email.Attempts))
+			} else {
+				email.LastError = ""
+				email.SentAt = &now
+				email.Text = ""
+				email.HTML = ""
+				sent++
+			}
+
+			if _, err := tx.Model(email).WherePK().Update(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return sent, err
+}
+
+// PruneOutbox deletes emails sent before before, and those given up on that were
+// queued before it.
+func PruneOutbox(db *DB, before time.Time) error {
+	_, err := db.Model((*OutboxEmail)(nil)).
+		WhereGroup(func(q *pg.Query) (*pg.Query, error) {
+			return q.Where("sent_at < ?", before).
+				WhereOrGroup(func(q *pg.Query) (*pg.Query, error) {
+					return q.Where("attempts >= ?", OutboxMaxAttempts).
+						Where("created_at < ?", before), nil
+				}), nil
+		}).
+		Delete()
+	return err
+}
+
+// outboxBackoff is the delay before the next attempt after the given number of
+// failed ones: one minute, doubling up to six hours.
+func outboxBackoff(attempts int) time.Duration {
+	backoff := outboxInitialBackoff
+	for i := 1; i < attempts && backoff < outboxMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > outboxMaxBackoff {
+		backoff = outboxMaxBackoff
+	}
+	return backoff
+}
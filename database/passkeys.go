@@ -0,0 +1,158 @@
+package database
+
+import (
+	"time"
+
+	"github.com/go-pg/pg/v10"
+)
+
+// Ceremonies a WebAuthn challenge can be used for.
+const (
+	CeremonyRegistration = "registration"
+	CeremonyLogin        = "login"
+	CeremonyMFA          = "mfa"
+)
+
+// Passkey is a WebAuthn credential registered by a user. Id is the base64url
+// credential ID and PublicKey the COSE-encoded public key.
+type Passkey struct {
+	Id         string     `pg:"id,pk"`
+	UserId     string     `pg:"user_id"`
+	Name       string     `pg:"name"`
+	PublicKey  []byte     `pg:"public_key"`
+	Algorithm  int64      `pg:"algorithm"`
+	SignCount  int64      `pg:"sign_count,use_zero"`
+	Transports []string   `pg:"transports,array"`
+	BackedUp   bool       `pg:"backed_up,use_zero"`
+	CreatedAt  time.Time  `pg:"created_at"`
+	LastUsedAt *time.Time `pg:"last_used_at"`
+}
+
+// WebAuthnChallenge is the server side of a registration or login ceremony in
+// progress. UserId is empty for passwordless logins, where the user is only known
+// once the authenticator answers.
+type WebAuthnChallenge struct {
+	Id        string    `pg:"id,pk"`
+	UserId    string    `pg:"user_id"`
+	Ceremony  string    `pg:"ceremony"`
+	Challenge []byte    `pg:"challenge"`
+	CreatedAt time.Time `pg:"created_at"`
+	ExpiresAt time.Time `pg:"expires_at"`
+}
+
+func (p *Passkey) Create(db *DB) error {
+	_, err := db.Model(p).Insert()
+	return err
+}
+
+func (p *Passkey) Update(db *DB) error {
+	_, err := db.Model(p).WherePK().Update()
+	return err
+}
+
+func (p *Passkey) Delete(db *DB) error {
+	_, err := db.Model(p).WherePK().Delete()
+	return err
+}
+
+// UseSignCount records a successful login with the passkey. It reports false if
+// the stored counter moved past signCount in the meantime, which happens when a
+// cloned authenticator is used concurrently. Authenticators without a counter
+// always report zero and are accepted.
+func (p *Passkey) UseSignCount(db *DB, signCount int64, backedUp bool) (bool, error) {
+	now := time.Now()
+	res, err := db.Model(p).
+		Set("sign_count = ?", signCount).
+		Set("backed_up = ?", backedUp).
+		Set("last_used_at = ?", now).
+		WherePK().
+		WhereGroup(func(q *pg.Query) (*pg.Query, error) {
+			return q.Where("sign_count < ?", signCount).
+				WhereOr("sign_count = 0 AND ? = 0", signCount), nil
+		}).
+		Update()
+	if err != nil {
+		return false, err
+	}
+	if res.RowsAffected() == 0 {
+		return false, nil
+	}
+	p.SignCount = signCount
+	p.BackedUp = backedUp
+	p.LastUsedAt = &now
+	return true, nil
+}
+
+func GetPasskey(db *DB, id string) (*Passkey, error) {
+	passkey := &Passkey{}
+	err := db.Model(passkey).
+		Where("id = ?", id).
+		Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return passkey, nil
+}
+
+// GetUserPasskeys returns the user's passkeys, oldest first.
+func GetUserPasskeys(db *DB, userID string) ([]*Passkey, error) {
+	var passkeys []*Passkey
+	err := db.Model(&passkeys).
+		Where("user_id = ?", userID).
+		Order("created_at ASC").
+		Select()
+	if err != nil {
+		return nil, err
+	}
+	return passkeys, nil
+}
+
+func CountPasskeys(db *DB, userID string) (int, error) {
+	return db.Model((*Passkey)(nil)).
+		Where("user_id = ?", userID).
+		Count()
+}
+
+// DeleteUserPasskeys removes every passkey the user registered.
+func DeleteUserPasskeys(db *DB, userID string) error {
+	_, err := db.Model((*Passkey)(nil)).
+		Where("user_id = ?", userID).
+		Delete()
+	return err
+}
+
+// Create stores the challenge and prunes challenges that expired unanswered.
+func (c *WebAuthnChallenge) Create(db *DB) error {
+	_, err := db.Model((*WebAuthnChallenge)(nil)).
+		Where("expires_at < ?", time.Now()).
+		Delete()
+	if err != nil {
+		return err
+	}
+	_, err = db.Model(c).Insert()
+	return err
+}
+
+// ConsumeWebAuthnChallenge deletes and returns the challenge so each one can be
+// answered only once. It returns nil if the challenge does not exist or expired.
+func ConsumeWebAuthnChallenge(db *DB, id, ceremony string) (*WebAuthnChallenge, error) {
+	challenge := &WebAuthnChallenge{}
+	res, err := db.Model(challenge).
+		Where("id = ?", id).
+		Where("ceremony = ?", ceremony).
+		Returning("*").
+		Delete()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if res.RowsAffected() == 0 || time.Now().After(challenge.ExpiresAt) {
+		return nil, nil
+	}
+	return challenge, nil
+}
@@ -0,0 +1,69 @@
+package database
+
+import (
+	"time"
+
+	"github.com/go-pg/pg/v10"
+)
+
+// PasswordResetToken is a single-use token emailed to a user who forgot their
+// password. Only the SHA-256 hash of the token is stored.
+type PasswordResetToken struct {
+	Id        string     `pg:"id,pk"`
+	UserId    string     `pg:"user_id"`
+	CreatedAt time.Time  `pg:"created_at"`
+	ExpiresAt time.Time  `pg:"expires_at"`
+	UsedAt    *time.Time `pg:"used_at"`
+}
+
+func (t *PasswordResetToken) Create(db *DB) error {
+	_, err := db.Model(t).Insert()
+	return err
+}
+
+func GetPasswordResetToken(db *DB, id string) (*PasswordResetToken, error) {
+	token := &PasswordResetToken{}
+	err := db.Model(token).
+		Where("id = ?", id).
+		Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return token, nil
+}
+
+// Consume marks the token as used. It reports false if the token had already
+// been used, so a reset link works only once even under concurrency.
+func (t *PasswordResetToken) Consume(db *DB) (bool, error) {
+	now := time.Now()
+	res, err := db.Model(t).
+		Set("used_at = ?", now).
+		Where("id = ?", t.Id).
+		Where("used_at IS NULL").
+		Update()
+	if err != nil {
+		return false, err
+	}
+	if res.RowsAffected() == 0 {
+		return false, nil
+	}
+	t.UsedAt = &now
+	return true, nil
+}
+
+func (t *PasswordResetToken) IsExpired() bool {
+	return time.Now().After(t.ExpiresAt)
+}
+
+// ExpirePasswordResetTokens invalidates every unused reset token of the user.
+func ExpirePasswordResetTokens(db *DB, userID string) error {
+	_, err := db.Model((*PasswordResetToken)(nil)).
+		Set("used_at = ?", time.Now()).
+		Where("user_id = ?", userID).
+		Where("used_at IS NULL").
+		Update()
+	return err
+}
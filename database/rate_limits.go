@@ -0,0 +1,50 @@
+package database
+
+import (
+	"time"
+
+	"github.com/go-pg/pg/v10"
+)
+
+// RateLimitBucket is a token bucket shared by every instance. FullAt is when the
+// bucket will have refilled, after which the row can be dropped.
+type RateLimitBucket struct {
+	Key       string    `pg:"key,pk"`
+	Tokens    float64   `pg:"tokens,use_zero"`
+	UpdatedAt time.Time `pg:"updated_at"`
+	FullAt    time.Time `pg:"full_at"`
+}
+
+// UpdateRateLimitBucket locks key's bucket, creating an empty one with a zero
+// UpdatedAt if there is none, lets update change it and stores the result.
+func UpdateRateLimitBucket(db *DB, key string, update func(*RateLimitBucket)) error {
+	return db.RunInTransaction(db.Context(), func(tx *pg.Tx) error {
+		bucket := &RateLimitBucket{Key: key}
+		_, err := tx.Model(bucket).
+			OnConflict("(key) DO NOTHING").
+			Insert()
+		if err != nil && err != pg.ErrNoRows {
+			return err
+		}
+
+		err = tx.Model(bucket).
+			WherePK().
+			For("UPDATE").
+			Select()
+		if err != nil {
+			return err
+		}
+
+		update(bucket)
+		_, err = tx.Model(bucket).WherePK().Update()
+		return err
+	})
+}
+
+// PruneRateLimitBuckets deletes buckets that have refilled by now.
+func PruneRateLimitBuckets(db *DB, now time.Time) error {
+	_, err := db.Model((*RateLimitBucket)(nil)).
+		Where("full_at < ?", now).
+		Delete()
+	return err
+}
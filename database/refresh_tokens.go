@@ -0,0 +1,77 @@
+package database
+
+import (
+	"time"
+
+	"github.com/go-pg/pg/v10"
+)
+
+// RefreshToken is an opaque, single-use token exchanged for a new access token.
+// Only its SHA-256 hash is stored. Every rotation issues a new token in the same
+// family, so replaying an already used token can revoke the whole chain.
+type RefreshToken struct {
+	Id        string     `pg:"id,pk"`
+	FamilyId  string     `pg:"family_id"`
+	UserId    string     `pg:"user_id"`
+	ClientId  string     `pg:"client_id"`
+	SessionId string     `pg:"session_id"`
+	Scope     string     `pg:"scope"`
+	AuthTime  time.Time  `pg:"auth_time"`
+	CreatedAt time.Time  `pg:"created_at"`
+	ExpiresAt time.Time  `pg:"expires_at"`
+	UsedAt    *time.Time `pg:"used_at"`
+	RevokedAt *time.Time `pg:"revoked_at"`
+}
+
+func (r *RefreshToken) Create(db *DB) error {
+	_, err := db.Model(r).Insert()
+	return err
+}
+
+func GetRefreshToken(db *DB, id string) (*RefreshToken, error) {
+	token := &RefreshToken{}
+	err := db.Model(token).
+		Where("id = ?", id).
+		Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return token, nil
+}
+
+// Use marks the token as rotated. It reports false if the token had already been
+// used or revoked, which callers must treat as a replay.
+func (r *RefreshToken) Use(db *DB) (bool, error) {
+	now := time.Now()
+	res, err := db.Model(r).
+		Set("used_at = ?", now).
+		Where("id = ?", r.Id).
+		Where("used_at IS NULL").
+		Where("revoked_at IS NULL").
+		Update()
+	if err != nil {
+		return false, err
+	}
+	if res.RowsAffected() == 0 {
+		return false, nil
+	}
+	r.UsedAt = &now
+	return true, nil
+}
+
+func (r *RefreshToken) IsExpired() bool {
+	return time.Now().After(r.ExpiresAt)
+}
+
+// RevokeRefreshTokenFamily revokes every token descending from the same login.
+func RevokeRefreshTokenFamily(db *DB, familyID string) error {
+	_, err := db.Model((*RefreshToken)(nil)).
+		Set("revoked_at = ?", time.Now()).
+		Where("family_id = ?", familyID).
+		Where("revoked_at IS NULL").
+		Update()
+	return err
+}
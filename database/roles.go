@@ -0,0 +1,337 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+)
+
+// Permissions that roles can grant.
+const (
+	PermUseApps       = "apps:use"
+	PermCreateInvites = "invites:create"
+	PermEditContent   = "content:edit"
+	PermAdminister    = "sso:admin"
+	PermManageUsers   = "users:manage"
+	PermManageRoles   = "roles:manage"
+	PermManageClients = "clients:manage"
+	PermManageInvites = "invites:manage"
+)
+
+// Built-in roles, which stand in for the bits of the old permission mask.
+const (
+	RoleUser   = "user"
+	RoleEditor = "editor"
+	RoleAdmin  = "admin"
+)
+
+var (
+	// ErrBuiltInRole is returned when deleting a role the server relies on.
+	ErrBuiltInRole = errors.New("built-in roles cannot be deleted")
+	// ErrRoleNameTaken is returned when another role already has the name.
+	ErrRoleNameTaken = errors.New("role name already in use")
+)
+
+// Permission is something a role can allow. The set of permissions is fixed by
+// the server and seeded on startup.
+type Permission struct {
+	Name        string `pg:"name,pk"`
+	Description string `pg:"description"`
+}
+
+// Role is a named set of permissions that can be given to users. Roles with a
+// ClientId belong to that application: their permissions are entitlements the
+// application defines, passed to it in access tokens, and they grant nothing in
+// the sign-in service itself.
+type Role struct {
+	Id          string    `pg:"id,pk"`
+	ClientId    string    `pg:"client_id"`
+	Name        string    `pg:"name"`
+	Description string    `pg:"description"`
+	Permissions []string  `pg:"permissions,array"`
+	BuiltIn     bool      `pg:"built_in,use_zero"`
+	CreatedAt   time.Time `pg:"created_at"`
+}
+
+// UserRole gives a user a role.
+type UserRole struct {
+	UserId    string    `pg:"user_id,pk"`
+	RoleId    string    `pg:"role_id,pk"`
+	CreatedAt time.Time `pg:"created_at"`
+}
+
+var permissionCatalog = []*Permission{
+	{PermUseApps, "Sign in to applications"},
+	{PermCreateInvites, "Invite people"},
+	{PermEditContent, "Edit content"},
+	{PermAdminister, "Administer the sign-in service"},
+	{PermManageUsers, "Manage users"},
+	{PermManageRoles, "Manage roles"},
+	{PermManageClients, "Manage applications"},
+	{PermManageInvites, "Manage everyone's invites"},
+}
+
+// builtInRoles are seeded on startup, in the order of the permission mask bits
+// they replace. Each grants the permission its compatibility helper checks.
+var builtInRoles = []struct {
+	bit  int
+	role *Role
+}{
+	{PermissionUser, &Role{
+		Id:          RoleUser,
+		Name:        "User",
+		Description: "Can sign in to applications and invite people",
+		Permissions: []string{PermUseApps, PermCreateInvites},
+	}},
+	{PermissionEditor, &Role{
+		Id:          RoleEditor,
+		Name:        "Editor",
+		Description: "Can edit content",
+		Permissions: []string{PermEditContent},
+	}},
+	{PermissionAdmin, &Role{
+		Id:          RoleAdmin,
+		Name:        "Admin",
+		Description: "Can administer the sign-in service",
+		Permissions: []string{PermAdminister, PermManageUsers, PermManageRoles, PermManageClients, PermManageInvites},
+	}},
+}
+
+// permissionBits maps the permissions behind IsUser, IsEditor and IsAdmin to
+// the mask bits those helpers read.
+var permissionBits = map[string]int{
+	PermUseApps:     PermissionUser,
+	PermEditContent: PermissionEditor,
+	PermAdminister:  PermissionAdmin,
+}
+
+// seedRoles adds the permission catalog and built-in roles. Built-in roles that
+// already exist are left alone, so changes made to them are kept.
+func seedRoles(db *DB) error {
+	_, err := db.Model(&permissionCatalog).
+		OnConflict("(name) DO UPDATE").
+		Set("description = EXCLUDED.description").
+		Insert()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, builtIn := range builtInRoles {
+		role := *builtIn.role
+		role.BuiltIn = true
+		role.CreatedAt = now
+		_, err := db.Model(&role).OnConflict("(id) DO NOTHING").Insert()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IsPermission reports whether name is a permission roles can grant.
+func IsPermission(name string) bool {
+	for _, permission := range permissionCatalog {
+		if permission.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func GetPermissions(db *DB) ([]*Permission, error) {
+	var permissions []*Permission
+	err := db.Model(&permissions).
+		Order("name ASC").
+		Select()
+	if err != nil {
+		return nil, err
+	}
+	return permissions, nil
+}
+
+func (r *Role) Create(db *DB) error {
+	_, err := db.Model(r).Insert()
+	return roleError(err)
+}
+
+// Update saves the role's name, description and permissions. It returns
+// ErrLastAdmin if that would leave no enabled admin.
+func (r *Role) Update(db *DB) error {
+	err := KeepAnAdmin(db.DB, func(tx *pg.Tx) error {
+		_, err := tx.Model(r).
+			Column("name", "description", "permissions").
+			WherePK().
+			Update()
+		return err
+	})
+	return roleError(err)
+}
+
+func roleError(err error) error {
+	if pgErr, ok := err.(pg.Error); ok && pgErr.Field('C') == "23505" {
+		return ErrRoleNameTaken
+	}
+	return err
+}
+
+// Delete removes a role that is not built in, taking it away from every user and
+// group that had it. It returns ErrLastAdmin if that would leave no enabled
+// admin.
+func (r *Role) Delete(db *DB) error {
+	if r.BuiltIn {
+		return ErrBuiltInRole
+	}
+	return KeepAnAdmin(db.DB, func(tx *pg.Tx) error {
+		for _, model := range []interface{}{(*UserRole)(nil), (*GroupRole)(nil)} {
+			_, err := tx.Model(model).Where("role_id = ?", r.Id).Delete()
+			if err != nil {
+				return err
+			}
+		}
+		_, err := tx.Model(r).WherePK().Delete()
+		return err
+	})
+}
+
+func GetRole(db *DB, id string) (*Role, error) {
+	role := &Role{}
+	err := db.Model(role).
+		Where("id = ?", id).
+		Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return role, nil
+}
+
+// GetRoles returns every role, those of the sign-in service first.
+func GetRoles(db *DB) ([]*Role, error) {
+	var roles []*Role
+	err := db.Model(&roles).
+		Order("built_in DESC").
+		OrderExpr("client_id NULLS FIRST").
+		Order("name ASC").
+		Select()
+	if err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// GetClientRoles returns the roles that belong to clientID.
+func GetClientRoles(db *DB, clientID string) ([]*Role, error) {
+	var roles []*Role
+	err := db.Model(&roles).
+		Where("client_id = ?", clientID).
+		Order("name ASC").
+		Select()
+	if err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// AssignRole gives userID the role. Assigning a role twice does nothing.
+func AssignRole(db orm.DB, userID, roleID string) error {
+	_, err := db.Model(&UserRole{UserId: userID, RoleId: roleID, CreatedAt: time.Now()}).
+		OnConflict("DO NOTHING").
+		Insert()
+	return err
+}
+
+// UnassignRole takes the role away from userID.
+func UnassignRole(db orm.DB, userID, roleID string) error {
+	_, err := db.Model((*UserRole)(nil)).
+		Where("user_id = ?", userID).
+		Where("role_id = ?", roleID).
+		Delete()
+	return err
+}
+
+// LoadRoles reads the user's roles into Roles and recomputes Permissions from
+// the sign-in service's own roles. Roles include those of applications and those
+// given to the user's groups or the groups they are nested inside.
+func (u *User) LoadRoles(db orm.DB) error {
+	var roles []*Role
+	err := db.Model(&roles).
+		WhereGroup(func(q *pg.Query) (*pg.Query, error) {
+			return q.Where("role.id IN (SELECT role_id FROM user_roles WHERE user_id = ?)", u.Id).
+				WhereOr("role.id IN (SELECT role_id FROM group_roles WHERE group_id IN ("+memberGroupsQuery+"))", u.Id), nil
+		}).
+		Order("role.name ASC").
+		Select()
+	if err != nil {
+		return err
+	}
+
+	u.Roles = roles
+	u.Permissions = 0
+	for _, role := range roles {
+		if role.ClientId != "" {
+			continue
+		}
+		for _, permission := range role.Permissions {
+			u.Permissions |= permissionBits[permission]
+		}
+	}
+	return nil
+}
+
+// HasPermission reports whether any of the user's loaded roles in the sign-in
+// service grants permission.
+func (u *User) HasPermission(permission string) bool {
+	for _, role := range u.Roles {
+		if role.ClientId != "" {
+			continue
+		}
+		for _, granted := range role.Permissions {
+			if granted == permission {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ClientRoles returns the user's loaded roles that belong to clientID.
+func (u *User) ClientRoles(clientID string) []*Role {
+	var roles []*Role
+	for _, role := range u.Roles {
+		if role.ClientId == clientID {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+// RoleIds returns the ids of the user's loaded roles.
+func (u *User) RoleIds() []string {
+	ids := make([]string, 0, len(u.Roles))
+	for _, role := range u.Roles {
+		ids = append(ids, role.Id)
+	}
+	return ids
+}
+
+// syncBuiltInRoles assigns the built-in roles whose bits are set in permissions.
+// With remove, it also takes away those whose bits are clear.
+func syncBuiltInRoles(db orm.DB, userID string, permissions int, remove bool) error {
+	for _, builtIn := range builtInRoles {
+		var err error
+		if permissions&builtIn.bit != 0 {
+			err = AssignRole(db, userID, builtIn.role.Id)
+		} else if remove {
+			err = UnassignRole(db, userID, builtIn.role.Id)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
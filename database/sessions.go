@@ -0,0 +1,127 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+)
+
+// Session is a signed-in browser or device. Every session token carries the
+// session ID as its `sid` claim, so revoking the row cuts the token off before
+// it expires.
+type Session struct {
+	Id         string     `pg:"id,pk"`
+	UserId     string     `pg:"user_id"`
+	Device     string     `pg:"device"`
+	IP         string     `pg:"ip"`
+	UserAgent  string     `pg:"user_agent"`
+	CreatedAt  time.Time  `pg:"created_at"`
+	LastSeenAt time.Time  `pg:"last_seen_at"`
+	ExpiresAt  time.Time  `pg:"expires_at"`
+	RevokedAt  *time.Time `pg:"revoked_at"`
+}
+
+func (s Session) String() string {
+	return fmt.Sprintf("Session<%s, %s, %s>", s.Id, s.UserId, s.Device)
+}
+
+func (s *Session) Create(db *DB) error {
+	_, err := db.Model(s).Insert()
+	return err
+}
+
+func (s *Session) IsActive() bool {
+	return s.RevokedAt == nil && time.Now().Before(s.ExpiresAt)
+}
+
+// Touch records activity on the session and extends it until expiresAt.
+func (s *Session) Touch(db *DB, ip string, expiresAt time.Time) error {
+	s.LastSeenAt = time.Now()
+	s.IP = ip
+	if expiresAt.After(s.ExpiresAt) {
+		s.ExpiresAt = expiresAt
+	}
+	_, err := db.Model(s).
+		Set("last_seen_at = ?last_seen_at").
+		Set("ip = ?ip").
+		Set("expires_at = ?expires_at").
+		WherePK().
+		Update()
+	return err
+}
+
+// Revoke ends the session along with every refresh token issued within it.
+func (s *Session) Revoke(db *DB) error {
+	return RevokeSessions(db, s.UserId, s.Id, "")
+}
+
+func GetSession(db *DB, id string) (*Session, error) {
+	session := &Session{}
+	err := db.Model(session).
+		Where("id = ?", id).
+		Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return session, nil
+}
+
+// GetUserSessions returns the user's active sessions, most recently used first.
+func GetUserSessions(db *DB, userID string) ([]*Session, error) {
+	var sessions []*Session
+	err := db.Model(&sessions).
+		Where("user_id = ?", userID).
+		Where("revoked_at IS NULL").
+		Where("expires_at > ?", time.Now()).
+		Order("last_seen_at DESC").
+		Select()
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// RevokeSessions revokes the user's sessions and their refresh tokens. A non-empty
+// only restricts it to that session; a non-empty except spares that session.
+func RevokeSessions(db *DB, userID, only, except string) error {
+	return db.RunInTransaction(db.Context(), func(tx *pg.Tx) error {
+		now := time.Now()
+
+		var ids []string
+		q := tx.Model((*Session)(nil)).
+			Column("id").
+			Where("user_id = ?", userID).
+			Where("revoked_at IS NULL")
+		if only != "" {
+			q = q.Where("id = ?", only)
+		}
+		if except != "" {
+			q = q.Where("id != ?", except)
+		}
+		if err := q.Select(&ids); err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+
+		_, err := tx.Model((*Session)(nil)).
+			Set("revoked_at = ?", now).
+			Where("id IN (?)", pg.In(ids)).
+			Update()
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Model((*RefreshToken)(nil)).
+			Set("revoked_at = ?", now).
+			Where("session_id IN (?)", pg.In(ids)).
+			Where("revoked_at IS NULL").
+			Update()
+		return err
+	})
+}
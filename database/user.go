@@ -2,23 +2,33 @@ package database
 
 import (
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/go-pg/pg/v10"
 )
 
+// Bits of User.Permissions, which mirror the built-in roles.
 const (
 	PermissionUser = 1 << iota
 	PermissionEditor
 	PermissionAdmin
 )
 
+// User is an account. Permissions is a view of the user's roles for code
+// written against the old permission mask: the loaders fill it in from Roles,
+// and Create and UpdatePermissions store it as built-in role assignments.
 type User struct {
-	Id               string        `pg:"id,pk"`
-	Email            string        `pg:"email,unique"`
-	Password         string        `pg:"password"`
-	Permissions      int           `pg:"permissions"`
-	Profile          *UserProfile  `pg:"rel:has-one"`
-	GeneratedInvites []*InviteCode `pg:"rel:has-many,fk:generated_by"`
+	Id                 string        `pg:"id,pk"`
+	Email              string        `pg:"email,unique"`
+	Password           string        `pg:"password"`
+	Permissions        int           `pg:"-"`
+	Roles              []*Role       `pg:"-"`
+	EmailVerifiedAt    *time.Time    `pg:"email_verified_at"`
+	VerificationSentAt *time.Time    `pg:"verification_sent_at"`
+	DisabledAt         *time.Time    `pg:"disabled_at"`
+	Profile            *UserProfile  `pg:"rel:has-one,fk:id,join_fk:user_id"`
+	GeneratedInvites   []*InviteCode `pg:"rel:has-many,fk:generated_by"`
 }
 
 type UserProfile struct {
@@ -51,12 +61,22 @@ func (s Socials) String() string {
 }
 
 func (u *User) Create(db *DB) error {
-	_, err := db.Model(u).Insert()
-	return err
+	return db.RunInTransaction(db.Context(), func(tx *pg.Tx) error {
+		if _, err := tx.Model(u).Insert(); err != nil {
+			return err
+		}
+		if err := syncBuiltInRoles(tx, u.Id, u.Permissions, false); err != nil {
+			return err
+		}
+		return u.LoadRoles(tx)
+	})
 }
 
 func (u *User) Read(db *DB) error {
-	return db.Model(u).WherePK().Select()
+	if err := db.Model(u).WherePK().Select(); err != nil {
+		return err
+	}
+	return u.LoadRoles(db)
 }
 
 func (u *User) Update(db *DB) error {
@@ -64,9 +84,118 @@ func (u *User) Update(db *DB) error {
 	return err
 }
 
+// Delete removes the user with everything that belongs to them: roles, group
+// memberships, profile, sign-in methods, tokens, sessions and the invites they
+// created. It returns ErrLastAdmin instead of deleting the last enabled admin.
 func (u *User) Delete(db *DB) error {
-	_, err := db.Model(u).WherePK().Delete()
-	return err
+	return KeepAnAdmin(db.DB, func(tx *pg.Tx) error {
+		_, err := tx.Model((*Socials)(nil)).
+			Where("user_profile_id IN (SELECT id FROM user_profiles WHERE user_id = ?)", u.Id).
+			Delete()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Model((*InviteCode)(nil)).Where("generated_by = ?", u.Id).Delete()
+		if err != nil {
+			return err
+		}
+
+		models := []interface{}{
+			(*UserRole)(nil),
+			(*GroupMember)(nil),
+			(*UserProfile)(nil),
+			(*Passkey)(nil),
+			(*WebAuthnChallenge)(nil),
+			(*TOTPDevice)(nil),
+			(*RecoveryCode)(nil),
+			(*PasswordResetToken)(nil),
+			(*EmailChange)(nil),
+			(*RefreshToken)(nil),
+			(*AuthorizationCode)(nil),
+			(*Session)(nil),
+		}
+		for _, model := range models {
+			_, err := tx.Model(model).Where("user_id = ?", u.Id).Delete()
+			if err != nil {
+				return err
+			}
+		}
+		_, err = tx.Model(u).WherePK().Delete()
+		return err
+	})
+}
+
+func (u *User) IsEmailVerified() bool {
+	return u.EmailVerifiedAt != nil
+}
+
+// MarkEmailVerified records that the user proved they own email. It reports false
+// if email is no longer the user's address or was already verified, so a
+// verification link only works once.
+func (u *User) MarkEmailVerified(db *DB, email string) (bool, error) {
+	now := time.Now()
+	res, err := db.Model(u).
+		Set("email_verified_at = ?", now).
+		WherePK().
+		Where("email = ?", email).
+		Where("email_verified_at IS NULL").
+		Update()
+	if err != nil {
+		return false, err
+	}
+	if res.RowsAffected() == 0 {
+		return false, nil
+	}
+	u.EmailVerifiedAt = &now
+	return true, nil
+}
+
+// ClaimVerificationEmail records that a verification email is being sent. It
+// reports false if one was already sent within interval, which throttles resends.
+func (u *User) ClaimVerificationEmail(db *DB, interval time.Duration) (bool, error) {
+	now := time.Now()
+	res, err := db.Model(u).
+		Set("verification_sent_at = ?", now).
+		WherePK().
+		WhereGroup(func(q *pg.Query) (*pg.Query, error) {
+			return q.Where("verification_sent_at IS NULL").
+				WhereOr("verification_sent_at < ?", now.Add(-interval)), nil
+		}).
+		Update()
+	if err != nil {
+		return false, err
+	}
+	if res.RowsAffected() == 0 {
+		return false, nil
+	}
+	u.VerificationSentAt = &now
+	return true, nil
+}
+
+func (u *User) IsDisabled() bool {
+	return u.DisabledAt != nil
+}
+
+// SetDisabled stops the user from signing in, or lets them again. It returns
+// ErrLastAdmin instead of disabling the last enabled admin.
+func (u *User) SetDisabled(db *DB, disabled bool) error {
+	var disabledAt *time.Time
+	if disabled {
+		now := time.Now()
+		disabledAt = &now
+	}
+	err := KeepAnAdmin(db.DB, func(tx *pg.Tx) error {
+		_, err := tx.Model(u).
+			Set("disabled_at = ?", disabledAt).
+			WherePK().
+			Update()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	u.DisabledAt = disabledAt
+	return nil
 }
 
 func (u *User) IsUser() bool {
@@ -143,12 +272,17 @@ func (s *Socials) Delete(db *DB) error {
 	return err
 }
 
+// UpdatePermissions gives the user the built-in roles whose bits are set in
+// Permissions and takes away the others. Custom roles and roles from groups are
+// kept, so Permissions may still include bits they grant afterwards. It returns
+// ErrLastAdmin instead of taking admin away from the last enabled admin.
 func (u *User) UpdatePermissions(db *pg.DB) error {
-	_, err := db.Model(u).
-		Set("permissions = ?", u.Permissions).
-		Where("id = ?", u.Id).
-		Update()
-	return err
+	return KeepAnAdmin(db, func(tx *pg.Tx) error {
+		if err := syncBuiltInRoles(tx, u.Id, u.Permissions, true); err != nil {
+			return err
+		}
+		return u.LoadRoles(tx)
+	})
 }
 
 func (u *User) GetHighestPermission() string {
@@ -163,7 +297,10 @@ func (u *User) GetHighestPermission() string {
 }
 
 func (u *User) GetUserWithProfile(db *DB) error {
-	return db.Model(u).Relation("Profile").WherePK().Select()
+	if err := db.Model(u).Relation("Profile").WherePK().Select(); err != nil {
+		return err
+	}
+	return u.LoadRoles(db)
 }
 
 func (p *UserProfile) GetUserProfileWithSocials(db *DB) error {
@@ -176,5 +313,52 @@ func GetUserByEmail(db *DB, email string) (*User, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := user.LoadRoles(db); err != nil {
+		return nil, err
+	}
 	return user, nil
 }
+
+// UserFilter narrows ListUsers. Query matches part of the email address or
+// profile name, ignoring case.
+type UserFilter struct {
+	Query  string
+	Limit  int
+	Offset int
+}
+
+// ListUsers returns the users matching filter with their profiles and roles,
+// ordered by email, along with how many match in total.
+func ListUsers(db *DB, filter UserFilter) ([]*User, int, error) {
+	var users []*User
+	q := db.Model(&users).
+		Relation("Profile").
+		Order("user.email ASC")
+	if filter.Query != "" {
+		pattern := "%" + likeEscaper.Replace(filter.Query) + "%"
+		q = q.WhereGroup(func(q *pg.Query) (*pg.Query, error) {
+			return q.Where(`"user".email ILIKE ?`, pattern).
+				WhereOr(`"profile".name ILIKE ?`, pattern), nil
+		})
+	}
+	if filter.Limit > 0 {
+		q = q.Limit(filter.Limit)
+	}
+	if filter.Offset > 0 {
+		q = q.Offset(filter.Offset)
+	}
+
+	total, err := q.SelectAndCount()
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, user := range users {
+		if err := user.LoadRoles(db); err != nil {
+			return nil, 0, err
+		}
+	}
+	return users, total, nil
+}
+
+// likeEscaper keeps search text from being read as LIKE wildcards.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/pragmahq/sso/database"
+	"github.com/pragmahq/sso/importer"
+)
+
+// runImport implements `sso import [-format json|keycloak|auth0] [-dry-run] FILE`.
+// It lists every user it could not import and fails if there were any.
+func runImport(db *database.DB, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	format := flags.String("format", importer.FormatJSON, "export format: json, keycloak or auth0")
+	dryRun := flags.Bool("dry-run", false, "validate the export without creating users")
+	batchSize := flags.Int("batch", 500, "users written per transaction")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: sso import [-format json|keycloak|auth0] [-dry-run] FILE")
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	records, failures, err := importer.Read(*format, file)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", flags.Arg(0), err)
+	}
+
+	result, err := importer.Import(db, records, importer.Options{BatchSize: *batchSize, DryRun: *dryRun})
+	if err != nil {
+		return err
+	}
+	failures = append(failures, result.Failed...)
+
+	for _, email := range result.Skipped {
+		fmt.Printf("skipped %s: already registered or listed twice\n", email)
+	}
+	for _, failure := range failures {
+		fmt.Printf("failed %s: %s\n", failure.Email, failure.Reason)
+	}
+	fmt.Printf("imported %d, skipped %d, failed %d\n", result.Imported, len(result.Skipped), len(failures))
+	if *dryRun {
+		fmt.Println("dry run, nothing was written")
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("%d users could not be imported", len(failures))
+	}
+	return nil
+}
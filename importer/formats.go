@@ -0,0 +1,349 @@
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pragmahq/sso/passwords"
+)
+
+// Formats that Read understands.
+const (
+	FormatJSON     = "json"
+	FormatKeycloak = "keycloak"
+	FormatAuth0    = "auth0"
+)
+
+// Read parses an export in the given format. Users whose password cannot be
+// converted are left out and reported as failures, so one bad hash does not stop
+// the rest of the import.
+func Read(format string, r io.Reader) ([]Record, []Failure, error) {
+	switch format {
+	case FormatJSON:
+		return readJSON(r)
+	case FormatKeycloak:
+		return readKeycloak(r)
+	case FormatAuth0:
+		return readAuth0(r)
+	}
+	return nil, nil, fmt.Errorf("unknown import format %q", format)
+}
+
+// jsonUser is our own format, for systems we export from with a script. The hash
+// must already be in a format the passwords package reads.
+type jsonUser struct {
+	Email         string `json:"email"`
+	Name          string `json:"name"`
+	EmailVerified bool   `json:"emailVerified"`
+	PasswordHash  string `json:"passwordHash"`
+}
+
+func readJSON(r io.Reader) ([]Record, []Failure, error) {
+	var records []Record
+	err := decodeEach(r, func(raw json.RawMessage) error {
+		var user jsonUser
+		if err := json.Unmarshal(raw, &user); err != nil {
+			return err
+		}
+		records = append(records, Record{
+			Email:         user.Email,
+			Name:          user.Name,
+			EmailVerified: user.EmailVerified,
+			PasswordHash:  user.PasswordHash,
+		})
+		return nil
+	})
+	return records, nil, err
+}
+
+// keycloakExport is a realm or users export from Keycloak.
+type keycloakExport struct {
+	Users []struct {
+		Email         string               `json:"email"`
+		EmailVerified bool                 `json:"emailVerified"`
+		FirstName     string               `json:"firstName"`
+		LastName      string               `json:"lastName"`
+		Credentials   []keycloakCredential `json:"credentials"`
+	} `json:"users"`
+}
+
+// keycloakCredential covers both the current layout, where secretData and
+// credentialData hold JSON documents, and the flat one used before Keycloak 11.
+type keycloakCredential struct {
+	Type           string `json:"type"`
+	SecretData     string `json:"secretData"`
+	CredentialData string `json:"credentialData"`
+
+	HashedSaltedValue string `json:"hashedSaltedValue"`
+	Salt              string `json:"salt"`
+	HashIterations    int    `json:"hashIterations"`
+	Algorithm         string `json:"algorithm"`
+}
+
+func readKeycloak(r io.Reader) ([]Record, []Failure, error) {
+	var export keycloakExport
+	if err := json.NewDecoder(r).Decode(&export); err != nil {
+		return nil, nil, err
+	}
+
+	var records []Record
+	var failures []Failure
+	for _, user := range export.Users {
+		record := Record{
+			Email:         user.Email,
+			Name:          strings.TrimSpace(user.FirstName + " " + user.LastName),
+			EmailVerified: user.EmailVerified,
+		}
+		var err error
+		for _, credential := range user.Credentials {
+			if credential.Type == "password" {
+				record.PasswordHash, err = convertKeycloak(credential)
+				break
+			}
+		}
+		if err != nil {
+			failures = append(failures, Failure{Email: user.Email, Reason: err.Error()})
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, failures, nil
+}
+
+func convertKeycloak(credential keycloakCredential) (string, error) {
+	value, salt := credential.HashedSaltedValue, credential.Salt
+	iterations, algorithm := credential.HashIterations, credential.Algorithm
+	if credential.SecretData != "" {
+		var secret struct {
+			Value string `json:"value"`
+			Salt  string `json:"salt"`
+		}
+		var data struct {
+			HashIterations int    `json:"hashIterations"`
+			Algorithm      string `json:"algorithm"`
+		}
+		if err := json.Unmarshal([]byte(credential.SecretData), &secret); err != nil {
+			return "", fmt.Errorf("invalid secretData: %w", err)
+		}
+		if err := json.Unmarshal([]byte(credential.CredentialData), &data); err != nil {
+			return "", fmt.Errorf("invalid credentialData: %w", err)
+		}
+		value, salt = secret.Value, secret.Salt
+		iterations, algorithm = data.HashIterations, data.Algorithm
+	}
+
+	digest, ok := map[string]string{
+		"pbkdf2":        "sha1",
+		"pbkdf2-sha256": "sha256",
+		"pbkdf2-sha512": "sha512",
+	}[algorithm]
+	if !ok {
+		return "", fmt.Errorf("unsupported password algorithm %q", algorithm)
+	}
+	saltBytes, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil {
+		return "", fmt.Errorf("invalid salt: %w", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid hash: %w", err)
+	}
+	if iterations <= 0 {
+		return "", fmt.Errorf("invalid iteration count %d", iterations)
+	}
+	return passwords.EncodePbkdf2(digest, iterations, saltBytes, key), nil
+}
+
+// auth0User is a user in Auth0's bulk import schema, which is also what their
+// support team produces for password hash exports.
+type auth0User struct {
+	Email              string           `json:"email"`
+	EmailVerified      bool             `json:"email_verified"`
+	Name               string           `json:"name"`
+	GivenName          string           `json:"given_name"`
+	FamilyName         string           `json:"family_name"`
+	PasswordHash       string           `json:"password_hash"`
+	CustomPasswordHash *auth0CustomHash `json:"custom_password_hash"`
+}
+
+type auth0CustomHash struct {
+	Algorithm string `json:"algorithm"`
+	Hash      struct {
+		Value    string `json:"value"`
+		Encoding string `json:"encoding"`
+	} `json:"hash"`
+	Salt *struct {
+		Value    string `json:"value"`
+		Encoding string `json:"encoding"`
+		Position string `json:"position"`
+	} `json:"salt"`
+}
+
+func readAuth0(r io.Reader) ([]Record, []Failure, error) {
+	var records []Record
+	var failures []Failure
+	err := decodeEach(r, func(raw json.RawMessage) error {
+		var user auth0User
+		if err := json.Unmarshal(raw, &user); err != nil {
+			return err
+		}
+		name := user.Name
+		if name == "" || name == user.Email {
+			name = strings.TrimSpace(user.GivenName + " " + user.FamilyName)
+		}
+
+		hash := user.PasswordHash
+		if user.CustomPasswordHash != nil {
+			converted, err := convertAuth0(user.CustomPasswordHash)
+			if err != nil {
+				failures = append(failures, Failure{Email: user.Email, Reason: err.Error()})
+				return nil
+			}
+			hash = converted
+		}
+
+		records = append(records, Record{
+			Email:         user.Email,
+			Name:          name,
+			EmailVerified: user.EmailVerified,
+			PasswordHash:  hash,
+		})
+		return nil
+	})
+	return records, failures, err
+}
+
+func convertAuth0(custom *auth0CustomHash) (string, error) {
+	switch custom.Algorithm {
+	case "bcrypt", "argon2":
+		return custom.Hash.Value, nil
+	case "pbkdf2":
+		return convertPHCPbkdf2(custom.Hash.Value)
+	case "sha1", "sha256", "sha512":
+		sum, err := decodeBytes(custom.Hash.Value, custom.Hash.Encoding, "hex")
+		if err != nil {
+			return "", fmt.Errorf("invalid hash: %w", err)
+		}
+		var salt []byte
+		position := passwords.SaltPrefix
+		if custom.Salt != nil {
+			salt, err = decodeBytes(custom.Salt.Value, custom.Salt.Encoding, "utf8")
+			if err != nil {
+				return "", fmt.Errorf("invalid salt: %w", err)
+			}
+			if custom.Salt.Position == passwords.SaltSuffix {
+				position = passwords.SaltSuffix
+			}
+		}
+		return passwords.EncodeSaltedSHA(custom.Algorithm, position, salt, sum), nil
+	}
+	return "", fmt.Errorf("unsupported password algorithm %q", custom.Algorithm)
+}
+
+// convertPHCPbkdf2 reads $pbkdf2-<digest>$i=<iterations>,l=<length>$<salt>$<key>
+// with padded or unpadded base64.
+func convertPHCPbkdf2(value string) (string, error) {
+	parts := strings.Split(value, "$")
+	if len(parts) != 5 || !strings.HasPrefix(parts[1], "pbkdf2-") {
+		return "", fmt.Errorf("invalid pbkdf2 hash")
+	}
+	digest := strings.TrimPrefix(parts[1], "pbkdf2-")
+	if digest != "sha1" && digest != "sha256" && digest != "sha512" {
+		return "", fmt.Errorf("unsupported pbkdf2 digest %q", digest)
+	}
+
+	iterations := 0
+	for _, param := range strings.Split(parts[2], ",") {
+		if v, ok := strings.CutPrefix(param, "i="); ok {
+			iterations, _ = strconv.Atoi(v)
+		}
+	}
+	if iterations <= 0 {
+		return "", fmt.Errorf("invalid pbkdf2 iteration count")
+	}
+
+	salt, err := decodeBytes(parts[3], "base64", "")
+	if err != nil {
+		return "", fmt.Errorf("invalid salt: %w", err)
+	}
+	key, err := decodeBytes(parts[4], "base64", "")
+	if err != nil {
+		return "", fmt.Errorf("invalid hash: %w", err)
+	}
+	return passwords.EncodePbkdf2(digest, iterations, salt, key), nil
+}
+
+func decodeBytes(value, encoding, fallback string) ([]byte, error) {
+	if encoding == "" {
+		encoding = fallback
+	}
+	switch encoding {
+	case "hex":
+		return hex.DecodeString(value)
+	case "base64":
+		return base64.RawStdEncoding.DecodeString(strings.TrimRight(value, "="))
+	case "utf8":
+		return []byte(value), nil
+	}
+	return nil, fmt.Errorf("unsupported encoding %q", encoding)
+}
+
+// decodeEach calls fn for every object in a JSON array or in newline-delimited
+// JSON.
+func decodeEach(r io.Reader, fn func(json.RawMessage) error) error {
+	reader := bufio.NewReader(r)
+	first, err := peekNonSpace(reader)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(reader)
+	if first == '[' {
+		var items []json.RawMessage
+		if err := decoder.Decode(&items); err != nil {
+			return err
+		}
+		for _, item := range items {
+			if err := fn(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for {
+		var item json.RawMessage
+		err := decoder.Decode(&item)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+}
+
+func peekNonSpace(r *bufio.Reader) (byte, error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if !bytes.ContainsRune([]byte(" \t\r\n"), rune(b)) {
+			return b, r.UnreadByte()
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package importer
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+func verify(t *testing.T, password, encoded string) bool {
+	ok, rehash, err := hasher.Verify(password, encoded)
+	assert.NoError(t, err)
+	// Imported hashes are always upgraded on the first sign-in
+	assert.Equal(t, ok, rehash)
+	return ok
+}
+
+func TestReadKeycloak(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	key := pbkdf2.Key([]byte("kc-password"), salt, 27500, 64, sha256.New)
+	secret := fmt.Sprintf(`{\"value\":\"%s\",\"salt\":\"%s\"}`,
+		base64.StdEncoding.EncodeToString(key), base64.StdEncoding.EncodeToString(salt))
+
+	export := `{"realm":"pragma","users":[
+		{"email":"kc@example.com","emailVerified":true,"firstName":"Kay","lastName":"Cloak","credentials":[
+			{"type":"password","secretData":"` + secret + `","credentialData":"{\"hashIterations\":27500,\"algorithm\":\"pbkdf2-sha256\"}"}
+		]},
+		{"email":"old@example.com","credentials":[
+			{"type":"password","hashedSaltedValue":"` + base64.StdEncoding.EncodeToString(key) + `","salt":"` + base64.StdEncoding.EncodeToString(salt) + `","hashIterations":27500,"algorithm":"pbkdf2-sha256"}
+		]},
+		{"email":"argon@example.com","credentials":[
+			{"type":"password","secretData":"{}","credentialData":"{\"algorithm\":\"argon2\"}"}
+		]},
+		{"email":"social@example.com"}
+	]}`
+
+	records, failures, err := Read(FormatKeycloak, strings.NewReader(export))
+	assert.NoError(t, err)
+	if assert.Len(t, records, 3) {
+		assert.Equal(t, "Kay Cloak", records[0].Name)
+		assert.True(t, records[0].EmailVerified)
+		assert.True(t, verify(t, "kc-password", records[0].PasswordHash))
+		assert.True(t, verify(t, "kc-password", records[1].PasswordHash))
+		assert.Empty(t, records[2].PasswordHash)
+	}
+	if assert.Len(t, failures, 1) {
+		assert.Equal(t, "argon@example.com", failures[0].Email)
+	}
+}
+
+func TestReadAuth0(t *testing.T) {
+	salt := []byte("pepper")
+	key := pbkdf2.Key([]byte("a0-password"), salt, 10000, 32, sha256.New)
+	sum := sha256.Sum256([]byte("a0-password" + "abc"))
+
+	export := `
+{"email":"pbkdf2@example.com","email_verified":true,"name":"pbkdf2@example.com","given_name":"Pat","family_name":"Kdf","custom_password_hash":{"algorithm":"pbkdf2","hash":{"value":"$pbkdf2-sha256$i=10000,l=32$` + base64.StdEncoding.EncodeToString(salt) + `$` + base64.RawStdEncoding.EncodeToString(key) + `"}}}
+{"email":"sha@example.com","name":"Sha","custom_password_hash":{"algorithm":"sha256","hash":{"value":"` + hex.EncodeToString(sum[:]) + `","encoding":"hex"},"salt":{"value":"abc","position":"suffix"}}}
+{"email":"md5@example.com","custom_password_hash":{"algorithm":"md5","hash":{"value":"abc"}}}
+`
+	records, failures, err := Read(FormatAuth0, strings.NewReader(export))
+	assert.NoError(t, err)
+	if assert.Len(t, records, 2) {
+		assert.Equal(t, "Pat Kdf", records[0].Name)
+		assert.True(t, verify(t, "a0-password", records[0].PasswordHash))
+		assert.True(t, verify(t, "a0-password", records[1].PasswordHash))
+		assert.False(t, verify(t, "wrong", records[1].PasswordHash))
+	}
+	if assert.Len(t, failures, 1) {
+		assert.Equal(t, "md5@example.com", failures[0].Email)
+	}
+
+	// Auth0 also hands out JSON arrays
+	records, _, err = Read(FormatAuth0, strings.NewReader(`[{"email":"a@example.com"},{"email":"b@example.com"}]`))
+	assert.NoError(t, err)
+	assert.Len(t, records, 2)
+
+	_, _, err = Read("ldap", strings.NewReader(""))
+	assert.Error(t, err)
+}
@@ -0,0 +1,181 @@
+// Package importer moves users from other identity providers into the database.
+// Foreign password hashes are converted into formats the passwords package can
+// verify, and are upgraded the first time each user signs in.
+package importer
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+	"github.com/pragmahq/sso/database"
+	"github.com/pragmahq/sso/passwords"
+)
+
+// Record is one user to import. PasswordHash must be empty, for users who will
+// reset their password, or a hash passwords.Hasher can check.
+type Record struct {
+	Email         string
+	Name          string
+	EmailVerified bool
+	PasswordHash  string
+}
+
+// Options control an import. Records are written BatchSize at a time, each batch
+// in its own transaction. DryRun validates everything without writing.
+type Options struct {
+	BatchSize int
+	DryRun    bool
+}
+
+// Failure is a record that could not be imported.
+type Failure struct {
+	Email  string
+	Reason string
+}
+
+// Result summarizes an import. Skipped lists addresses that already had an
+// account or appeared earlier in the same import.
+type Result struct {
+	Imported int
+	Skipped  []string
+	Failed   []Failure
+}
+
+// hasher only checks hash formats, so its cost parameters only raise the bounds
+// imported hashes are checked against.
+var hasher = passwords.NewHasher(passwords.DefaultArgon2Params())
+
+// Import creates a user and profile for every valid record whose email is not
+// taken yet. Imported users get the built-in user role.
+func Import(db *database.DB, records []Record, opts Options) (*Result, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 500
+	}
+
+	result := &Result{}
+	seen := make(map[string]bool)
+	var valid []Record
+	for _, record := range records {
+		record.Email = strings.TrimSpace(record.Email)
+		if reason := validate(record); reason != "" {
+			result.Failed = append(result.Failed, Failure{Email: record.Email, Reason: reason})
+			continue
+		}
+		key := strings.ToLower(record.Email)
+		if seen[key] {
+			result.Skipped = append(result.Skipped, record.Email)
+			continue
+		}
+		seen[key] = true
+		valid = append(valid, record)
+	}
+
+	for start := 0; start < len(valid); start += opts.BatchSize {
+		batch := valid[start:min(start+opts.BatchSize, len(valid))]
+		imported, skipped, err := importBatch(db, batch, opts.DryRun)
+		if err != nil {
+			return result, fmt.Errorf("importing records %d-%d: %w", start+1, start+len(batch), err)
+		}
+		result.Imported += imported
+		result.Skipped = append(result.Skipped, skipped...)
+	}
+	return result, nil
+}
+
+func validate(record Record) string {
+	if !strings.Contains(record.Email, "@") {
+		return "invalid email address"
+	}
+	if record.PasswordHash == "" {
+		return ""
+	}
+	err := hasher.Check(record.PasswordHash)
+	if err == passwords.ErrUnknownHash {
+		return "unsupported password hash"
+	}
+	if err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+func importBatch(db *database.DB, batch []Record, dryRun bool) (int, []string, error) {
+	emails := make([]string, len(batch))
+	for i, record := range batch {
+		emails[i] = record.Email
+	}
+
+	var existing []string
+	err := db.Model((*database.User)(nil)).
+		Column("email").
+		Where("lower(email) IN (?)", pg.In(lowered(emails))).
+		Select(&existing)
+	if err != nil {
+		return 0, nil, err
+	}
+	taken := make(map[string]bool, len(existing))
+	for _, email := range existing {
+		taken[strings.ToLower(email)] = true
+	}
+
+	var skipped []string
+	var users []*database.User
+	var profiles []*database.UserProfile
+	var roles []*database.UserRole
+	now := time.Now()
+	for _, record := range batch {
+		if taken[strings.ToLower(record.Email)] {
+			skipped = append(skipped, record.Email)
+			continue
+		}
+
+		user := &database.User{
+			Id:       uuid.New().String(),
+			Email:    record.Email,
+			Password: record.PasswordHash,
+		}
+		if record.EmailVerified {
+			user.EmailVerifiedAt = &now
+		}
+		users = append(users, user)
+		profiles = append(profiles, &database.UserProfile{
+			UserId: user.Id,
+			Name:   record.Name,
+			Email:  record.Email,
+		})
+		roles = append(roles, &database.UserRole{
+			UserId:    user.Id,
+			RoleId:    database.RoleUser,
+			CreatedAt: now,
+		})
+	}
+	if dryRun || len(users) == 0 {
+		return len(users), skipped, nil
+	}
+
+	err = db.RunInTransaction(db.Context(), func(tx *pg.Tx) error {
+		if _, err := tx.Model(&users).Insert(); err != nil {
+			return err
+		}
+		if _, err := tx.Model(&profiles).Insert(); err != nil {
+			return err
+		}
+		_, err := tx.Model(&roles).Insert()
+		return err
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	return len(users), skipped, nil
+}
+
+func lowered(values []string) []string {
+	out := make([]string, len(values))
+	for i, value := range values {
+		out[i] = strings.ToLower(value)
+	}
+	return out
+}
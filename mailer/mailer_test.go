@@ -0,0 +1,62 @@
+package mailer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRender(t *testing.T) {
+	msg, err := Render("password_reset", "user@example.com", map[string]interface{}{
+		"Product": "Pragma",
+		"Link":    "https://example.com/reset?token=abc&x=<y>",
+		"Expires": "1h0m0s",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "user@example.com", msg.To)
+	assert.Equal(t, "Reset your Pragma password", msg.Subject)
+	assert.Contains(t, msg.Text, "https://example.com/reset?token=abc&x=<y>")
+	assert.Contains(t, msg.HTML, "<h1")
+	assert.Contains(t, msg.HTML, "token=abc&amp;x=%3cy%3e")
+
+	_, err = Render("missing", "user@example.com", nil)
+	assert.Error(t, err)
+}
+
+func TestCompose(t *testing.T) {
+	msg := &Message{To: "user@example.com", Subject: "Grüße", Text: "plain", HTML: "<p>html</p>"}
+	data, err := Compose("Pragma <no-reply@example.com>", msg, time.Now())
+	assert.NoError(t, err)
+
+	composed := string(data)
+	assert.Contains(t, composed, "To: user@example.com\r\n")
+	assert.Contains(t, composed, "Subject: =?utf-8?q?Gr=C3=BC=C3=9Fe?=\r\n")
+	assert.Contains(t, composed, "@example.com>\r\n")
+	assert.Contains(t, composed, "multipart/alternative")
+	assert.Contains(t, composed, "<p>html</p>")
+
+	// Header injection through the recipient or subject is refused
+	_, err = Compose("no-reply@example.com", &Message{To: "a@example.com\r\nBcc: b@example.com", Text: "x"}, time.Now())
+	assert.Error(t, err)
+}
+
+func TestFileMailer(t *testing.T) {
+	dir := t.TempDir()
+	m := &FileMailer{Dir: dir, From: "no-reply@example.com"}
+
+	err := m.Send(context.Background(), &Message{To: "user@example.com", Subject: "Hello", Text: "Hi there"})
+	assert.NoError(t, err)
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	assert.NoError(t, err)
+	if assert.Len(t, files, 1) {
+		data, err := os.ReadFile(files[0])
+		assert.NoError(t, err)
+		assert.True(t, strings.Contains(string(data), "Hi there"))
+	}
+}
@@ -0,0 +1,140 @@
+package mailer
+
+import (
+	"context"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// smtpStub is a minimal in-process SMTP server that records what it receives.
+type smtpStub struct {
+	listener net.Listener
+	reject   bool
+
+	mu         sync.Mutex
+	auth       string
+	from       string
+	recipients []string
+	data       string
+}
+
+func newSMTPStub(t *testing.T) *smtpStub {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := &smtpStub{listener: listener}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go stub.serve(conn)
+		}
+	}()
+	return stub
+}
+
+func (s *smtpStub) serve(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 localhost ESMTP stub")
+
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+
+		s.mu.Lock()
+		switch verb {
+		case "EHLO":
+			text.PrintfLine("250-localhost\r\n250 AUTH PLAIN")
+		case "HELO", "NOOP", "RSET":
+			text.PrintfLine("250 OK")
+		case "AUTH":
+			s.auth = line
+			text.PrintfLine("235 Authenticated")
+		case "MAIL":
+			s.from = line
+			text.PrintfLine("250 OK")
+		case "RCPT":
+			if s.reject {
+				text.PrintfLine("550 No such user")
+				break
+			}
+			s.recipients = append(s.recipients, line)
+			text.PrintfLine("250 OK")
+		case "DATA":
+			text.PrintfLine("354 Go ahead")
+			data, err := text.ReadDotBytes()
+			if err != nil {
+				s.mu.Unlock()
+				return
+			}
+			s.data = string(data)
+			text.PrintfLine("250 Queued")
+		case "QUIT":
+			text.PrintfLine("221 Bye")
+			s.mu.Unlock()
+			return
+		default:
+			text.PrintfLine("502 Unknown command")
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *smtpStub) mailer() *SMTPMailer {
+	host, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	return &SMTPMailer{Host: host, Port: port, From: "no-reply@example.com"}
+}
+
+func TestSMTPMailer(t *testing.T) {
+	stub := newSMTPStub(t)
+	m := stub.mailer()
+	m.Username = "user"
+	m.Password = "secret"
+
+	err := m.Send(context.Background(), &Message{
+		To:      "user@example.com",
+		Subject: "Hello",
+		Text:    "Hi there",
+		HTML:    "<p>Hi there</p>",
+	})
+	assert.NoError(t, err)
+
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	assert.Contains(t, stub.auth, "AUTH PLAIN")
+	assert.Equal(t, "MAIL FROM:<no-reply@example.com>", stub.from)
+	assert.Equal(t, []string{"RCPT TO:<user@example.com>"}, stub.recipients)
+	assert.Contains(t, stub.data, "Subject: Hello")
+	assert.Contains(t, stub.data, "<p>Hi there</p>")
+}
+
+func TestSMTPMailerRejected(t *testing.T) {
+	stub := newSMTPStub(t)
+	stub.reject = true
+
+	err := stub.mailer().Send(context.Background(), &Message{To: "nobody@example.com", Subject: "Hello", Text: "Hi"})
+	assert.Error(t, err)
+}
+
+func TestSMTPMailerUnreachable(t *testing.T) {
+	stub := newSMTPStub(t)
+	m := stub.mailer()
+	stub.listener.Close()
+
+	err := m.Send(context.Background(), &Message{To: "user@example.com", Subject: "Hello", Text: "Hi"})
+	assert.Error(t, err)
+}
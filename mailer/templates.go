@@ -0,0 +1,43 @@
+package mailer
+
+import (
+	"bytes"
+	"embed"
+	htmltemplate "html/template"
+	texttemplate "text/template"
+)
+
+//go:embed templates
+var templates embed.FS
+
+// Render builds the message for the named template. templates/<name>.txt defines
+// the "subject" and "text" blocks and templates/<name>.html the "content" block
+// placed into the shared HTML layout. data is available to all of them.
+func Render(name, to string, data interface{}) (*Message, error) {
+	text, err := texttemplate.ParseFS(templates, "templates/"+name+".txt")
+	if err != nil {
+		return nil, err
+	}
+	html, err := htmltemplate.ParseFS(templates, "templates/layout.html", "templates/"+name+".html")
+	if err != nil {
+		return nil, err
+	}
+
+	var subject, body, htmlBody bytes.Buffer
+	if err := text.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return nil, err
+	}
+	if err := text.ExecuteTemplate(&body, "text", data); err != nil {
+		return nil, err
+	}
+	if err := html.ExecuteTemplate(&htmlBody, "layout", data); err != nil {
+		return nil, err
+	}
+
+	return &Message{
+		To:      to,
+		Subject: subject.String(),
+		Text:    body.String(),
+		HTML:    htmlBody.String(),
+	}, nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"log"
+	"os"
 
 	"github.com/pragmahq/sso/database"
 	"github.com/pragmahq/sso/web"
@@ -14,5 +15,12 @@ func main() {
 	}
 
 	defer db.Close()
+
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		if err := runImport(db, os.Args[2:]); err != nil {
+			log.Fatalf("Failed to import users: %v", err)
+		}
+		return
+	}
 	web.Serve(db)
 }
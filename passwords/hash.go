@@ -0,0 +1,297 @@
+package passwords
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrUnknownHash is returned for stored hashes no registered algorithm can read.
+var ErrUnknownHash = errors.New("unknown password hash format")
+
+// ErrMalformedHash is returned for stored hashes that claim a known algorithm but
+// cannot be parsed.
+var ErrMalformedHash = errors.New("malformed password hash")
+
+// ErrHashTooCostly is returned for stored hashes whose cost parameters are beyond
+// what the server is willing to compute on every sign-in attempt.
+var ErrHashTooCostly = errors.New("password hash cost parameters out of range")
+
+// Upper bounds on the cost parameters of stored hashes. They are well above what
+// any of the supported systems use, but keep a hash from making each sign-in
+// attempt take minutes or gigabytes.
+const (
+	maxArgon2Memory      = 1024 * 1024 // KiB
+	maxArgon2Iterations  = 32
+	maxArgon2Parallelism = 16
+	maxBcryptCost        = 16
+	maxPbkdf2Iterations  = 2000000
+	maxScryptMemory      = 1 << 30 // bytes, 128 * N * r
+	maxScryptParallelism = 16
+	maxKeyLength         = 128
+)
+
+// Algorithm is one way of hashing passwords. Hashes are self-describing strings,
+// in PHC format where the algorithm has one, so the stored value alone says how
+// to verify it.
+type Algorithm interface {
+	// Identifies reports whether encoded was produced by this algorithm.
+	Identifies(encoded string) bool
+	Hash(password string) (string, error)
+	Verify(password, encoded string) (bool, error)
+	// Check parses encoded without verifying a password against it, returning
+	// ErrMalformedHash or ErrHashTooCostly if Verify could not use it.
+	Check(encoded string) error
+	// Outdated reports whether encoded used weaker parameters than Hash would
+	// use today.
+	Outdated(encoded string) bool
+}
+
+// Hasher hashes new passwords with Current and verifies stored hashes with
+// whichever algorithm produced them.
+type Hasher struct {
+	Current Algorithm
+	Legacy  []Algorithm
+}
+
+// NewHasher returns a hasher that writes argon2id hashes and still accepts bcrypt
+// and the formats users are imported with.
+func NewHasher(params Argon2Params) *Hasher {
+	return &Hasher{
+		Current: &Argon2id{Params: params},
+		Legacy: []Algorithm{
+			&Bcrypt{Cost: bcrypt.DefaultCost},
+			&Pbkdf2{Digest: "sha1", Iterations: 600000},
+			&Pbkdf2{Digest: "sha256", Iterations: 600000},
+			&Pbkdf2{Digest: "sha512", Iterations: 210000},
+			&Scrypt{LogN: 15, BlockSize: 8, Parallelism: 1},
+			&SaltedSHA{Digest: "sha1"},
+			&SaltedSHA{Digest: "sha256"},
+			&SaltedSHA{Digest: "sha512"},
+		},
+	}
+}
+
+func (h *Hasher) Hash(password string) (string, error) {
+	return h.Current.Hash(password)
+}
+
+// Verify checks password against encoded. rehash is true when the password is
+// correct but encoded should be replaced by a fresh Hash, because it used another
+// algorithm or outdated parameters.
+func (h *Hasher) Verify(password, encoded string) (ok, rehash bool, err error) {
+	algorithm := h.algorithm(encoded)
+	if algorithm == nil {
+		return false, false, ErrUnknownHash
+	}
+	ok, err = algorithm.Verify(password, encoded)
+	if err != nil || !ok {
+		return false, false, err
+	}
+	return true, algorithm != h.Current || h.Current.Outdated(encoded), nil
+}
+
+// Recognizes reports whether encoded is in a format the hasher can verify.
+func (h *Hasher) Recognizes(encoded string) bool {
+	return h.algorithm(encoded) != nil
+}
+
+// Check fully parses encoded, so hashes that would never verify are caught
+// before they are stored. It returns ErrUnknownHash, ErrMalformedHash or
+// ErrHashTooCostly.
+func (h *Hasher) Check(encoded string) error {
+	algorithm := h.algorithm(encoded)
+	if algorithm == nil {
+		return ErrUnknownHash
+	}
+	return algorithm.Check(encoded)
+}
+
+func (h *Hasher) algorithm(encoded string) Algorithm {
+	if h.Current.Identifies(encoded) {
+		return h.Current
+	}
+	for _, algorithm := range h.Legacy {
+		if algorithm.Identifies(encoded) {
+			return algorithm
+		}
+	}
+	return nil
+}
+
+// Argon2Params are the argon2id cost parameters. Memory is in KiB.
+type Argon2Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  int
+	KeyLength   int
+}
+
+// DefaultArgon2Params follow the OWASP recommendation for argon2id.
+func DefaultArgon2Params() Argon2Params {
+	return Argon2Params{
+		Memory:      64 * 1024,
+		Iterations:  3,
+		Parallelism: 2,
+		SaltLength:  16,
+		KeyLength:   32,
+	}
+}
+
+// Argon2id hashes to $argon2id$v=19$m=<memory>,t=<iterations>,p=<parallelism>$<salt>$<key>
+// with unpadded base64 salt and key.
+type Argon2id struct {
+	Params Argon2Params
+}
+
+func (a *Argon2id) Identifies(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+func (a *Argon2id) Hash(password string) (string, error) {
+	salt := make([]byte, a.Params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	p := a.Params
+	key := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, uint32(p.KeyLength))
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.Memory, p.Iterations, p.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (a *Argon2id) Verify(password, encoded string) (bool, error) {
+	p, salt, key, err := a.decode(encoded)
+	if err != nil {
+		return false, err
+	}
+	actual := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, uint32(len(key)))
+	return subtle.ConstantTimeCompare(actual, key) == 1, nil
+}
+
+func (a *Argon2id) Check(encoded string) error {
+	_, _, _, err := a.decode(encoded)
+	return err
+}
+
+// decode parses encoded and checks its cost against the bounds, which are raised
+// to the configured Params so the server's own hashes always pass.
+func (a *Argon2id) decode(encoded string) (p Argon2Params, salt, key []byte, err error) {
+	p, salt, key, err = decodeArgon2id(encoded)
+	if err != nil {
+		return p, nil, nil, err
+	}
+	if p.Memory > max(maxArgon2Memory, a.Params.Memory) ||
+		p.Iterations > max(maxArgon2Iterations, a.Params.Iterations) ||
+		p.Parallelism > max(maxArgon2Parallelism, a.Params.Parallelism) ||
+		p.KeyLength > maxKeyLength {
+		return p, nil, nil, ErrHashTooCostly
+	}
+	return p, salt, key, nil
+}
+
+func (a *Argon2id) Outdated(encoded string) bool {
+	p, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+	return p.Memory < a.Params.Memory ||
+		p.Iterations < a.Params.Iterations ||
+		p.Parallelism < a.Params.Parallelism ||
+		len(salt) < a.Params.SaltLength ||
+		len(key) < a.Params.KeyLength
+}
+
+func decodeArgon2id(encoded string) (p Argon2Params, salt, key []byte, err error) {
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, key
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return p, nil, nil, ErrMalformedHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, ErrMalformedHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism); err != nil ||
+		parts[3] != fmt.Sprintf("m=%d,t=%d,p=%d", p.Memory, p.Iterations, p.Parallelism) {
+		return p, nil, nil, ErrMalformedHash
+	}
+	if p.Memory == 0 || p.Iterations == 0 || p.Parallelism == 0 {
+		return p, nil, nil, ErrMalformedHash
+	}
+
+	salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, ErrMalformedHash
+	}
+	key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return p, nil, nil, ErrMalformedHash
+	}
+	p.SaltLength = len(salt)
+	p.KeyLength = len(key)
+	return p, salt, key, nil
+}
+
+// Bcrypt reads and writes the $2a$/$2b$/$2y$ modular crypt format. It only sees
+// the first BcryptMaxLength bytes of a password.
+type Bcrypt struct {
+	Cost int
+}
+
+func (b *Bcrypt) Identifies(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") ||
+		strings.HasPrefix(encoded, "$2b$") ||
+		strings.HasPrefix(encoded, "$2y$")
+}
+
+func (b *Bcrypt) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), b.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func (b *Bcrypt) Verify(password, encoded string) (bool, error) {
+	if err := b.Check(encoded); err != nil {
+		return false, err
+	}
+	// bcrypt refuses longer input outright, so no stored hash can match it.
+	if len(password) > BcryptMaxLength {
+		return false, nil
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	if err != nil {
+		return false, ErrMalformedHash
+	}
+	return true, nil
+}
+
+func (b *Bcrypt) Check(encoded string) error {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	if err != nil || len(encoded) != 60 {
+		return ErrMalformedHash
+	}
+	if cost > max(maxBcryptCost, b.Cost) {
+		return ErrHashTooCostly
+	}
+	return nil
+}
+
+func (b *Bcrypt) Outdated(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost < b.Cost
+}
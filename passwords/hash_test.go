@@ -0,0 +1,58 @@
+package passwords
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var testParams = Argon2Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+func TestArgon2id(t *testing.T) {
+	hasher := NewHasher(testParams)
+
+	encoded, err := hasher.Hash("correct horse")
+	assert.NoError(t, err)
+	assert.Regexp(t, `^\$argon2id\$v=19\$m=1024,t=1,p=1\$[A-Za-z0-9+/]{22}\$[A-Za-z0-9+/]{43}$`, encoded)
+
+	ok, rehash, err := hasher.Verify("correct horse", encoded)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.False(t, rehash)
+
+	ok, _, err = hasher.Verify("wrong horse", encoded)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// Raising the cost marks existing hashes for an upgrade
+	stronger := testParams
+	stronger.Iterations = 2
+	ok, rehash, err = NewHasher(stronger).Verify("correct horse", encoded)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, rehash)
+
+	_, _, err = hasher.Verify("correct horse", "$argon2id$v=19$m=0,t=1,p=1$AAAA$AAAA")
+	assert.ErrorIs(t, err, ErrMalformedHash)
+}
+
+func TestBcryptLegacy(t *testing.T) {
+	hasher := NewHasher(testParams)
+
+	legacy, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	assert.NoError(t, err)
+
+	ok, rehash, err := hasher.Verify("correct horse", string(legacy))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, rehash)
+
+	ok, rehash, err = hasher.Verify("wrong horse", string(legacy))
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.False(t, rehash)
+
+	_, _, err = hasher.Verify("correct horse", "plaintext")
+	assert.ErrorIs(t, err, ErrUnknownHash)
+}
@@ -0,0 +1,252 @@
+package passwords
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// The algorithms below only exist to verify hashes imported from other systems.
+// A successful login replaces them with a hash from Hasher.Current. They all use
+// PHC-style strings with unpadded base64 salt and key, which is what importers
+// convert foreign formats into.
+
+// hashFunctions are the digests the legacy formats can be built on.
+var hashFunctions = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// Pbkdf2 verifies $pbkdf2-<digest>$i=<iterations>$<salt>$<key>, where digest is
+// sha1, sha256 or sha512.
+type Pbkdf2 struct {
+	Digest     string
+	Iterations int
+}
+
+func (p *Pbkdf2) id() string {
+	return "pbkdf2-" + p.Digest
+}
+
+func (p *Pbkdf2) Identifies(encoded string) bool {
+	return strings.HasPrefix(encoded, "$"+p.id()+"$")
+}
+
+func (p *Pbkdf2) Hash(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	newHash := hashFunctions[p.Digest]
+	key := pbkdf2.Key([]byte(password), salt, p.Iterations, newHash().Size(), newHash)
+	return EncodePbkdf2(p.Digest, p.Iterations, salt, key), nil
+}
+
+func (p *Pbkdf2) Verify(password, encoded string) (bool, error) {
+	iterations, salt, key, err := p.decode(encoded)
+	if err != nil {
+		return false, err
+	}
+	actual := pbkdf2.Key([]byte(password), salt, iterations, len(key), hashFunctions[p.Digest])
+	return subtle.ConstantTimeCompare(actual, key) == 1, nil
+}
+
+func (p *Pbkdf2) Check(encoded string) error {
+	_, _, _, err := p.decode(encoded)
+	return err
+}
+
+func (p *Pbkdf2) decode(encoded string) (iterations int, salt, key []byte, err error) {
+	params, salt, key, err := splitPHC(encoded, p.id())
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if _, err := fmt.Sscanf(params, "i=%d", &iterations); err != nil || iterations <= 0 || params != fmt.Sprintf("i=%d", iterations) {
+		return 0, nil, nil, ErrMalformedHash
+	}
+	if iterations > max(maxPbkdf2Iterations, p.Iterations) || len(key) > maxKeyLength {
+		return 0, nil, nil, ErrHashTooCostly
+	}
+	return iterations, salt, key, nil
+}
+
+func (p *Pbkdf2) Outdated(encoded string) bool {
+	return true
+}
+
+// EncodePbkdf2 formats a PBKDF2 hash the way Pbkdf2 reads it.
+func EncodePbkdf2(digest string, iterations int, salt, key []byte) string {
+	return fmt.Sprintf("$pbkdf2-%s$i=%d$%s$%s", digest, iterations, encodeB64(salt), encodeB64(key))
+}
+
+// Scrypt verifies $scrypt$ln=<log2 N>,r=<block size>,p=<parallelism>$<salt>$<key>.
+type Scrypt struct {
+	LogN        int
+	BlockSize   int
+	Parallelism int
+}
+
+func (s *Scrypt) Identifies(encoded string) bool {
+	return strings.HasPrefix(encoded, "$scrypt$")
+}
+
+func (s *Scrypt) Hash(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := scrypt.Key([]byte(password), salt, 1<<s.LogN, s.BlockSize, s.Parallelism, 32)
+	if err != nil {
+		return "", err
+	}
+	return EncodeScrypt(s.LogN, s.BlockSize, s.Parallelism, salt, key), nil
+}
+
+func (s *Scrypt) Verify(password, encoded string) (bool, error) {
+	logN, r, p, salt, key, err := s.decode(encoded)
+	if err != nil {
+		return false, err
+	}
+	actual, err := scrypt.Key([]byte(password), salt, 1<<logN, r, p, len(key))
+	if err != nil {
+		return false, ErrMalformedHash
+	}
+	return subtle.ConstantTimeCompare(actual, key) == 1, nil
+}
+
+func (s *Scrypt) Check(encoded string) error {
+	_, _, _, _, _, err := s.decode(encoded)
+	return err
+}
+
+func (s *Scrypt) decode(encoded string) (logN, r, p int, salt, key []byte, err error) {
+	params, salt, key, err := splitPHC(encoded, "scrypt")
+	if err != nil {
+		return 0, 0, 0, nil, nil, err
+	}
+	if _, err := fmt.Sscanf(params, "ln=%d,r=%d,p=%d", &logN, &r, &p); err != nil ||
+		logN <= 0 || r <= 0 || p <= 0 || params != fmt.Sprintf("ln=%d,r=%d,p=%d", logN, r, p) {
+		return 0, 0, 0, nil, nil, ErrMalformedHash
+	}
+	if logN > 23 || r > maxScryptMemory>>(7+logN) || p > maxScryptParallelism || len(key) > maxKeyLength {
+		return 0, 0, 0, nil, nil, ErrHashTooCostly
+	}
+	return logN, r, p, salt, key, nil
+}
+
+func (s *Scrypt) Outdated(encoded string) bool {
+	return true
+}
+
+// EncodeScrypt formats an scrypt hash the way Scrypt reads it.
+func EncodeScrypt(logN, r, p int, salt, key []byte) string {
+	return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s", logN, r, p, encodeB64(salt), encodeB64(key))
+}
+
+// Salt positions for SaltedSHA.
+const (
+	SaltPrefix = "prefix"
+	SaltSuffix = "suffix"
+)
+
+// SaltedSHA verifies a single salted digest,
+// $salted-<digest>$pos=<prefix|suffix>$<salt>$<digest>, where pos says whether
+// the salt was placed before or after the password.
+type SaltedSHA struct {
+	Digest string
+}
+
+func (s *SaltedSHA) id() string {
+	return "salted-" + s.Digest
+}
+
+func (s *SaltedSHA) Identifies(encoded string) bool {
+	return strings.HasPrefix(encoded, "$"+s.id()+"$")
+}
+
+func (s *SaltedSHA) Hash(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	sum := saltedSum(s.Digest, password, salt, SaltSuffix)
+	return EncodeSaltedSHA(s.Digest, SaltSuffix, salt, sum), nil
+}
+
+func (s *SaltedSHA) Verify(password, encoded string) (bool, error) {
+	position, salt, sum, err := s.decode(encoded)
+	if err != nil {
+		return false, err
+	}
+	actual := saltedSum(s.Digest, password, salt, position)
+	return subtle.ConstantTimeCompare(actual, sum) == 1, nil
+}
+
+func (s *SaltedSHA) Check(encoded string) error {
+	_, _, _, err := s.decode(encoded)
+	return err
+}
+
+func (s *SaltedSHA) decode(encoded string) (position string, salt, sum []byte, err error) {
+	params, salt, sum, err := splitPHC(encoded, s.id())
+	if err != nil {
+		return "", nil, nil, err
+	}
+	position, ok := strings.CutPrefix(params, "pos=")
+	if !ok || position != SaltPrefix && position != SaltSuffix || len(sum) != hashFunctions[s.Digest]().Size() {
+		return "", nil, nil, ErrMalformedHash
+	}
+	return position, salt, sum, nil
+}
+
+func (s *SaltedSHA) Outdated(encoded string) bool {
+	return true
+}
+
+// EncodeSaltedSHA formats a salted digest the way SaltedSHA reads it.
+func EncodeSaltedSHA(digest, position string, salt, sum []byte) string {
+	return fmt.Sprintf("$salted-%s$pos=%s$%s$%s", digest, position, encodeB64(salt), encodeB64(sum))
+}
+
+func saltedSum(digest, password string, salt []byte, position string) []byte {
+	h := hashFunctions[digest]()
+	if position == SaltPrefix {
+		h.Write(salt)
+		h.Write([]byte(password))
+	} else {
+		h.Write([]byte(password))
+		h.Write(salt)
+	}
+	return h.Sum(nil)
+}
+
+// splitPHC splits $<id>$<params>$<salt>$<key> and decodes salt and key.
+func splitPHC(encoded, id string) (params string, salt, key []byte, err error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 5 || parts[0] != "" || parts[1] != id {
+		return "", nil, nil, ErrMalformedHash
+	}
+	salt, err = base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return "", nil, nil, ErrMalformedHash
+	}
+	key, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil || len(key) == 0 {
+		return "", nil, nil, ErrMalformedHash
+	}
+	return parts[2], salt, key, nil
+}
+
+func encodeB64(data []byte) string {
+	return base64.RawStdEncoding.EncodeToString(data)
+}
@@ -0,0 +1,98 @@
+package passwords
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+func TestLegacyHashes(t *testing.T) {
+	hasher := NewHasher(testParams)
+
+	// Hashes computed the way the source systems did, then converted
+	salt := []byte("seasalt")
+	key := pbkdf2.Key([]byte("lètmein"), salt, 30000, 32, sha256.New)
+	encoded := EncodePbkdf2("sha256", 30000, salt, key)
+
+	sum := sha1.Sum(append([]byte("s4lt"), "hunter2"...))
+	sha := sum[:]
+
+	cases := map[string]string{
+		"pbkdf2-sha256": encoded,
+		"salted-sha1":   EncodeSaltedSHA("sha1", SaltPrefix, []byte("s4lt"), sha),
+	}
+	passwords := map[string]string{
+		"pbkdf2-sha256": "lètmein",
+		"salted-sha1":   "hunter2",
+	}
+
+	for _, algorithm := range []Algorithm{
+		&Pbkdf2{Digest: "sha512", Iterations: 1000},
+		&Scrypt{LogN: 10, BlockSize: 8, Parallelism: 1},
+		&SaltedSHA{Digest: "sha256"},
+	} {
+		encoded, err := algorithm.Hash("correct horse")
+		assert.NoError(t, err)
+		cases[encoded] = encoded
+		passwords[encoded] = "correct horse"
+	}
+
+	for name, encoded := range cases {
+		assert.True(t, hasher.Recognizes(encoded), name)
+
+		ok, rehash, err := hasher.Verify(passwords[name], encoded)
+		assert.NoError(t, err, name)
+		assert.True(t, ok, name)
+		assert.True(t, rehash, name)
+
+		ok, _, err = hasher.Verify("wrong", encoded)
+		assert.NoError(t, err, name)
+		assert.False(t, ok, name)
+	}
+
+	// The salt position matters
+	swapped := EncodeSaltedSHA("sha1", SaltSuffix, []byte("s4lt"), sha)
+	ok, _, err := hasher.Verify("hunter2", swapped)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	_, _, err = hasher.Verify("hunter2", "$scrypt$ln=x$AAAA$AAAA")
+	assert.ErrorIs(t, err, ErrMalformedHash)
+}
+
+func TestCheck(t *testing.T) {
+	hasher := NewHasher(testParams)
+
+	encoded, err := hasher.Hash("correct horse")
+	assert.NoError(t, err)
+	assert.NoError(t, hasher.Check(encoded))
+
+	// Hashes with a known prefix still have to parse
+	for _, encoded := range []string{
+		"$pbkdf2-sha256$garbage",
+		"$pbkdf2-sha256$i=1000x$c2FsdA$a2V5",
+		"$scrypt$ln=10,r=8$c2FsdA$a2V5",
+		"$salted-sha1$pos=middle$c2FsdA$a2V5",
+		"$2b$10$tooshort",
+	} {
+		assert.ErrorIs(t, hasher.Check(encoded), ErrMalformedHash, encoded)
+	}
+
+	// Costs far beyond what any supported system uses are refused, and never
+	// computed at sign-in either
+	for _, encoded := range []string{
+		EncodePbkdf2("sha256", 1<<30, []byte("salt"), []byte("key")),
+		EncodeScrypt(22, 8, 1, []byte("salt"), []byte("key")),
+		"$argon2id$v=19$m=4194304,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=1024,t=1000,p=1$c2FsdA$a2V5",
+	} {
+		assert.ErrorIs(t, hasher.Check(encoded), ErrHashTooCostly, encoded)
+		_, _, err := hasher.Verify("correct horse", encoded)
+		assert.ErrorIs(t, err, ErrHashTooCostly, encoded)
+	}
+
+	assert.ErrorIs(t, hasher.Check("plaintext"), ErrUnknownHash)
+}
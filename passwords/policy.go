@@ -0,0 +1,117 @@
+// Package passwords decides which passwords users may choose.
+package passwords
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// DefaultMaxLength bounds the work a single login can cause.
+	DefaultMaxLength = 128
+
+	// BcryptMaxLength is the number of bytes bcrypt accepts. Policies for bcrypt
+	// hashes must not allow more.
+	BcryptMaxLength = 72
+)
+
+// Reasons a password is rejected.
+const (
+	ReasonTooShort     = "too_short"
+	ReasonTooLong      = "too_long"
+	ReasonCommon       = "common"
+	ReasonMatchesEmail = "matches_email"
+)
+
+//go:embed common.txt
+var commonList []byte
+
+var common = parseList(commonList)
+
+// Policy holds the rules new passwords must follow. MinLength counts characters
+// and MaxLength bytes, as that is what the hash sees.
+type Policy struct {
+	MinLength     int
+	MaxLength     int
+	Blocklist     bool
+	DisallowEmail bool
+}
+
+// Violation is one rule a password broke. Reason is stable for clients to act on
+// and Message is meant for people.
+type Violation struct {
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+// DefaultPolicy is the policy used when nothing is configured.
+func DefaultPolicy() *Policy {
+	return &Policy{
+		MinLength:     8,
+		MaxLength:     DefaultMaxLength,
+		Blocklist:     true,
+		DisallowEmail: true,
+	}
+}
+
+// Check returns every rule password breaks for the account with the given email,
+// or nil if it is acceptable.
+func (p *Policy) Check(password, email string) []Violation {
+	var violations []Violation
+
+	if utf8.RuneCountInString(password) < p.MinLength {
+		violations = append(violations, Violation{
+			Reason:  ReasonTooShort,
+			Message: fmt.Sprintf("Password must be at least %d characters long", p.MinLength),
+		})
+	}
+	if p.MaxLength > 0 && len(password) > p.MaxLength {
+		violations = append(violations, Violation{
+			Reason:  ReasonTooLong,
+			Message: fmt.Sprintf("Password must be at most %d bytes long", p.MaxLength),
+		})
+	}
+
+	lower := strings.ToLower(password)
+	if p.Blocklist && common[lower] {
+		violations = append(violations, Violation{
+			Reason:  ReasonCommon,
+			Message: "Password is too common",
+		})
+	}
+	if p.DisallowEmail && email != "" && matchesEmail(lower, strings.ToLower(email)) {
+		violations = append(violations, Violation{
+			Reason:  ReasonMatchesEmail,
+			Message: "Password must not be your email address",
+		})
+	}
+
+	return violations
+}
+
+// matchesEmail reports whether the password is the email address or its local
+// part.
+func matchesEmail(password, email string) bool {
+	if password == email {
+		return true
+	}
+	local, _, found := strings.Cut(email, "@")
+	return found && password == local
+}
+
+func parseList(data []byte) map[string]bool {
+	list := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		list[strings.ToLower(line)] = true
+	}
+	return list
+}
@@ -0,0 +1,36 @@
+package passwords
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func reasons(violations []Violation) []string {
+	var out []string
+	for _, v := range violations {
+		out = append(out, v.Reason)
+	}
+	return out
+}
+
+func TestPolicy(t *testing.T) {
+	policy := DefaultPolicy()
+
+	assert.Empty(t, policy.Check("correct horse battery", "user@example.com"))
+	assert.Equal(t, []string{ReasonTooShort}, reasons(policy.Check("", "user@example.com")))
+	assert.Equal(t, []string{ReasonTooShort}, reasons(policy.Check("xK9#a", "user@example.com")))
+
+	// Length limits count characters at the bottom and bytes at the top
+	assert.Empty(t, policy.Check("пароль-пароль", "user@example.com"))
+	assert.Equal(t, []string{ReasonTooLong}, reasons(policy.Check(strings.Repeat("ж", 65), "user@example.com")))
+
+	assert.Equal(t, []string{ReasonCommon}, reasons(policy.Check("Password123", "user@example.com")))
+	assert.Equal(t, []string{ReasonMatchesEmail}, reasons(policy.Check("User@Example.com", "user@example.com")))
+	assert.Equal(t, []string{ReasonMatchesEmail}, reasons(policy.Check("longusername", "longusername@example.com")))
+	assert.Equal(t, []string{ReasonTooShort, ReasonCommon}, reasons(policy.Check("qwerty", "")))
+
+	relaxed := &Policy{MinLength: 1}
+	assert.Empty(t, relaxed.Check("qwerty", "qwerty@example.com"))
+}
@@ -0,0 +1,47 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often MemoryStore drops buckets that have been full for a
+// while, which is the same as not having them.
+const sweepInterval = 10 * time.Minute
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time
+}
+
+// MemoryStore keeps buckets in the process. Limits only hold per instance, so it
+// is meant for tests and single instance deployments.
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]bucket
+	lastSweep time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]bucket)}
+}
+
+func (s *MemoryStore) Take(key string, limit Limit, now time.Time) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastSweep) > sweepInterval {
+		for k, b := range s.buckets {
+			if now.After(b.full) {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	b := s.buckets[key]
+	left, allowed, retryAfter := Take(b.tokens, b.updated, limit, now)
+	s.buckets[key] = bucket{tokens: left, updated: now, full: fullAt(left, limit, now)}
+	return allowed, retryAfter, nil
+}
@@ -0,0 +1,126 @@
+package ratelimit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// KeyFunc picks what a request is counted against. It returns ErrNoKey when the
+// request has nothing to count by.
+type KeyFunc func(c echo.Context) (string, error)
+
+// Rule limits a group of routes by one key. Routes are written as the method and
+// echo route path, such as "POST /api/auth/login", and share a single bucket per
+// key.
+type Rule struct {
+	Name   string
+	Routes []string
+	Limit  Limit
+	Key    KeyFunc
+}
+
+// Middleware applies every rule matching the request's route and responds with
+// 429 and Retry-After when any of them is exhausted. Store errors are passed to
+// onError and the request is let through, so an outage of the store does not take
+// sign-in down with it.
+func Middleware(store Store, rules []Rule, onError func(echo.Context, error)) echo.MiddlewareFunc {
+	byRoute := make(map[string][]Rule)
+	for _, rule := range rules {
+		if rule.Limit.Disabled() {
+			continue
+		}
+		for _, route := range rule.Routes {
+			byRoute[route] = append(byRoute[route], rule)
+		}
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			var wait time.Duration
+			limited := false
+			now := time.Now()
+
+			for _, rule := range byRoute[c.Request().Method+" "+c.Path()] {
+				key, err := rule.Key(c)
+				if err == ErrNoKey {
+					continue
+				}
+				if err != nil {
+					return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+				}
+
+				allowed, retryAfter, err := store.Take(rule.Name+":"+key, rule.Limit, now)
+				if err != nil {
+					onError(c, err)
+					continue
+				}
+				if !allowed {
+					limited = true
+					wait = max(wait, retryAfter)
+				}
+			}
+
+			if limited {
+				seconds := int(math.Ceil(wait.Seconds()))
+				c.Response().Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+				return c.JSON(http.StatusTooManyRequests, map[string]string{"error": "Too many requests, please try again later"})
+			}
+			return next(c)
+		}
+	}
+}
+
+// ByIP counts requests per client IP, as found by the echo instance's
+// IPExtractor. Without one, echo believes any X-Forwarded-For header, so clients
+// could pick a fresh IP for every request.
+func ByIP(c echo.Context) (string, error) {
+	return c.RealIP(), nil
+}
+
+// ByJSONField counts requests per value of a top-level string field in a JSON
+// body, compared case-insensitively. The body is left in place for the handler.
+func ByJSONField(field string) KeyFunc {
+	return func(c echo.Context) (string, error) {
+		req := c.Request()
+		if req.Body == nil || !strings.HasPrefix(req.Header.Get(echo.HeaderContentType), echo.MIMEApplicationJSON) {
+			return "", ErrNoKey
+		}
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return "", err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+
+		var fields map[string]interface{}
+		if err := json.Unmarshal(body, &fields); err != nil {
+			// Leave malformed bodies for the handler to reject.
+			return "", ErrNoKey
+		}
+		value, _ := fields[field].(string)
+		value = strings.ToLower(strings.TrimSpace(value))
+		if value == "" {
+			return "", ErrNoKey
+		}
+		return value, nil
+	}
+}
+
+// ByClientID counts requests per OAuth client, taken from HTTP Basic credentials
+// or the client_id form parameter.
+func ByClientID(c echo.Context) (string, error) {
+	if id, _, ok := c.Request().BasicAuth(); ok && id != "" {
+		return id, nil
+	}
+	if id := c.FormValue("client_id"); id != "" {
+		return id, nil
+	}
+	return "", ErrNoKey
+}
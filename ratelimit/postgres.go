@@ -0,0 +1,30 @@
+package ratelimit
+
+import (
+	"time"
+
+	"github.com/pragmahq/sso/database"
+)
+
+// PostgresStore keeps buckets in the rate_limit_buckets table, so limits hold
+// across every instance.
+type PostgresStore struct {
+	DB *database.DB
+}
+
+func NewPostgresStore(db *database.DB) *PostgresStore {
+	return &PostgresStore{DB: db}
+}
+
+func (s *PostgresStore) Take(key string, limit Limit, now time.Time) (bool, time.Duration, error) {
+	var allowed bool
+	var retryAfter time.Duration
+	err := database.UpdateRateLimitBucket(s.DB, key, func(bucket *database.RateLimitBucket) {
+		var left float64
+		left, allowed, retryAfter = Take(bucket.Tokens, bucket.UpdatedAt, limit, now)
+		bucket.Tokens = left
+		bucket.UpdatedAt = now
+		bucket.FullAt = fullAt(left, limit, now)
+	})
+	return allowed, retryAfter, err
+}
@@ -0,0 +1,91 @@
+// Package ratelimit limits how often a key, such as a client IP or an email
+// address, may hit a group of routes, using token buckets.
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limit allows Burst requests at once, refilled at Rate requests per second.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Every allows n requests per period, all of which may come at once.
+func Every(n int, period time.Duration) Limit {
+	return Limit{Rate: float64(n) / period.Seconds(), Burst: n}
+}
+
+// ParseLimit reads a limit written as "<n>/<period>", such as "10/1m". A value of
+// "off" or "0" disables the limit and returns a zero Limit.
+func ParseLimit(value string) (Limit, error) {
+	if value == "off" || value == "0" {
+		return Limit{}, nil
+	}
+	count, period, found := strings.Cut(value, "/")
+	if !found {
+		return Limit{}, fmt.Errorf("rate limit %q is not <n>/<period>", value)
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 {
+		return Limit{}, fmt.Errorf("rate limit %q has an invalid count", value)
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return Limit{}, fmt.Errorf("rate limit %q has an invalid period", value)
+	}
+	return Every(n, d), nil
+}
+
+// Disabled reports whether the limit lets everything through.
+func (l Limit) Disabled() bool {
+	return l.Burst <= 0 || l.Rate <= 0
+}
+
+// Store keeps token buckets. Take must be atomic for a key, also across
+// instances for stores shared between them.
+type Store interface {
+	// Take removes a token from key's bucket if one is available. Otherwise it
+	// reports how long until there will be one.
+	Take(key string, limit Limit, now time.Time) (allowed bool, retryAfter time.Duration, err error)
+}
+
+// ErrNoKey tells the middleware to skip a rule for a request, such as an email
+// rule for a request without an email address.
+var ErrNoKey = errors.New("no rate limit key")
+
+// refill returns the tokens at now in a bucket that held tokens at updated. A
+// bucket seen for the first time is full.
+func refill(tokens float64, updated time.Time, limit Limit, now time.Time) float64 {
+	if updated.IsZero() {
+		return float64(limit.Burst)
+	}
+	elapsed := now.Sub(updated).Seconds()
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	return math.Min(float64(limit.Burst), tokens+elapsed*limit.Rate)
+}
+
+// Take applies one request to a bucket holding tokens since updated. It returns
+// the tokens left and, when the request is refused, how long to wait.
+func Take(tokens float64, updated time.Time, limit Limit, now time.Time) (left float64, allowed bool, retryAfter time.Duration) {
+	tokens = refill(tokens, updated, limit, now)
+	if tokens >= 1 {
+		return tokens - 1, true, 0
+	}
+	wait := (1 - tokens) / limit.Rate
+	return tokens, false, time.Duration(math.Ceil(wait * float64(time.Second)))
+}
+
+// fullAt is when a bucket holding tokens at now will have refilled.
+func fullAt(tokens float64, limit Limit, now time.Time) time.Time {
+	seconds := (float64(limit.Burst) - tokens) / limit.Rate
+	return now.Add(time.Duration(seconds * float64(time.Second)))
+}
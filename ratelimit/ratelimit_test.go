@@ -0,0 +1,102 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLimit(t *testing.T) {
+	limit, err := ParseLimit("10/1m")
+	assert.NoError(t, err)
+	assert.Equal(t, 10, limit.Burst)
+	assert.InDelta(t, 10.0/60, limit.Rate, 1e-9)
+
+	limit, err = ParseLimit("off")
+	assert.NoError(t, err)
+	assert.True(t, limit.Disabled())
+
+	for _, value := range []string{"10", "x/1m", "10/soon", "10/-1s"} {
+		_, err = ParseLimit(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore()
+	limit := Every(2, time.Minute)
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 2; i++ {
+		allowed, _, err := store.Take("ip:1", limit, now)
+		assert.NoError(t, err)
+		assert.True(t, allowed)
+	}
+	allowed, retryAfter, err := store.Take("ip:1", limit, now)
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+	assert.Equal(t, 30*time.Second, retryAfter)
+
+	// Other keys have their own bucket
+	allowed, _, err = store.Take("ip:2", limit, now)
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+
+	// Tokens come back at the configured rate
+	allowed, _, err = store.Take("ip:1", limit, now.Add(30*time.Second))
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+	allowed, _, err = store.Take("ip:1", limit, now.Add(31*time.Second))
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+}
+
+func TestMiddleware(t *testing.T) {
+	e := echo.New()
+	e.Use(Middleware(NewMemoryStore(), []Rule{
+		{Name: "login", Routes: []string{"POST /login"}, Limit: Every(3, time.Hour), Key: ByIP},
+		{Name: "login-email", Routes: []string{"POST /login"}, Limit: Every(1, time.Hour), Key: ByJSONField("email")},
+	}, func(echo.Context, error) {}))
+	e.POST("/login", func(c echo.Context) error {
+		var body struct {
+			Email string `json:"email"`
+		}
+		if err := c.Bind(&body); err != nil {
+			return err
+		}
+		return c.String(http.StatusOK, body.Email)
+	})
+	e.GET("/other", func(c echo.Context) error { return c.NoContent(http.StatusOK) })
+
+	post := func(email string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"email":"`+email+`"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// The handler still sees the body the middleware read
+	rec := post("a@example.com")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "a@example.com", rec.Body.String())
+
+	rec = post("A@example.com")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "3600", rec.Header().Get("Retry-After"))
+
+	assert.Equal(t, http.StatusOK, post("b@example.com").Code)
+	assert.Equal(t, http.StatusTooManyRequests, post("c@example.com").Code)
+
+	// Routes without rules are not limited
+	for i := 0; i < 5; i++ {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/other", nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+	}
+}
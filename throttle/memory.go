@@ -0,0 +1,47 @@
+package throttle
+
+import (
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps counts in the process. It is meant for tests and single
+// instance deployments; counts are lost on restart.
+type MemoryStore struct {
+	mu     sync.Mutex
+	states map[string]State
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{states: make(map[string]State)}
+}
+
+func (s *MemoryStore) Get(key string) (State, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.states[key], nil
+}
+
+func (s *MemoryStore) Fail(key string, now time.Time, window time.Duration, lockAfter int, lockFor time.Duration) (State, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := s.states[key]
+	if now.Sub(state.LastFailureAt) > window {
+		state.Failures = 0
+	}
+	state.Failures++
+	state.LastFailureAt = now
+	if lockAfter > 0 && state.Failures >= lockAfter {
+		state.LockedUntil = now.Add(lockFor)
+	}
+	s.states[key] = state
+	return state, nil
+}
+
+func (s *MemoryStore) Reset(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.states, key)
+	return nil
+}
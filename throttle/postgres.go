@@ -0,0 +1,45 @@
+package throttle
+
+import (
+	"time"
+
+	"github.com/pragmahq/sso/database"
+)
+
+// PostgresStore keeps counts in the login_throttles table, so every instance
+// sees the same failures.
+type PostgresStore struct {
+	DB *database.DB
+}
+
+func NewPostgresStore(db *database.DB) *PostgresStore {
+	return &PostgresStore{DB: db}
+}
+
+func (s *PostgresStore) Get(key string) (State, error) {
+	throttle, err := database.GetLoginThrottle(s.DB, key)
+	if err != nil || throttle == nil {
+		return State{}, err
+	}
+	return stateOf(throttle), nil
+}
+
+func (s *PostgresStore) Fail(key string, now time.Time, window time.Duration, lockAfter int, lockFor time.Duration) (State, error) {
+	throttle, err := database.RecordLoginFailure(s.DB, key, now, window, lockAfter, lockFor)
+	if err != nil {
+		return State{}, err
+	}
+	return stateOf(throttle), nil
+}
+
+func (s *PostgresStore) Reset(key string) error {
+	return database.ResetLoginThrottle(s.DB, key)
+}
+
+func stateOf(throttle *database.LoginThrottle) State {
+	state := State{Failures: throttle.Failures, LastFailureAt: throttle.LastFailureAt}
+	if throttle.LockedUntil != nil {
+		state.LockedUntil = *throttle.LockedUntil
+	}
+	return state
+}
@@ -0,0 +1,147 @@
+// Package throttle slows down and eventually locks out repeated failed sign-ins.
+//
+// Failures are counted per key, usually one for the account's email address and
+// one for the client IP. After a few free attempts each new attempt has to wait
+// longer than the last, and a key that keeps failing is locked for a while.
+package throttle
+
+import (
+	"strings"
+	"time"
+)
+
+// State is what a Store knows about a key.
+type State struct {
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   time.Time
+}
+
+// Store keeps failure counts. Implementations shared between instances must
+// apply Fail atomically.
+type Store interface {
+	Get(key string) (State, error)
+	// Fail counts a failure at now. The count restarts if the previous failure is
+	// older than window, and the key is locked until now+lockFor when the count
+	// reaches lockAfter. A lockAfter of zero never locks.
+	Fail(key string, now time.Time, window time.Duration, lockAfter int, lockFor time.Duration) (State, error)
+	Reset(key string) error
+}
+
+// Policy says how failures for one kind of key are punished.
+type Policy struct {
+	// Window is how long a failure counts.
+	Window time.Duration
+	// FreeAttempts failures are allowed before delays start.
+	FreeAttempts int
+	// BaseDelay is the wait after the first failure past FreeAttempts. It doubles
+	// with every further failure, up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// LockAfter failures lock the key for LockFor. Zero disables locking.
+	LockAfter int
+	LockFor   time.Duration
+}
+
+// delay is how long to wait after the last of failures before another attempt.
+func (p Policy) delay(failures int) time.Duration {
+	over := failures - p.FreeAttempts
+	if over <= 0 || p.BaseDelay <= 0 {
+		return 0
+	}
+	delay := p.BaseDelay
+	for i := 1; i < over && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, p.MaxDelay)
+}
+
+// Decision is the outcome of Check. RetryAfter is set when the attempt is not
+// allowed; Locked tells a lockout apart from a delay.
+type Decision struct {
+	Allowed    bool
+	Locked     bool
+	RetryAfter time.Duration
+}
+
+// Throttler applies the Account policy to email addresses and the IP policy to
+// client addresses.
+type Throttler struct {
+	Store   Store
+	Account Policy
+	IP      Policy
+
+	// Now is replaced in tests.
+	Now func() time.Time
+}
+
+func New(store Store, account, ip Policy) *Throttler {
+	return &Throttler{Store: store, Account: account, IP: ip, Now: time.Now}
+}
+
+func accountKey(email string) string {
+	return "email:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// Check reports whether a sign-in for email from ip may be attempted now. It
+// does not count anything; call Fail or Succeed with the result.
+func (t *Throttler) Check(email, ip string) (Decision, error) {
+	decision := Decision{Allowed: true}
+	for _, check := range []struct {
+		key    string
+		policy Policy
+	}{
+		{accountKey(email), t.Account},
+		{ipKey(ip), t.IP},
+	} {
+		state, err := t.Store.Get(check.key)
+		if err != nil {
+			return Decision{}, err
+		}
+		d := t.decide(state, check.policy)
+		if !d.Allowed && (decision.Allowed || d.RetryAfter > decision.RetryAfter) {
+			decision = d
+		}
+	}
+	return decision, nil
+}
+
+func (t *Throttler) decide(state State, policy Policy) Decision {
+	now := t.Now()
+	if now.Before(state.LockedUntil) {
+		return Decision{Locked: true, RetryAfter: state.LockedUntil.Sub(now)}
+	}
+	if now.Sub(state.LastFailureAt) > policy.Window {
+		return Decision{Allowed: true}
+	}
+	if wait := state.LastFailureAt.Add(policy.delay(state.Failures)).Sub(now); wait > 0 {
+		return Decision{RetryAfter: wait}
+	}
+	return Decision{Allowed: true}
+}
+
+// Fail counts a failed sign-in for email from ip. Unknown addresses are counted
+// too, so the response never reveals whether an account exists.
+func (t *Throttler) Fail(email, ip string) error {
+	now := t.Now()
+	if _, err := t.Store.Fail(accountKey(email), now, t.Account.Window, t.Account.LockAfter, t.Account.LockFor); err != nil {
+		return err
+	}
+	_, err := t.Store.Fail(ipKey(ip), now, t.IP.Window, t.IP.LockAfter, t.IP.LockFor)
+	return err
+}
+
+// Succeed clears the account's failures. The IP keeps its count, so one valid
+// account does not let an address keep guessing at others.
+func (t *Throttler) Succeed(email string) error {
+	return t.Store.Reset(accountKey(email))
+}
+
+// Unlock clears the account's failures and lock.
+func (t *Throttler) Unlock(email string) error {
+	return t.Store.Reset(accountKey(email))
+}
@@ -0,0 +1,93 @@
+package throttle
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThrottler(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	throttler := New(NewMemoryStore(),
+		Policy{Window: 15 * time.Minute, FreeAttempts: 2, BaseDelay: time.Second, MaxDelay: 4 * time.Second, LockAfter: 5, LockFor: 10 * time.Minute},
+		Policy{Window: 15 * time.Minute, FreeAttempts: 100, BaseDelay: time.Second, MaxDelay: time.Minute},
+	)
+	throttler.Now = func() time.Time { return now }
+
+	fail := func() {
+		decision, err := throttler.Check("User@example.com", "192.0.2.1")
+		assert.NoError(t, err)
+		assert.True(t, decision.Allowed)
+		assert.NoError(t, throttler.Fail("user@example.com", "192.0.2.1"))
+	}
+
+	// Free attempts go through immediately
+	fail()
+	fail()
+
+	// Then each failure doubles the wait, up to the maximum
+	fail()
+	for _, wait := range []time.Duration{time.Second, 2 * time.Second} {
+		decision, err := throttler.Check("user@example.com", "192.0.2.1")
+		assert.NoError(t, err)
+		assert.False(t, decision.Allowed)
+		assert.False(t, decision.Locked)
+		assert.Equal(t, wait, decision.RetryAfter)
+
+		now = now.Add(wait)
+		fail()
+	}
+
+	// The fifth failure locks the account, but not other accounts
+	decision, err := throttler.Check("user@example.com", "198.51.100.7")
+	assert.NoError(t, err)
+	assert.True(t, decision.Locked)
+	assert.Equal(t, 10*time.Minute, decision.RetryAfter)
+
+	decision, err = throttler.Check("other@example.com", "198.51.100.7")
+	assert.NoError(t, err)
+	assert.True(t, decision.Allowed)
+
+	assert.NoError(t, throttler.Unlock("user@example.com"))
+	decision, err = throttler.Check("user@example.com", "198.51.100.7")
+	assert.NoError(t, err)
+	assert.True(t, decision.Allowed)
+
+	// Failures are forgotten after the window
+	fail()
+	fail()
+	fail()
+	now = now.Add(16 * time.Minute)
+	decision, err = throttler.Check("user@example.com", "198.51.100.7")
+	assert.NoError(t, err)
+	assert.True(t, decision.Allowed)
+}
+
+func TestThrottlerPerIP(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	throttler := New(NewMemoryStore(),
+		Policy{Window: time.Minute, FreeAttempts: 100, BaseDelay: time.Second, MaxDelay: time.Minute},
+		Policy{Window: time.Minute, FreeAttempts: 3, BaseDelay: time.Second, MaxDelay: time.Minute},
+	)
+	throttler.Now = func() time.Time { return now }
+
+	// Spraying one password over many accounts is slowed down by the IP
+	for _, email := range []string{"a@example.com", "b@example.com", "c@example.com", "d@example.com"} {
+		assert.NoError(t, throttler.Fail(email, "192.0.2.1"))
+	}
+	decision, err := throttler.Check("e@example.com", "192.0.2.1")
+	assert.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, time.Second, decision.RetryAfter)
+
+	// A successful sign-in does not clear the IP
+	assert.NoError(t, throttler.Succeed("e@example.com"))
+	decision, err = throttler.Check("e@example.com", "192.0.2.1")
+	assert.NoError(t, err)
+	assert.False(t, decision.Allowed)
+
+	decision, err = throttler.Check("e@example.com", "198.51.100.7")
+	assert.NoError(t, err)
+	assert.True(t, decision.Allowed)
+}
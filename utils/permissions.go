@@ -7,16 +7,36 @@ import (
 	"github.com/pragmahq/sso/database"
 )
 
+// currentUserKey is where the signed-in user is kept in the echo context. The
+// JWT middleware already uses "user" for the parsed token.
+const currentUserKey = "currentUser"
+
+// SetCurrentUser stores the signed-in user for the rest of the request.
+func SetCurrentUser(c echo.Context, user *database.User) {
+	c.Set(currentUserKey, user)
+}
+
+// CurrentUser returns the user stored by SetCurrentUser, or nil if the request
+// was not authenticated.
+func CurrentUser(c echo.Context) *database.User {
+	user, _ := c.Get(currentUserKey).(*database.User)
+	return user
+}
+
+// RequirePermission lets through users holding any of the bits in permission. It
+// must run after the middleware that sets the current user.
 func RequirePermission(permission int) echo.MiddlewareFunc {
-	return func(next echo.HandlerFunc) echo.HandlerFunc {
-		return func(c echo.Context) error {
-			user := c.Get("user").(*database.User)
-			if user.Permissions&permission == 0 {
-				return c.JSON(http.StatusForbidden, map[string]string{"error": "Insufficient permissions"})
-			}
-			return next(c)
-		}
-	}
+	return require(func(user *database.User) bool {
+		return user.Permissions&permission != 0
+	})
+}
+
+// RequireGrant lets through users whose roles grant the named permission, such
+// as database.PermManageUsers.
+func RequireGrant(permission string) echo.MiddlewareFunc {
+	return require(func(user *database.User) bool {
+		return user.HasPermission(permission)
+	})
 }
 
 func RequireAdmin(next echo.HandlerFunc) echo.HandlerFunc {
@@ -26,3 +46,18 @@ func RequireAdmin(next echo.HandlerFunc) echo.HandlerFunc {
 func RequireEditor(next echo.HandlerFunc) echo.HandlerFunc {
 	return RequirePermission(database.PermissionEditor)(next)
 }
+
+func require(allowed func(*database.User) bool) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			user := CurrentUser(c)
+			if user == nil {
+				return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Not signed in"})
+			}
+			if !allowed(user) {
+				return c.JSON(http.StatusForbidden, map[string]string{"error": "Insufficient permissions"})
+			}
+			return next(c)
+		}
+	}
+}
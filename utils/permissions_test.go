@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pragmahq/sso/database"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequirePermission(t *testing.T) {
+	ok := func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	}
+	run := func(middleware echo.MiddlewareFunc, user *database.User) int {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+		if user != nil {
+			SetCurrentUser(c, user)
+		}
+		middleware(ok)(c)
+		return rec.Code
+	}
+
+	admin := &database.User{
+		Permissions: database.PermissionUser | database.PermissionAdmin,
+		Roles:       []*database.Role{{Id: database.RoleAdmin, Permissions: []string{database.PermAdminister, database.PermManageUsers}}},
+	}
+	editor := &database.User{
+		Permissions: database.PermissionEditor,
+		Roles: []*database.Role{
+			{Id: database.RoleEditor, Permissions: []string{database.PermEditContent}},
+			{Id: "docs-admin", ClientId: "docs", Permissions: []string{database.PermManageUsers}},
+		},
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, run(RequireAdmin, nil))
+	assert.Equal(t, http.StatusOK, run(RequireAdmin, admin))
+	assert.Equal(t, http.StatusForbidden, run(RequireAdmin, editor))
+	assert.Equal(t, http.StatusOK, run(RequireEditor, editor))
+	assert.Equal(t, http.StatusOK, run(RequireGrant(database.PermManageUsers), admin))
+
+	// Application roles do not count
+	assert.Equal(t, http.StatusForbidden, run(RequireGrant(database.PermManageUsers), editor))
+}
@@ -0,0 +1,28 @@
+package web
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/pragmahq/sso/database"
+	"github.com/pragmahq/sso/utils"
+)
+
+func registerAdminRoutes(router *echo.Echo, db *database.DB) {
+	a := router.Group("/api/admin")
+	a.Use(requireUser(db))
+	a.Use(utils.RequireAdmin)
+
+	// Each area also needs the permission that manages it, so a custom admin role
+	// can hand out part of the admin API.
+	registerClientRoutes(a.Group("", utils.RequireGrant(database.PermManageClients)), db)
+	registerRoleRoutes(a.Group("", utils.RequireGrant(database.PermManageRoles)), db)
+
+	users := a.Group("", utils.RequireGrant(database.PermManageUsers))
+	registerGroupRoutes(users, db)
+	registerUserRoutes(users, db)
+	users.DELETE("/users/:id/sessions", revokeUserSessions(db))
+	users.POST("/users/:id/unlock", unlockUser(db))
+
+	invites := a.Group("", utils.RequireGrant(database.PermManageInvites))
+	invites.GET("/invites", listAllInvites(db))
+	invites.DELETE("/invites/:id", revokeAnyInvite(db))
+}
@@ -0,0 +1,91 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/pragmahq/sso/database"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminRoutePermissions(t *testing.T) {
+	e := echo.New()
+	registerAdminRoutes(e, testDB)
+	request := func(method, path, session string, body interface{}) int {
+		payload, _ := json.Marshal(body)
+		req := httptest.NewRequest(method, path, strings.NewReader(string(payload)))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.AddCookie(&http.Cookie{Name: "Token", Value: session})
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Create a test user whose custom admin role only manages users, and one who
+	// manages users without being an admin
+	admins := &database.Role{Id: uuid.New().String(), Name: "User admins", Permissions: []string{database.PermAdminister, database.PermManageUsers}, CreatedAt: time.Now()}
+	managers := &database.Role{Id: uuid.New().String(), Name: "User managers", Permissions: []string{database.PermManageUsers}, CreatedAt: time.Now()}
+	var sessions []string
+	var users []*database.User
+	for _, role := range []*database.Role{admins, managers} {
+		err := role.Create(testDB)
+		assert.NoError(t, err)
+		testUser := &database.User{Id: uuid.New().String(), Email: role.Id + "@example.com"}
+		err = testUser.Create(testDB)
+		assert.NoError(t, err)
+		err = database.AssignRole(testDB, testUser.Id, role.Id)
+		assert.NoError(t, err)
+		session, err := createSessionToken(testUser, createTestSession(t, testUser))
+		assert.NoError(t, err)
+		users = append(users, testUser)
+		sessions = append(sessions, session)
+	}
+
+	for path, status := range map[string]int{
+		"/api/admin/users":   http.StatusOK,
+		"/api/admin/groups":  http.StatusOK,
+		"/api/admin/clients": http.StatusForbidden,
+		"/api/admin/roles":   http.StatusForbidden,
+		"/api/admin/invites": http.StatusForbidden,
+	} {
+		assert.Equal(t, status, request(http.MethodGet, path, sessions[0], nil), path)
+
+		// Only admins reach the admin API at all
+		assert.Equal(t, http.StatusForbidden, request(http.MethodGet, path, sessions[1], nil), path)
+	}
+
+	// Without managing roles, nobody can be given a group's roles
+	privileged := &database.Group{Id: uuid.New().String(), Name: "Privileged", CreatedAt: time.Now()}
+	team := &database.Group{Id: uuid.New().String(), Name: "Team", CreatedAt: time.Now()}
+	for _, group := range []*database.Group{privileged, team} {
+		err := group.Create(testDB)
+		assert.NoError(t, err)
+	}
+	err := database.AssignGroupRole(testDB, privileged.Id, database.RoleEditor)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, request(http.MethodPut, "/api/admin/groups/"+privileged.Id+"/members/"+users[0].Id, sessions[0], nil))
+	assert.Equal(t, http.StatusOK, request(http.MethodPut, "/api/admin/groups/"+team.Id+"/members/"+users[0].Id, sessions[0], nil))
+	assert.Equal(t, http.StatusForbidden, request(http.MethodPut, "/api/admin/groups/"+team.Id, sessions[0], GroupBody{Name: team.Name, ParentId: privileged.Id}))
+
+	// Clean up
+	err = database.UnassignRole(testDB, users[0].Id, admins.Id)
+	assert.NoError(t, err)
+	for _, testUser := range users {
+		err := testUser.Delete(testDB)
+		assert.NoError(t, err)
+	}
+	for _, role := range []*database.Role{admins, managers} {
+		err := role.Delete(testDB)
+		assert.NoError(t, err)
+	}
+	for _, group := range []*database.Group{privileged, team} {
+		err := group.Delete(testDB)
+		assert.NoError(t, err)
+	}
+}
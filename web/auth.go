@@ -2,15 +2,16 @@ package web
 
 import (
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/go-pg/pg/v10"
-	"github.com/golang-jwt/jwt"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	echojwt "github.com/labstack/echo-jwt/v4"
 	"github.com/labstack/echo/v4"
 	"github.com/pragmahq/sso/database"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/pragmahq/sso/utils"
 )
 
 type ReqBody struct {
@@ -28,16 +29,69 @@ func registerAuthRoutes(router *echo.Echo, db *database.DB) {
 	r := router.Group("/api/auth")
 	r.POST("/register", registerUser(db))
 	r.POST("/login", login(db))
-	r.GET("/logout", logout)
+	r.POST("/login/mfa", loginMFA(db))
+	r.POST("/passkey/begin", beginPasskeyLogin(db))
+	r.POST("/passkey/finish", finishPasskeyLogin(db))
+	r.GET("/logout", logout(db))
+	r.POST("/refresh", refreshSession(db))
 	r.GET("/validate", validateToken(db))
 	r.GET("/validate-invite/:invite", validateInvite(db))
 
+	r.GET("/validate-redirect", validateRedirect(db))
+	registerVerificationRoutes(r, db)
+
 	d := router.Group("/api/user")
-	d.Use(echojwt.WithConfig(echojwt.Config{
-		SigningKey:  SECRET,
-		TokenLookup: "cookie:Token",
-	}))
+	d.Use(requireSession(db))
 	d.GET("/", getUser(db))
+	registerSessionRoutes(d, db)
+	registerMFARoutes(d, db)
+	registerPasskeyRoutes(d, db)
+	registerPasswordRoutes(r, d, db)
+	registerEmailChangeRoutes(r, d, db)
+	registerInviteRoutes(d, db)
+	d.GET("/groups", listMyGroups(db))
+}
+
+// requireSession rejects requests without a valid Token cookie or whose session
+// has been revoked. It stores the parsed *jwt.Token in the context under "user"
+// and the *database.Session under "session".
+func requireSession(db *database.DB) echo.MiddlewareFunc {
+	verifyToken := echojwt.WithConfig(echojwt.Config{
+		KeyFunc:     sessionKey,
+		TokenLookup: "cookie:Token",
+	})
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return verifyToken(checkSession(db)(next))
+	}
+}
+
+// requireUser runs requireSession and loads the signed-in user with their roles,
+// so utils.RequirePermission and the handlers after it can read it with
+// utils.CurrentUser.
+func requireUser(db *database.DB) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return requireSession(db)(func(c echo.Context) error {
+			if _, err := currentUser(c, db); err != nil {
+				return c.JSON(http.StatusUnauthorized, map[string]string{"error": "User not found"})
+			}
+			return next(c)
+		})
+	}
+}
+
+// currentUser returns the user behind the request's session, loading it the
+// first time it is needed in a request.
+func currentUser(c echo.Context, db *database.DB) (*database.User, error) {
+	if user := utils.CurrentUser(c); user != nil {
+		return user, nil
+	}
+	session := c.Get("session").(*database.Session)
+	user := &database.User{Id: session.UserId}
+	if err := user.Read(db); err != nil {
+		return nil, err
+	}
+	utils.SetCurrentUser(c, user)
+	return user, nil
 }
 
 func validateInvite(db *database.DB) echo.HandlerFunc {
@@ -49,11 +103,55 @@ func validateInvite(db *database.DB) echo.HandlerFunc {
 		}
 
 		inviteCode, err := database.GetInviteCode(db, code)
-		if err != nil || inviteCode == nil {
-			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid invite code"})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
 		}
-		if inviteCode.UsedBy != "" {
-			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invite code already used"})
+		if inviteCode == nil {
+			return inviteError(c, database.ErrInviteNotFound)
+		}
+		if err := inviteCode.Check("", time.Now()); err != nil {
+			return inviteError(c, err)
+		}
+
+		// The signup page fills in the address an invite is bound to.
+		return c.JSON(http.StatusOK, map[string]string{"message": "valid", "email": inviteCode.Email})
+	}
+}
+
+// inviteReasons are the machine-readable reasons an invite was refused, with the
+// message shown to people.
+var inviteReasons = map[error][2]string{
+	database.ErrInviteNotFound:   {"invalid", "Invalid invite code"},
+	database.ErrInviteRevoked:    {"revoked", "This invite has been revoked"},
+	database.ErrInviteExpired:    {"expired", "This invite has expired"},
+	database.ErrInviteExhausted:  {"exhausted", "This invite has already been used"},
+	database.ErrInviteWrongEmail: {"email_mismatch", "This invite is for a different email address"},
+}
+
+// inviteError responds to an invite that cannot be used with the reason it was
+// refused.
+func inviteError(c echo.Context, err error) error {
+	reason := inviteReasons[err]
+	return c.JSON(http.StatusBadRequest, map[string]string{"error": reason[1], "reason": reason[0]})
+}
+
+// validateRedirect tells the login page whether it may send the user to the given
+// URL after signing in: either our own authorize endpoint or a redirect URI
+// registered by an enabled client.
+func validateRedirect(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		redirect := c.QueryParam("redirect")
+
+		if strings.HasPrefix(redirect, ISSUER+"/authorize?") {
+			return c.JSON(http.StatusOK, map[string]string{"message": "valid"})
+		}
+
+		client, err := database.GetClientByRedirectURI(db, redirect)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		if client == nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid redirect"})
 		}
 
 		return c.JSON(http.StatusOK, map[string]string{"message": "valid"})
@@ -76,22 +174,36 @@ func registerUser(db *database.DB) echo.HandlerFunc {
 		}
 
 		inviteCode, err := database.GetInviteCode(db, req.InviteCode)
-		if err != nil || inviteCode == nil {
-			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid invite code"})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
 		}
-		if inviteCode.UsedBy != "" {
-			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invite code already used"})
+		if inviteCode == nil {
+			return inviteError(c, database.ErrInviteNotFound)
+		}
+		if err := inviteCode.Check(req.Email, time.Now()); err != nil {
+			return inviteError(c, err)
+		}
+
+		if resp := weakPassword(req.Password, req.Email); resp != nil {
+			return c.JSON(http.StatusBadRequest, resp)
 		}
 
-		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		hashedPassword, err := passwordHasher.Hash(req.Password)
 		if err != nil {
 			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to hash password"})
 		}
 
+		now := time.Now()
 		user := &database.User{
-			Id:       uuid.New().String(),
-			Email:    req.Email,
-			Password: string(hashedPassword),
+			Id:                 uuid.New().String(),
+			Email:              req.Email,
+			Password:           hashedPassword,
+			VerificationSentAt: &now,
+		}
+
+		verification, err := newVerificationEmail(user)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to send email"})
 		}
 
 		err = db.RunInTransaction(c.Request().Context(), func(tx *pg.Tx) error {
@@ -100,27 +212,35 @@ func registerUser(db *database.DB) echo.HandlerFunc {
 				return err
 			}
 
-			inviteCode.UsedBy = user.Id
-			if inviteCode.UsedAt == nil {
-				inviteCode.UsedAt = new(time.Time)
+			_, err = tx.Model(verification).Insert()
+			if err != nil {
+				return err
 			}
-			*inviteCode.UsedAt = time.Now()
 
-			_, err = tx.Model(inviteCode).
-				Set("used_by = ?used_by").
-				Set("used_at = ?used_at").
-				Where("id = ?id").
-				Update()
+			ok, err := inviteCode.Use(tx, user.Id, time.Now())
 			if err != nil {
 				return err
 			}
+			if !ok {
+				return database.ErrInviteExhausted
+			}
 
-			return nil
+			return inviteCode.Grant(tx, user.Id, time.Now())
 		})
 
+		if err == database.ErrInviteExhausted {
+			// The invite changed since it was checked; report what happened to it.
+			if current, _ := database.GetInviteCode(db, inviteCode.Id); current != nil {
+				if reason := current.Check(req.Email, time.Now()); reason != nil {
+					return inviteError(c, reason)
+				}
+			}
+			return inviteError(c, err)
+		}
 		if err != nil {
 			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create user"})
 		}
+		notifyMailer()
 
 		return c.JSON(http.StatusCreated, map[string]string{"message": "User created successfully"})
 	}
@@ -133,52 +253,132 @@ func login(db *database.DB) echo.HandlerFunc {
 			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
 		}
 
+		if ok, err := checkLoginThrottle(c, req.Email); !ok {
+			return err
+		}
+
 		// Get user by email
 		user, err := database.GetUserByEmail(db, req.Email)
 		if err != nil {
+			failLogin(c, req.Email)
 			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid credentials"})
 		}
 
 		// Check password
-		err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password))
-		if err != nil {
+		ok, rehash := verifyPassword(user, req.Password)
+		if !ok {
+			failLogin(c, req.Email)
 			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid credentials"})
 		}
+		if rehash {
+			if err := rehashPassword(db, user, req.Password); err != nil {
+				c.Logger().Errorf("Failed to upgrade password hash: %v", err)
+			}
+		}
 
-		// Create token
-		token := jwt.New(jwt.SigningMethodHS256)
-		claims := token.Claims.(jwt.MapClaims)
-		claims["user_id"] = user.Id
-		claims["exp"] = time.Now().Add(time.Hour * 72).Unix()
-
-		// Generate encoded token
-		t, err := token.SignedString(SECRET)
+		// Ask for the second factor before signing in
+		mfa, err := requiresMFA(db, user)
 		if err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to generate token"})
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		if mfa {
+			mfaToken, err := createMFAToken(user)
+			if err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to generate token"})
+			}
+			return c.JSON(http.StatusOK, map[string]string{"status": "mfa_required", "mfaToken": mfaToken})
 		}
 
-		// Set cookie
-		cookie := new(http.Cookie)
-		cookie.Name = "Token"
-		cookie.Value = t
-		cookie.Expires = time.Now().Add(72 * time.Hour)
-		cookie.Path = "/"
-		cookie.HttpOnly = true
-		c.SetCookie(cookie)
+		return completeLogin(c, db, user)
+	}
+}
+
+// completeLogin starts a session for an authenticated user and sets the session
+// cookies.
+func completeLogin(c echo.Context, db *database.DB, user *database.User) error {
+	if user.IsDisabled() {
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "This account has been disabled"})
+	}
+	if requiresVerifiedEmail(user, VerificationLogin) {
+		return c.JSON(http.StatusForbidden, map[string]string{"status": "email_unverified", "error": "Email address not verified"})
+	}
+	if err := loginThrottle.Succeed(user.Email); err != nil {
+		c.Logger().Errorf("Failed to reset login throttle: %v", err)
+	}
+
+	session, err := startSession(c, db, user)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create session"})
+	}
+
+	t, err := createSessionToken(user, session)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to generate token"})
+	}
+
+	refreshToken, err := issueRefreshToken(db, database.RefreshToken{
+		UserId:    user.Id,
+		SessionId: session.Id,
+		AuthTime:  session.CreatedAt,
+	})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to generate token"})
+	}
+
+	// Set cookies
+	setSessionCookies(c, t, refreshToken)
+
+	return c.JSON(http.StatusOK, map[string]string{"token": t})
+}
+
+// checkPassword reports whether password matches the user's stored hash.
+func checkPassword(user *database.User, password string) bool {
+	ok, _ := verifyPassword(user, password)
+	return ok
+}
+
+// verifyPassword is checkPassword that also reports whether the stored hash uses
+// an outdated algorithm or cost and should be replaced.
+func verifyPassword(user *database.User, password string) (ok, rehash bool) {
+	ok, rehash, err := passwordHasher.Verify(password, user.Password)
+	if err != nil {
+		return false, false
+	}
+	return ok, rehash
+}
 
-		return c.JSON(http.StatusOK, map[string]string{"token": t})
+// rehashPassword stores a fresh hash of the user's password, which the caller has
+// just verified. It only applies if the stored hash has not changed since.
+func rehashPassword(db *database.DB, user *database.User, password string) error {
+	hash, err := passwordHasher.Hash(password)
+	if err != nil {
+		return err
+	}
+	_, err = db.Model(user).
+		Set("password = ?", hash).
+		WherePK().
+		Where("password = ?", user.Password).
+		Update()
+	if err != nil {
+		return err
 	}
+	user.Password = hash
+	return nil
 }
 
-func logout(c echo.Context) error {
-	cookie := new(http.Cookie)
-	cookie.Name = "Token"
-	cookie.Value = ""
-	cookie.Path = "/"
-	cookie.MaxAge = -1
+func logout(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if cookie, err := c.Cookie("RefreshToken"); err == nil {
+			refreshToken, err := database.GetRefreshToken(db, hashToken(cookie.Value))
+			if err == nil && refreshToken != nil {
+				database.RevokeSessions(db, refreshToken.UserId, refreshToken.SessionId, "")
+				database.RevokeRefreshTokenFamily(db, refreshToken.FamilyId)
+			}
+		}
 
-	c.SetCookie(cookie)
-	return c.String(http.StatusOK, "Logged out successfully")
+		clearSessionCookies(c)
+		return c.String(http.StatusOK, "Logged out successfully")
+	}
 }
 
 func validateToken(db *database.DB) echo.HandlerFunc {
@@ -188,12 +388,7 @@ func validateToken(db *database.DB) echo.HandlerFunc {
 			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "No token provided"})
 		}
 
-		token, err := jwt.Parse(cookie.Value, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, echo.NewHTTPError(http.StatusUnauthorized, "invalid token")
-			}
-			return []byte(SECRET), nil
-		})
+		token, err := jwt.Parse(cookie.Value, sessionKey, validMethods)
 
 		if err != nil {
 			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid token"})
@@ -211,6 +406,10 @@ func validateToken(db *database.DB) echo.HandlerFunc {
 				return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid token claims"})
 			}
 
+			if _, err := activeSession(db, claims); err != nil {
+				return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Session expired"})
+			}
+
 			user := &database.User{Id: userID}
 			err := db.Model(user).WherePK().Select()
 			if err != nil {
@@ -220,8 +419,9 @@ func validateToken(db *database.DB) echo.HandlerFunc {
 			return c.JSON(http.StatusOK, map[string]interface{}{
 				"valid": true,
 				"user": map[string]interface{}{
-					"id":    user.Id,
-					"email": user.Email,
+					"id":             user.Id,
+					"email":          user.Email,
+					"email_verified": user.IsEmailVerified(),
 				},
 			})
 		}
@@ -232,11 +432,9 @@ func validateToken(db *database.DB) echo.HandlerFunc {
 
 func getUser(db *database.DB) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		user := c.Get("user").(*jwt.Token)
-		claims := user.Claims.(jwt.MapClaims)
-		userID := claims["user_id"].(string)
+		session := c.Get("session").(*database.Session)
 
-		dbUser := &database.User{Id: userID}
+		dbUser := &database.User{Id: session.UserId}
 		err := dbUser.Read(db)
 		if err != nil {
 			return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
@@ -0,0 +1,54 @@
+package web
+
+import (
+	"slices"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pragmahq/sso/database"
+)
+
+// claimSource adds claims about user to an access token issued to clientID. The
+// user's roles are already loaded.
+type claimSource func(db *database.DB, user *database.User, clientID, scope string, claims jwt.MapClaims) error
+
+// accessTokenClaims build the authorization data in access tokens, in order, so
+// each application can authorize requests from the token alone.
+var accessTokenClaims = []claimSource{
+	applicationRoleClaims,
+	groupClaims,
+}
+
+// applicationRoleClaims adds the names of the user's roles in the requesting
+// application as `roles`, and the entitlements those roles grant as
+// `entitlements`. Roles of other applications and of the sign-in service itself
+// are left out.
+func applicationRoleClaims(db *database.DB, user *database.User, clientID, scope string, claims jwt.MapClaims) error {
+	roles := []string{}
+	entitlements := []string{}
+	for _, role := range user.ClientRoles(clientID) {
+		roles = append(roles, role.Name)
+		entitlements = append(entitlements, role.Permissions...)
+	}
+	slices.Sort(roles)
+	slices.Sort(entitlements)
+
+	claims["roles"] = roles
+	claims["entitlements"] = slices.Compact(entitlements)
+	return nil
+}
+
+// groupClaims adds the names of the groups the user is in as `groups`, including
+// the groups those are nested inside.
+func groupClaims(db *database.DB, user *database.User, clientID, scope string, claims jwt.MapClaims) error {
+	groups, err := database.GetUserGroups(db, user.Id)
+	if err != nil {
+		return err
+	}
+
+	names := []string{}
+	for _, group := range groups {
+		names = append(names, group.Name)
+	}
+	claims["groups"] = names
+	return nil
+}
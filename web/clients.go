@@ -0,0 +1,267 @@
+package web
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/pragmahq/sso/database"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// defaultClientScopes are granted to clients registered without an explicit list.
+var defaultClientScopes = []string{"openid", "email"}
+
+type ClientBody struct {
+	Name         string   `json:"name"`
+	LogoURL      string   `json:"logoUrl"`
+	RedirectURIs []string `json:"redirectUris"`
+	Scopes       []string `json:"scopes"`
+	Public       bool     `json:"public"`
+}
+
+func registerClientRoutes(g *echo.Group, db *database.DB) {
+	g.GET("/clients", listClients(db))
+	g.POST("/clients", createClient(db))
+	g.GET("/clients/:id", getClient(db))
+	g.PUT("/clients/:id", updateClient(db))
+	g.POST("/clients/:id/secret", rotateClientSecret(db))
+	g.POST("/clients/:id/disable", setClientDisabled(db, true))
+	g.POST("/clients/:id/enable", setClientDisabled(db, false))
+}
+
+func listClients(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		clients, err := database.GetClients(db)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+
+		response := []map[string]interface{}{}
+		for _, client := range clients {
+			response = append(response, clientJSON(client))
+		}
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+func createClient(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req ClientBody
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		}
+		if msg := req.validate(); msg != "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+		}
+
+		now := time.Now()
+		client := &database.Client{
+			Id:        uuid.New().String(),
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		if token, ok := c.Get("user").(*jwt.Token); ok {
+			client.CreatedBy, _ = token.Claims.(jwt.MapClaims)["user_id"].(string)
+		}
+		req.apply(client)
+
+		var secret string
+		if !client.Public {
+			var err error
+			secret, err = setClientSecret(client)
+			if err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to generate client secret"})
+			}
+		}
+
+		if err := client.Create(db); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create client"})
+		}
+
+		response := clientJSON(client)
+		if secret != "" {
+			response["clientSecret"] = secret
+		}
+		return c.JSON(http.StatusCreated, response)
+	}
+}
+
+func getClient(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		client, err := database.GetClient(db, c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		if client == nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Client not found"})
+		}
+		return c.JSON(http.StatusOK, clientJSON(client))
+	}
+}
+
+func updateClient(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req ClientBody
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		}
+		if msg := req.validate(); msg != "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+		}
+
+		client, err := database.GetClient(db, c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		if client == nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Client not found"})
+		}
+		if req.Public != client.Public {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "A client cannot change between public and confidential"})
+		}
+
+		req.apply(client)
+		if err := client.Update(db); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update client"})
+		}
+		return c.JSON(http.StatusOK, clientJSON(client))
+	}
+}
+
+func rotateClientSecret(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		client, err := database.GetClient(db, c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		if client == nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Client not found"})
+		}
+		if client.Public {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Public clients have no secret"})
+		}
+
+		secret, err := setClientSecret(client)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to generate client secret"})
+		}
+		if err := client.Update(db); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update client"})
+		}
+
+		response := clientJSON(client)
+		response["clientSecret"] = secret
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+func setClientDisabled(db *database.DB, disabled bool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		client, err := database.GetClient(db, c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		if client == nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Client not found"})
+		}
+
+		if disabled && client.DisabledAt == nil {
+			now := time.Now()
+			client.DisabledAt = &now
+		} else if !disabled {
+			client.DisabledAt = nil
+		}
+
+		if err := client.Update(db); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update client"})
+		}
+		return c.JSON(http.StatusOK, clientJSON(client))
+	}
+}
+
+// authenticateClient identifies the client calling the token endpoint, using
+// client_secret_basic or client_secret_post for confidential clients and the
+// client_id alone for public ones.
+func authenticateClient(c echo.Context, db *database.DB) (*database.Client, bool) {
+	clientID, secret, basic := c.Request().BasicAuth()
+	if basic {
+		// RFC 6749 section 2.3.1 form-encodes the credentials before Basic encoding.
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID = c.FormValue("client_id")
+		secret = c.FormValue("client_secret")
+	}
+
+	client, err := database.GetClient(db, clientID)
+	if err != nil || client == nil || client.IsDisabled() {
+		return nil, false
+	}
+	if client.Public {
+		return client, true
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(client.SecretHash), []byte(secret))
+	if err != nil {
+		return nil, false
+	}
+	return client, true
+}
+
+func setClientSecret(client *database.Client) (string, error) {
+	secret, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	client.SecretHash = string(hash)
+	return secret, nil
+}
+
+func (req *ClientBody) validate() string {
+	if req.Name == "" {
+		return "Name is required"
+	}
+	if len(req.RedirectURIs) == 0 {
+		return "At least one redirect URI is required"
+	}
+	for _, uri := range req.RedirectURIs {
+		if !isValidRedirectURI(uri) {
+			return "Invalid redirect URI: " + uri
+		}
+	}
+	return ""
+}
+
+func (req *ClientBody) apply(client *database.Client) {
+	client.Name = req.Name
+	client.LogoURL = req.LogoURL
+	client.RedirectURIs = req.RedirectURIs
+	client.Scopes = req.Scopes
+	client.Public = req.Public
+	if len(client.Scopes) == 0 {
+		client.Scopes = defaultClientScopes
+	}
+}
+
+func clientJSON(client *database.Client) map[string]interface{} {
+	return map[string]interface{}{
+		"id":           client.Id,
+		"name":         client.Name,
+		"logoUrl":      client.LogoURL,
+		"redirectUris": client.RedirectURIs,
+		"scopes":       client.Scopes,
+		"public":       client.Public,
+		"createdAt":    client.CreatedAt,
+		"updatedAt":    client.UpdatedAt,
+		"disabled":     client.IsDisabled(),
+	}
+}
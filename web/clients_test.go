@@ -0,0 +1,52 @@
+package web
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pragmahq/sso/database"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateClientAndAuthenticate(t *testing.T) {
+	e := echo.New()
+	reqBody := `{"name":"Docs","redirectUris":["https://docs.example.com/callback"]}`
+
+	req := httptest.NewRequest(http.MethodPost, "/api/admin/clients", strings.NewReader(reqBody))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	if !assert.NoError(t, createClient(testDB)(c)) || !assert.Equal(t, http.StatusCreated, rec.Code) {
+		return
+	}
+
+	var response map[string]interface{}
+	err := json.Unmarshal(rec.Body.Bytes(), &response)
+	assert.NoError(t, err)
+	clientID := response["id"].(string)
+	secret := response["clientSecret"].(string)
+	assert.NotEmpty(t, secret)
+	assert.Equal(t, []interface{}{"openid", "email"}, response["scopes"])
+
+	// The secret authenticates the client with client_secret_basic
+	req = httptest.NewRequest(http.MethodPost, "/token", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Basic "+base64.StdEncoding.EncodeToString([]byte(clientID+":"+secret)))
+	client, ok := authenticateClient(e.NewContext(req, httptest.NewRecorder()), testDB)
+	assert.True(t, ok)
+	assert.Equal(t, clientID, client.Id)
+
+	req = httptest.NewRequest(http.MethodPost, "/token", nil)
+	req.SetBasicAuth(clientID, "wrong")
+	_, ok = authenticateClient(e.NewContext(req, httptest.NewRecorder()), testDB)
+	assert.False(t, ok)
+
+	// Clean up
+	err = (&database.Client{Id: clientID}).Delete(testDB)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,193 @@
+package web
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/pragmahq/sso/database"
+)
+
+// emailChangeCancelWindow is how long the old address can undo a change, even
+// after it was confirmed.
+const emailChangeCancelWindow = 7 * 24 * time.Hour
+
+var (
+	// EMAIL_CHANGE_URL is the frontend page the confirmation and cancel links
+	// point to. The token is appended as the `token` query parameter, and cancel
+	// links also carry `action=cancel`.
+	EMAIL_CHANGE_URL = envString("EMAIL_CHANGE_URL", loginOrigin().String()+"/change-email")
+	EMAIL_CHANGE_TTL = envDuration("EMAIL_CHANGE_TTL", 24*time.Hour)
+)
+
+type ChangeEmailBody struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+type EmailChangeTokenBody struct {
+	Token string `json:"token"`
+}
+
+func registerEmailChangeRoutes(r *echo.Group, d *echo.Group, db *database.DB) {
+	d.POST("/email", requestEmailChange(db))
+	r.POST("/email/change/confirm", confirmEmailChange(db))
+	r.POST("/email/change/cancel", cancelEmailChange(db))
+}
+
+// requestEmailChange starts moving the signed-in user to a new address. Nothing
+// changes until the link sent to the new address is followed; the old address is
+// told about the request and can cancel it.
+func requestEmailChange(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req ChangeEmailBody
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		}
+
+		user, status, msg := checkReauth(c, db, ReauthBody{Password: req.Password, Code: req.Code})
+		if user == nil {
+			return c.JSON(status, map[string]string{"error": msg})
+		}
+
+		address := strings.TrimSpace(req.Email)
+		if !strings.Contains(address, "@") {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid email address"})
+		}
+		if strings.EqualFold(address, user.Email) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "This is already your email address"})
+		}
+
+		_, err := database.GetUserByEmail(db, address)
+		if err == nil {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Email address already in use"})
+		} else if err != pg.ErrNoRows {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+
+		confirmToken, err := randomToken(32)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to generate token"})
+		}
+		cancelToken, err := randomToken(32)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to generate token"})
+		}
+
+		now := time.Now()
+		change := &database.EmailChange{
+			Id:          uuid.New().String(),
+			UserId:      user.Id,
+			OldEmail:    user.Email,
+			NewEmail:    address,
+			ConfirmHash: hashToken(confirmToken),
+			CancelHash:  hashToken(cancelToken),
+			CreatedAt:   now,
+			ExpiresAt:   now.Add(EMAIL_CHANGE_TTL),
+		}
+
+		confirmation, err := newEmail("email_change_confirm", address, map[string]interface{}{
+			"Link":    appendQuery(EMAIL_CHANGE_URL, url.Values{"token": {confirmToken}}),
+			"Expires": EMAIL_CHANGE_TTL.String(),
+		})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to send email"})
+		}
+		notice, err := newEmail("email_change_notice", user.Email, map[string]interface{}{
+			"NewEmail": address,
+			"Link":     appendQuery(EMAIL_CHANGE_URL, url.Values{"action": {"cancel"}, "token": {cancelToken}}),
+		})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to send email"})
+		}
+
+		if err := database.CancelPendingEmailChanges(db, user.Id); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		err = db.RunInTransaction(c.Request().Context(), func(tx *pg.Tx) error {
+			for _, model := range []interface{}{change, confirmation, notice} {
+				if _, err := tx.Model(model).Insert(); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		notifyMailer()
+
+		return c.JSON(http.StatusAccepted, map[string]string{"message": "Check your new address for a confirmation link"})
+	}
+}
+
+func confirmEmailChange(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req EmailChangeTokenBody
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		}
+
+		change, err := database.GetEmailChangeByConfirmHash(db, hashToken(req.Token))
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		if change == nil || !change.IsPending() {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid or expired link"})
+		}
+
+		ok, err := change.Confirm(db)
+		if err == database.ErrEmailTaken {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Email address already in use"})
+		}
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		if !ok {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid or expired link"})
+		}
+
+		return c.JSON(http.StatusOK, map[string]string{"message": "Email address changed"})
+	}
+}
+
+// cancelEmailChange handles the link sent to the old address. A change that was
+// already confirmed is undone and every session is signed out, since the request
+// may have come from someone who took over the account.
+func cancelEmailChange(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req EmailChangeTokenBody
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		}
+
+		change, err := database.GetEmailChangeByCancelHash(db, hashToken(req.Token))
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		if change == nil || change.CancelledAt != nil || time.Since(change.CreatedAt) > emailChangeCancelWindow {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid or expired link"})
+		}
+
+		reverted, err := change.Cancel(db)
+		if err == database.ErrEmailTaken {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Email address already in use"})
+		}
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		if !reverted {
+			return c.JSON(http.StatusOK, map[string]string{"message": "Email change cancelled"})
+		}
+
+		if err := database.RevokeSessions(db, change.UserId, "", ""); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to revoke sessions"})
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "Email change undone, please sign in and change your password"})
+	}
+}
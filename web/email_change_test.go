@@ -0,0 +1,99 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/pragmahq/sso/database"
+	"github.com/pragmahq/sso/mailer"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestEmailChange(t *testing.T) {
+	captured := &mailer.CaptureMailer{}
+	mail = captured
+
+	// Create a test user with a session
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	testUser := &database.User{
+		Id:       uuid.New().String(),
+		Email:    "change-old@example.com",
+		Password: string(hash),
+	}
+	err = testUser.Create(testDB)
+	assert.NoError(t, err)
+	session := createTestSession(t, testUser)
+
+	// The password is required
+	rec := postJSON(requestEmailChange(testDB), ChangeEmailBody{Email: "change-new@example.com", Password: "wrong"}, session)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	rec = postJSON(requestEmailChange(testDB), ChangeEmailBody{Email: "change-new@example.com", Password: "password123"}, session)
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	_, err = deliverOutbox(context.Background(), testDB)
+	assert.NoError(t, err)
+	confirmToken := mailedToken(t, captured.Last("change-new@example.com"))
+	cancelToken := mailedToken(t, captured.Last(testUser.Email))
+
+	// Nothing changes until the new address confirms
+	err = testUser.Read(testDB)
+	assert.NoError(t, err)
+	assert.Equal(t, "change-old@example.com", testUser.Email)
+
+	rec = postJSON(confirmEmailChange(testDB), EmailChangeTokenBody{Token: confirmToken}, nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	err = testUser.Read(testDB)
+	assert.NoError(t, err)
+	assert.Equal(t, "change-new@example.com", testUser.Email)
+	assert.True(t, testUser.IsEmailVerified())
+
+	// The confirmation link only works once
+	rec = postJSON(confirmEmailChange(testDB), EmailChangeTokenBody{Token: confirmToken}, nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// The old address can still undo the change, which signs everyone out
+	rec = postJSON(cancelEmailChange(testDB), EmailChangeTokenBody{Token: cancelToken}, nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	err = testUser.Read(testDB)
+	assert.NoError(t, err)
+	assert.Equal(t, "change-old@example.com", testUser.Email)
+
+	current, err := database.GetSession(testDB, session.Id)
+	assert.NoError(t, err)
+	assert.False(t, current.IsActive())
+
+	// Clean up
+	_, err = testDB.Model((*database.EmailChange)(nil)).Where("user_id = ?", testUser.Id).Delete()
+	assert.NoError(t, err)
+	err = testUser.Delete(testDB)
+	assert.NoError(t, err)
+}
+
+func TestEmailChangeTaken(t *testing.T) {
+	// Create two test users
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	testUser := &database.User{Id: uuid.New().String(), Email: "taken-a@example.com", Password: string(hash)}
+	err = testUser.Create(testDB)
+	assert.NoError(t, err)
+	otherUser := &database.User{Id: uuid.New().String(), Email: "taken-b@example.com", Password: string(hash)}
+	err = otherUser.Create(testDB)
+	assert.NoError(t, err)
+	session := createTestSession(t, testUser)
+
+	rec := postJSON(requestEmailChange(testDB), ChangeEmailBody{Email: otherUser.Email, Password: "password123"}, session)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+
+	rec = postJSON(requestEmailChange(testDB), ChangeEmailBody{Email: testUser.Email, Password: "password123"}, session)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// Clean up
+	err = testUser.Delete(testDB)
+	assert.NoError(t, err)
+	err = otherUser.Delete(testDB)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,338 @@
+package web
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/pragmahq/sso/database"
+	"github.com/pragmahq/sso/utils"
+)
+
+// GroupBody describes a group. An empty ParentId puts it at the top level.
+type GroupBody struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	ParentId    string `json:"parentId"`
+}
+
+func registerGroupRoutes(g *echo.Group, db *database.DB) {
+	g.GET("/groups", listGroups(db))
+	g.POST("/groups", createGroup(db))
+	g.GET("/groups/:id", getGroup(db))
+	g.PUT("/groups/:id", updateGroup(db))
+	g.DELETE("/groups/:id", deleteGroup(db))
+	g.PUT("/groups/:id/members/:user", addGroupMember(db))
+	g.DELETE("/groups/:id/members/:user", removeGroupMember(db))
+	g.PUT("/groups/:id/roles/:role", assignGroupRole(db), utils.RequireGrant(database.PermManageRoles))
+	g.DELETE("/groups/:id/roles/:role", unassignGroupRole(db), utils.RequireGrant(database.PermManageRoles))
+}
+
+func (req *GroupBody) validate(db *database.DB) (int, string) {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return http.StatusBadRequest, "Name is required"
+	}
+	if req.ParentId != "" {
+		parent, err := database.GetGroup(db, req.ParentId)
+		if err != nil {
+			return http.StatusInternalServerError, "Database error"
+		}
+		if parent == nil {
+			return http.StatusBadRequest, "Parent group not found"
+		}
+	}
+	return 0, ""
+}
+
+func (req *GroupBody) apply(group *database.Group) {
+	group.Name = req.Name
+	group.Description = req.Description
+	group.ParentId = req.ParentId
+}
+
+func groupJSON(group *database.Group) map[string]interface{} {
+	return map[string]interface{}{
+		"id":          group.Id,
+		"parentId":    group.ParentId,
+		"name":        group.Name,
+		"description": group.Description,
+		"createdAt":   group.CreatedAt,
+	}
+}
+
+func listGroups(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		groups, err := database.GetGroups(db)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+
+		response := []map[string]interface{}{}
+		for _, group := range groups {
+			response = append(response, groupJSON(group))
+		}
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+func createGroup(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req GroupBody
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		}
+		if status, msg := req.validate(db); msg != "" {
+			return c.JSON(status, map[string]string{"error": msg})
+		}
+
+		group := &database.Group{
+			Id:        uuid.New().String(),
+			CreatedAt: time.Now(),
+		}
+		req.apply(group)
+
+		err := group.Create(db)
+		if err == database.ErrGroupNameTaken {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "A group with this name already exists"})
+		}
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create group"})
+		}
+		return c.JSON(http.StatusCreated, groupJSON(group))
+	}
+}
+
+// getGroup returns a group with its direct members and roles.
+func getGroup(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		group, err := database.GetGroup(db, c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		if group == nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Group not found"})
+		}
+
+		members, err := database.GetGroupMembers(db, group.Id)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		roles, err := database.GetGroupRoles(db, group.Id)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+
+		response := groupJSON(group)
+		memberList := []map[string]interface{}{}
+		for _, member := range members {
+			memberList = append(memberList, map[string]interface{}{
+				"id":    member.Id,
+				"email": member.Email,
+			})
+		}
+		roleList := []map[string]interface{}{}
+		for _, role := range roles {
+			roleList = append(roleList, roleJSON(role))
+		}
+		response["members"] = memberList
+		response["roles"] = roleList
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+func updateGroup(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req GroupBody
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		}
+		if status, msg := req.validate(db); msg != "" {
+			return c.JSON(status, map[string]string{"error": msg})
+		}
+
+		group, err := database.GetGroup(db, c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		if group == nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Group not found"})
+		}
+
+		if req.ParentId != "" && req.ParentId != group.ParentId {
+			if status, msg := checkGroupRoles(c, db, req.ParentId); msg != "" {
+				return c.JSON(status, map[string]string{"error": msg})
+			}
+		}
+
+		req.apply(group)
+		err = group.Update(db)
+		if err == database.ErrGroupCycle {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "A group cannot be nested inside itself"})
+		}
+		if err == database.ErrGroupNameTaken {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "A group with this name already exists"})
+		}
+		if err == database.ErrLastAdmin {
+			return lastAdmin(c)
+		}
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update group"})
+		}
+		return c.JSON(http.StatusOK, groupJSON(group))
+	}
+}
+
+func deleteGroup(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		group, err := database.GetGroup(db, c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		if group == nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Group not found"})
+		}
+
+		err = group.Delete(db)
+		if err == database.ErrLastAdmin {
+			return lastAdmin(c)
+		}
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete group"})
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "Group deleted"})
+	}
+}
+
+func addGroupMember(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		group, status, msg := pathGroup(c, db)
+		if msg != "" {
+			return c.JSON(status, map[string]string{"error": msg})
+		}
+		user := &database.User{Id: c.Param("user")}
+		if err := user.Read(db); err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+		}
+		if status, msg := checkGroupRoles(c, db, group.Id); msg != "" {
+			return c.JSON(status, map[string]string{"error": msg})
+		}
+
+		if err := database.AddGroupMember(db, group.Id, user.Id); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to add member"})
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "Member added"})
+	}
+}
+
+func removeGroupMember(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		group, status, msg := pathGroup(c, db)
+		if msg != "" {
+			return c.JSON(status, map[string]string{"error": msg})
+		}
+
+		err := database.KeepAnAdmin(db.DB, func(tx *pg.Tx) error {
+			return database.RemoveGroupMember(tx, group.Id, c.Param("user"))
+		})
+		if err == database.ErrLastAdmin {
+			return lastAdmin(c)
+		}
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to remove member"})
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "Member removed"})
+	}
+}
+
+func assignGroupRole(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		group, status, msg := pathGroup(c, db)
+		if msg != "" {
+			return c.JSON(status, map[string]string{"error": msg})
+		}
+		role, err := database.GetRole(db, c.Param("role"))
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		if role == nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Role not found"})
+		}
+
+		if err := database.AssignGroupRole(db, group.Id, role.Id); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to assign role"})
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "Role assigned"})
+	}
+}
+
+func unassignGroupRole(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		group, status, msg := pathGroup(c, db)
+		if msg != "" {
+			return c.JSON(status, map[string]string{"error": msg})
+		}
+
+		err := database.KeepAnAdmin(db.DB, func(tx *pg.Tx) error {
+			return database.UnassignGroupRole(tx, group.Id, c.Param("role"))
+		})
+		if err == database.ErrLastAdmin {
+			return lastAdmin(c)
+		}
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to remove role"})
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "Role removed"})
+	}
+}
+
+// listMyGroups returns the groups the signed-in user is in, including those
+// their groups are nested inside.
+func listMyGroups(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		session := c.Get("session").(*database.Session)
+
+		groups, err := database.GetUserGroups(db, session.UserId)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+
+		response := []map[string]interface{}{}
+		for _, group := range groups {
+			response = append(response, groupJSON(group))
+		}
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+// pathGroup loads the group named in the path.
+func pathGroup(c echo.Context, db *database.DB) (*database.Group, int, string) {
+	group, err := database.GetGroup(db, c.Param("id"))
+	if err != nil {
+		return nil, http.StatusInternalServerError, "Database error"
+	}
+	if group == nil {
+		return nil, http.StatusNotFound, "Group not found"
+	}
+	return group, 0, ""
+}
+
+// checkGroupRoles refuses to put anyone in the group, directly or by nesting
+// another group inside it, if that would hand out roles and the signed-in user
+// cannot manage roles.
+func checkGroupRoles(c echo.Context, db *database.DB, groupID string) (int, string) {
+	if user := utils.CurrentUser(c); user != nil && user.HasPermission(database.PermManageRoles) {
+		return 0, ""
+	}
+	grants, err := database.GroupGrantsRoles(db, groupID)
+	if err != nil {
+		return http.StatusInternalServerError, "Database error"
+	}
+	if grants {
+		return http.StatusForbidden, "Only users who manage roles can give out this group's roles"
+	}
+	return 0, ""
+}
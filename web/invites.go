@@ -0,0 +1,332 @@
+package web
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/pragmahq/sso/database"
+)
+
+// maxInvitePage caps how many invites the admin listing returns at once.
+const maxInvitePage = 200
+
+var (
+	// INVITE_URL is the frontend signup page. Invite links carry the code as the
+	// `invite` query parameter.
+	INVITE_URL = envString("INVITE_URL", loginOrigin().String()+"/signup")
+	// INVITE_TTL is how long an invite lasts when no expiry is given, and
+	// INVITE_MAX_TTL the longest expiry anyone but an admin may choose.
+	INVITE_TTL     = envDuration("INVITE_TTL", 7*24*time.Hour)
+	INVITE_MAX_TTL = envDuration("INVITE_MAX_TTL", 30*24*time.Hour)
+	// INVITE_MAX_USES is the most registrations one invite from a non-admin may
+	// allow. Admins may also create invites without a limit.
+	INVITE_MAX_USES = envInt("INVITE_MAX_USES", 5)
+
+	// Quotas are how many active invites a user may have at once, by their
+	// highest permission. Zero stops them from inviting and a negative quota is
+	// unlimited.
+	INVITE_QUOTA_USER   = envInt("INVITE_QUOTA_USER", 5)
+	INVITE_QUOTA_EDITOR = envInt("INVITE_QUOTA_EDITOR", 25)
+	INVITE_QUOTA_ADMIN  = envInt("INVITE_QUOTA_ADMIN", -1)
+)
+
+// CreateInviteBody describes a new invite. Permissions is a mask of the
+// database.Permission bits the new account receives, and Groups the ids of the
+// groups it joins.
+type CreateInviteBody struct {
+	Email       string     `json:"email"`
+	Note        string     `json:"note"`
+	MaxUses     *int       `json:"maxUses"`
+	ExpiresAt   *time.Time `json:"expiresAt"`
+	Permissions int        `json:"permissions"`
+	Groups      []string   `json:"groups"`
+}
+
+func registerInviteRoutes(g *echo.Group, db *database.DB) {
+	g.GET("/invites", listInvites(db))
+	g.POST("/invites", createInvite(db))
+	g.DELETE("/invites/:id", revokeInvite(db))
+}
+
+// inviteQuota returns how many active invites user may have.
+func inviteQuota(user *database.User) int {
+	switch {
+	case user.IsAdmin():
+		return INVITE_QUOTA_ADMIN
+	case user.IsEditor():
+		return INVITE_QUOTA_EDITOR
+	}
+	return INVITE_QUOTA_USER
+}
+
+func inviteJSON(invite *database.InviteCode, now time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"id":          invite.Id,
+		"link":        appendQuery(INVITE_URL, url.Values{"invite": {invite.Id}}),
+		"status":      invite.Status(now),
+		"generatedBy": invite.GeneratedBy,
+		"email":       invite.Email,
+		"note":        invite.Note,
+		"maxUses":     invite.MaxUses,
+		"uses":        invite.Uses,
+		"usedBy":      invite.UsedBy,
+		"createdAt":   invite.CreatedAt,
+		"usedAt":      invite.UsedAt,
+		"expiresAt":   invite.ExpiresAt,
+		"revokedAt":   invite.RevokedAt,
+		"permissions": invite.Permissions,
+		"groups":      invite.GroupIds,
+	}
+}
+
+func listInvites(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		session := c.Get("session").(*database.Session)
+
+		user := &database.User{Id: session.UserId}
+		if err := user.GetUserWithInvites(db); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+
+		now := time.Now()
+		active := 0
+		invites := []map[string]interface{}{}
+		for _, invite := range user.GeneratedInvites {
+			if invite.Status(now) == database.InviteActive {
+				active++
+			}
+			invites = append(invites, inviteJSON(invite, now))
+		}
+
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"invites": invites,
+			"quota":   inviteQuota(user),
+			"active":  active,
+		})
+	}
+}
+
+func createInvite(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req CreateInviteBody
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		}
+
+		user, err := currentUser(c, db)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		quota := inviteQuota(user)
+		if quota == 0 || !user.HasPermission(database.PermCreateInvites) {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "You cannot create invites"})
+		}
+
+		now := time.Now()
+		invite := &database.InviteCode{
+			Id:          uuid.New().String(),
+			GeneratedBy: user.Id,
+			CreatedAt:   now,
+			MaxUses:     1,
+			Email:       strings.TrimSpace(req.Email),
+			Note:        strings.TrimSpace(req.Note),
+		}
+		if invite.Email != "" && !strings.Contains(invite.Email, "@") {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid email address"})
+		}
+
+		if req.MaxUses != nil {
+			invite.MaxUses = *req.MaxUses
+		}
+		if invite.MaxUses < 0 || (!user.IsAdmin() && (invite.MaxUses < 1 || invite.MaxUses > INVITE_MAX_USES)) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid number of uses"})
+		}
+
+		expiresAt := now.Add(INVITE_TTL)
+		if req.ExpiresAt != nil {
+			expiresAt = *req.ExpiresAt
+		}
+		if !expiresAt.After(now) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Expiry must be in the future"})
+		}
+		if !user.IsAdmin() && expiresAt.After(now.Add(INVITE_MAX_TTL)) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Expiry is too far in the future"})
+		}
+		invite.ExpiresAt = &expiresAt
+
+		if status, msg := checkInviteGrants(db, user, req.Permissions, req.Groups); msg != "" {
+			return c.JSON(status, map[string]string{"error": msg})
+		}
+		invite.Permissions = req.Permissions
+		invite.GroupIds = req.Groups
+
+		created, err := invite.CreateWithinQuota(db, quota)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create invite"})
+		}
+		if !created {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "You have reached your invite limit"})
+		}
+
+		return c.JSON(http.StatusCreated, inviteJSON(invite, now))
+	}
+}
+
+// checkInviteGrants makes sure user may hand out permissions and groups with an
+// invite. Nobody can grant permissions they do not hold themselves, and only
+// those who manage roles can grant more than the user role or, like
+// checkGroupRoles, add people to groups that give out roles. Only admins can add
+// people to groups they are not in.
+func checkInviteGrants(db *database.DB, user *database.User, permissions int, groups []string) (int, string) {
+	if permissions < 0 || permissions&^(database.PermissionUser|database.PermissionEditor|database.PermissionAdmin) != 0 {
+		return http.StatusBadRequest, "Invalid permissions"
+	}
+	if permissions&^user.Permissions != 0 {
+		return http.StatusForbidden, "You cannot grant permissions you do not have"
+	}
+	if permissions&^database.PermissionUser != 0 && !user.HasPermission(database.PermManageRoles) {
+		return http.StatusForbidden, "Only users who manage roles can grant more than the user role"
+	}
+
+	for _, id := range groups {
+		group, err := database.GetGroup(db, id)
+		if err != nil {
+			return http.StatusInternalServerError, "Database error"
+		}
+		if group == nil {
+			return http.StatusBadRequest, "Group not found"
+		}
+		if !user.HasPermission(database.PermManageRoles) {
+			grants, err := database.GroupGrantsRoles(db, id)
+			if err != nil {
+				return http.StatusInternalServerError, "Database error"
+			}
+			if grants {
+				return http.StatusForbidden, "Only users who manage roles can give out this group's roles"
+			}
+		}
+		if user.IsAdmin() {
+			continue
+		}
+		member, err := database.IsGroupMember(db, id, user.Id)
+		if err != nil {
+			return http.StatusInternalServerError, "Database error"
+		}
+		if !member {
+			return http.StatusForbidden, "You can only invite people to groups you are in"
+		}
+	}
+	return 0, ""
+}
+
+func revokeInvite(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		session := c.Get("session").(*database.Session)
+
+		invite, err := database.GetInviteCode(db, c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		if invite == nil || invite.GeneratedBy != session.UserId {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Invite not found"})
+		}
+
+		if err := invite.Revoke(db); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to revoke invite"})
+		}
+		return c.JSON(http.StatusOK, inviteJSON(invite, time.Now()))
+	}
+}
+
+// listAllInvites lets an admin search every invite. It accepts the query
+// parameters createdBy, status, createdAfter and createdBefore (RFC 3339 times or
+// YYYY-MM-DD dates), limit and offset.
+func listAllInvites(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		filter := database.InviteFilter{
+			GeneratedBy: c.QueryParam("createdBy"),
+			Status:      c.QueryParam("status"),
+			Limit:       50,
+		}
+
+		switch filter.Status {
+		case "", database.InviteActive, database.InviteRevoked, database.InviteExpired, database.InviteExhausted:
+		default:
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid status"})
+		}
+
+		var ok bool
+		if filter.CreatedAfter, ok = parseDateParam(c.QueryParam("createdAfter")); !ok {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid createdAfter"})
+		}
+		if filter.CreatedBefore, ok = parseDateParam(c.QueryParam("createdBefore")); !ok {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid createdBefore"})
+		}
+
+		if value := c.QueryParam("limit"); value != "" {
+			limit, err := strconv.Atoi(value)
+			if err != nil || limit < 1 || limit > maxInvitePage {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid limit"})
+			}
+			filter.Limit = limit
+		}
+		if value := c.QueryParam("offset"); value != "" {
+			offset, err := strconv.Atoi(value)
+			if err != nil || offset < 0 {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid offset"})
+			}
+			filter.Offset = offset
+		}
+
+		now := time.Now()
+		invites, total, err := database.ListInvites(db, filter, now)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+
+		response := []map[string]interface{}{}
+		for _, invite := range invites {
+			response = append(response, inviteJSON(invite, now))
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"invites": response,
+			"total":   total,
+		})
+	}
+}
+
+// revokeAnyInvite lets an admin revoke an invite regardless of who created it.
+func revokeAnyInvite(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		invite, err := database.GetInviteCode(db, c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		if invite == nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Invite not found"})
+		}
+
+		if err := invite.Revoke(db); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to revoke invite"})
+		}
+		return c.JSON(http.StatusOK, inviteJSON(invite, time.Now()))
+	}
+}
+
+// parseDateParam reads an RFC 3339 time or a YYYY-MM-DD date. An empty value is
+// the zero time.
+func parseDateParam(value string) (time.Time, bool) {
+	if value == "" {
+		return time.Time{}, true
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, true
+	}
+	t, err := time.Parse(time.DateOnly, value)
+	return t, err == nil
+}
@@ -0,0 +1,379 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/pragmahq/sso/database"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterWithInvite(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	bound := &database.InviteCode{Id: uuid.New().String(), CreatedAt: time.Now(), MaxUses: 1, Email: "invited@example.com"}
+	expired := &database.InviteCode{Id: uuid.New().String(), CreatedAt: time.Now(), ExpiresAt: &past}
+	for _, invite := range []*database.InviteCode{bound, expired} {
+		err := invite.Create(testDB)
+		assert.NoError(t, err)
+	}
+
+	register := func(email, invite string) (int, string) {
+		rec := postJSON(registerUser(testDB), RegisterBody{Email: email, Password: "a long passphrase", InviteCode: invite}, nil)
+		return rec.Code, rec.Body.String()
+	}
+
+	code, body := register("someone@example.com", "nonexistent")
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, body, `"reason":"invalid"`)
+
+	code, body = register("someone@example.com", expired.Id)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, body, `"reason":"expired"`)
+
+	code, body = register("someone@example.com", bound.Id)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, body, `"reason":"email_mismatch"`)
+
+	code, _ = register("Invited@example.com", bound.Id)
+	assert.Equal(t, http.StatusCreated, code)
+
+	code, body = register("invited2@example.com", bound.Id)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, body, `"reason":"exhausted"`)
+
+	// Revoked invites are refused before anything else
+	err := bound.Revoke(testDB)
+	assert.NoError(t, err)
+	rec := getInvite(bound.Id)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"reason":"revoked"`)
+
+	// Invited accounts may use applications and invite others
+	user, err := database.GetUserByEmail(testDB, "Invited@example.com")
+	if assert.NoError(t, err) {
+		assert.True(t, user.HasPermission(database.PermUseApps))
+		assert.True(t, user.HasPermission(database.PermCreateInvites))
+
+		// Clean up
+		_, err = testDB.Exec("DELETE FROM outbox_emails WHERE recipient = ?", user.Email)
+		assert.NoError(t, err)
+		err = user.Delete(testDB)
+		assert.NoError(t, err)
+	}
+	for _, invite := range []*database.InviteCode{bound, expired} {
+		_, err = testDB.Model(invite).WherePK().Delete()
+		assert.NoError(t, err)
+	}
+}
+
+func TestInviteManagement(t *testing.T) {
+	quota := INVITE_QUOTA_USER
+	INVITE_QUOTA_USER = 1
+	defer func() { INVITE_QUOTA_USER = quota }()
+
+	// Create a test user with a session
+	testUser := &database.User{
+		Id:          uuid.New().String(),
+		Email:       "inviter@example.com",
+		Permissions: database.PermissionUser,
+	}
+	err := testUser.Create(testDB)
+	assert.NoError(t, err)
+	session := createTestSession(t, testUser)
+
+	// Non-admins cannot create unlimited invites
+	unlimited := 0
+	rec := postJSON(createInvite(testDB), CreateInviteBody{MaxUses: &unlimited}, session)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = postJSON(createInvite(testDB), CreateInviteBody{Email: "friend@example.com", Note: "For a friend"}, session)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	var invite map[string]interface{}
+	err = json.Unmarshal(rec.Body.Bytes(), &invite)
+	assert.NoError(t, err)
+	assert.Equal(t, database.InviteActive, invite["status"])
+	assert.Equal(t, "friend@example.com", invite["email"])
+
+	// The quota only allows one active invite
+	rec = postJSON(createInvite(testDB), CreateInviteBody{}, session)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	rec = postJSON(listInvites(testDB), nil, session)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var listed struct {
+		Invites []map[string]interface{} `json:"invites"`
+		Active  int                      `json:"active"`
+	}
+	err = json.Unmarshal(rec.Body.Bytes(), &listed)
+	assert.NoError(t, err)
+	assert.Len(t, listed.Invites, 1)
+	assert.Equal(t, 1, listed.Active)
+
+	// Revoking frees the slot
+	rec = deleteInvite(revokeInvite(testDB), invite["id"].(string), session)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"status":"revoked"`)
+
+	rec = postJSON(createInvite(testDB), CreateInviteBody{}, session)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+
+	// Other users cannot revoke it
+	other := &database.User{Id: uuid.New().String(), Email: "other-inviter@example.com"}
+	err = other.Create(testDB)
+	assert.NoError(t, err)
+	rec = deleteInvite(revokeInvite(testDB), invite["id"].(string), createTestSession(t, other))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	// Users without a role that allows inviting cannot create invites
+	rec = postJSON(createInvite(testDB), CreateInviteBody{}, createTestSession(t, other))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	// Clean up
+	_, err = testDB.Model((*database.InviteCode)(nil)).Where("generated_by = ?", testUser.Id).Delete()
+	assert.NoError(t, err)
+	for _, user := range []*database.User{testUser, other} {
+		err = user.Delete(testDB)
+		assert.NoError(t, err)
+	}
+}
+
+func TestRegisterWithInviteGrants(t *testing.T) {
+	// Create an editor in a group, with a session
+	inviter := &database.User{
+		Id:          uuid.New().String(),
+		Email:       "granting-inviter@example.com",
+		Permissions: database.PermissionUser | database.PermissionEditor,
+	}
+	err := inviter.Create(testDB)
+	assert.NoError(t, err)
+	session := createTestSession(t, inviter)
+	team := &database.Group{Id: uuid.New().String(), Name: "Docs team", CreatedAt: time.Now()}
+	err = team.Create(testDB)
+	assert.NoError(t, err)
+	other := &database.Group{Id: uuid.New().String(), Name: "Other team", CreatedAt: time.Now()}
+	err = other.Create(testDB)
+	assert.NoError(t, err)
+	err = database.AddGroupMember(testDB, team.Id, inviter.Id)
+	assert.NoError(t, err)
+
+	// Inviters cannot grant more than they have, nor more than the user role
+	// without managing roles
+	rec := postJSON(createInvite(testDB), CreateInviteBody{Permissions: database.PermissionAdmin}, session)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	rec = postJSON(createInvite(testDB), CreateInviteBody{Permissions: database.PermissionUser | database.PermissionEditor}, session)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	rec = postJSON(createInvite(testDB), CreateInviteBody{Groups: []string{other.Id}}, session)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	rec = postJSON(createInvite(testDB), CreateInviteBody{
+		Permissions: database.PermissionUser,
+		Groups:      []string{team.Id},
+	}, session)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	var invite map[string]interface{}
+	err = json.Unmarshal(rec.Body.Bytes(), &invite)
+	assert.NoError(t, err)
+
+	rec = postJSON(registerUser(testDB), RegisterBody{Email: "granted@example.com", Password: "a long passphrase", InviteCode: invite["id"].(string)}, nil)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+
+	user, err := database.GetUserByEmail(testDB, "granted@example.com")
+	if assert.NoError(t, err) {
+		assert.False(t, user.IsEditor())
+		groups, err := database.GetUserGroupIds(testDB, user.Id)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{team.Id}, groups)
+
+		// Clean up
+		_, err = testDB.Exec("DELETE FROM outbox_emails WHERE recipient = ?", user.Email)
+		assert.NoError(t, err)
+		err = user.Delete(testDB)
+		assert.NoError(t, err)
+	}
+
+	// Leaving a group stops earlier invites from adding people to it
+	rec = postJSON(createInvite(testDB), CreateInviteBody{Groups: []string{team.Id}}, session)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	err = json.Unmarshal(rec.Body.Bytes(), &invite)
+	assert.NoError(t, err)
+	_, err = testDB.Model((*database.GroupMember)(nil)).Where("group_id = ? AND user_id = ?", team.Id, inviter.Id).Delete()
+	assert.NoError(t, err)
+
+	rec = postJSON(registerUser(testDB), RegisterBody{Email: "granted-later@example.com", Password: "a long passphrase", InviteCode: invite["id"].(string)}, nil)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+
+	user, err = database.GetUserByEmail(testDB, "granted-later@example.com")
+	if assert.NoError(t, err) {
+		groups, err := database.GetUserGroupIds(testDB, user.Id)
+		assert.NoError(t, err)
+		assert.Empty(t, groups)
+
+		// Clean up
+		_, err = testDB.Exec("DELETE FROM outbox_emails WHERE recipient = ?", user.Email)
+		assert.NoError(t, err)
+		err = user.Delete(testDB)
+		assert.NoError(t, err)
+	}
+	_, err = testDB.Model((*database.InviteCode)(nil)).Where("generated_by = ?", inviter.Id).Delete()
+	assert.NoError(t, err)
+	for _, group := range []*database.Group{team, other} {
+		err = group.Delete(testDB)
+		assert.NoError(t, err)
+	}
+	err = inviter.Delete(testDB)
+	assert.NoError(t, err)
+}
+
+func TestInviteRoleGroups(t *testing.T) {
+	// Create an admin who cannot manage roles, and a user in a group that gives
+	// out the editor role
+	admins := &database.Role{Id: uuid.New().String(), Name: "Inviting admins", Permissions: []string{database.PermAdminister, database.PermCreateInvites}, CreatedAt: time.Now()}
+	err := admins.Create(testDB)
+	assert.NoError(t, err)
+	admin := &database.User{Id: uuid.New().String(), Email: "role-groups-admin@example.com"}
+	err = admin.Create(testDB)
+	assert.NoError(t, err)
+	err = database.AssignRole(testDB, admin.Id, admins.Id)
+	assert.NoError(t, err)
+	member := &database.User{Id: uuid.New().String(), Email: "role-groups-member@example.com", Permissions: database.PermissionUser}
+	err = member.Create(testDB)
+	assert.NoError(t, err)
+
+	privileged := &database.Group{Id: uuid.New().String(), Name: "Invite editors", CreatedAt: time.Now()}
+	team := &database.Group{Id: uuid.New().String(), Name: "Invite team", CreatedAt: time.Now()}
+	for _, group := range []*database.Group{privileged, team} {
+		err := group.Create(testDB)
+		assert.NoError(t, err)
+		err = database.AddGroupMember(testDB, group.Id, member.Id)
+		assert.NoError(t, err)
+	}
+	err = database.AssignGroupRole(testDB, privileged.Id, database.RoleEditor)
+	assert.NoError(t, err)
+
+	// Neither can invite people to a group that gives out roles
+	for _, inviter := range []*database.User{admin, member} {
+		rec := postJSON(createInvite(testDB), CreateInviteBody{Groups: []string{privileged.Id}}, createTestSession(t, inviter))
+		assert.Equal(t, http.StatusForbidden, rec.Code, inviter.Email)
+	}
+
+	// Nesting a group inside one with roles stops earlier invites from adding
+	// people to it
+	rec := postJSON(createInvite(testDB), CreateInviteBody{Groups: []string{team.Id}}, createTestSession(t, member))
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	var invite map[string]interface{}
+	err = json.Unmarshal(rec.Body.Bytes(), &invite)
+	assert.NoError(t, err)
+	team.ParentId = privileged.Id
+	err = team.Update(testDB)
+	assert.NoError(t, err)
+
+	rec = postJSON(registerUser(testDB), RegisterBody{Email: "role-groups-invitee@example.com", Password: "a long passphrase", InviteCode: invite["id"].(string)}, nil)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+
+	user, err := database.GetUserByEmail(testDB, "role-groups-invitee@example.com")
+	if assert.NoError(t, err) {
+		assert.False(t, user.IsEditor())
+		groups, err := database.GetUserGroupIds(testDB, user.Id)
+		assert.NoError(t, err)
+		assert.Empty(t, groups)
+
+		// Clean up
+		_, err = testDB.Exec("DELETE FROM outbox_emails WHERE recipient = ?", user.Email)
+		assert.NoError(t, err)
+		err = user.Delete(testDB)
+		assert.NoError(t, err)
+	}
+
+	// Clean up
+	_, err = testDB.Model((*database.InviteCode)(nil)).Where("generated_by IN (?)", pg.In([]string{admin.Id, member.Id})).Delete()
+	assert.NoError(t, err)
+	for _, group := range []*database.Group{team, privileged} {
+		err = group.Delete(testDB)
+		assert.NoError(t, err)
+	}
+	err = database.UnassignRole(testDB, admin.Id, admins.Id)
+	assert.NoError(t, err)
+	for _, testUser := range []*database.User{admin, member} {
+		err = testUser.Delete(testDB)
+		assert.NoError(t, err)
+	}
+	err = admins.Delete(testDB)
+	assert.NoError(t, err)
+}
+
+func TestInvitePermissionsNeedRoleManagement(t *testing.T) {
+	// Create an admin who cannot manage roles
+	admins := &database.Role{Id: uuid.New().String(), Name: "Granting admins", Permissions: []string{database.PermAdminister, database.PermCreateInvites}, CreatedAt: time.Now()}
+	err := admins.Create(testDB)
+	assert.NoError(t, err)
+	admin := &database.User{Id: uuid.New().String(), Email: "granting-admin@example.com"}
+	err = admin.Create(testDB)
+	assert.NoError(t, err)
+	err = database.AssignRole(testDB, admin.Id, admins.Id)
+	assert.NoError(t, err)
+	session := createTestSession(t, admin)
+
+	// They cannot invite admins or editors, only users
+	for _, permissions := range []int{database.PermissionAdmin, database.PermissionEditor} {
+		rec := postJSON(createInvite(testDB), CreateInviteBody{Permissions: permissions}, session)
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+	}
+	rec := postJSON(createInvite(testDB), CreateInviteBody{Permissions: database.PermissionUser}, session)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+
+	// Invites they already hold are limited to the user role when used
+	invite := &database.InviteCode{Id: uuid.New().String(), GeneratedBy: admin.Id, CreatedAt: time.Now(), Permissions: database.PermissionUser | database.PermissionAdmin}
+	err = invite.Create(testDB)
+	assert.NoError(t, err)
+	rec = postJSON(registerUser(testDB), RegisterBody{Email: "granted-admin@example.com", Password: "a long passphrase", InviteCode: invite.Id}, nil)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+
+	user, err := database.GetUserByEmail(testDB, "granted-admin@example.com")
+	if assert.NoError(t, err) {
+		assert.False(t, user.IsAdmin())
+		assert.True(t, user.HasPermission(database.PermUseApps))
+
+		// Clean up
+		_, err = testDB.Exec("DELETE FROM outbox_emails WHERE recipient = ?", user.Email)
+		assert.NoError(t, err)
+		err = user.Delete(testDB)
+		assert.NoError(t, err)
+	}
+
+	// Clean up
+	_, err = testDB.Model((*database.InviteCode)(nil)).Where("generated_by = ?", admin.Id).Delete()
+	assert.NoError(t, err)
+	err = database.UnassignRole(testDB, admin.Id, admins.Id)
+	assert.NoError(t, err)
+	err = admin.Delete(testDB)
+	assert.NoError(t, err)
+	err = admins.Delete(testDB)
+	assert.NoError(t, err)
+}
+
+func deleteInvite(handler echo.HandlerFunc, id string, session *database.Session) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodDelete, "/", nil)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	c.SetParamNames("id")
+	c.SetParamValues(id)
+	c.Set("session", session)
+	handler(c)
+	return rec
+}
+
+func getInvite(code string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	c.SetParamNames("invite")
+	c.SetParamValues(code)
+	validateInvite(testDB)(c)
+	return rec
+}
@@ -0,0 +1,265 @@
+package web
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Supported JWS algorithms for the keys in a KeySet.
+const (
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+	AlgEdDSA = "EdDSA"
+)
+
+// SigningKey is a private key used to sign tokens, identified by its `kid`.
+type SigningKey struct {
+	ID        string
+	Algorithm string
+	Private   crypto.Signer
+}
+
+// KeySet holds every key tokens may be signed with. New tokens are signed with the
+// active key; verification accepts any key in the set, looked up by `kid`.
+type KeySet struct {
+	mu     sync.RWMutex
+	keys   map[string]*SigningKey
+	active string
+}
+
+var signingKeys = &KeySet{keys: map[string]*SigningKey{}}
+
+// GenerateSigningKey creates a new random key for the given algorithm.
+func GenerateSigningKey(alg string) (*SigningKey, error) {
+	var private crypto.Signer
+	var err error
+
+	switch alg {
+	case AlgRS256:
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case AlgES256:
+		private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgEdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm: %s", alg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return newSigningKey(private)
+}
+
+// parseSigningKey reads a DER encoded PKCS#8 private key.
+func parseSigningKey(der []byte) (*SigningKey, error) {
+	parsed, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+
+	private, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported private key type")
+	}
+	return newSigningKey(private)
+}
+
+func newSigningKey(private crypto.Signer) (*SigningKey, error) {
+	key := &SigningKey{Private: private}
+
+	switch k := private.(type) {
+	case *rsa.PrivateKey:
+		key.Algorithm = AlgRS256
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, errors.New("only P-256 ECDSA keys are supported")
+		}
+		key.Algorithm = AlgES256
+	case ed25519.PrivateKey:
+		key.Algorithm = AlgEdDSA
+	default:
+		return nil, errors.New("unsupported private key type")
+	}
+
+	thumbprint, err := key.Thumbprint()
+	if err != nil {
+		return nil, err
+	}
+	key.ID = thumbprint
+	return key, nil
+}
+
+// Public returns the public half of the key.
+func (k *SigningKey) Public() crypto.PublicKey {
+	return k.Private.Public()
+}
+
+// Method returns the jwt signing method matching the key's algorithm.
+func (k *SigningKey) Method() jwt.SigningMethod {
+	return jwt.GetSigningMethod(k.Algorithm)
+}
+
+// JWK returns the public key in JSON Web Key format (RFC 7517).
+func (k *SigningKey) JWK() map[string]string {
+	jwk := k.publicJWK()
+	jwk["kid"] = k.ID
+	jwk["use"] = "sig"
+	jwk["alg"] = k.Algorithm
+	return jwk
+}
+
+// Thumbprint computes the RFC 7638 JWK thumbprint, which is used as the `kid`.
+func (k *SigningKey) Thumbprint() (string, error) {
+	// encoding/json sorts map keys, which yields the canonical member order.
+	data, err := json.Marshal(k.publicJWK())
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+func (k *SigningKey) publicJWK() map[string]string {
+	switch pub := k.Public().(type) {
+	case *rsa.PublicKey:
+		return map[string]string{
+			"kty": "RSA",
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}
+	case *ecdsa.PublicKey:
+		return map[string]string{
+			"kty": "EC",
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(pub.X.FillBytes(make([]byte, 32))),
+			"y":   base64.RawURLEncoding.EncodeToString(pub.Y.FillBytes(make([]byte, 32))),
+		}
+	case ed25519.PublicKey:
+		return map[string]string{
+			"kty": "OKP",
+			"crv": "Ed25519",
+			"x":   base64.RawURLEncoding.EncodeToString(pub),
+		}
+	}
+	return map[string]string{}
+}
+
+// Add puts a key in the set, replacing any key with the same `kid`.
+func (s *KeySet) Add(key *SigningKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[key.ID] = key
+}
+
+// Replace swaps in the keys and active key of other, which must not be changed
+// afterwards. Readers see either the old keys or the new ones, never a mix.
+func (s *KeySet) Replace(other *KeySet) {
+	other.mu.RLock()
+	keys, active := other.keys, other.active
+	other.mu.RUnlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+	s.active = active
+}
+
+// Active returns the key new tokens are signed with.
+func (s *KeySet) Active() (*SigningKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	key, ok := s.keys[s.active]
+	if !ok {
+		return nil, errors.New("no active signing key")
+	}
+	return key, nil
+}
+
+// Get looks up a key by `kid`.
+func (s *KeySet) Get(kid string) (*SigningKey, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	key, ok := s.keys[kid]
+	return key, ok
+}
+
+// Keys returns every key in the set, ordered by `kid`.
+func (s *KeySet) Keys() []*SigningKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]*SigningKey, 0, len(s.keys))
+	for _, key := range s.keys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	return keys
+}
+
+// Algorithms lists the distinct algorithms of the keys in the set.
+func (s *KeySet) Algorithms() []string {
+	var algs []string
+	seen := map[string]bool{}
+	for _, key := range s.Keys() {
+		if !seen[key.Algorithm] {
+			seen[key.Algorithm] = true
+			algs = append(algs, key.Algorithm)
+		}
+	}
+	return algs
+}
+
+// signToken signs claims with the active key and stamps its `kid` header. An empty
+// typ keeps the default "JWT" type header.
+func signToken(claims jwt.Claims, typ string) (string, error) {
+	key, err := signingKeys.Active()
+	if err != nil {
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(key.Method(), claims)
+	token.Header["kid"] = key.ID
+	if typ != "" {
+		token.Header["typ"] = typ
+	}
+	return token.SignedString(key.Private)
+}
+
+// verificationKey is a jwt.Keyfunc resolving the public key a token was signed
+// with from its `kid` header.
+func verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		return nil, errors.New("token has no kid header")
+	}
+
+	key, ok := signingKeys.Get(kid)
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key: %s", kid)
+	}
+	if token.Method.Alg() != key.Algorithm {
+		return nil, errors.New("token algorithm does not match its key")
+	}
+	return key.Public(), nil
+}
+
+// validMethods restricts parsing to the asymmetric algorithms this service signs with.
+var validMethods = jwt.WithValidMethods([]string{AlgRS256, AlgES256, AlgEdDSA})
@@ -0,0 +1,161 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/pragmahq/sso/database"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSigningKeyAlgorithms(t *testing.T) {
+	for _, alg := range []string{AlgRS256, AlgES256, AlgEdDSA} {
+		key, err := GenerateSigningKey(alg)
+		if !assert.NoError(t, err, alg) {
+			continue
+		}
+		assert.Equal(t, alg, key.Algorithm)
+		assert.NotEmpty(t, key.ID)
+
+		set := &KeySet{keys: map[string]*SigningKey{}}
+		set.Add(key)
+		set.active = key.ID
+
+		previous := signingKeys
+		signingKeys = set
+
+		signed, err := signToken(jwt.MapClaims{"exp": time.Now().Add(time.Minute).Unix()}, "")
+		assert.NoError(t, err, alg)
+
+		token, err := jwt.Parse(signed, verificationKey, validMethods)
+		assert.NoError(t, err, alg)
+		assert.Equal(t, key.ID, token.Header["kid"])
+
+		signingKeys = previous
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	if assert.NoError(t, jwks(c)) {
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		var response struct {
+			Keys []map[string]string `json:"keys"`
+		}
+		err := json.Unmarshal(rec.Body.Bytes(), &response)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, response.Keys)
+		for _, key := range response.Keys {
+			assert.NotEmpty(t, key["kid"])
+			assert.Empty(t, key["d"])
+		}
+	}
+}
+
+func TestSigningKeyRotation(t *testing.T) {
+	current, err := signingKeys.Active()
+	assert.NoError(t, err)
+
+	// Close to the end of the rotation interval a successor is published
+	now := time.Now().Add(SIGNING_KEY_ROTATION - signingKeyPrepublish/2)
+	err = rotateSigningKeys(testDB, now)
+	assert.NoError(t, err)
+
+	keys, err := database.GetSigningKeys(testDB)
+	assert.NoError(t, err)
+	states := map[string]string{}
+	for _, key := range keys {
+		states[key.Id] = key.State
+	}
+	assert.Equal(t, database.KeyStateActive, states[current.ID])
+	assert.Len(t, keys, 2)
+
+	// Once due, the successor takes over and the old key keeps verifying
+	now = now.Add(signingKeyPrepublish)
+	err = rotateSigningKeys(testDB, now)
+	assert.NoError(t, err)
+	err = loadSigningKeys(testDB)
+	assert.NoError(t, err)
+
+	next, err := signingKeys.Active()
+	assert.NoError(t, err)
+	assert.NotEqual(t, current.ID, next.ID)
+	_, ok := signingKeys.Get(current.ID)
+	assert.True(t, ok)
+
+	// After the retention period the old key is gone
+	err = rotateSigningKeys(testDB, now.Add(signingKeyRetention))
+	assert.NoError(t, err)
+	err = loadSigningKeys(testDB)
+	assert.NoError(t, err)
+
+	_, ok = signingKeys.Get(current.ID)
+	assert.False(t, ok)
+}
+
+func TestKeySetReplace(t *testing.T) {
+	first, err := GenerateSigningKey(AlgEdDSA)
+	assert.NoError(t, err)
+	second, err := GenerateSigningKey(AlgEdDSA)
+	assert.NoError(t, err)
+
+	set := &KeySet{keys: map[string]*SigningKey{}}
+	set.Add(first)
+	set.active = first.ID
+
+	// Readers keep working while the set is replaced underneath them
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			_, err := set.Active()
+			assert.NoError(t, err)
+		}
+	}()
+
+	next := &KeySet{keys: map[string]*SigningKey{}}
+	next.Add(second)
+	next.active = second.ID
+	set.Replace(next)
+	<-done
+
+	active, err := set.Active()
+	assert.NoError(t, err)
+	assert.Equal(t, second.ID, active.ID)
+	_, ok := set.Get(first.ID)
+	assert.False(t, ok)
+}
+
+func TestChangeCookieSecret(t *testing.T) {
+	secret, previous := SECRET, PREVIOUS_SECRETS
+	defer func() { SECRET, PREVIOUS_SECRETS = secret, previous }()
+
+	// Without the old value the stored keys cannot be opened
+	SECRET = []byte("a-new-cookie-secret")
+	assert.Error(t, loadSigningKeys(testDB))
+
+	// With it they are loaded and sealed again under the new secret
+	PREVIOUS_SECRETS = "unrelated," + string(secret)
+	assert.NoError(t, loadSigningKeys(testDB))
+	records, err := database.GetSigningKeys(testDB)
+	assert.NoError(t, err)
+	for _, record := range records {
+		_, stale, err := decryptSecret(record.PrivateKey)
+		assert.NoError(t, err)
+		assert.False(t, stale)
+	}
+
+	// Change back for the other tests
+	SECRET, PREVIOUS_SECRETS = secret, "a-new-cookie-secret"
+	assert.NoError(t, loadSigningKeys(testDB))
+}
@@ -0,0 +1,169 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pragmahq/sso/database"
+	"github.com/pragmahq/sso/mailer"
+)
+
+const (
+	// mailPollInterval is how often the outbox is checked for emails that are due
+	// for a retry. New emails wake the worker right away.
+	mailPollInterval = 30 * time.Second
+	mailBatchSize    = 20
+
+	// outboxRetention is how long sent and undeliverable emails stay in the
+	// outbox, and outboxPruneInterval how often older ones are deleted.
+	outboxRetention     = 7 * 24 * time.Hour
+	outboxPruneInterval = time.Hour
+)
+
+// MAILER selects how email is delivered: "smtp", "file" (written as .eml files
+// into MAIL_DIR) or "log" (printed to the server log). Emails carry working reset
+// and verification links, so the log mailer has to be chosen explicitly and SMTP
+// is the default.
+var (
+	MAILER        = envString("MAILER", "smtp")
+	MAIL_FROM     = envString("MAIL_FROM", "Pragma <no-reply@localhost>")
+	MAIL_DIR      = envString("MAIL_DIR", "mail")
+	SMTP_HOST     = envString("SMTP_HOST", "")
+	SMTP_PORT     = envString("SMTP_PORT", "587")
+	SMTP_USERNAME = envString("SMTP_USERNAME", "")
+	SMTP_PASSWORD = envString("SMTP_PASSWORD", "")
+
+	// PRODUCT_NAME is how the service refers to itself in emails.
+	PRODUCT_NAME = envString("PRODUCT_NAME", "Pragma")
+)
+
+// mail delivers outgoing email. Tests replace it with a *mailer.CaptureMailer.
+var mail mailer.Mailer = &mailer.LogMailer{}
+
+// mailQueued wakes the delivery worker when an email is added to the outbox.
+var mailQueued = make(chan struct{}, 1)
+
+func newMailer() (mailer.Mailer, error) {
+	switch MAILER {
+	case "smtp":
+		if SMTP_HOST == "" {
+			return nil, errors.New("SMTP_HOST is not set; set it, or MAILER=file or MAILER=log for development")
+		}
+		return &mailer.SMTPMailer{
+			Host:     SMTP_HOST,
+			Port:     SMTP_PORT,
+			Username: SMTP_USERNAME,
+			Password: SMTP_PASSWORD,
+			From:     MAIL_FROM,
+		}, nil
+	case "file":
+		return &mailer.FileMailer{Dir: MAIL_DIR, From: MAIL_FROM}, nil
+	case "log":
+		return &mailer.LogMailer{}, nil
+	}
+	return nil, fmt.Errorf("unknown MAILER %q", MAILER)
+}
+
+// newEmail renders the named template into an outbox row addressed to to. The
+// product name is added to data as "Product".
+func newEmail(template, to string, data map[string]interface{}) (*database.OutboxEmail, error) {
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	data["Product"] = PRODUCT_NAME
+
+	msg, err := mailer.Render(template, to, data)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	return &database.OutboxEmail{
+		Id:            uuid.New().String(),
+		Recipient:     msg.To,
+		Subject:       msg.Subject,
+		Text:          msg.Text,
+		HTML:          msg.HTML,
+		CreatedAt:     now,
+		NextAttemptAt: now,
+	}, nil
+}
+
+// queueMail renders the named template and stores it in the outbox. Use newEmail
+// instead to insert the email in the same transaction as other changes, and call
+// notifyMailer once it is committed.
+func queueMail(db *database.DB, template, to string, data map[string]interface{}) error {
+	email, err := newEmail(template, to, data)
+	if err != nil {
+		return err
+	}
+	if err := email.Create(db); err != nil {
+		return err
+	}
+	notifyMailer()
+	return nil
+}
+
+func notifyMailer() {
+	select {
+	case mailQueued <- struct{}{}:
+	default:
+	}
+}
+
+// deliverMail sends emails from the outbox until ctx is cancelled.
+func deliverMail(ctx context.Context, db *database.DB) {
+	ticker := time.NewTicker(mailPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-mailQueued:
+		}
+
+		if _, err := deliverOutbox(ctx, db); err != nil {
+			log.Printf("Failed to deliver mail: %v", err)
+		}
+	}
+}
+
+// deliverOutbox sends the emails that are due and returns how many were sent.
+func deliverOutbox(ctx context.Context, db *database.DB) (int, error) {
+	return database.ProcessOutbox(db, mailBatchSize, func(email *database.OutboxEmail) error {
+		err := mail.Send(ctx, &mailer.Message{
+			To:      email.Recipient,
+			Subject: email.Subject,
+			Text:    email.Text,
+			HTML:    email.HTML,
+		})
+		if err != nil {
+			log.Printf("Failed to send mail %s to %s (attempt %d): %v", email.Id, email.Recipient, email.Attempts, err)
+		}
+		return err
+	})
+}
+
+// pruneOutbox periodically deletes emails that are done with.
+func pruneOutbox(ctx context.Context, db *database.DB) {
+	ticker := time.NewTicker(outboxPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := database.PruneOutbox(db, time.Now().Add(-outboxRetention)); err != nil {
+			log.Printf("Failed to prune outbox: %v", err)
+		}
+	}
+}
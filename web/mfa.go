@@ -0,0 +1,400 @@
+package web
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/pragmahq/sso/database"
+	"github.com/pragmahq/sso/utils"
+)
+
+const (
+	// mfaTokenType is the `typ` header of the token handed out between the password
+	// and second-factor steps of login. It grants nothing but finishing the login.
+	mfaTokenType = "mfa+jwt"
+	mfaTokenTTL  = 5 * time.Minute
+
+	recoveryCodeCount = 10
+)
+
+// MFA_ISSUER is the account issuer shown in authenticator apps.
+var MFA_ISSUER = envString("MFA_ISSUER", "Pragma")
+
+type MFALoginBody struct {
+	MFAToken     string            `json:"mfaToken"`
+	Code         string            `json:"code"`
+	RecoveryCode string            `json:"recoveryCode"`
+	Passkey      *PasskeyLoginBody `json:"passkey"`
+}
+
+type ReauthBody struct {
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+func registerMFARoutes(g *echo.Group, db *database.DB) {
+	g.GET("/mfa", getMFAStatus(db))
+	g.POST("/mfa/totp", enrollTOTP(db))
+	g.POST("/mfa/totp/confirm", confirmTOTP(db))
+	g.DELETE("/mfa/totp", disableTOTP(db))
+	g.POST("/mfa/recovery-codes", regenerateRecoveryCodes(db))
+}
+
+// loginMFA finishes a login that was paused for a second factor, accepting a TOTP
+// code, a recovery code or a passkey assertion.
+func loginMFA(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req MFALoginBody
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		}
+
+		user, err := parseMFAToken(db, req.MFAToken)
+		if err != nil {
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Login expired, please sign in again"})
+		}
+
+		if ok, err := checkLoginThrottle(c, user.Email); !ok {
+			return err
+		}
+
+		if req.Passkey != nil {
+			verified, status, msg := verifyPasskey(db, req.Passkey, database.CeremonyMFA, user.Id)
+			if verified == nil {
+				if status == http.StatusUnauthorized {
+					failLogin(c, user.Email)
+				}
+				return c.JSON(status, map[string]string{"error": msg})
+			}
+			return completeLogin(c, db, user)
+		}
+
+		var ok bool
+		if req.RecoveryCode != "" {
+			ok, err = database.UseRecoveryCode(db, user.Id, hashToken(normalizeRecoveryCode(req.RecoveryCode)))
+		} else {
+			ok, err = verifyTOTP(db, user.Id, req.Code)
+		}
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		if !ok {
+			failLogin(c, user.Email)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid code"})
+		}
+
+		return completeLogin(c, db, user)
+	}
+}
+
+func getMFAStatus(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		session := c.Get("session").(*database.Session)
+
+		device, err := database.GetTOTPDevice(db, session.UserId)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		remaining, err := database.CountRecoveryCodes(db, session.UserId)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		passkeys, err := database.CountPasskeys(db, session.UserId)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"totp":                   device != nil && device.IsConfirmed(),
+			"passkeys":               passkeys,
+			"recoveryCodesRemaining": remaining,
+		})
+	}
+}
+
+// enrollTOTP starts enrollment by generating a secret the user adds to their
+// authenticator app. It is not used for login until confirmed.
+func enrollTOTP(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, status, msg := reauthenticate(c, db)
+		if user == nil {
+			return c.JSON(status, map[string]string{"error": msg})
+		}
+
+		device, err := database.GetTOTPDevice(db, user.Id)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		if device != nil && device.IsConfirmed() {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Two-factor authentication is already enabled"})
+		}
+
+		secret, err := utils.GenerateTOTPSecret()
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to generate secret"})
+		}
+		sealed, err := encryptSecret([]byte(secret))
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to generate secret"})
+		}
+
+		device = &database.TOTPDevice{
+			UserId:    user.Id,
+			Secret:    sealed,
+			CreatedAt: time.Now(),
+		}
+		if err := device.Save(db); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+
+		return c.JSON(http.StatusOK, map[string]string{
+			"secret": secret,
+			"uri":    utils.TOTPURI(MFA_ISSUER, user.Email, secret),
+		})
+	}
+}
+
+// confirmTOTP enables the pending device once the user enters a valid code, and
+// hands out the initial set of recovery codes.
+func confirmTOTP(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		session := c.Get("session").(*database.Session)
+
+		var req ReauthBody
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		}
+
+		device, err := database.GetTOTPDevice(db, session.UserId)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		if device == nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "No pending enrollment"})
+		}
+		if device.IsConfirmed() {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Two-factor authentication is already enabled"})
+		}
+
+		ok, err := checkTOTP(db, device, req.Code)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		if !ok {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid code"})
+		}
+
+		codes, err := newRecoveryCodes(db, session.UserId)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to generate recovery codes"})
+		}
+
+		now := time.Now()
+		device.ConfirmedAt = &now
+		if err := device.Update(db); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+
+		return c.JSON(http.StatusOK, map[string]interface{}{"recoveryCodes": codes})
+	}
+}
+
+func disableTOTP(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, status, msg := reauthenticate(c, db)
+		if user == nil {
+			return c.JSON(status, map[string]string{"error": msg})
+		}
+
+		if err := database.DeleteMFA(db, user.Id); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "Two-factor authentication disabled"})
+	}
+}
+
+func regenerateRecoveryCodes(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, status, msg := reauthenticate(c, db)
+		if user == nil {
+			return c.JSON(status, map[string]string{"error": msg})
+		}
+
+		device, err := database.GetTOTPDevice(db, user.Id)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		if device == nil || !device.IsConfirmed() {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Two-factor authentication is not enabled"})
+		}
+
+		codes, err := newRecoveryCodes(db, user.Id)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to generate recovery codes"})
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{"recoveryCodes": codes})
+	}
+}
+
+// reauthenticate loads the signed-in user and checks the password in the request
+// body. When the user already has a confirmed TOTP device a valid code is required
+// as well; passkeys cannot be checked within a single request so they are not
+// asked for. On failure the user is nil and the status and message describe why.
+func reauthenticate(c echo.Context, db *database.DB) (*database.User, int, string) {
+	var req ReauthBody
+	if err := c.Bind(&req); err != nil {
+		return nil, http.StatusBadRequest, "Invalid request body"
+	}
+	return checkReauth(c, db, req)
+}
+
+// checkReauth is reauthenticate for handlers that bind a larger request body.
+// Failures count against the account like failed sign-ins, so a stolen session
+// cannot be used to guess the password.
+func checkReauth(c echo.Context, db *database.DB, req ReauthBody) (*database.User, int, string) {
+	session := c.Get("session").(*database.Session)
+
+	user := &database.User{Id: session.UserId}
+	if err := user.Read(db); err != nil {
+		return nil, http.StatusNotFound, "User not found"
+	}
+	if status, msg := loginThrottled(c, user.Email); msg != "" {
+		return nil, status, msg
+	}
+	if !checkPassword(user, req.Password) {
+		failLogin(c, user.Email)
+		return nil, http.StatusUnauthorized, "Invalid credentials"
+	}
+
+	device, err := database.GetTOTPDevice(db, user.Id)
+	if err != nil {
+		return nil, http.StatusInternalServerError, "Database error"
+	}
+	if device != nil && device.IsConfirmed() {
+		ok, err := checkTOTP(db, device, req.Code)
+		if err != nil {
+			return nil, http.StatusInternalServerError, "Database error"
+		}
+		if !ok {
+			failLogin(c, user.Email)
+			return nil, http.StatusUnauthorized, "Invalid code"
+		}
+	}
+
+	return user, http.StatusOK, ""
+}
+
+// requiresMFA reports whether the user has a confirmed TOTP device or a passkey.
+func requiresMFA(db *database.DB, user *database.User) (bool, error) {
+	device, err := database.GetTOTPDevice(db, user.Id)
+	if err != nil {
+		return false, err
+	}
+	if device != nil && device.IsConfirmed() {
+		return true, nil
+	}
+	passkeys, err := database.CountPasskeys(db, user.Id)
+	if err != nil {
+		return false, err
+	}
+	return passkeys > 0, nil
+}
+
+// verifyTOTP checks a code against the user's confirmed device.
+func verifyTOTP(db *database.DB, userID, code string) (bool, error) {
+	device, err := database.GetTOTPDevice(db, userID)
+	if err != nil || device == nil || !device.IsConfirmed() {
+		return false, err
+	}
+	return checkTOTP(db, device, code)
+}
+
+// checkTOTP validates a code from the device, rejecting codes from a time step
+// that was already used.
+func checkTOTP(db *database.DB, device *database.TOTPDevice, code string) (bool, error) {
+	secret, stale, err := decryptSecret(device.Secret)
+	if err != nil {
+		return false, err
+	}
+	if stale {
+		if device.Secret, err = encryptSecret(secret); err != nil {
+			return false, err
+		}
+		if _, err := db.Model(device).Column("secret").WherePK().Update(); err != nil {
+			return false, err
+		}
+	}
+
+	counter, ok := utils.ValidateTOTP(string(secret), code, time.Now())
+	if !ok {
+		return false, nil
+	}
+	return device.UseCounter(db, counter)
+}
+
+func createMFAToken(user *database.User) (string, error) {
+	now := time.Now()
+	return signToken(jwt.MapClaims{
+		"sub": user.Id,
+		"iat": now.Unix(),
+		"exp": now.Add(mfaTokenTTL).Unix(),
+	}, mfaTokenType)
+}
+
+func parseMFAToken(db *database.DB, tokenString string) (*database.User, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if token.Header["typ"] != mfaTokenType {
+			return nil, errors.New("not an MFA token")
+		}
+		return verificationKey(token)
+	}, validMethods, jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, err
+	}
+
+	userID, err := token.Claims.GetSubject()
+	if err != nil {
+		return nil, err
+	}
+
+	user := &database.User{Id: userID}
+	if err := user.Read(db); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// newRecoveryCodes replaces the user's recovery codes and returns the new ones in
+// the form shown to the user, e.g. "k3m9q-7tx2p".
+func newRecoveryCodes(db *database.DB, userID string) ([]string, error) {
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(encoding.EncodeToString(b))[:10]
+		codes = append(codes, code[:5]+"-"+code[5:])
+		hashes = append(hashes, hashToken(code))
+	}
+
+	if err := database.ReplaceRecoveryCodes(db, userID, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.ReplaceAll(code, " ", "")
+}
@@ -0,0 +1,101 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/pragmahq/sso/database"
+	"github.com/pragmahq/sso/utils"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLoginWithTOTP(t *testing.T) {
+	e := echo.New()
+
+	// Create a test user with a confirmed authenticator
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	testUser := &database.User{
+		Id:       uuid.New().String(),
+		Email:    "mfa@example.com",
+		Password: string(hash),
+	}
+	err = testUser.Create(testDB)
+	assert.NoError(t, err)
+
+	secret, err := utils.GenerateTOTPSecret()
+	assert.NoError(t, err)
+	sealed, err := encryptSecret([]byte(secret))
+	assert.NoError(t, err)
+	now := time.Now()
+	device := &database.TOTPDevice{UserId: testUser.Id, Secret: sealed, CreatedAt: now, ConfirmedAt: &now}
+	err = device.Save(testDB)
+	assert.NoError(t, err)
+
+	recoveryCodes, err := newRecoveryCodes(testDB, testUser.Id)
+	assert.NoError(t, err)
+
+	// The password alone only yields an MFA token
+	reqBody := `{"email":"mfa@example.com","password":"password123"}`
+	req := httptest.NewRequest(http.MethodPost, "/api/auth/login", strings.NewReader(reqBody))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+
+	var response map[string]string
+	if assert.NoError(t, login(testDB)(e.NewContext(req, rec))) {
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Empty(t, rec.Header().Get("Set-Cookie"))
+
+		err := json.Unmarshal(rec.Body.Bytes(), &response)
+		assert.NoError(t, err)
+		assert.Equal(t, "mfa_required", response["status"])
+	}
+
+	// A valid code completes the login
+	code, err := utils.TOTPCode(secret, utils.TOTPCounter(time.Now()))
+	assert.NoError(t, err)
+	mfaBody, _ := json.Marshal(MFALoginBody{MFAToken: response["mfaToken"], Code: code})
+
+	req = httptest.NewRequest(http.MethodPost, "/api/auth/login/mfa", strings.NewReader(string(mfaBody)))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec = httptest.NewRecorder()
+
+	if assert.NoError(t, loginMFA(testDB)(e.NewContext(req, rec))) {
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Header().Get("Set-Cookie"), "Token=")
+	}
+
+	// The same code cannot be replayed
+	req = httptest.NewRequest(http.MethodPost, "/api/auth/login/mfa", strings.NewReader(string(mfaBody)))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec = httptest.NewRecorder()
+
+	if assert.NoError(t, loginMFA(testDB)(e.NewContext(req, rec))) {
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	}
+
+	// Recovery codes work exactly once
+	mfaBody, _ = json.Marshal(MFALoginBody{MFAToken: response["mfaToken"], RecoveryCode: strings.ToUpper(recoveryCodes[0])})
+	for _, expected := range []int{http.StatusOK, http.StatusUnauthorized} {
+		req = httptest.NewRequest(http.MethodPost, "/api/auth/login/mfa", strings.NewReader(string(mfaBody)))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec = httptest.NewRecorder()
+
+		if assert.NoError(t, loginMFA(testDB)(e.NewContext(req, rec))) {
+			assert.Equal(t, expected, rec.Code)
+		}
+	}
+
+	// Clean up
+	err = database.DeleteMFA(testDB, testUser.Id)
+	assert.NoError(t, err)
+	err = testUser.Delete(testDB)
+	assert.NoError(t, err)
+}
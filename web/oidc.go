@@ -0,0 +1,490 @@
+package web
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/pragmahq/sso/database"
+)
+
+// ISSUER is the public base URL of this service, used as the `iss` claim of every
+// OIDC token and as the prefix of the endpoints it advertises.
+var ISSUER = os.Getenv("OIDC_ISSUER")
+
+// LOGIN_URL is the frontend page users are sent to when /authorize is hit without
+// a valid session. The original authorize request is passed back as `redirect`.
+var LOGIN_URL = os.Getenv("LOGIN_URL")
+
+const (
+	authorizationCodeTTL = 5 * time.Minute
+	idTokenTTL           = time.Hour
+
+	// accessTokenType is the JOSE `typ` header of access tokens (RFC 9068), which
+	// keeps them from being confused with ID tokens or session cookies.
+	accessTokenType = "at+jwt"
+)
+
+func registerOIDCRoutes(router *echo.Echo, db *database.DB) {
+	router.GET("/.well-known/openid-configuration", discovery)
+	router.GET("/.well-known/jwks.json", jwks)
+	router.GET("/authorize", authorize(db))
+	router.POST("/authorize", authorize(db))
+	router.POST("/token", exchangeToken(db))
+	router.GET("/userinfo", userInfo(db))
+	router.POST("/userinfo", userInfo(db))
+}
+
+// discovery serves the OpenID Provider Configuration document.
+func discovery(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"issuer":                                ISSUER,
+		"authorization_endpoint":                ISSUER + "/authorize",
+		"token_endpoint":                        ISSUER + "/token",
+		"userinfo_endpoint":                     ISSUER + "/userinfo",
+		"jwks_uri":                              ISSUER + "/.well-known/jwks.json",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code", "refresh_token"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": signingKeys.Algorithms(),
+		"scopes_supported":                      []string{"openid", "email"},
+		"token_endpoint_auth_methods_supported": []string{"none", "client_secret_basic", "client_secret_post"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported":                      []string{"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "sid", "email", "email_verified", "roles", "entitlements", "groups"},
+	})
+}
+
+// jwks serves the public halves of the signing keys so relying parties can verify
+// tokens without sharing any secret with this service.
+func jwks(c echo.Context) error {
+	keys := []map[string]string{}
+	for _, key := range signingKeys.Keys() {
+		keys = append(keys, key.JWK())
+	}
+
+	c.Response().Header().Set("Cache-Control", "public, max-age=3600")
+	return c.JSON(http.StatusOK, map[string]interface{}{"keys": keys})
+}
+
+// authorize implements the authorization endpoint of the OIDC authorization code
+// flow. PKCE with S256 is mandatory for every client.
+func authorize(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		clientID := c.FormValue("client_id")
+		redirectURI := c.FormValue("redirect_uri")
+		state := c.FormValue("state")
+
+		// Until the client and redirect_uri are known to be registered, errors are
+		// shown to the user instead of being sent to an untrusted redirect_uri.
+		client, err := database.GetClient(db, clientID)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		}
+		if client == nil || client.IsDisabled() {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid_request", "error_description": "Unknown client_id"})
+		}
+		if !client.AllowsRedirectURI(redirectURI) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid_request", "error_description": "Unregistered redirect_uri"})
+		}
+
+		if c.FormValue("response_type") != "code" {
+			return redirectWithError(c, redirectURI, state, "unsupported_response_type", "Only the code response type is supported")
+		}
+
+		scope := c.FormValue("scope")
+		if !slices.Contains(strings.Fields(scope), "openid") {
+			return redirectWithError(c, redirectURI, state, "invalid_scope", "The openid scope is required")
+		}
+		if !client.AllowsScopes(strings.Fields(scope)) {
+			return redirectWithError(c, redirectURI, state, "invalid_scope", "The client is not allowed to request this scope")
+		}
+
+		codeChallenge := c.FormValue("code_challenge")
+		codeChallengeMethod := c.FormValue("code_challenge_method")
+		if codeChallenge == "" {
+			return redirectWithError(c, redirectURI, state, "invalid_request", "code_challenge is required")
+		}
+		if codeChallengeMethod != "S256" {
+			return redirectWithError(c, redirectURI, state, "invalid_request", "code_challenge_method must be S256")
+		}
+
+		prompt := strings.Fields(c.FormValue("prompt"))
+		user, session, err := sessionUser(c, db)
+		if err != nil || slices.Contains(prompt, "login") {
+			if slices.Contains(prompt, "none") {
+				return redirectWithError(c, redirectURI, state, "login_required", "The user is not logged in")
+			}
+			return redirectToLogin(c)
+		}
+		if user.IsDisabled() {
+			return redirectWithError(c, redirectURI, state, "access_denied", "The account has been disabled")
+		}
+		if requiresVerifiedEmail(user, VerificationToken) {
+			return redirectWithError(c, redirectURI, state, "access_denied", "The email address has not been verified")
+		}
+		if !user.HasPermission(database.PermUseApps) {
+			return redirectWithError(c, redirectURI, state, "access_denied", "The account may not sign in to applications")
+		}
+
+		code, err := randomToken(32)
+		if err != nil {
+			return redirectWithError(c, redirectURI, state, "server_error", "Failed to generate code")
+		}
+
+		now := time.Now()
+		authCode := &database.AuthorizationCode{
+			Id:                  hashToken(code),
+			ClientId:            client.Id,
+			UserId:              user.Id,
+			SessionId:           session.Id,
+			RedirectURI:         redirectURI,
+			Scope:               scope,
+			Nonce:               c.FormValue("nonce"),
+			CodeChallenge:       codeChallenge,
+			CodeChallengeMethod: codeChallengeMethod,
+			AuthTime:            session.CreatedAt,
+			CreatedAt:           now,
+			ExpiresAt:           now.Add(authorizationCodeTTL),
+		}
+		if err := authCode.Create(db); err != nil {
+			return redirectWithError(c, redirectURI, state, "server_error", "Failed to store code")
+		}
+
+		params := url.Values{}
+		params.Set("code", code)
+		if state != "" {
+			params.Set("state", state)
+		}
+		return c.Redirect(http.StatusFound, appendQuery(redirectURI, params))
+	}
+}
+
+// exchangeToken implements the token endpoint for the authorization_code and
+// refresh_token grants.
+func exchangeToken(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		c.Response().Header().Set("Cache-Control", "no-store")
+		c.Response().Header().Set("Pragma", "no-cache")
+
+		grantType := c.FormValue("grant_type")
+		if grantType != "authorization_code" && grantType != "refresh_token" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		}
+
+		client, ok := authenticateClient(c, db)
+		if !ok {
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Basic realm="token"`)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		}
+
+		if grantType == "refresh_token" {
+			return exchangeRefreshToken(c, db, client)
+		}
+		return exchangeAuthorizationCode(c, db, client)
+	}
+}
+
+func exchangeAuthorizationCode(c echo.Context, db *database.DB, client *database.Client) error {
+	code := c.FormValue("code")
+	if code == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid_request", "error_description": "code is required"})
+	}
+
+	authCode, err := database.GetAuthorizationCode(db, hashToken(code))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "server_error"})
+	}
+	if authCode == nil || authCode.IsExpired() {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "Invalid or expired code"})
+	}
+	if authCode.ClientId != client.Id || authCode.RedirectURI != c.FormValue("redirect_uri") {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "client_id or redirect_uri mismatch"})
+	}
+	if !verifyCodeChallenge(c.FormValue("code_verifier"), authCode.CodeChallenge) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "Invalid code_verifier"})
+	}
+
+	consumed, err := authCode.Consume(db)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "server_error"})
+	}
+	if !consumed {
+		// A code presented twice may have been intercepted, so the tokens already
+		// issued from it are revoked (RFC 6749 section 4.1.2).
+		if err := revokeCodeTokens(db, authCode); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		}
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "Code has already been used"})
+	}
+
+	user := &database.User{Id: authCode.UserId}
+	if err := user.Read(db); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "User not found"})
+	}
+
+	// The refresh token family is named after the code, so a replayed code can
+	// find the tokens issued from it.
+	refreshToken, err := issueRefreshToken(db, database.RefreshToken{
+		FamilyId:  authCode.Id,
+		UserId:    user.Id,
+		ClientId:  client.Id,
+		SessionId: authCode.SessionId,
+		Scope:     authCode.Scope,
+		AuthTime:  authCode.AuthTime,
+	})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "server_error"})
+	}
+
+	return tokenResponse(c, db, user, client.Id, authCode.SessionId, authCode.Scope, authCode.Nonce, authCode.AuthTime, refreshToken)
+}
+
+// revokeCodeTokens revokes the refresh tokens issued from an authorization code
+// and the session it was issued in, which also invalidates its access tokens.
+func revokeCodeTokens(db *database.DB, authCode *database.AuthorizationCode) error {
+	if err := database.RevokeRefreshTokenFamily(db, authCode.Id); err != nil {
+		return err
+	}
+	return database.RevokeSessions(db, authCode.UserId, authCode.SessionId, "")
+}
+
+func exchangeRefreshToken(c echo.Context, db *database.DB, client *database.Client) error {
+	refreshToken, next, err := rotateRefreshToken(db, c.FormValue("refresh_token"), client.Id)
+	if err == errInvalidRefreshToken || err == errRefreshTokenReused {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "Invalid refresh token"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "server_error"})
+	}
+
+	user := &database.User{Id: refreshToken.UserId}
+	if err := user.Read(db); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "User not found"})
+	}
+
+	return tokenResponse(c, db, user, client.Id, refreshToken.SessionId, refreshToken.Scope, "", refreshToken.AuthTime, next)
+}
+
+func tokenResponse(c echo.Context, db *database.DB, user *database.User, clientID, sessionID, scope, nonce string, authTime time.Time, refreshToken string) error {
+	if user.IsDisabled() {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "The account has been disabled"})
+	}
+	if requiresVerifiedEmail(user, VerificationToken) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "The email address has not been verified"})
+	}
+	if !user.HasPermission(database.PermUseApps) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "The account may not sign in to applications"})
+	}
+
+	accessToken, err := createAccessToken(db, user, clientID, sessionID, scope)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "server_error"})
+	}
+	idToken, err := createIDToken(user, clientID, sessionID, scope, nonce, authTime)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "server_error"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"access_token":  accessToken,
+		"token_type":    "Bearer",
+		"expires_in":    int(ACCESS_TOKEN_TTL.Seconds()),
+		"id_token":      idToken,
+		"refresh_token": refreshToken,
+		"scope":         scope,
+	})
+}
+
+// userInfo returns the claims about the user identified by a bearer access token.
+func userInfo(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		header := c.Request().Header.Get(echo.HeaderAuthorization)
+		tokenString, ok := strings.CutPrefix(header, "Bearer ")
+		if !ok {
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer error="invalid_token"`)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "invalid_token"})
+		}
+
+		claims, err := parseAccessToken(tokenString)
+		if err == nil {
+			_, err = activeSession(db, claims)
+		}
+		if err != nil {
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer error="invalid_token"`)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "invalid_token"})
+		}
+
+		// A disabled account keeps no access, even with a token issued before it
+		// was disabled.
+		user := &database.User{Id: claims["sub"].(string)}
+		if err := user.Read(db); err != nil || user.IsDisabled() {
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer error="invalid_token"`)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "invalid_token"})
+		}
+
+		info := map[string]interface{}{"sub": user.Id}
+		scope, _ := claims["scope"].(string)
+		if slices.Contains(strings.Fields(scope), "email") {
+			info["email"] = user.Email
+			info["email_verified"] = user.IsEmailVerified()
+		}
+		return c.JSON(http.StatusOK, info)
+	}
+}
+
+func createAccessToken(db *database.DB, user *database.User, clientID, sessionID, scope string) (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":       ISSUER,
+		"sub":       user.Id,
+		"aud":       clientID,
+		"sid":       sessionID,
+		"client_id": clientID,
+		"scope":     scope,
+		"iat":       now.Unix(),
+		"exp":       now.Add(ACCESS_TOKEN_TTL).Unix(),
+	}
+	for _, source := range accessTokenClaims {
+		if err := source(db, user, clientID, scope, claims); err != nil {
+			return "", err
+		}
+	}
+	return signToken(claims, accessTokenType)
+}
+
+func createIDToken(user *database.User, clientID, sessionID, scope, nonce string, authTime time.Time) (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":       ISSUER,
+		"sub":       user.Id,
+		"aud":       clientID,
+		"sid":       sessionID,
+		"iat":       now.Unix(),
+		"exp":       now.Add(idTokenTTL).Unix(),
+		"auth_time": authTime.Unix(),
+	}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	if slices.Contains(strings.Fields(scope), "email") {
+		claims["email"] = user.Email
+		claims["email_verified"] = user.IsEmailVerified()
+	}
+	return signToken(claims, "")
+}
+
+func parseAccessToken(tokenString string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if token.Header["typ"] != accessTokenType {
+			return nil, errors.New("not an access token")
+		}
+		return verificationKey(token)
+	}, validMethods, jwt.WithIssuer(ISSUER), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, err
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+	if _, ok := claims["sub"].(string); !ok {
+		return nil, errors.New("missing subject")
+	}
+	return claims, nil
+}
+
+// sessionUser resolves the user and session behind the login session cookie set
+// by `login`. An expired session token is renewed from the RefreshToken cookie
+// when possible.
+func sessionUser(c echo.Context, db *database.DB) (*database.User, *database.Session, error) {
+	cookie, err := c.Cookie("Token")
+	if err != nil {
+		return renewSession(c, db)
+	}
+
+	token, err := jwt.Parse(cookie.Value, sessionKey, validMethods, jwt.WithExpirationRequired())
+	if err != nil {
+		return renewSession(c, db)
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+	session, err := activeSession(db, claims)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	user := &database.User{Id: session.UserId}
+	if err := user.Read(db); err != nil {
+		return nil, nil, err
+	}
+	return user, session, nil
+}
+
+func redirectToLogin(c echo.Context) error {
+	params, _ := c.FormParams()
+	params.Del("prompt")
+
+	target := url.Values{}
+	target.Set("redirect", ISSUER+"/authorize?"+params.Encode())
+	return c.Redirect(http.StatusFound, appendQuery(LOGIN_URL, target))
+}
+
+func redirectWithError(c echo.Context, redirectURI, state, code, description string) error {
+	params := url.Values{}
+	params.Set("error", code)
+	params.Set("error_description", description)
+	if state != "" {
+		params.Set("state", state)
+	}
+	return c.Redirect(http.StatusFound, appendQuery(redirectURI, params))
+}
+
+func isValidRedirectURI(redirectURI string) bool {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		return false
+	}
+	return u.IsAbs() && u.Host != "" && u.Fragment == ""
+}
+
+func appendQuery(rawURL string, params url.Values) string {
+	if strings.Contains(rawURL, "?") {
+		return rawURL + "&" + params.Encode()
+	}
+	return rawURL + "?" + params.Encode()
+}
+
+// verifyCodeChallenge checks a PKCE code_verifier against the stored S256 challenge.
+func verifyCodeChallenge(verifier, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+// randomToken returns n random bytes encoded as unpadded base64url.
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken returns the hex SHA-256 of an opaque token, which is what gets stored
+// in the database in place of the token itself.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
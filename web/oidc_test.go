@@ -0,0 +1,396 @@
+package web
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/pragmahq/sso/database"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	e := echo.New()
+
+	// Create a test user with a login session
+	testUser := &database.User{
+		Id:          uuid.New().String(),
+		Email:       "oidc@example.com",
+		Password:    "password123",
+		Permissions: database.PermissionUser,
+	}
+	err := testUser.Create(testDB)
+	assert.NoError(t, err)
+
+	client := createTestClient(t)
+
+	session, err := createSessionToken(testUser, createTestSession(t, testUser))
+	assert.NoError(t, err)
+
+	verifier := strings.Repeat("v", 43)
+	sum := sha256.Sum256([]byte(verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {client.Id},
+		"redirect_uri":          {"https://app.example.com/callback"},
+		"scope":                 {"openid email"},
+		"state":                 {"xyz"},
+		"nonce":                 {"n-0S6"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	// Authorize
+	req := httptest.NewRequest(http.MethodGet, "/authorize?"+params.Encode(), nil)
+	req.AddCookie(&http.Cookie{Name: "Token", Value: session})
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	if !assert.NoError(t, authorize(testDB)(c)) || !assert.Equal(t, http.StatusFound, rec.Code) {
+		return
+	}
+	location, err := url.Parse(rec.Header().Get(echo.HeaderLocation))
+	assert.NoError(t, err)
+	assert.Equal(t, "xyz", location.Query().Get("state"))
+	code := location.Query().Get("code")
+	assert.NotEmpty(t, code)
+
+	// Exchange the code
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"client_id":     {client.Id},
+		"redirect_uri":  {"https://app.example.com/callback"},
+		"code_verifier": {verifier},
+	}
+	req = httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(form.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec = httptest.NewRecorder()
+	c = e.NewContext(req, rec)
+
+	var refreshToken string
+	if assert.NoError(t, exchangeToken(testDB)(c)) {
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		var response map[string]interface{}
+		err := json.Unmarshal(rec.Body.Bytes(), &response)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, response["access_token"])
+		refreshToken, _ = response["refresh_token"].(string)
+
+		claims := jwt.MapClaims{}
+		_, err = jwt.ParseWithClaims(response["id_token"].(string), claims, verificationKey, validMethods)
+		assert.NoError(t, err)
+		assert.Equal(t, testUser.Id, claims["sub"])
+		assert.Equal(t, "n-0S6", claims["nonce"])
+		assert.Equal(t, testUser.Email, claims["email"])
+	}
+
+	// A code can only be redeemed once, and redeeming it again revokes the
+	// tokens it was exchanged for
+	req = httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(form.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec = httptest.NewRecorder()
+	c = e.NewContext(req, rec)
+
+	if assert.NoError(t, exchangeToken(testDB)(c)) {
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	}
+	_, _, err = rotateRefreshToken(testDB, refreshToken, client.Id)
+	assert.Equal(t, errInvalidRefreshToken, err)
+
+	// Clean up
+	err = testUser.Delete(testDB)
+	assert.NoError(t, err)
+	err = client.Delete(testDB)
+	assert.NoError(t, err)
+}
+
+func TestAuthorizeWithoutSession(t *testing.T) {
+	e := echo.New()
+	client := createTestClient(t)
+	defer client.Delete(testDB)
+
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {client.Id},
+		"redirect_uri":          {"https://app.example.com/callback"},
+		"scope":                 {"openid"},
+		"state":                 {"xyz"},
+		"code_challenge":        {"challenge"},
+		"code_challenge_method": {"S256"},
+		"prompt":                {"none"},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/authorize?"+params.Encode(), nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	if assert.NoError(t, authorize(testDB)(c)) {
+		assert.Equal(t, http.StatusFound, rec.Code)
+
+		location, err := url.Parse(rec.Header().Get(echo.HeaderLocation))
+		assert.NoError(t, err)
+		assert.Equal(t, "login_required", location.Query().Get("error"))
+	}
+}
+
+func TestAuthorizeWithoutAppsPermission(t *testing.T) {
+	e := echo.New()
+	client := createTestClient(t)
+	defer client.Delete(testDB)
+
+	// Create a test user without any roles
+	testUser := &database.User{Id: uuid.New().String(), Email: "no-apps@example.com"}
+	err := testUser.Create(testDB)
+	assert.NoError(t, err)
+	session, err := createSessionToken(testUser, createTestSession(t, testUser))
+	assert.NoError(t, err)
+
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {client.Id},
+		"redirect_uri":          {"https://app.example.com/callback"},
+		"scope":                 {"openid"},
+		"code_challenge":        {"challenge"},
+		"code_challenge_method": {"S256"},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/authorize?"+params.Encode(), nil)
+	req.AddCookie(&http.Cookie{Name: "Token", Value: session})
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	if assert.NoError(t, authorize(testDB)(c)) {
+		assert.Equal(t, http.StatusFound, rec.Code)
+
+		location, err := url.Parse(rec.Header().Get(echo.HeaderLocation))
+		assert.NoError(t, err)
+		assert.Equal(t, "access_denied", location.Query().Get("error"))
+	}
+
+	// Clean up
+	err = testUser.Delete(testDB)
+	assert.NoError(t, err)
+}
+
+func TestDisabledUserCannotUseApps(t *testing.T) {
+	e := echo.New()
+	client := createTestClient(t)
+	defer client.Delete(testDB)
+
+	// Create a test user who is disabled while still signed in
+	testUser := &database.User{Id: uuid.New().String(), Email: "disabled-apps@example.com", Permissions: database.PermissionUser}
+	err := testUser.Create(testDB)
+	assert.NoError(t, err)
+	session := createTestSession(t, testUser)
+	sessionToken, err := createSessionToken(testUser, session)
+	assert.NoError(t, err)
+	accessToken, err := createAccessToken(testDB, testUser, client.Id, session.Id, "openid")
+	assert.NoError(t, err)
+	err = testUser.SetDisabled(testDB, true)
+	assert.NoError(t, err)
+
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {client.Id},
+		"redirect_uri":          {"https://app.example.com/callback"},
+		"scope":                 {"openid"},
+		"code_challenge":        {"challenge"},
+		"code_challenge_method": {"S256"},
+	}
+	req := httptest.NewRequest(http.MethodGet, "/authorize?"+params.Encode(), nil)
+	req.AddCookie(&http.Cookie{Name: "Token", Value: sessionToken})
+	rec := httptest.NewRecorder()
+
+	if assert.NoError(t, authorize(testDB)(e.NewContext(req, rec))) {
+		assert.Equal(t, http.StatusFound, rec.Code)
+
+		location, err := url.Parse(rec.Header().Get(echo.HeaderLocation))
+		assert.NoError(t, err)
+		assert.Equal(t, "access_denied", location.Query().Get("error"))
+	}
+
+	// Tokens issued before the account was disabled stop working too
+	req = httptest.NewRequest(http.MethodGet, "/userinfo", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+accessToken)
+	rec = httptest.NewRecorder()
+
+	if assert.NoError(t, userInfo(testDB)(e.NewContext(req, rec))) {
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	}
+
+	// Clean up
+	err = testUser.Delete(testDB)
+	assert.NoError(t, err)
+}
+
+func TestLegacyUserKeepsAccess(t *testing.T) {
+	e := echo.New()
+	client := createTestClient(t)
+	defer client.Delete(testDB)
+
+	// Create a test user as older versions did, with an empty permission mask
+	testUser := &database.User{Id: uuid.New().String(), Email: "legacy@example.com"}
+	err := testUser.Create(testDB)
+	assert.NoError(t, err)
+	_, err = testDB.Exec("ALTER TABLE users ADD COLUMN permissions bigint NOT NULL DEFAULT 0")
+	assert.NoError(t, err)
+
+	// Starting up migrates the mask to roles
+	db, err := database.InitDB()
+	if assert.NoError(t, err) {
+		db.Close()
+	}
+	err = testUser.Read(testDB)
+	assert.NoError(t, err)
+	assert.True(t, testUser.IsUser())
+
+	// The user can still sign in to applications
+	session := createTestSession(t, testUser)
+	token, err := createSessionToken(testUser, session)
+	assert.NoError(t, err)
+	verifier := strings.Repeat("v", 43)
+	sum := sha256.Sum256([]byte(verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {client.Id},
+		"redirect_uri":          {"https://app.example.com/callback"},
+		"scope":                 {"openid"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {"S256"},
+	}
+	req := httptest.NewRequest(http.MethodGet, "/authorize?"+params.Encode(), nil)
+	req.AddCookie(&http.Cookie{Name: "Token", Value: token})
+	rec := httptest.NewRecorder()
+	if assert.NoError(t, authorize(testDB)(e.NewContext(req, rec))) && assert.Equal(t, http.StatusFound, rec.Code) {
+		location, err := url.Parse(rec.Header().Get(echo.HeaderLocation))
+		assert.NoError(t, err)
+
+		form := url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {location.Query().Get("code")},
+			"client_id":     {client.Id},
+			"redirect_uri":  {"https://app.example.com/callback"},
+			"code_verifier": {verifier},
+		}
+		req = httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(form.Encode()))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		rec = httptest.NewRecorder()
+		if assert.NoError(t, exchangeToken(testDB)(e.NewContext(req, rec))) {
+			assert.Equal(t, http.StatusOK, rec.Code)
+		}
+	}
+
+	// And invite people
+	rec = postJSON(createInvite(testDB), CreateInviteBody{}, session)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+
+	// Clean up
+	_, err = testDB.Exec("ALTER TABLE users DROP COLUMN legacy_permissions")
+	assert.NoError(t, err)
+	_, err = testDB.Model((*database.InviteCode)(nil)).Where("generated_by = ?", testUser.Id).Delete()
+	assert.NoError(t, err)
+	err = testUser.Delete(testDB)
+	assert.NoError(t, err)
+}
+
+func TestAuthorizeUnregisteredRedirect(t *testing.T) {
+	e := echo.New()
+	client := createTestClient(t)
+	defer client.Delete(testDB)
+
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {client.Id},
+		"redirect_uri":          {"https://evil.example.com/callback"},
+		"scope":                 {"openid"},
+		"code_challenge":        {"challenge"},
+		"code_challenge_method": {"S256"},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/authorize?"+params.Encode(), nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	if assert.NoError(t, authorize(testDB)(c)) {
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Empty(t, rec.Header().Get(echo.HeaderLocation))
+	}
+}
+
+func createTestClient(t *testing.T) *database.Client {
+	client := &database.Client{
+		Id:           uuid.New().String(),
+		Name:         "Test App",
+		Public:       true,
+		RedirectURIs: []string{"https://app.example.com/callback"},
+		Scopes:       []string{"openid", "email"},
+		CreatedAt:    time.Now(),
+		UpdatedAt:    time.Now(),
+	}
+	err := client.Create(testDB)
+	assert.NoError(t, err)
+	return client
+}
+
+func TestAccessTokenRoleClaims(t *testing.T) {
+	// Create a test user with roles in two applications and the sign-in service
+	testUser := &database.User{
+		Id:          uuid.New().String(),
+		Email:       "claims@example.com",
+		Permissions: database.PermissionUser,
+	}
+	err := testUser.Create(testDB)
+	assert.NoError(t, err)
+	docs := createTestClient(t)
+	other := createTestClient(t)
+
+	roles := []*database.Role{
+		{Id: uuid.New().String(), ClientId: docs.Id, Name: "docs-editor", Permissions: []string{"docs:read", "docs:write"}},
+		{Id: uuid.New().String(), ClientId: docs.Id, Name: "docs-reader", Permissions: []string{"docs:read"}},
+		{Id: uuid.New().String(), ClientId: other.Id, Name: "billing-admin", Permissions: []string{"billing:manage"}},
+	}
+	for _, role := range roles {
+		role.CreatedAt = time.Now()
+		err = role.Create(testDB)
+		assert.NoError(t, err)
+		err = database.AssignRole(testDB, testUser.Id, role.Id)
+		assert.NoError(t, err)
+	}
+	err = testUser.Read(testDB)
+	assert.NoError(t, err)
+
+	token, err := createAccessToken(testDB, testUser, docs.Id, "session", "openid")
+	assert.NoError(t, err)
+	claims, err := parseAccessToken(token)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"docs-editor", "docs-reader"}, claims["roles"])
+	assert.Equal(t, []interface{}{"docs:read", "docs:write"}, claims["entitlements"])
+	assert.Equal(t, []interface{}{}, claims["groups"])
+
+	// Application roles grant nothing in the sign-in service
+	assert.False(t, testUser.HasPermission("docs:read"))
+	assert.True(t, testUser.IsUser())
+
+	// Clean up
+	for _, role := range roles {
+		err = role.Delete(testDB)
+		assert.NoError(t, err)
+	}
+	for _, client := range []*database.Client{docs, other} {
+		err = client.Delete(testDB)
+		assert.NoError(t, err)
+	}
+	err = testUser.Delete(testDB)
+	assert.NoError(t, err)
+}
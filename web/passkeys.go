@@ -0,0 +1,378 @@
+package web
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/pragmahq/sso/database"
+	"github.com/pragmahq/sso/webauthn"
+)
+
+const passkeyChallengeTTL = 5 * time.Minute
+
+// WEBAUTHN_RP_ID is the domain passkeys are bound to and WEBAUTHN_ORIGINS the
+// comma-separated origins the login page is served from. Both default to the
+// origin of LOGIN_URL.
+var (
+	WEBAUTHN_RP_ID   = envString("WEBAUTHN_RP_ID", loginOrigin().Hostname())
+	WEBAUTHN_ORIGINS = envString("WEBAUTHN_ORIGINS", loginOrigin().String())
+)
+
+var relyingParty = &webauthn.RelyingParty{
+	ID:      WEBAUTHN_RP_ID,
+	Name:    MFA_ISSUER,
+	Origins: strings.Split(WEBAUTHN_ORIGINS, ","),
+	Timeout: passkeyChallengeTTL,
+}
+
+type PasskeyBeginBody struct {
+	MFAToken string `json:"mfaToken"`
+}
+
+type PasskeyLoginBody struct {
+	ChallengeId string                       `json:"challengeId"`
+	Credential  webauthn.AssertionCredential `json:"credential"`
+}
+
+type PasskeyRegisterBody struct {
+	ChallengeId string                          `json:"challengeId"`
+	Name        string                          `json:"name"`
+	Credential  webauthn.RegistrationCredential `json:"credential"`
+}
+
+type PasskeyRenameBody struct {
+	Name string `json:"name"`
+}
+
+func registerPasskeyRoutes(g *echo.Group, db *database.DB) {
+	g.GET("/passkeys", listPasskeys(db))
+	g.POST("/passkeys/register/begin", beginPasskeyRegistration(db))
+	g.POST("/passkeys/register/finish", finishPasskeyRegistration(db))
+	g.PATCH("/passkeys/:id", renamePasskey(db))
+	g.DELETE("/passkeys/:id", deletePasskey(db))
+}
+
+// beginPasskeyLogin starts an authentication ceremony. With an MFA token it asks
+// for one of that user's passkeys as the second factor; without one it starts a
+// passwordless login where the browser offers any passkey saved for this site.
+func beginPasskeyLogin(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req PasskeyBeginBody
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		}
+
+		if req.MFAToken == "" {
+			challenge, err := startCeremony(db, "", database.CeremonyLogin)
+			if err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to start login"})
+			}
+			return c.JSON(http.StatusOK, map[string]interface{}{
+				"challengeId": challenge.Id,
+				"publicKey":   relyingParty.RequestOptions(challenge.Challenge, nil, webauthn.VerificationRequired),
+			})
+		}
+
+		user, err := parseMFAToken(db, req.MFAToken)
+		if err != nil {
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Login expired, please sign in again"})
+		}
+		passkeys, err := database.GetUserPasskeys(db, user.Id)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		if len(passkeys) == 0 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "No passkeys registered"})
+		}
+
+		challenge, err := startCeremony(db, user.Id, database.CeremonyMFA)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to start login"})
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"challengeId": challenge.Id,
+			"publicKey":   relyingParty.RequestOptions(challenge.Challenge, credentialDescriptors(passkeys), webauthn.VerificationDiscouraged),
+		})
+	}
+}
+
+// finishPasskeyLogin signs the user in with a passkey alone. The passkey must have
+// verified the user (PIN or biometrics), which makes it a second factor in itself,
+// so no TOTP code is asked for.
+func finishPasskeyLogin(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req PasskeyLoginBody
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		}
+
+		user, status, msg := verifyPasskey(db, &req, database.CeremonyLogin, "")
+		if user == nil {
+			return c.JSON(status, map[string]string{"error": msg})
+		}
+		return completeLogin(c, db, user)
+	}
+}
+
+func listPasskeys(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		session := c.Get("session").(*database.Session)
+
+		passkeys, err := database.GetUserPasskeys(db, session.UserId)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+
+		response := []map[string]interface{}{}
+		for _, passkey := range passkeys {
+			response = append(response, passkeyJSON(passkey))
+		}
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+// beginPasskeyRegistration starts registering a new passkey. Like enrolling an
+// authenticator app it requires the password, and a TOTP code if one is set up.
+func beginPasskeyRegistration(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, status, msg := reauthenticate(c, db)
+		if user == nil {
+			return c.JSON(status, map[string]string{"error": msg})
+		}
+
+		passkeys, err := database.GetUserPasskeys(db, user.Id)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+
+		challenge, err := startCeremony(db, user.Id, database.CeremonyRegistration)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to start registration"})
+		}
+
+		account := webauthn.User{ID: []byte(user.Id), Name: user.Email, DisplayName: user.Email}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"challengeId": challenge.Id,
+			"publicKey":   relyingParty.CreationOptions(account, challenge.Challenge, credentialDescriptors(passkeys)),
+		})
+	}
+}
+
+func finishPasskeyRegistration(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		session := c.Get("session").(*database.Session)
+
+		var req PasskeyRegisterBody
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		}
+
+		challenge, err := database.ConsumeWebAuthnChallenge(db, req.ChallengeId, database.CeremonyRegistration)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		if challenge == nil || challenge.UserId != session.UserId {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Registration expired, please try again"})
+		}
+
+		cred, err := relyingParty.VerifyRegistration(&req.Credential, challenge.Challenge, false)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid passkey"})
+		}
+
+		id := base64.RawURLEncoding.EncodeToString(cred.ID)
+		existing, err := database.GetPasskey(db, id)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		if existing != nil {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Passkey already registered"})
+		}
+
+		name := strings.TrimSpace(req.Name)
+		if name == "" {
+			name = describeDevice(c.Request().UserAgent())
+		}
+
+		passkey := &database.Passkey{
+			Id:         id,
+			UserId:     session.UserId,
+			Name:       name,
+			PublicKey:  cred.PublicKey,
+			Algorithm:  cred.Algorithm,
+			SignCount:  int64(cred.SignCount),
+			Transports: cred.Transports,
+			BackedUp:   cred.BackedUp,
+			CreatedAt:  time.Now(),
+		}
+		if err := passkey.Create(db); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+
+		return c.JSON(http.StatusCreated, passkeyJSON(passkey))
+	}
+}
+
+func renamePasskey(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		session := c.Get("session").(*database.Session)
+
+		var req PasskeyRenameBody
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		}
+		name := strings.TrimSpace(req.Name)
+		if name == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Name is required"})
+		}
+
+		passkey, err := database.GetPasskey(db, c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		if passkey == nil || passkey.UserId != session.UserId {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Passkey not found"})
+		}
+
+		passkey.Name = name
+		if err := passkey.Update(db); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		return c.JSON(http.StatusOK, passkeyJSON(passkey))
+	}
+}
+
+func deletePasskey(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, status, msg := reauthenticate(c, db)
+		if user == nil {
+			return c.JSON(status, map[string]string{"error": msg})
+		}
+
+		passkey, err := database.GetPasskey(db, c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		if passkey == nil || passkey.UserId != user.Id {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Passkey not found"})
+		}
+
+		if err := passkey.Delete(db); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "Passkey removed"})
+	}
+}
+
+// verifyPasskey checks an assertion against a challenge issued for ceremony. For
+// second-factor logins userID is the user who entered their password and the
+// passkey must be theirs. On success the passkey's counter is advanced and its
+// owner returned; on failure the user is nil and the status and message say why.
+func verifyPasskey(db *database.DB, req *PasskeyLoginBody, ceremony, userID string) (*database.User, int, string) {
+	challenge, err := database.ConsumeWebAuthnChallenge(db, req.ChallengeId, ceremony)
+	if err != nil {
+		return nil, http.StatusInternalServerError, "Database error"
+	}
+	if challenge == nil || challenge.UserId != userID {
+		return nil, http.StatusUnauthorized, "Login expired, please try again"
+	}
+
+	cred := &req.Credential
+	id := cred.ID
+	if len(cred.RawID) > 0 {
+		id = base64.RawURLEncoding.EncodeToString(cred.RawID)
+	}
+	passkey, err := database.GetPasskey(db, id)
+	if err != nil {
+		return nil, http.StatusInternalServerError, "Database error"
+	}
+	if passkey == nil || (userID != "" && passkey.UserId != userID) {
+		return nil, http.StatusUnauthorized, "Invalid passkey"
+	}
+	if len(cred.Response.UserHandle) > 0 && string(cred.Response.UserHandle) != passkey.UserId {
+		return nil, http.StatusUnauthorized, "Invalid passkey"
+	}
+
+	requireUV := ceremony == database.CeremonyLogin
+	assertion, err := relyingParty.VerifyAssertion(cred, challenge.Challenge, passkey.PublicKey, uint32(passkey.SignCount), requireUV)
+	if err != nil {
+		return nil, http.StatusUnauthorized, "Invalid passkey"
+	}
+
+	ok, err := passkey.UseSignCount(db, int64(assertion.SignCount), assertion.BackedUp)
+	if err != nil {
+		return nil, http.StatusInternalServerError, "Database error"
+	}
+	if !ok {
+		return nil, http.StatusUnauthorized, "Invalid passkey"
+	}
+
+	user := &database.User{Id: passkey.UserId}
+	if err := user.Read(db); err != nil {
+		return nil, http.StatusUnauthorized, "Invalid passkey"
+	}
+	return user, http.StatusOK, ""
+}
+
+// startCeremony stores a fresh challenge for a registration or login ceremony.
+func startCeremony(db *database.DB, userID, ceremony string) (*database.WebAuthnChallenge, error) {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	record := &database.WebAuthnChallenge{
+		Id:        uuid.New().String(),
+		UserId:    userID,
+		Ceremony:  ceremony,
+		Challenge: challenge,
+		CreatedAt: now,
+		ExpiresAt: now.Add(passkeyChallengeTTL),
+	}
+	if err := record.Create(db); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func credentialDescriptors(passkeys []*database.Passkey) []webauthn.CredentialDescriptor {
+	descriptors := make([]webauthn.CredentialDescriptor, 0, len(passkeys))
+	for _, passkey := range passkeys {
+		id, err := base64.RawURLEncoding.DecodeString(passkey.Id)
+		if err != nil {
+			continue
+		}
+		descriptors = append(descriptors, webauthn.CredentialDescriptor{
+			Type:       "public-key",
+			ID:         id,
+			Transports: passkey.Transports,
+		})
+	}
+	return descriptors
+}
+
+func passkeyJSON(passkey *database.Passkey) map[string]interface{} {
+	return map[string]interface{}{
+		"id":         passkey.Id,
+		"name":       passkey.Name,
+		"backedUp":   passkey.BackedUp,
+		"createdAt":  passkey.CreatedAt,
+		"lastUsedAt": passkey.LastUsedAt,
+	}
+}
+
+// loginOrigin is the origin of the login page, which passkeys are scoped to unless
+// configured otherwise.
+func loginOrigin() *url.URL {
+	u, err := url.Parse(LOGIN_URL)
+	if err != nil || u.Host == "" {
+		return &url.URL{Scheme: "http", Host: "localhost:3000"}
+	}
+	return &url.URL{Scheme: u.Scheme, Host: u.Host}
+}
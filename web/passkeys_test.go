@@ -0,0 +1,182 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/pragmahq/sso/database"
+	"github.com/pragmahq/sso/webauthn"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func postJSON(handler echo.HandlerFunc, body interface{}, session *database.Session) *httptest.ResponseRecorder {
+	payload, _ := json.Marshal(body)
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(string(payload)))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+
+	c := echo.New().NewContext(req, rec)
+	if session != nil {
+		c.Set("session", session)
+	}
+	handler(c)
+	return rec
+}
+
+func TestPasskeyRegistrationAndLogin(t *testing.T) {
+	// Create a test user with a session
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	testUser := &database.User{
+		Id:       uuid.New().String(),
+		Email:    "passkey@example.com",
+		Password: string(hash),
+	}
+	err = testUser.Create(testDB)
+	assert.NoError(t, err)
+	session := createTestSession(t, testUser)
+
+	authenticator, err := webauthn.NewAuthenticator()
+	assert.NoError(t, err)
+	origin := relyingParty.Origins[0]
+
+	// Register a passkey
+	rec := postJSON(beginPasskeyRegistration(testDB), ReauthBody{Password: "password123"}, session)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var creation struct {
+		ChallengeId string                   `json:"challengeId"`
+		PublicKey   webauthn.CreationOptions `json:"publicKey"`
+	}
+	err = json.Unmarshal(rec.Body.Bytes(), &creation)
+	assert.NoError(t, err)
+
+	credential, err := authenticator.Register(&creation.PublicKey, origin)
+	assert.NoError(t, err)
+	rec = postJSON(finishPasskeyRegistration(testDB), PasskeyRegisterBody{
+		ChallengeId: creation.ChallengeId,
+		Name:        "Test key",
+		Credential:  *credential,
+	}, session)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+
+	passkeys, err := database.GetUserPasskeys(testDB, testUser.Id)
+	assert.NoError(t, err)
+	if assert.Len(t, passkeys, 1) {
+		assert.Equal(t, "Test key", passkeys[0].Name)
+	}
+
+	// The password alone is no longer enough
+	rec = postJSON(login(testDB), ReqBody{Email: testUser.Email, Password: "password123"}, nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "mfa_required")
+
+	// Passwordless login with the passkey
+	rec = postJSON(beginPasskeyLogin(testDB), PasskeyBeginBody{}, nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var request struct {
+		ChallengeId string                  `json:"challengeId"`
+		PublicKey   webauthn.RequestOptions `json:"publicKey"`
+	}
+	err = json.Unmarshal(rec.Body.Bytes(), &request)
+	assert.NoError(t, err)
+
+	assertion, err := authenticator.Assert(&request.PublicKey, origin)
+	assert.NoError(t, err)
+	loginBody := PasskeyLoginBody{ChallengeId: request.ChallengeId, Credential: *assertion}
+	rec = postJSON(finishPasskeyLogin(testDB), loginBody, nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Header().Get("Set-Cookie"), "Token=")
+
+	// A challenge can only be answered once
+	rec = postJSON(finishPasskeyLogin(testDB), loginBody, nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// Replaying an old signature counter is rejected
+	rec = postJSON(beginPasskeyLogin(testDB), PasskeyBeginBody{}, nil)
+	err = json.Unmarshal(rec.Body.Bytes(), &request)
+	assert.NoError(t, err)
+	authenticator.SignCount = 0
+	assertion, err = authenticator.Assert(&request.PublicKey, origin)
+	assert.NoError(t, err)
+	rec = postJSON(finishPasskeyLogin(testDB), PasskeyLoginBody{ChallengeId: request.ChallengeId, Credential: *assertion}, nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// Clean up
+	for _, passkey := range passkeys {
+		err = passkey.Delete(testDB)
+		assert.NoError(t, err)
+	}
+	err = testUser.Delete(testDB)
+	assert.NoError(t, err)
+}
+
+func TestPasskeyAsSecondFactor(t *testing.T) {
+	// Create a test user with a registered passkey
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	testUser := &database.User{
+		Id:       uuid.New().String(),
+		Email:    "passkey-mfa@example.com",
+		Password: string(hash),
+	}
+	err = testUser.Create(testDB)
+	assert.NoError(t, err)
+	session := createTestSession(t, testUser)
+
+	authenticator, err := webauthn.NewAuthenticator()
+	assert.NoError(t, err)
+	origin := relyingParty.Origins[0]
+
+	rec := postJSON(beginPasskeyRegistration(testDB), ReauthBody{Password: "password123"}, session)
+	var creation struct {
+		ChallengeId string                   `json:"challengeId"`
+		PublicKey   webauthn.CreationOptions `json:"publicKey"`
+	}
+	err = json.Unmarshal(rec.Body.Bytes(), &creation)
+	assert.NoError(t, err)
+	credential, err := authenticator.Register(&creation.PublicKey, origin)
+	assert.NoError(t, err)
+	rec = postJSON(finishPasskeyRegistration(testDB), PasskeyRegisterBody{ChallengeId: creation.ChallengeId, Credential: *credential}, session)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+
+	// Sign in with the password, then the passkey
+	rec = postJSON(login(testDB), ReqBody{Email: testUser.Email, Password: "password123"}, nil)
+	var response map[string]string
+	err = json.Unmarshal(rec.Body.Bytes(), &response)
+	assert.NoError(t, err)
+
+	rec = postJSON(beginPasskeyLogin(testDB), PasskeyBeginBody{MFAToken: response["mfaToken"]}, nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var request struct {
+		ChallengeId string                  `json:"challengeId"`
+		PublicKey   webauthn.RequestOptions `json:"publicKey"`
+	}
+	err = json.Unmarshal(rec.Body.Bytes(), &request)
+	assert.NoError(t, err)
+	assert.Len(t, request.PublicKey.AllowCredentials, 1)
+
+	assertion, err := authenticator.Assert(&request.PublicKey, origin)
+	assert.NoError(t, err)
+	rec = postJSON(loginMFA(testDB), MFALoginBody{
+		MFAToken: response["mfaToken"],
+		Passkey:  &PasskeyLoginBody{ChallengeId: request.ChallengeId, Credential: *assertion},
+	}, nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Header().Get("Set-Cookie"), "Token=")
+
+	// Clean up
+	passkeys, err := database.GetUserPasskeys(testDB, testUser.Id)
+	assert.NoError(t, err)
+	for _, passkey := range passkeys {
+		err = passkey.Delete(testDB)
+		assert.NoError(t, err)
+	}
+	err = testUser.Delete(testDB)
+	assert.NoError(t, err)
+}
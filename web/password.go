@@ -0,0 +1,243 @@
+package web
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/labstack/echo/v4"
+	"github.com/pragmahq/sso/database"
+	"github.com/pragmahq/sso/passwords"
+)
+
+var (
+	// PASSWORD_RESET_URL is the frontend page reset links point to. The token is
+	// appended as the `token` query parameter.
+	PASSWORD_RESET_URL = envString("PASSWORD_RESET_URL", loginOrigin().String()+"/reset-password")
+	PASSWORD_RESET_TTL = envDuration("PASSWORD_RESET_TTL", time.Hour)
+
+	PASSWORD_MIN_LENGTH = envInt("PASSWORD_MIN_LENGTH", 8)
+	PASSWORD_MAX_LENGTH = envInt("PASSWORD_MAX_LENGTH", passwords.DefaultMaxLength)
+	PASSWORD_BLOCKLIST  = envBool("PASSWORD_BLOCKLIST", true)
+
+	// Argon2id cost for new hashes. Raising them upgrades existing hashes as users
+	// sign in. PASSWORD_ARGON2_MEMORY is in KiB.
+	PASSWORD_ARGON2_MEMORY      = envInt("PASSWORD_ARGON2_MEMORY", int(passwords.DefaultArgon2Params().Memory))
+	PASSWORD_ARGON2_ITERATIONS  = envInt("PASSWORD_ARGON2_ITERATIONS", int(passwords.DefaultArgon2Params().Iterations))
+	PASSWORD_ARGON2_PARALLELISM = envInt("PASSWORD_ARGON2_PARALLELISM", int(passwords.DefaultArgon2Params().Parallelism))
+)
+
+var passwordHasher = passwords.NewHasher(passwords.Argon2Params{
+	Memory:      uint32(PASSWORD_ARGON2_MEMORY),
+	Iterations:  uint32(PASSWORD_ARGON2_ITERATIONS),
+	Parallelism: uint8(PASSWORD_ARGON2_PARALLELISM),
+	SaltLength:  passwords.DefaultArgon2Params().SaltLength,
+	KeyLength:   passwords.DefaultArgon2Params().KeyLength,
+})
+
+var passwordPolicy = &passwords.Policy{
+	MinLength:     PASSWORD_MIN_LENGTH,
+	MaxLength:     PASSWORD_MAX_LENGTH,
+	Blocklist:     PASSWORD_BLOCKLIST,
+	DisallowEmail: true,
+}
+
+type ForgotPasswordBody struct {
+	Email string `json:"email"`
+}
+
+type ResetPasswordBody struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type ChangePasswordBody struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+	Code            string `json:"code"`
+}
+
+func registerPasswordRoutes(r *echo.Group, d *echo.Group, db *database.DB) {
+	r.POST("/password/forgot", forgotPassword(db))
+	r.POST("/password/reset", resetPassword(db))
+	d.POST("/password", changePassword(db))
+}
+
+// weakPassword returns the error response for a password the policy rejects, or
+// nil if it is acceptable. Every broken rule is listed under "reasons" so forms
+// can show them all at once.
+func weakPassword(password, email string) map[string]interface{} {
+	violations := passwordPolicy.Check(password, email)
+	if len(violations) == 0 {
+		return nil
+	}
+	return map[string]interface{}{
+		"error":   "Password does not meet the requirements",
+		"reasons": violations,
+	}
+}
+
+// forgotPassword emails a reset link if an account exists for the address. The
+// response is the same either way so it cannot be used to find out who has an
+// account. Requesting a new link invalidates earlier ones.
+func forgotPassword(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req ForgotPasswordBody
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		}
+
+		response := map[string]string{"message": "If an account exists for that address, a reset link has been sent"}
+
+		user, err := database.GetUserByEmail(db, req.Email)
+		if err != nil {
+			return c.JSON(http.StatusOK, response)
+		}
+
+		if status, msg := sendPasswordReset(c, db, user); msg != "" {
+			return c.JSON(status, map[string]string{"error": msg})
+		}
+
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+// sendPasswordReset emails user a new reset link, invalidating earlier ones. It
+// returns the status and message of the error response on failure.
+func sendPasswordReset(c echo.Context, db *database.DB, user *database.User) (int, string) {
+	if err := database.ExpirePasswordResetTokens(db, user.Id); err != nil {
+		return http.StatusInternalServerError, "Database error"
+	}
+
+	token, err := randomToken(32)
+	if err != nil {
+		return http.StatusInternalServerError, "Failed to generate token"
+	}
+	now := time.Now()
+	reset := &database.PasswordResetToken{
+		Id:        hashToken(token),
+		UserId:    user.Id,
+		CreatedAt: now,
+		ExpiresAt: now.Add(PASSWORD_RESET_TTL),
+	}
+	email, err := newEmail("password_reset", user.Email, map[string]interface{}{
+		"Link":    appendQuery(PASSWORD_RESET_URL, url.Values{"token": {token}}),
+		"Expires": PASSWORD_RESET_TTL.String(),
+	})
+	if err != nil {
+		return http.StatusInternalServerError, "Failed to send email"
+	}
+
+	err = db.RunInTransaction(c.Request().Context(), func(tx *pg.Tx) error {
+		if _, err := tx.Model(reset).Insert(); err != nil {
+			return err
+		}
+		_, err := tx.Model(email).Insert()
+		return err
+	})
+	if err != nil {
+		return http.StatusInternalServerError, "Database error"
+	}
+	notifyMailer()
+	return 0, ""
+}
+
+// resetPassword sets a new password using a token from a reset email. Every
+// session of the user is revoked, so whoever knew the old password is signed out.
+func resetPassword(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req ResetPasswordBody
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		}
+
+		reset, err := database.GetPasswordResetToken(db, hashToken(req.Token))
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		if reset == nil || reset.UsedAt != nil || reset.IsExpired() {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid or expired reset link"})
+		}
+
+		user := &database.User{Id: reset.UserId}
+		if err := user.Read(db); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid or expired reset link"})
+		}
+		if resp := weakPassword(req.Password, user.Email); resp != nil {
+			return c.JSON(http.StatusBadRequest, resp)
+		}
+
+		hashedPassword, err := passwordHasher.Hash(req.Password)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to hash password"})
+		}
+
+		ok, err := reset.Consume(db)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		if !ok {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid or expired reset link"})
+		}
+
+		user.Password = hashedPassword
+		_, err = db.Model(user).Set("password = ?password").WherePK().Update()
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+
+		if err := database.ExpirePasswordResetTokens(db, user.Id); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		if err := database.RevokeSessions(db, user.Id, "", ""); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to revoke sessions"})
+		}
+
+		return c.JSON(http.StatusOK, map[string]string{"message": "Password has been reset"})
+	}
+}
+
+// changePassword sets a new password for the signed-in user after checking the
+// current one. Other sessions are signed out; the one making the change is kept.
+func changePassword(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		session := c.Get("session").(*database.Session)
+
+		var req ChangePasswordBody
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		}
+
+		user, status, msg := checkReauth(c, db, ReauthBody{Password: req.CurrentPassword, Code: req.Code})
+		if user == nil {
+			return c.JSON(status, map[string]string{"error": msg})
+		}
+		if resp := weakPassword(req.NewPassword, user.Email); resp != nil {
+			return c.JSON(http.StatusBadRequest, resp)
+		}
+		if req.NewPassword == req.CurrentPassword {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "New password must be different"})
+		}
+
+		hashedPassword, err := passwordHasher.Hash(req.NewPassword)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to hash password"})
+		}
+
+		user.Password = hashedPassword
+		_, err = db.Model(user).Set("password = ?password").WherePK().Update()
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+
+		if err := database.ExpirePasswordResetTokens(db, user.Id); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		if err := database.RevokeSessions(db, user.Id, "", session.Id); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to revoke sessions"})
+		}
+
+		return c.JSON(http.StatusOK, map[string]string{"message": "Password changed"})
+	}
+}
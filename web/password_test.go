@@ -0,0 +1,198 @@
+package web
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/pragmahq/sso/database"
+	"github.com/pragmahq/sso/mailer"
+	"github.com/pragmahq/sso/passwords"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+var mailedTokenPattern = regexp.MustCompile(`token=([A-Za-z0-9_-]+)`)
+
+// mailedToken extracts the token from the link in an email.
+func mailedToken(t *testing.T, msg *mailer.Message) string {
+	if !assert.NotNil(t, msg) {
+		return ""
+	}
+	match := mailedTokenPattern.FindStringSubmatch(msg.Text)
+	if !assert.Len(t, match, 2) {
+		return ""
+	}
+	return match[1]
+}
+
+func TestPasswordReset(t *testing.T) {
+	captured := &mailer.CaptureMailer{}
+	mail = captured
+
+	// Create a test user with a session
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	testUser := &database.User{
+		Id:       uuid.New().String(),
+		Email:    "reset@example.com",
+		Password: string(hash),
+	}
+	err = testUser.Create(testDB)
+	assert.NoError(t, err)
+	session := createTestSession(t, testUser)
+
+	// Unknown addresses get the same answer and no email
+	rec := postJSON(forgotPassword(testDB), ForgotPasswordBody{Email: "nobody@example.com"}, nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	unknown := rec.Body.String()
+	assert.Nil(t, captured.Last("nobody@example.com"))
+
+	rec = postJSON(forgotPassword(testDB), ForgotPasswordBody{Email: testUser.Email}, nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, unknown, rec.Body.String())
+	_, err = deliverOutbox(context.Background(), testDB)
+	assert.NoError(t, err)
+	token := mailedToken(t, captured.Last(testUser.Email))
+
+	// The new password has to follow the policy
+	rec = postJSON(resetPassword(testDB), ResetPasswordBody{Token: token, Password: "short"}, nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), passwords.ReasonTooShort)
+
+	rec = postJSON(resetPassword(testDB), ResetPasswordBody{Token: token, Password: "newpassword456"}, nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	err = testUser.Read(testDB)
+	assert.NoError(t, err)
+	assert.True(t, checkPassword(testUser, "newpassword456"))
+
+	// Existing sessions are signed out
+	current, err := database.GetSession(testDB, session.Id)
+	assert.NoError(t, err)
+	assert.False(t, current.IsActive())
+
+	// The link only works once
+	rec = postJSON(resetPassword(testDB), ResetPasswordBody{Token: token, Password: "another789"}, nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// Clean up
+	_, err = testDB.Model((*database.PasswordResetToken)(nil)).Where("user_id = ?", testUser.Id).Delete()
+	assert.NoError(t, err)
+	err = testUser.Delete(testDB)
+	assert.NoError(t, err)
+}
+
+func TestChangePassword(t *testing.T) {
+	// Create a test user with two sessions
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	testUser := &database.User{
+		Id:       uuid.New().String(),
+		Email:    "change-password@example.com",
+		Password: string(hash),
+	}
+	err = testUser.Create(testDB)
+	assert.NoError(t, err)
+	session := createTestSession(t, testUser)
+	other := createTestSession(t, testUser)
+
+	// The current password is required
+	rec := postJSON(changePassword(testDB), ChangePasswordBody{CurrentPassword: "wrong", NewPassword: "newpassword456"}, session)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// Weak passwords are rejected with every reason
+	rec = postJSON(changePassword(testDB), ChangePasswordBody{CurrentPassword: "password123", NewPassword: "qwerty"}, session)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	var response struct {
+		Reasons []passwords.Violation `json:"reasons"`
+	}
+	err = json.Unmarshal(rec.Body.Bytes(), &response)
+	assert.NoError(t, err)
+	if assert.Len(t, response.Reasons, 2) {
+		assert.Equal(t, passwords.ReasonTooShort, response.Reasons[0].Reason)
+		assert.Equal(t, passwords.ReasonCommon, response.Reasons[1].Reason)
+	}
+
+	rec = postJSON(changePassword(testDB), ChangePasswordBody{CurrentPassword: "password123", NewPassword: testUser.Email}, session)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), passwords.ReasonMatchesEmail)
+
+	rec = postJSON(changePassword(testDB), ChangePasswordBody{CurrentPassword: "password123", NewPassword: "newpassword456"}, session)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	err = testUser.Read(testDB)
+	assert.NoError(t, err)
+	assert.True(t, checkPassword(testUser, "newpassword456"))
+
+	// Only the other session is signed out
+	current, err := database.GetSession(testDB, session.Id)
+	assert.NoError(t, err)
+	assert.True(t, current.IsActive())
+	current, err = database.GetSession(testDB, other.Id)
+	assert.NoError(t, err)
+	assert.False(t, current.IsActive())
+
+	// Clean up
+	err = testUser.Delete(testDB)
+	assert.NoError(t, err)
+}
+
+func TestLoginUpgradesPasswordHash(t *testing.T) {
+	// Create a test user with a bcrypt hash
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	testUser := &database.User{
+		Id:       uuid.New().String(),
+		Email:    "rehash@example.com",
+		Password: string(hash),
+	}
+	err = testUser.Create(testDB)
+	assert.NoError(t, err)
+
+	// A failed login leaves the hash alone
+	rec := postJSON(login(testDB), ReqBody{Email: testUser.Email, Password: "wrong"}, nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	err = testUser.Read(testDB)
+	assert.NoError(t, err)
+	assert.Equal(t, string(hash), testUser.Password)
+
+	rec = postJSON(login(testDB), ReqBody{Email: testUser.Email, Password: "password123"}, nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	err = testUser.Read(testDB)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(testUser.Password, "$argon2id$"))
+	assert.True(t, checkPassword(testUser, "password123"))
+
+	// Clean up
+	err = testUser.Delete(testDB)
+	assert.NoError(t, err)
+}
+
+func TestLoginWithImportedHash(t *testing.T) {
+	// Create a test user with a hash imported from another system
+	salt := []byte("imported-salt")
+	key := pbkdf2.Key([]byte("password123"), salt, 1000, 32, sha256.New)
+	testUser := &database.User{
+		Id:       uuid.New().String(),
+		Email:    "imported@example.com",
+		Password: passwords.EncodePbkdf2("sha256", 1000, salt, key),
+	}
+	err := testUser.Create(testDB)
+	assert.NoError(t, err)
+
+	rec := postJSON(login(testDB), ReqBody{Email: testUser.Email, Password: "password123"}, nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	err = testUser.Read(testDB)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(testUser.Password, "$argon2id$"))
+
+	// Clean up
+	err = testUser.Delete(testDB)
+	assert.NoError(t, err)
+}
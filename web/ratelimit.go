@@ -0,0 +1,120 @@
+package web
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pragmahq/sso/database"
+	"github.com/pragmahq/sso/ratelimit"
+)
+
+// Limits for the public auth endpoints, written as "<n>/<period>" or "off".
+var (
+	RATE_LIMIT_LOGIN         = envLimit("RATE_LIMIT_LOGIN", "30/1m")
+	RATE_LIMIT_LOGIN_EMAIL   = envLimit("RATE_LIMIT_LOGIN_EMAIL", "10/1m")
+	RATE_LIMIT_REGISTER      = envLimit("RATE_LIMIT_REGISTER", "10/1h")
+	RATE_LIMIT_INVITE        = envLimit("RATE_LIMIT_INVITE", "30/1h")
+	RATE_LIMIT_EMAIL         = envLimit("RATE_LIMIT_EMAIL", "10/15m")
+	RATE_LIMIT_EMAIL_ADDRESS = envLimit("RATE_LIMIT_EMAIL_ADDRESS", "3/15m")
+	RATE_LIMIT_TOKEN         = envLimit("RATE_LIMIT_TOKEN", "120/1m")
+	RATE_LIMIT_TOKEN_CLIENT  = envLimit("RATE_LIMIT_TOKEN_CLIENT", "300/1m")
+	RATE_LIMIT_EMAIL_LINKS   = envLimit("RATE_LIMIT_EMAIL_LINKS", "30/15m")
+)
+
+const rateLimitPruneInterval = 10 * time.Minute
+
+func envLimit(name, fallback string) ratelimit.Limit {
+	limit, err := ratelimit.ParseLimit(envString(name, fallback))
+	if err != nil {
+		log.Printf("Invalid %s, using %s: %v", name, fallback, err)
+		limit, _ = ratelimit.ParseLimit(fallback)
+	}
+	return limit
+}
+
+// rateLimitRules groups the public endpoints by what an attacker would be
+// guessing or flooding, and says what each group is counted by.
+func rateLimitRules() []ratelimit.Rule {
+	return []ratelimit.Rule{
+		{
+			Name:   "login",
+			Routes: []string{"POST /api/auth/login", "POST /api/auth/login/mfa", "POST /api/auth/passkey/begin", "POST /api/auth/passkey/finish"},
+			Limit:  RATE_LIMIT_LOGIN,
+			Key:    ratelimit.ByIP,
+		},
+		{
+			Name:   "login-email",
+			Routes: []string{"POST /api/auth/login"},
+			Limit:  RATE_LIMIT_LOGIN_EMAIL,
+			Key:    ratelimit.ByJSONField("email"),
+		},
+		{
+			Name:   "register",
+			Routes: []string{"POST /api/auth/register"},
+			Limit:  RATE_LIMIT_REGISTER,
+			Key:    ratelimit.ByIP,
+		},
+		{
+			Name:   "invite",
+			Routes: []string{"GET /api/auth/validate-invite/:invite", "POST /api/auth/register"},
+			Limit:  RATE_LIMIT_INVITE,
+			Key:    ratelimit.ByIP,
+		},
+		{
+			Name:   "email",
+			Routes: []string{"POST /api/auth/password/forgot", "POST /api/auth/email/verify/resend"},
+			Limit:  RATE_LIMIT_EMAIL,
+			Key:    ratelimit.ByIP,
+		},
+		{
+			Name:   "email-address",
+			Routes: []string{"POST /api/auth/password/forgot", "POST /api/auth/email/verify/resend"},
+			Limit:  RATE_LIMIT_EMAIL_ADDRESS,
+			Key:    ratelimit.ByJSONField("email"),
+		},
+		{
+			Name:   "email-links",
+			Routes: []string{"POST /api/auth/password/reset", "POST /api/auth/email/verify", "POST /api/auth/email/change/confirm", "POST /api/auth/email/change/cancel"},
+			Limit:  RATE_LIMIT_EMAIL_LINKS,
+			Key:    ratelimit.ByIP,
+		},
+		{
+			Name:   "token",
+			Routes: []string{"POST /token"},
+			Limit:  RATE_LIMIT_TOKEN,
+			Key:    ratelimit.ByIP,
+		},
+		{
+			Name:   "token-client",
+			Routes: []string{"POST /token"},
+			Limit:  RATE_LIMIT_TOKEN_CLIENT,
+			Key:    ratelimit.ByClientID,
+		},
+	}
+}
+
+func rateLimiter(store ratelimit.Store) echo.MiddlewareFunc {
+	return ratelimit.Middleware(store, rateLimitRules(), func(c echo.Context, err error) {
+		c.Logger().Errorf("Failed to apply rate limit: %v", err)
+	})
+}
+
+// pruneRateLimits periodically deletes buckets that have refilled.
+func pruneRateLimits(ctx context.Context, db *database.DB) {
+	ticker := time.NewTicker(rateLimitPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := database.PruneRateLimitBuckets(db, time.Now()); err != nil {
+			log.Printf("Failed to prune rate limits: %v", err)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pragmahq/sso/ratelimit"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimitIgnoresForwardedFor(t *testing.T) {
+	// Set up a router the way Serve does, without trusted proxies
+	e := echo.New()
+	extractor, err := clientIPExtractor("")
+	assert.NoError(t, err)
+	e.IPExtractor = extractor
+	e.Use(rateLimiter(ratelimit.NewMemoryStore()))
+	e.POST("/api/auth/register", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+
+	// Making up a new X-Forwarded-For for every request does not get a fresh bucket
+	for i := 0; i <= RATE_LIMIT_REGISTER.Burst; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/api/auth/register", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set(echo.HeaderXForwardedFor, "203.0.113."+strconv.Itoa(i))
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		if i < RATE_LIMIT_REGISTER.Burst {
+			assert.Equal(t, http.StatusOK, rec.Code)
+		} else {
+			assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/pragmahq/sso/database"
+)
+
+// ACCESS_TOKEN_TTL is the lifetime of session cookies and OIDC access tokens.
+// It can be kept short because clients renew them with a refresh token.
+var ACCESS_TOKEN_TTL = envDuration("ACCESS_TOKEN_TTL", 15*time.Minute)
+
+// REFRESH_TOKEN_TTL is how long a refresh token may go unused before the user has
+// to sign in again.
+var REFRESH_TOKEN_TTL = envDuration("REFRESH_TOKEN_TTL", 30*24*time.Hour)
+
+var (
+	errInvalidRefreshToken = errors.New("invalid refresh token")
+	errRefreshTokenReused  = errors.New("refresh token reused")
+	errSignInRefused       = errors.New("the account may not sign in")
+)
+
+// issueRefreshToken stores a new refresh token with the user, client, session and
+// scope of template and returns its opaque value. An empty FamilyId starts a new
+// family.
+func issueRefreshToken(db *database.DB, template database.RefreshToken) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	refreshToken := &template
+	if refreshToken.FamilyId == "" {
+		refreshToken.FamilyId = uuid.New().String()
+	}
+
+	now := time.Now()
+	refreshToken.Id = hashToken(token)
+	refreshToken.CreatedAt = now
+	refreshToken.ExpiresAt = now.Add(REFRESH_TOKEN_TTL)
+	refreshToken.UsedAt = nil
+	refreshToken.RevokedAt = nil
+	if err := refreshToken.Create(db); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// rotateRefreshToken redeems a refresh token issued to clientID and returns the
+// record it was stored as together with its successor. Presenting a token that
+// was already redeemed revokes the whole family, since either the legitimate
+// client or an attacker is holding a stolen copy.
+func rotateRefreshToken(db *database.DB, token, clientID string) (*database.RefreshToken, string, error) {
+	refreshToken, err := database.GetRefreshToken(db, hashToken(token))
+	if err != nil {
+		return nil, "", err
+	}
+	if refreshToken == nil || refreshToken.ClientId != clientID || refreshToken.IsExpired() {
+		return nil, "", errInvalidRefreshToken
+	}
+	if refreshToken.RevokedAt != nil {
+		return nil, "", errInvalidRefreshToken
+	}
+	if refreshToken.SessionId != "" {
+		session, err := database.GetSession(db, refreshToken.SessionId)
+		if err != nil {
+			return nil, "", err
+		}
+		if session == nil || !session.IsActive() {
+			return nil, "", errInvalidRefreshToken
+		}
+	}
+
+	ok, err := refreshToken.Use(db)
+	if err != nil {
+		return nil, "", err
+	}
+	if !ok {
+		if err := database.RevokeRefreshTokenFamily(db, refreshToken.FamilyId); err != nil {
+			return nil, "", err
+		}
+		return nil, "", errRefreshTokenReused
+	}
+
+	next, err := issueRefreshToken(db, *refreshToken)
+	if err != nil {
+		return nil, "", err
+	}
+	return refreshToken, next, nil
+}
+
+// refreshSession renews the session cookies from the RefreshToken cookie.
+func refreshSession(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, _, err := renewSession(c, db)
+		if err != nil {
+			clearSessionCookies(c)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid refresh token"})
+		}
+
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"id":    user.Id,
+			"email": user.Email,
+		})
+	}
+}
+
+// renewSession rotates the RefreshToken cookie and issues a fresh session cookie.
+// Users who could not sign in now are refused, as completeLogin would.
+func renewSession(c echo.Context, db *database.DB) (*database.User, *database.Session, error) {
+	cookie, err := c.Cookie("RefreshToken")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	refreshToken, next, err := rotateRefreshToken(db, cookie.Value, "")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	user := &database.User{Id: refreshToken.UserId}
+	if err := user.Read(db); err != nil {
+		return nil, nil, err
+	}
+	if user.IsDisabled() || requiresVerifiedEmail(user, VerificationLogin) {
+		return nil, nil, errSignInRefused
+	}
+
+	session, err := database.GetSession(db, refreshToken.SessionId)
+	if err != nil || session == nil {
+		return nil, nil, errSessionRevoked
+	}
+	if err := session.Touch(db, c.RealIP(), time.Now().Add(REFRESH_TOKEN_TTL)); err != nil {
+		return nil, nil, err
+	}
+
+	token, err := createSessionToken(user, session)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	setSessionCookies(c, token, next)
+	return user, session, nil
+}
+
+// createSessionToken signs the short-lived token stored in the Token cookie.
+func createSessionToken(user *database.User, session *database.Session) (string, error) {
+	now := time.Now()
+	return signToken(jwt.MapClaims{
+		"user_id":   user.Id,
+		"sid":       session.Id,
+		"iat":       now.Unix(),
+		"auth_time": session.CreatedAt.Unix(),
+		"exp":       now.Add(ACCESS_TOKEN_TTL).Unix(),
+	}, sessionTokenType)
+}
+
+func setSessionCookies(c echo.Context, token, refreshToken string) {
+	cookie := new(http.Cookie)
+	cookie.Name = "Token"
+	cookie.Value = token
+	cookie.Expires = time.Now().Add(ACCESS_TOKEN_TTL)
+	cookie.Path = "/"
+	cookie.HttpOnly = true
+	c.SetCookie(cookie)
+
+	refresh := new(http.Cookie)
+	refresh.Name = "RefreshToken"
+	refresh.Value = refreshToken
+	refresh.Expires = time.Now().Add(REFRESH_TOKEN_TTL)
+	refresh.Path = "/"
+	refresh.HttpOnly = true
+	refresh.SameSite = http.SameSiteLaxMode
+	c.SetCookie(refresh)
+}
+
+func clearSessionCookies(c echo.Context) {
+	for _, name := range []string{"Token", "RefreshToken"} {
+		cookie := new(http.Cookie)
+		cookie.Name = name
+		cookie.Value = ""
+		cookie.Path = "/"
+		cookie.MaxAge = -1
+		c.SetCookie(cookie)
+	}
+}
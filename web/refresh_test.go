@@ -0,0 +1,101 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/pragmahq/sso/database"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRefreshTokenRotation(t *testing.T) {
+	testUser := &database.User{
+		Id:       uuid.New().String(),
+		Email:    "refresh@example.com",
+		Password: "password123",
+	}
+	err := testUser.Create(testDB)
+	assert.NoError(t, err)
+
+	session := createTestSession(t, testUser)
+
+	first, err := issueRefreshToken(testDB, database.RefreshToken{
+		UserId:    testUser.Id,
+		SessionId: session.Id,
+		AuthTime:  time.Now(),
+	})
+	assert.NoError(t, err)
+
+	// Each use hands out a new token in the same family
+	record, second, err := rotateRefreshToken(testDB, first, "")
+	assert.NoError(t, err)
+	assert.Equal(t, testUser.Id, record.UserId)
+	assert.NotEqual(t, first, second)
+
+	// A token issued to the first-party session cannot be used by a client
+	_, _, err = rotateRefreshToken(testDB, second, "some-client")
+	assert.Equal(t, errInvalidRefreshToken, err)
+
+	// Replaying the first token revokes the whole family
+	_, _, err = rotateRefreshToken(testDB, first, "")
+	assert.Equal(t, errRefreshTokenReused, err)
+
+	_, _, err = rotateRefreshToken(testDB, second, "")
+	assert.Equal(t, errInvalidRefreshToken, err)
+
+	// Refresh tokens die with their session
+	third, err := issueRefreshToken(testDB, database.RefreshToken{
+		UserId:    testUser.Id,
+		SessionId: session.Id,
+		AuthTime:  time.Now(),
+	})
+	assert.NoError(t, err)
+	err = session.Revoke(testDB)
+	assert.NoError(t, err)
+	_, _, err = rotateRefreshToken(testDB, third, "")
+	assert.Equal(t, errInvalidRefreshToken, err)
+
+	// Clean up
+	err = testUser.Delete(testDB)
+	assert.NoError(t, err)
+}
+
+func TestRenewSessionRefused(t *testing.T) {
+	policy := EMAIL_VERIFICATION_POLICY
+	defer func() { EMAIL_VERIFICATION_POLICY = policy }()
+
+	// Create a test user with a session
+	testUser := &database.User{Id: uuid.New().String(), Email: "renew@example.com"}
+	err := testUser.Create(testDB)
+	assert.NoError(t, err)
+	session := createTestSession(t, testUser)
+	renew := func() error {
+		token, err := issueRefreshToken(testDB, database.RefreshToken{
+			UserId:    testUser.Id,
+			SessionId: session.Id,
+			AuthTime:  time.Now(),
+		})
+		assert.NoError(t, err)
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		req.AddCookie(&http.Cookie{Name: "RefreshToken", Value: token})
+		_, _, err = renewSession(echo.New().NewContext(req, httptest.NewRecorder()), testDB)
+		return err
+	}
+
+	// Users who could not sign in cannot stay signed in either
+	EMAIL_VERIFICATION_POLICY = VerificationLogin
+	assert.Equal(t, errSignInRefused, renew())
+	EMAIL_VERIFICATION_POLICY = VerificationOptional
+	assert.NoError(t, renew())
+	err = testUser.SetDisabled(testDB, true)
+	assert.NoError(t, err)
+	assert.Equal(t, errSignInRefused, renew())
+
+	// Clean up
+	err = testUser.Delete(testDB)
+	assert.NoError(t, err)
+}
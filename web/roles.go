@@ -0,0 +1,276 @@
+package web
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/pragmahq/sso/database"
+)
+
+// RoleBody describes a role. A ClientId makes it a role of that application,
+// whose permissions are entitlements the application defines. It is only read
+// when the role is created.
+type RoleBody struct {
+	ClientId    string   `json:"clientId"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+func registerRoleRoutes(g *echo.Group, db *database.DB) {
+	g.GET("/permissions", listPermissions(db))
+	g.GET("/roles", listRoles(db))
+	g.POST("/roles", createRole(db))
+	g.PUT("/roles/:id", updateRole(db))
+	g.DELETE("/roles/:id", deleteRole(db))
+	g.GET("/users/:id/roles", listUserRoles(db))
+	g.PUT("/users/:id/roles/:role", assignUserRole(db))
+	g.DELETE("/users/:id/roles/:role", unassignUserRole(db))
+}
+
+func (req *RoleBody) validate() string {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return "Name is required"
+	}
+	for _, permission := range req.Permissions {
+		if req.ClientId == "" && !database.IsPermission(permission) {
+			return "Unknown permission: " + permission
+		}
+		if permission == "" || strings.ContainsAny(permission, " \t\r\n") {
+			return "Invalid entitlement: " + permission
+		}
+	}
+	return ""
+}
+
+func (req *RoleBody) apply(role *database.Role) {
+	role.Name = req.Name
+	role.Description = req.Description
+	role.Permissions = req.Permissions
+	if role.Permissions == nil {
+		role.Permissions = []string{}
+	}
+}
+
+func roleJSON(role *database.Role) map[string]interface{} {
+	return map[string]interface{}{
+		"id":          role.Id,
+		"clientId":    role.ClientId,
+		"name":        role.Name,
+		"description": role.Description,
+		"permissions": role.Permissions,
+		"builtIn":     role.BuiltIn,
+		"createdAt":   role.CreatedAt,
+	}
+}
+
+func listPermissions(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		permissions, err := database.GetPermissions(db)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+
+		response := []map[string]interface{}{}
+		for _, permission := range permissions {
+			response = append(response, map[string]interface{}{
+				"name":        permission.Name,
+				"description": permission.Description,
+			})
+		}
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+// listRoles returns every role, or with the clientId query parameter only the
+// roles of that application.
+func listRoles(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var roles []*database.Role
+		var err error
+		if clientID := c.QueryParam("clientId"); clientID != "" {
+			roles, err = database.GetClientRoles(db, clientID)
+		} else {
+			roles, err = database.GetRoles(db)
+		}
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+
+		response := []map[string]interface{}{}
+		for _, role := range roles {
+			response = append(response, roleJSON(role))
+		}
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+func createRole(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req RoleBody
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		}
+		if msg := req.validate(); msg != "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+		}
+
+		if req.ClientId != "" {
+			client, err := database.GetClient(db, req.ClientId)
+			if err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+			}
+			if client == nil {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Client not found"})
+			}
+		}
+
+		role := &database.Role{
+			Id:        uuid.New().String(),
+			ClientId:  req.ClientId,
+			CreatedAt: time.Now(),
+		}
+		req.apply(role)
+
+		err := role.Create(db)
+		if err == database.ErrRoleNameTaken {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "A role with this name already exists"})
+		}
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create role"})
+		}
+		return c.JSON(http.StatusCreated, roleJSON(role))
+	}
+}
+
+// updateRole changes a role's name, description and permissions. Built-in roles
+// can be changed too, although the permission behind their compatibility helper
+// decides whether IsUser, IsEditor or IsAdmin holds.
+func updateRole(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req RoleBody
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		}
+
+		role, err := database.GetRole(db, c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		if role == nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Role not found"})
+		}
+
+		req.ClientId = role.ClientId
+		if msg := req.validate(); msg != "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+		}
+
+		req.apply(role)
+		err = role.Update(db)
+		if err == database.ErrRoleNameTaken {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "A role with this name already exists"})
+		}
+		if err == database.ErrLastAdmin {
+			return lastAdmin(c)
+		}
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update role"})
+		}
+		return c.JSON(http.StatusOK, roleJSON(role))
+	}
+}
+
+func deleteRole(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		role, err := database.GetRole(db, c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		if role == nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Role not found"})
+		}
+
+		err = role.Delete(db)
+		if err == database.ErrBuiltInRole {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Built-in roles cannot be deleted"})
+		}
+		if err == database.ErrLastAdmin {
+			return lastAdmin(c)
+		}
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete role"})
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "Role deleted"})
+	}
+}
+
+func listUserRoles(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user := &database.User{Id: c.Param("id")}
+		if err := user.Read(db); err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+		}
+
+		response := []map[string]interface{}{}
+		for _, role := range user.Roles {
+			response = append(response, roleJSON(role))
+		}
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+func assignUserRole(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, role, status, msg := userAndRole(c, db)
+		if msg != "" {
+			return c.JSON(status, map[string]string{"error": msg})
+		}
+
+		if err := database.AssignRole(db, user.Id, role.Id); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to assign role"})
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "Role assigned"})
+	}
+}
+
+func unassignUserRole(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, role, status, msg := userAndRole(c, db)
+		if msg != "" {
+			return c.JSON(status, map[string]string{"error": msg})
+		}
+
+		err := database.KeepAnAdmin(db.DB, func(tx *pg.Tx) error {
+			return database.UnassignRole(tx, user.Id, role.Id)
+		})
+		if err == database.ErrLastAdmin {
+			return lastAdmin(c)
+		}
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to remove role"})
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "Role removed"})
+	}
+}
+
+// userAndRole loads the user and role named in the path.
+func userAndRole(c echo.Context, db *database.DB) (*database.User, *database.Role, int, string) {
+	user := &database.User{Id: c.Param("id")}
+	if err := user.Read(db); err != nil {
+		return nil, nil, http.StatusNotFound, "User not found"
+	}
+	role, err := database.GetRole(db, c.Param("role"))
+	if err != nil {
+		return nil, nil, http.StatusInternalServerError, "Database error"
+	}
+	if role == nil {
+		return nil, nil, http.StatusNotFound, "Role not found"
+	}
+	return user, role, 0, ""
+}
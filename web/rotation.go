@@ -0,0 +1,215 @@
+package web
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/pragmahq/sso/database"
+)
+
+const (
+	// signingKeyPrepublish is how long a pending key is published in the JWKS
+	// before it starts signing, so relying parties caching the JWKS see it first.
+	signingKeyPrepublish = 24 * time.Hour
+
+	// signingKeyRetention is how long a superseded key keeps verifying tokens. It
+	// must outlive the longest-lived token a key can sign.
+	signingKeyRetention = 31 * 24 * time.Hour
+
+	// signingKeyRefresh is how often every instance re-reads the key set and
+	// advances the rotation schedule.
+	signingKeyRefresh = time.Minute
+
+	// signingKeyLock is the Postgres advisory lock serialising rotation across instances.
+	signingKeyLock = 0x5550_4b45_5953
+)
+
+// SIGNING_ALG selects the algorithm of newly generated signing keys.
+var SIGNING_ALG = envString("SIGNING_ALG", AlgRS256)
+
+// SIGNING_KEY_ROTATION is how long a key stays active before its successor takes over.
+var SIGNING_KEY_ROTATION = envDuration("SIGNING_KEY_ROTATION", 30*24*time.Hour)
+
+// loadSigningKeys advances the rotation schedule and loads every non-retired key
+// from the database into signingKeys. Keys sealed under a previous COOKIE_SECRET
+// are sealed again under the current one. The set is replaced in place, since request
+// goroutines read it while maintainSigningKeys reloads it.
+func loadSigningKeys(db *database.DB) error {
+	if err := rotateSigningKeys(db, time.Now()); err != nil {
+		return err
+	}
+
+	records, err := database.GetSigningKeys(db)
+	if err != nil {
+		return err
+	}
+
+	set := &KeySet{keys: map[string]*SigningKey{}}
+	for _, record := range records {
+		der, stale, err := decryptSecret(record.PrivateKey)
+		if err != nil {
+			return fmt.Errorf("decrypting signing key %s (list old COOKIE_SECRET values in COOKIE_SECRET_PREVIOUS): %w", record.Id, err)
+		}
+		if stale {
+			if err := resealSigningKey(db, record, der); err != nil {
+				return err
+			}
+		}
+		key, err := parseSigningKey(der)
+		if err != nil {
+			return err
+		}
+
+		set.Add(key)
+		if record.State == database.KeyStateActive {
+			set.active = key.ID
+		}
+	}
+
+	signingKeys.Replace(set)
+	return nil
+}
+
+// resealSigningKey stores the key encrypted under the current SECRET.
+func resealSigningKey(db *database.DB, record *database.SigningKey, der []byte) error {
+	sealed, err := encryptSecret(der)
+	if err != nil {
+		return err
+	}
+	record.PrivateKey = sealed
+	_, err = db.Model(record).Column("private_key").WherePK().Update()
+	return err
+}
+
+// maintainSigningKeys periodically reloads the key set until ctx is cancelled, so
+// keys rotated by any instance are picked up by all of them.
+func maintainSigningKeys(ctx context.Context, db *database.DB) {
+	ticker := time.NewTicker(signingKeyRefresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := loadSigningKeys(db); err != nil {
+				log.Printf("Failed to refresh signing keys: %v", err)
+			}
+		}
+	}
+}
+
+// rotateSigningKeys moves the persisted keys through their lifecycle:
+//
+//   - with no active key, one is generated and activated immediately;
+//   - a pending successor is generated signingKeyPrepublish before the active
+//     key has been in use for SIGNING_KEY_ROTATION;
+//   - once due, the pending key is activated and the old one superseded;
+//   - superseded keys are retired after signingKeyRetention.
+func rotateSigningKeys(db *database.DB, now time.Time) error {
+	return db.RunInTransaction(context.Background(), func(tx *pg.Tx) error {
+		_, err := tx.Exec("SELECT pg_advisory_xact_lock(?)", signingKeyLock)
+		if err != nil {
+			return err
+		}
+
+		var records []*database.SigningKey
+		err = tx.Model(&records).
+			Where("state != ?", database.KeyStateRetired).
+			Order("created_at ASC").
+			Select()
+		if err != nil {
+			return err
+		}
+
+		var active, pending *database.SigningKey
+		for _, record := range records {
+			switch record.State {
+			case database.KeyStateActive:
+				active = record
+			case database.KeyStatePending:
+				pending = record
+			case database.KeyStateSuperseded:
+				if record.RetiresAt != nil && !now.Before(*record.RetiresAt) {
+					record.State = database.KeyStateRetired
+					record.RetiredAt = &now
+					record.PrivateKey = nil
+					if _, err := tx.Model(record).WherePK().Update(); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		if active == nil && pending == nil {
+			key, err := newSigningKeyRecord(now)
+			if err != nil {
+				return err
+			}
+			key.State = database.KeyStateActive
+			key.ActivatedAt = &now
+			_, err = tx.Model(key).Insert()
+			return err
+		}
+
+		if active != nil && pending == nil {
+			rotatesAt := active.ActivatedAt.Add(SIGNING_KEY_ROTATION)
+			if !now.Before(rotatesAt.Add(-signingKeyPrepublish)) {
+				key, err := newSigningKeyRecord(rotatesAt)
+				if err != nil {
+					return err
+				}
+				_, err = tx.Model(key).Insert()
+				return err
+			}
+		}
+
+		if pending != nil && (active == nil || !now.Before(pending.ActivatesAt)) {
+			if active != nil {
+				retiresAt := now.Add(signingKeyRetention)
+				active.State = database.KeyStateSuperseded
+				active.RetiresAt = &retiresAt
+				if _, err := tx.Model(active).WherePK().Update(); err != nil {
+					return err
+				}
+			}
+
+			pending.State = database.KeyStateActive
+			pending.ActivatedAt = &now
+			if _, err := tx.Model(pending).WherePK().Update(); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func newSigningKeyRecord(activatesAt time.Time) (*database.SigningKey, error) {
+	key, err := GenerateSigningKey(SIGNING_ALG)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key.Private)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := encryptSecret(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &database.SigningKey{
+		Id:          key.ID,
+		Algorithm:   key.Algorithm,
+		PrivateKey:  encrypted,
+		State:       database.KeyStatePending,
+		CreatedAt:   time.Now(),
+		ActivatesAt: activatesAt,
+	}, nil
+}
@@ -0,0 +1,79 @@
+package web
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"strings"
+)
+
+// PREVIOUS_SECRETS lists values COOKIE_SECRET had before it was rotated,
+// separated by commas. Secrets sealed under them can still be opened, and are
+// sealed again under SECRET when next loaded.
+var PREVIOUS_SECRETS = envString("COOKIE_SECRET_PREVIOUS", "")
+
+// encryptSecret seals key material such as signing keys and TOTP secrets with
+// AES-256-GCM under a key derived from SECRET, so a database dump alone is not
+// enough to forge tokens or one-time codes.
+func encryptSecret(plaintext []byte) ([]byte, error) {
+	aead, err := keyEncryptionCipher(SECRET)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// decryptSecret opens a secret sealed by encryptSecret. Secrets sealed under one
+// of PREVIOUS_SECRETS are reported as stale, so the caller can seal them again.
+func decryptSecret(sealed []byte) (plaintext []byte, stale bool, err error) {
+	aead, err := keyEncryptionCipher(SECRET)
+	if err != nil {
+		return nil, false, err
+	}
+	plaintext, err = openSecret(aead, sealed)
+	if err == nil {
+		return plaintext, false, nil
+	}
+
+	for _, previous := range strings.Split(PREVIOUS_SECRETS, ",") {
+		if previous == "" {
+			continue
+		}
+		aead, cipherErr := keyEncryptionCipher([]byte(previous))
+		if cipherErr != nil {
+			return nil, false, cipherErr
+		}
+		if plaintext, openErr := openSecret(aead, sealed); openErr == nil {
+			return plaintext, true, nil
+		}
+	}
+	return nil, false, err
+}
+
+func openSecret(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("encrypted secret is too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
+
+func keyEncryptionCipher(secret []byte) (cipher.AEAD, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("COOKIE_SECRET is not set")
+	}
+
+	key := sha256.Sum256(secret)
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
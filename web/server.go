@@ -1,24 +1,123 @@
 package web
 
 import (
+	"context"
+	"fmt"
+	"net"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/pragmahq/sso/database"
+	"github.com/pragmahq/sso/ratelimit"
+	"github.com/pragmahq/sso/throttle"
 )
 
 var router *echo.Echo
 
+// TRUSTED_PROXIES lists the reverse proxies in front of the server as addresses
+// or CIDR ranges, separated by commas. X-Forwarded-For is only believed from
+// them, so clients cannot pick the IP their sign-in attempts, rate limits and
+// sessions are recorded under.
+var TRUSTED_PROXIES = envString("TRUSTED_PROXIES", "")
+
 func Serve(db *database.DB) {
 	router = echo.New()
+
+	extractor, err := clientIPExtractor(TRUSTED_PROXIES)
+	if err != nil {
+		router.Logger.Fatal(err)
+	}
+	router.IPExtractor = extractor
+
+	if err := loadSigningKeys(db); err != nil {
+		router.Logger.Fatal(err)
+	}
+	go maintainSigningKeys(context.Background(), db)
+
+	m, err := newMailer()
+	if err != nil {
+		router.Logger.Fatal(err)
+	}
+	mail = m
+	go deliverMail(context.Background(), db)
+	go pruneOutbox(context.Background(), db)
+
+	loginThrottle = newLoginThrottle(throttle.NewPostgresStore(db))
+	go pruneLoginThrottles(context.Background(), db)
+
 	router.Use(middleware.CORSWithConfig(middleware.CORSConfig{
 		AllowOrigins:     []string{"http://localhost:3000"},
 		AllowHeaders:     []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAccept},
+		ExposeHeaders:    []string{"Retry-After"},
 		AllowCredentials: true,
 	}))
+	router.Use(rateLimiter(ratelimit.NewPostgresStore(db)))
+	go pruneRateLimits(context.Background(), db)
 
 	registerAuthRoutes(router, db)
+	registerOIDCRoutes(router, db)
+	registerAdminRoutes(router, db)
 
 	router.Logger.Fatal(router.Start(":" + os.Getenv("SERVER_PORT")))
 }
+
+// clientIPExtractor returns how c.RealIP() finds the client: the connection's
+// address, or with trusted proxies the last X-Forwarded-For entry added by
+// someone other than them.
+func clientIPExtractor(trusted string) (echo.IPExtractor, error) {
+	if trusted == "" {
+		return echo.ExtractIPDirect(), nil
+	}
+
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, proxy := range strings.Split(trusted, ",") {
+		proxy = strings.TrimSpace(proxy)
+		if ip := net.ParseIP(proxy); ip != nil {
+			proxy = ip.String() + "/128"
+			if ip.To4() != nil {
+				proxy = ip.String() + "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TRUSTED_PROXIES entry %q", proxy)
+		}
+		options = append(options, echo.TrustIPRange(ipNet))
+	}
+	return echo.ExtractIPFromXFFHeader(options...), nil
+}
+
+func envString(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func envDuration(name string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(name))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func envInt(name string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func envBool(name string, fallback bool) bool {
+	value, err := strconv.ParseBool(os.Getenv(name))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
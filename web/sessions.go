@@ -0,0 +1,210 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/pragmahq/sso/database"
+)
+
+const (
+	// sessionTokenType is the `typ` header of the token in the Token cookie. Tokens
+	// handed to applications have other types, so they cannot be replayed as the
+	// cookie.
+	sessionTokenType = "session+jwt"
+
+	// sessionTouchInterval throttles how often a session's last-seen time is written.
+	sessionTouchInterval = time.Minute
+)
+
+var errSessionRevoked = errors.New("session revoked or expired")
+
+func registerSessionRoutes(g *echo.Group, db *database.DB) {
+	g.GET("/sessions", listSessions(db))
+	g.DELETE("/sessions/:id", revokeSession(db))
+	g.DELETE("/sessions", revokeOtherSessions(db))
+}
+
+// startSession records a new sign-in from the requesting device.
+func startSession(c echo.Context, db *database.DB, user *database.User) (*database.Session, error) {
+	now := time.Now()
+	userAgent := c.Request().UserAgent()
+	session := &database.Session{
+		Id:         uuid.New().String(),
+		UserId:     user.Id,
+		Device:     describeDevice(userAgent),
+		IP:         c.RealIP(),
+		UserAgent:  userAgent,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(REFRESH_TOKEN_TTL),
+	}
+	if err := session.Create(db); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// sessionKey is the jwt.Keyfunc for session tokens. It refuses tokens of any
+// other type and any meant for an application.
+func sessionKey(token *jwt.Token) (interface{}, error) {
+	if token.Header["typ"] != sessionTokenType {
+		return nil, errors.New("not a session token")
+	}
+	if claims, ok := token.Claims.(jwt.MapClaims); !ok || claims["aud"] != nil {
+		return nil, errors.New("session tokens have no audience")
+	}
+	return verificationKey(token)
+}
+
+// activeSession returns the session named by the `sid` claim if it is still active.
+func activeSession(db *database.DB, claims jwt.MapClaims) (*database.Session, error) {
+	sid, ok := claims["sid"].(string)
+	if !ok {
+		return nil, errors.New("token has no session")
+	}
+
+	session, err := database.GetSession(db, sid)
+	if err != nil {
+		return nil, err
+	}
+	if session == nil || !session.IsActive() {
+		return nil, errSessionRevoked
+	}
+	return session, nil
+}
+
+// checkSession runs after the JWT middleware and rejects tokens whose session has
+// been revoked. The session is stored in the context under "session".
+func checkSession(db *database.DB) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			token := c.Get("user").(*jwt.Token)
+			session, err := activeSession(db, token.Claims.(jwt.MapClaims))
+			if err != nil {
+				return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Session expired"})
+			}
+
+			if time.Since(session.LastSeenAt) > sessionTouchInterval {
+				session.Touch(db, c.RealIP(), time.Time{})
+			}
+
+			c.Set("session", session)
+			return next(c)
+		}
+	}
+}
+
+func listSessions(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		current := c.Get("session").(*database.Session)
+
+		sessions, err := database.GetUserSessions(db, current.UserId)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+
+		response := []map[string]interface{}{}
+		for _, session := range sessions {
+			response = append(response, map[string]interface{}{
+				"id":         session.Id,
+				"device":     session.Device,
+				"ip":         session.IP,
+				"userAgent":  session.UserAgent,
+				"createdAt":  session.CreatedAt,
+				"lastSeenAt": session.LastSeenAt,
+				"current":    session.Id == current.Id,
+			})
+		}
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+func revokeSession(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		current := c.Get("session").(*database.Session)
+
+		session, err := database.GetSession(db, c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		if session == nil || session.UserId != current.UserId {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Session not found"})
+		}
+
+		if err := session.Revoke(db); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to revoke session"})
+		}
+		if session.Id == current.Id {
+			clearSessionCookies(c)
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "Session revoked"})
+	}
+}
+
+// revokeOtherSessions signs the user out everywhere except the current session.
+func revokeOtherSessions(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		current := c.Get("session").(*database.Session)
+
+		if err := database.RevokeSessions(db, current.UserId, "", current.Id); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to revoke sessions"})
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "Other sessions revoked"})
+	}
+}
+
+// revokeUserSessions lets an admin sign a user out of every session.
+func revokeUserSessions(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user := &database.User{Id: c.Param("id")}
+		if err := user.Read(db); err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+		}
+
+		if err := database.RevokeSessions(db, user.Id, "", ""); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to revoke sessions"})
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "Sessions revoked"})
+	}
+}
+
+// describeDevice turns a user agent into a short label such as "Firefox on Linux".
+func describeDevice(userAgent string) string {
+	browsers := []struct{ token, name string }{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+		{"curl/", "curl"},
+	}
+	systems := []struct{ token, name string }{
+		{"Android", "Android"},
+		{"iPhone", "iOS"},
+		{"iPad", "iPadOS"},
+		{"Mac OS X", "macOS"},
+		{"Windows", "Windows"},
+		{"CrOS", "ChromeOS"},
+		{"Linux", "Linux"},
+	}
+
+	browser := "Unknown browser"
+	for _, b := range browsers {
+		if strings.Contains(userAgent, b.token) {
+			browser = b.name
+			break
+		}
+	}
+	for _, s := range systems {
+		if strings.Contains(userAgent, s.token) {
+			return browser + " on " + s.name
+		}
+	}
+	return browser
+}
@@ -0,0 +1,127 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/pragmahq/sso/database"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRevokeOtherSessions(t *testing.T) {
+	e := echo.New()
+
+	testUser := &database.User{
+		Id:       uuid.New().String(),
+		Email:    "sessions@example.com",
+		Password: "password123",
+	}
+	err := testUser.Create(testDB)
+	assert.NoError(t, err)
+
+	current := createTestSession(t, testUser)
+	other := createTestSession(t, testUser)
+
+	// Both sessions are listed
+	req := httptest.NewRequest(http.MethodGet, "/api/user/sessions", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.Set("session", current)
+
+	if assert.NoError(t, listSessions(testDB)(c)) {
+		var response []map[string]interface{}
+		err := json.Unmarshal(rec.Body.Bytes(), &response)
+		assert.NoError(t, err)
+		assert.Len(t, response, 2)
+	}
+
+	// Signing out everywhere else keeps only the current session
+	req = httptest.NewRequest(http.MethodDelete, "/api/user/sessions", nil)
+	rec = httptest.NewRecorder()
+	c = e.NewContext(req, rec)
+	c.Set("session", current)
+
+	if assert.NoError(t, revokeOtherSessions(testDB)(c)) {
+		assert.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	sessions, err := database.GetUserSessions(testDB, testUser.Id)
+	assert.NoError(t, err)
+	if assert.Len(t, sessions, 1) {
+		assert.Equal(t, current.Id, sessions[0].Id)
+	}
+
+	revoked, err := database.GetSession(testDB, other.Id)
+	assert.NoError(t, err)
+	assert.False(t, revoked.IsActive())
+
+	// Clean up
+	err = testUser.Delete(testDB)
+	assert.NoError(t, err)
+}
+
+func TestSessionTokenType(t *testing.T) {
+	e := echo.New()
+
+	testUser := &database.User{
+		Id:       uuid.New().String(),
+		Email:    "session-type@example.com",
+		Password: "password123",
+	}
+	err := testUser.Create(testDB)
+	assert.NoError(t, err)
+	session := createTestSession(t, testUser)
+
+	sessionToken, err := createSessionToken(testUser, session)
+	assert.NoError(t, err)
+	idToken, err := createIDToken(testUser, "app", session.Id, "openid", "", session.CreatedAt)
+	assert.NoError(t, err)
+	accessToken, err := createAccessToken(testDB, testUser, "app", session.Id, "openid")
+	assert.NoError(t, err)
+
+	// Only the session token works as the Token cookie
+	for token, status := range map[string]int{
+		sessionToken: http.StatusOK,
+		idToken:      http.StatusUnauthorized,
+		accessToken:  http.StatusUnauthorized,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/auth/validate", nil)
+		req.AddCookie(&http.Cookie{Name: "Token", Value: token})
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+
+		if assert.NoError(t, validateToken(testDB)(c)) {
+			assert.Equal(t, status, rec.Code)
+		}
+	}
+
+	// Clean up
+	err = testUser.Delete(testDB)
+	assert.NoError(t, err)
+}
+
+func TestDescribeDevice(t *testing.T) {
+	ua := "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36"
+	assert.Equal(t, "Chrome on macOS", describeDevice(ua))
+	assert.Equal(t, "Unknown browser", describeDevice(""))
+}
+
+func createTestSession(t *testing.T, user *database.User) *database.Session {
+	now := time.Now()
+	session := &database.Session{
+		Id:         uuid.New().String(),
+		UserId:     user.Id,
+		Device:     "Test",
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(time.Hour),
+	}
+	err := session.Create(testDB)
+	assert.NoError(t, err)
+	return session
+}
@@ -0,0 +1,121 @@
+package web
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pragmahq/sso/database"
+	"github.com/pragmahq/sso/throttle"
+)
+
+var (
+	// LOGIN_THROTTLE_WINDOW is how long a failed sign-in counts against the
+	// account and the client IP.
+	LOGIN_THROTTLE_WINDOW   = envDuration("LOGIN_THROTTLE_WINDOW", 15*time.Minute)
+	LOGIN_FREE_ATTEMPTS     = envInt("LOGIN_FREE_ATTEMPTS", 3)
+	LOGIN_IP_FREE_ATTEMPTS  = envInt("LOGIN_IP_FREE_ATTEMPTS", 10)
+	LOGIN_MAX_DELAY         = envDuration("LOGIN_MAX_DELAY", 30*time.Second)
+	LOGIN_LOCKOUT_THRESHOLD = envInt("LOGIN_LOCKOUT_THRESHOLD", 10)
+	LOGIN_LOCKOUT_DURATION  = envDuration("LOGIN_LOCKOUT_DURATION", 15*time.Minute)
+)
+
+const throttlePruneInterval = time.Hour
+
+// loginThrottle counts failed sign-ins. Serve replaces the in-memory store with
+// one shared through the database.
+var loginThrottle = newLoginThrottle(throttle.NewMemoryStore())
+
+func newLoginThrottle(store throttle.Store) *throttle.Throttler {
+	return throttle.New(store,
+		throttle.Policy{
+			Window:       LOGIN_THROTTLE_WINDOW,
+			FreeAttempts: LOGIN_FREE_ATTEMPTS,
+			BaseDelay:    time.Second,
+			MaxDelay:     LOGIN_MAX_DELAY,
+			LockAfter:    LOGIN_LOCKOUT_THRESHOLD,
+			LockFor:      LOGIN_LOCKOUT_DURATION,
+		},
+		// Addresses are only slowed down, as many users can share one.
+		throttle.Policy{
+			Window:       LOGIN_THROTTLE_WINDOW,
+			FreeAttempts: LOGIN_IP_FREE_ATTEMPTS,
+			BaseDelay:    time.Second,
+			MaxDelay:     LOGIN_MAX_DELAY,
+		},
+	)
+}
+
+// checkLoginThrottle responds with 429 and reports false if a sign-in for email
+// may not be tried yet.
+func checkLoginThrottle(c echo.Context, email string) (bool, error) {
+	if status, msg := loginThrottled(c, email); msg != "" {
+		return false, c.JSON(status, map[string]string{"error": msg})
+	}
+	return true, nil
+}
+
+// loginThrottled returns the status and message to refuse a sign-in for email
+// with, setting Retry-After, or an empty message if it may be tried.
+func loginThrottled(c echo.Context, email string) (int, string) {
+	decision, err := loginThrottle.Check(email, c.RealIP())
+	if err != nil {
+		return http.StatusInternalServerError, "Database error"
+	}
+	if decision.Allowed {
+		return 0, ""
+	}
+
+	seconds := int(math.Ceil(decision.RetryAfter.Seconds()))
+	c.Response().Header().Set("Retry-After", strconv.Itoa(seconds))
+	if decision.Locked {
+		return http.StatusTooManyRequests, "Account temporarily locked after too many failed attempts"
+	}
+	return http.StatusTooManyRequests, "Too many failed attempts, please wait before trying again"
+}
+
+// failLogin counts a failed sign-in. Errors are only logged, since the attempt
+// failed either way.
+func failLogin(c echo.Context, email string) {
+	if err := loginThrottle.Fail(email, c.RealIP()); err != nil {
+		c.Logger().Errorf("Failed to record failed login: %v", err)
+	}
+}
+
+// unlockUser clears the failed sign-ins and lockout of a user.
+func unlockUser(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user := &database.User{Id: c.Param("id")}
+		if err := user.Read(db); err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+		}
+
+		if err := loginThrottle.Unlock(user.Email); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "User unlocked"})
+	}
+}
+
+// pruneLoginThrottles periodically deletes counters that no longer matter.
+func pruneLoginThrottles(ctx context.Context, db *database.DB) {
+	ticker := time.NewTicker(throttlePruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		before := time.Now().Add(-max(LOGIN_THROTTLE_WINDOW, LOGIN_LOCKOUT_DURATION))
+		if err := database.PruneLoginThrottles(db, before); err != nil {
+			log.Printf("Failed to prune login throttles: %v", err)
+		}
+	}
+}
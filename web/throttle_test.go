@@ -0,0 +1,118 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/pragmahq/sso/database"
+	"github.com/pragmahq/sso/throttle"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLoginLockout(t *testing.T) {
+	previous := loginThrottle
+	loginThrottle = newLoginThrottle(throttle.NewMemoryStore())
+	loginThrottle.Account.BaseDelay = 0
+	loginThrottle.IP.BaseDelay = 0
+	defer func() { loginThrottle = previous }()
+
+	// Create a test user
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	testUser := &database.User{
+		Id:       uuid.New().String(),
+		Email:    "lockout@example.com",
+		Password: string(hash),
+	}
+	err = testUser.Create(testDB)
+	assert.NoError(t, err)
+
+	for i := 0; i < LOGIN_LOCKOUT_THRESHOLD; i++ {
+		rec := postJSON(login(testDB), ReqBody{Email: testUser.Email, Password: "wrong"}, nil)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	}
+
+	// Even the right password is refused while locked
+	rec := postJSON(login(testDB), ReqBody{Email: testUser.Email, Password: "password123"}, nil)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.NotEmpty(t, rec.Header().Get("Retry-After"))
+
+	// An admin can lift the lock
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	unlockRec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, unlockRec)
+	c.SetParamNames("id")
+	c.SetParamValues(testUser.Id)
+	assert.NoError(t, unlockUser(testDB)(c))
+	assert.Equal(t, http.StatusOK, unlockRec.Code)
+
+	rec = postJSON(login(testDB), ReqBody{Email: testUser.Email, Password: "password123"}, nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// Clean up
+	err = testUser.Delete(testDB)
+	assert.NoError(t, err)
+}
+
+func TestReauthLockout(t *testing.T) {
+	previous := loginThrottle
+	loginThrottle = newLoginThrottle(throttle.NewMemoryStore())
+	loginThrottle.Account.BaseDelay = 0
+	loginThrottle.IP.BaseDelay = 0
+	defer func() { loginThrottle = previous }()
+
+	// Create a test user with a session
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	testUser := &database.User{
+		Id:       uuid.New().String(),
+		Email:    "reauth-lockout@example.com",
+		Password: string(hash),
+	}
+	err = testUser.Create(testDB)
+	assert.NoError(t, err)
+	session := createTestSession(t, testUser)
+
+	// Guessing the password through a signed-in session counts too
+	for i := 0; i < LOGIN_LOCKOUT_THRESHOLD; i++ {
+		rec := postJSON(changePassword(testDB), ChangePasswordBody{CurrentPassword: "wrong", NewPassword: "a new passphrase"}, session)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	}
+	rec := postJSON(changePassword(testDB), ChangePasswordBody{CurrentPassword: "password123", NewPassword: "a new passphrase"}, session)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	rec = postJSON(login(testDB), ReqBody{Email: testUser.Email, Password: "password123"}, nil)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+
+	// Clean up
+	err = testUser.Delete(testDB)
+	assert.NoError(t, err)
+}
+
+func TestClientIPExtractor(t *testing.T) {
+	request := func(remoteAddr, forwardedFor string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set(echo.HeaderXForwardedFor, forwardedFor)
+		return req
+	}
+
+	// Without trusted proxies the header is ignored
+	direct, err := clientIPExtractor("")
+	assert.NoError(t, err)
+	assert.Equal(t, "192.0.2.1", direct(request("192.0.2.1:1234", "203.0.113.9")))
+
+	// Behind a trusted proxy the address it saw is used, but not what the client
+	// put in the header before it
+	behindProxy, err := clientIPExtractor("10.0.0.1, 10.1.0.0/16")
+	assert.NoError(t, err)
+	assert.Equal(t, "203.0.113.9", behindProxy(request("10.0.0.1:1234", "203.0.113.9")))
+	assert.Equal(t, "203.0.113.9", behindProxy(request("10.1.2.3:1234", "198.51.100.7, 203.0.113.9")))
+	assert.Equal(t, "192.0.2.1", behindProxy(request("192.0.2.1:1234", "203.0.113.9")))
+
+	_, err = clientIPExtractor("not-an-address")
+	assert.Error(t, err)
+}
@@ -7,7 +7,7 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
-// The secret is a generated 32-bit string used to provide a signature to our signed tokens.
+// The secret is a generated 32-bit string used to encrypt the token signing keys at rest.
 var SECRET = []byte(os.Getenv("COOKIE_SECRET"))
 
 // Claims represents the custom claims structure for JWT tokens.
@@ -20,7 +20,8 @@ type Claims struct {
 	jwt.RegisteredClaims        // Embedded struct for standard JWT claims.
 }
 
-// CreateToken generates a new JWT token with the provided email and a default expiration time.
+// CreateToken generates a new JWT token with the provided email and a default expiration time,
+// signed with the active signing key.
 //
 // Parameters:
 //   - email: The email address to be included in the token claims.
@@ -29,12 +30,10 @@ type Claims struct {
 //   - string: The generated JWT token as a string.
 //   - error: An error, if any, encountered during token generation.
 func CreateToken(email string) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+	tokenStr, err := signToken(jwt.MapClaims{
 		"email": email,
-		"exp":   time.Now().Add(time.Hour * 720).Unix(),
-	})
-
-	tokenStr, err := token.SignedString(SECRET)
+		"exp":   time.Now().Add(ACCESS_TOKEN_TTL).Unix(),
+	}, "")
 	if err != nil {
 		return "", err
 	}
@@ -51,9 +50,7 @@ func CreateToken(email string) (string, error) {
 //   - *Claims: The custom claims decoded from the token.
 //   - error: An error, if any, encountered during token decoding.
 func DecodeToken(tokenString string) (*Claims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		return SECRET, nil
-	}, jwt.WithLeeway(5*time.Second))
+	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, verificationKey, validMethods, jwt.WithLeeway(5*time.Second))
 
 	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
 		return claims, nil
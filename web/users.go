@@ -0,0 +1,227 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pragmahq/sso/database"
+	"github.com/pragmahq/sso/utils"
+)
+
+// maxUserPage caps how many users the admin listing returns at once.
+const maxUserPage = 200
+
+// UpdatePermissionsBody sets a user's built-in roles as a mask of the
+// database.Permission bits.
+type UpdatePermissionsBody struct {
+	Permissions int `json:"permissions"`
+}
+
+func registerUserRoutes(g *echo.Group, db *database.DB) {
+	g.GET("/users", listUsers(db))
+	g.GET("/users/:id", getUserDetails(db))
+	g.DELETE("/users/:id", deleteUser(db))
+	g.PUT("/users/:id/permissions", updateUserPermissions(db), utils.RequireGrant(database.PermManageRoles))
+	g.POST("/users/:id/disable", setUserDisabled(db, true))
+	g.POST("/users/:id/enable", setUserDisabled(db, false))
+	g.POST("/users/:id/reset-password", forcePasswordReset(db))
+}
+
+func userJSON(user *database.User) map[string]interface{} {
+	name := ""
+	if user.Profile != nil {
+		name = user.Profile.Name
+	}
+	return map[string]interface{}{
+		"id":              user.Id,
+		"email":           user.Email,
+		"name":            name,
+		"permissions":     user.Permissions,
+		"roles":           user.RoleIds(),
+		"emailVerifiedAt": user.EmailVerifiedAt,
+		"disabledAt":      user.DisabledAt,
+	}
+}
+
+// lastAdmin is the response for changes refused with database.ErrLastAdmin.
+func lastAdmin(c echo.Context) error {
+	return c.JSON(http.StatusConflict, map[string]string{"error": "Cannot remove the last admin"})
+}
+
+// listUsers lets an admin page through users. It accepts the query parameters q,
+// matched against email addresses and names, limit and offset.
+func listUsers(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		filter := database.UserFilter{
+			Query: strings.TrimSpace(c.QueryParam("q")),
+			Limit: 50,
+		}
+
+		if value := c.QueryParam("limit"); value != "" {
+			limit, err := strconv.Atoi(value)
+			if err != nil || limit < 1 || limit > maxUserPage {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid limit"})
+			}
+			filter.Limit = limit
+		}
+		if value := c.QueryParam("offset"); value != "" {
+			offset, err := strconv.Atoi(value)
+			if err != nil || offset < 0 {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid offset"})
+			}
+			filter.Offset = offset
+		}
+
+		users, total, err := database.ListUsers(db, filter)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+
+		response := []map[string]interface{}{}
+		for _, user := range users {
+			response = append(response, userJSON(user))
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"users": response,
+			"total": total,
+		})
+	}
+}
+
+// getUserDetails returns a user with their profile and the invites they created.
+func getUserDetails(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user := &database.User{Id: c.Param("id")}
+		if err := user.GetUserWithProfile(db); err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+		}
+		if err := user.GetUserWithInvites(db); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+
+		now := time.Now()
+		invites := []map[string]interface{}{}
+		for _, invite := range user.GeneratedInvites {
+			invites = append(invites, inviteJSON(invite, now))
+		}
+
+		response := userJSON(user)
+		if user.Profile != nil {
+			response["profile"] = map[string]interface{}{
+				"name":              user.Profile.Name,
+				"email":             user.Profile.Email,
+				"profilePictureUrl": user.Profile.ProfilePictureURL,
+				"bio":               user.Profile.Bio,
+			}
+		}
+		response["invites"] = invites
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+// updateUserPermissions gives a user the built-in roles in the mask and takes
+// away the others.
+func updateUserPermissions(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req UpdatePermissionsBody
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		}
+		if req.Permissions < 0 || req.Permissions&^(database.PermissionUser|database.PermissionEditor|database.PermissionAdmin) != 0 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid permissions"})
+		}
+
+		user := &database.User{Id: c.Param("id")}
+		if err := user.Read(db); err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+		}
+
+		user.Permissions = req.Permissions
+		err := user.UpdatePermissions(db.DB)
+		if err == database.ErrLastAdmin {
+			return lastAdmin(c)
+		}
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update permissions"})
+		}
+		if err := user.Read(db); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		return c.JSON(http.StatusOK, userJSON(user))
+	}
+}
+
+// setUserDisabled stops a user from signing in, signing them out everywhere, or
+// lets them sign in again.
+func setUserDisabled(db *database.DB, disabled bool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user := &database.User{Id: c.Param("id")}
+		if err := user.Read(db); err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+		}
+
+		err := user.SetDisabled(db, disabled)
+		if err == database.ErrLastAdmin {
+			return lastAdmin(c)
+		}
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update user"})
+		}
+		if disabled {
+			if err := database.RevokeSessions(db, user.Id, "", ""); err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to revoke sessions"})
+			}
+		}
+		return c.JSON(http.StatusOK, userJSON(user))
+	}
+}
+
+// forcePasswordReset clears a user's password, deletes their passkeys, signs
+// them out everywhere and emails them a reset link, so the new password they
+// choose is the only way left to sign in.
+func forcePasswordReset(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user := &database.User{Id: c.Param("id")}
+		if err := user.Read(db); err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+		}
+
+		_, err := db.Model(user).Set("password = ''").WherePK().Update()
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		if err := database.DeleteUserPasskeys(db, user.Id); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		if err := database.RevokeSessions(db, user.Id, "", ""); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to revoke sessions"})
+		}
+		if status, msg := sendPasswordReset(c, db, user); msg != "" {
+			return c.JSON(status, map[string]string{"error": msg})
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "A reset link has been sent"})
+	}
+}
+
+// deleteUser deletes a user's account. Their sessions go with it, which signs
+// them out everywhere.
+func deleteUser(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user := &database.User{Id: c.Param("id")}
+		if err := user.Read(db); err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+		}
+
+		err := user.Delete(db)
+		if err == database.ErrLastAdmin {
+			return lastAdmin(c)
+		}
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete user"})
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "User deleted"})
+	}
+}
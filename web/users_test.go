@@ -0,0 +1,111 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/pragmahq/sso/database"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAdminUserManagement(t *testing.T) {
+	// Create a test user
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	testUser := &database.User{
+		Id:          uuid.New().String(),
+		Email:       "managed-user@example.com",
+		Password:    string(hash),
+		Permissions: database.PermissionUser,
+	}
+	err = testUser.Create(testDB)
+	assert.NoError(t, err)
+
+	// Search finds the user by part of their email address
+	rec := adminRequest(listUsers(testDB), http.MethodGet, "", "q=MANAGED-user", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var list struct {
+		Users []map[string]interface{} `json:"users"`
+		Total int                      `json:"total"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &list))
+	assert.Equal(t, 1, list.Total)
+	if assert.Len(t, list.Users, 1) {
+		assert.Equal(t, testUser.Id, list.Users[0]["id"])
+	}
+	rec = adminRequest(listUsers(testDB), http.MethodGet, "", "limit=1000", nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = adminRequest(getUserDetails(testDB), http.MethodGet, testUser.Id, "", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"invites":[]`)
+
+	// A disabled user cannot sign in until enabled again
+	rec = adminRequest(setUserDisabled(testDB, true), http.MethodPost, testUser.Id, "", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = postJSON(login(testDB), ReqBody{Email: testUser.Email, Password: "password123"}, nil)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	rec = adminRequest(setUserDisabled(testDB, false), http.MethodPost, testUser.Id, "", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = postJSON(login(testDB), ReqBody{Email: testUser.Email, Password: "password123"}, nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// Make the user the only admin, who then cannot be demoted, disabled or deleted
+	rec = adminRequest(updateUserPermissions(testDB), http.MethodPut, testUser.Id, "", UpdatePermissionsBody{Permissions: database.PermissionUser | database.PermissionAdmin})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = adminRequest(updateUserPermissions(testDB), http.MethodPut, testUser.Id, "", UpdatePermissionsBody{Permissions: database.PermissionUser})
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	rec = adminRequest(setUserDisabled(testDB, true), http.MethodPost, testUser.Id, "", nil)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	rec = adminRequest(deleteUser(testDB), http.MethodDelete, testUser.Id, "", nil)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	rec = adminRequest(updateUserPermissions(testDB), http.MethodPut, testUser.Id, "", UpdatePermissionsBody{Permissions: 1 << 10})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// A forced reset stops the old password and passkeys from working and signs
+	// the user out
+	passkey := &database.Passkey{Id: uuid.New().String(), UserId: testUser.Id, Name: "Laptop", PublicKey: []byte("key"), CreatedAt: time.Now()}
+	err = passkey.Create(testDB)
+	assert.NoError(t, err)
+	session := createTestSession(t, testUser)
+	rec = adminRequest(forcePasswordReset(testDB), http.MethodPost, testUser.Id, "", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = postJSON(login(testDB), ReqBody{Email: testUser.Email, Password: "password123"}, nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	count, err := database.CountPasskeys(testDB, testUser.Id)
+	assert.NoError(t, err)
+	assert.Zero(t, count)
+	session, err = database.GetSession(testDB, session.Id)
+	if assert.NoError(t, err) {
+		assert.False(t, session.IsActive())
+	}
+
+	// Clean up
+	err = database.UnassignRole(testDB, testUser.Id, database.RoleAdmin)
+	assert.NoError(t, err)
+	rec = adminRequest(deleteUser(testDB), http.MethodDelete, testUser.Id, "", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = adminRequest(getUserDetails(testDB), http.MethodGet, testUser.Id, "", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func adminRequest(handler echo.HandlerFunc, method, id, query string, body interface{}) *httptest.ResponseRecorder {
+	payload, _ := json.Marshal(body)
+	req := httptest.NewRequest(method, "/?"+query, strings.NewReader(string(payload)))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	if id != "" {
+		c.SetParamNames("id")
+		c.SetParamValues(id)
+	}
+	handler(c)
+	return rec
+}
@@ -0,0 +1,178 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/pragmahq/sso/database"
+)
+
+// emailVerificationTokenType is the `typ` header of the tokens in verification
+// links. They are bound to the address they were sent to, so a link stops working
+// once the address is verified or changed.
+const emailVerificationTokenType = "verify+jwt"
+
+// Values of EMAIL_VERIFICATION_POLICY.
+const (
+	// VerificationOptional lets unverified users do everything.
+	VerificationOptional = "optional"
+	// VerificationToken lets unverified users sign in here but refuses to issue
+	// them tokens for other applications.
+	VerificationToken = "token"
+	// VerificationLogin refuses to sign unverified users in at all.
+	VerificationLogin = "login"
+)
+
+var (
+	EMAIL_VERIFICATION_POLICY = envString("EMAIL_VERIFICATION_POLICY", VerificationOptional)
+
+	// EMAIL_VERIFICATION_URL is the frontend page verification links point to. The
+	// token is appended as the `token` query parameter.
+	EMAIL_VERIFICATION_URL = envString("EMAIL_VERIFICATION_URL", loginOrigin().String()+"/verify-email")
+	EMAIL_VERIFICATION_TTL = envDuration("EMAIL_VERIFICATION_TTL", 48*time.Hour)
+
+	// EMAIL_VERIFICATION_RESEND_INTERVAL is the minimum time between two
+	// verification emails to the same user.
+	EMAIL_VERIFICATION_RESEND_INTERVAL = envDuration("EMAIL_VERIFICATION_RESEND_INTERVAL", 5*time.Minute)
+)
+
+type VerifyEmailBody struct {
+	Token string `json:"token"`
+}
+
+type ResendVerificationBody struct {
+	Email string `json:"email"`
+}
+
+func registerVerificationRoutes(g *echo.Group, db *database.DB) {
+	g.POST("/email/verify", verifyEmail(db))
+	g.POST("/email/verify/resend", resendVerification(db))
+}
+
+func verifyEmail(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req VerifyEmailBody
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		}
+
+		userID, email, err := parseEmailToken(req.Token, emailVerificationTokenType)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid or expired verification link"})
+		}
+
+		user := &database.User{Id: userID}
+		ok, err := user.MarkEmailVerified(db, email)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		if !ok {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid or expired verification link"})
+		}
+
+		return c.JSON(http.StatusOK, map[string]string{"message": "Email address verified"})
+	}
+}
+
+// resendVerification sends a new verification link to an unverified address. Like
+// forgotPassword it answers the same whether or not the address belongs to an
+// account, and it sends at most one email per EMAIL_VERIFICATION_RESEND_INTERVAL.
+func resendVerification(db *database.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req ResendVerificationBody
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		}
+
+		response := map[string]string{"message": "If the address needs verifying, a new link has been sent"}
+
+		user, err := database.GetUserByEmail(db, req.Email)
+		if err != nil || user.IsEmailVerified() {
+			return c.JSON(http.StatusOK, response)
+		}
+
+		ok, err := user.ClaimVerificationEmail(db, EMAIL_VERIFICATION_RESEND_INTERVAL)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		if !ok {
+			return c.JSON(http.StatusOK, response)
+		}
+
+		email, err := newVerificationEmail(user)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to send email"})
+		}
+		if err := email.Create(db); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		notifyMailer()
+
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+// newVerificationEmail builds the email with the link that verifies the user's
+// current address.
+func newVerificationEmail(user *database.User) (*database.OutboxEmail, error) {
+	token, err := createEmailToken(user.Id, user.Email, emailVerificationTokenType, EMAIL_VERIFICATION_TTL)
+	if err != nil {
+		return nil, err
+	}
+	return newEmail("email_verification", user.Email, map[string]interface{}{
+		"Link":    appendQuery(EMAIL_VERIFICATION_URL, url.Values{"token": {token}}),
+		"Expires": EMAIL_VERIFICATION_TTL.String(),
+	})
+}
+
+// requiresVerifiedEmail reports whether the policy stops an unverified user at the
+// given stage: VerificationLogin for signing in, VerificationToken for getting
+// tokens for other applications.
+func requiresVerifiedEmail(user *database.User, stage string) bool {
+	if user.IsEmailVerified() {
+		return false
+	}
+	switch EMAIL_VERIFICATION_POLICY {
+	case VerificationLogin:
+		return true
+	case VerificationToken:
+		return stage == VerificationToken
+	}
+	return false
+}
+
+// createEmailToken signs a token proving the holder received an email sent to
+// email on behalf of the user.
+func createEmailToken(userID, email, typ string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	return signToken(jwt.MapClaims{
+		"sub":   userID,
+		"email": email,
+		"iat":   now.Unix(),
+		"exp":   now.Add(ttl).Unix(),
+	}, typ)
+}
+
+func parseEmailToken(tokenString, typ string) (userID, email string, err error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if token.Header["typ"] != typ {
+			return nil, errors.New("unexpected token type")
+		}
+		return verificationKey(token)
+	}, validMethods, jwt.WithExpirationRequired())
+	if err != nil {
+		return "", "", err
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+	userID, _ = claims["sub"].(string)
+	email, _ = claims["email"].(string)
+	if userID == "" || email == "" {
+		return "", "", errors.New("incomplete token")
+	}
+	return userID, email, nil
+}
@@ -0,0 +1,77 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/pragmahq/sso/database"
+	"github.com/pragmahq/sso/mailer"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestEmailVerification(t *testing.T) {
+	captured := &mailer.CaptureMailer{}
+	mail = captured
+	EMAIL_VERIFICATION_POLICY = VerificationLogin
+	defer func() { EMAIL_VERIFICATION_POLICY = VerificationOptional }()
+
+	// Create an unverified test user
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	testUser := &database.User{
+		Id:       uuid.New().String(),
+		Email:    "verify@example.com",
+		Password: string(hash),
+	}
+	err = testUser.Create(testDB)
+	assert.NoError(t, err)
+
+	// The policy keeps the user out until the address is verified
+	rec := postJSON(login(testDB), ReqBody{Email: testUser.Email, Password: "password123"}, nil)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Contains(t, rec.Body.String(), "email_unverified")
+
+	// Resending is throttled
+	for i := 0; i < 2; i++ {
+		rec = postJSON(resendVerification(testDB), ResendVerificationBody{Email: testUser.Email}, nil)
+		assert.Equal(t, http.StatusOK, rec.Code)
+	}
+	_, err = deliverOutbox(context.Background(), testDB)
+	assert.NoError(t, err)
+	sent := 0
+	for _, msg := range captured.Messages() {
+		if msg.To == testUser.Email {
+			sent++
+		}
+	}
+	assert.Equal(t, 1, sent)
+
+	// The link verifies the address exactly once
+	token := mailedToken(t, captured.Last(testUser.Email))
+	rec = postJSON(verifyEmail(testDB), VerifyEmailBody{Token: token}, nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = postJSON(verifyEmail(testDB), VerifyEmailBody{Token: token}, nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = postJSON(login(testDB), ReqBody{Email: testUser.Email, Password: "password123"}, nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// The ID token carries the verified state
+	err = testUser.Read(testDB)
+	assert.NoError(t, err)
+	idToken, err := createIDToken(testUser, "client", "session", "openid email", "", time.Now())
+	assert.NoError(t, err)
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(idToken, claims, verificationKey, validMethods)
+	assert.NoError(t, err)
+	assert.Equal(t, true, claims["email_verified"])
+
+	// Clean up
+	err = testUser.Delete(testDB)
+	assert.NoError(t, err)
+}
@@ -8,7 +8,6 @@ import (
 	"strings"
 	"testing"
 
-	"github.com/golang-jwt/jwt"
 	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
 	"github.com/pragmahq/sso/database"
@@ -27,6 +26,14 @@ func TestMain(m *testing.M) {
 		panic(err)
 	}
 
+	if len(SECRET) == 0 {
+		SECRET = []byte("test-cookie-secret")
+	}
+	err = loadSigningKeys(testDB)
+	if err != nil {
+		panic(err)
+	}
+
 	// Run tests
 	code := m.Run()
 
@@ -86,7 +93,7 @@ func TestLogout(t *testing.T) {
 	rec := httptest.NewRecorder()
 	c := e.NewContext(req, rec)
 
-	if assert.NoError(t, logout(c)) {
+	if assert.NoError(t, logout(testDB)(c)) {
 		assert.Equal(t, http.StatusOK, rec.Code)
 		assert.Equal(t, "Logged out successfully", rec.Body.String())
 
@@ -112,12 +119,8 @@ func TestGetUser(t *testing.T) {
 	err := testUser.Create(testDB)
 	assert.NoError(t, err)
 
-	// Mock JWT token
-	c.Set("user", &jwt.Token{
-		Claims: jwt.MapClaims{
-			"user_id": testUser.Id,
-		},
-	})
+	// The session set by requireSession names the user
+	c.Set("session", createTestSession(t, testUser))
 
 	h := getUser(testDB)
 	if assert.NoError(t, h(c)) {
@@ -0,0 +1,133 @@
+package webauthn
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+)
+
+// Authenticator is a software authenticator holding a single ES256 credential.
+// It lets tests run the registration and login ceremonies end to end without
+// hardware. It always performs user verification and increments its counter on
+// every assertion.
+type Authenticator struct {
+	CredentialID []byte
+	UserHandle   []byte
+	SignCount    uint32
+
+	key *ecdsa.PrivateKey
+}
+
+func NewAuthenticator() (*Authenticator, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	return &Authenticator{CredentialID: id, key: key}, nil
+}
+
+// Register answers navigator.credentials.create() for options as if it was called
+// from origin.
+func (a *Authenticator) Register(options *CreationOptions, origin string) (*RegistrationCredential, error) {
+	publicKey, err := encodePublicKey(&a.key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	authData := a.authenticatorData(options.RP.ID, flagAttestedData)
+	authData = append(authData, make([]byte, 16)...)
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(a.CredentialID)))
+	authData = append(authData, a.CredentialID...)
+	authData = append(authData, publicKey...)
+
+	attestation, err := encodeCBOR(map[interface{}]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[interface{}]interface{}{},
+		"authData": authData,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	clientData, err := a.clientData("webauthn.create", options.Challenge, origin)
+	if err != nil {
+		return nil, err
+	}
+
+	a.UserHandle = options.User.ID
+
+	cred := &RegistrationCredential{
+		ID:    base64.RawURLEncoding.EncodeToString(a.CredentialID),
+		RawID: a.CredentialID,
+		Type:  "public-key",
+	}
+	cred.Response.ClientDataJSON = clientData
+	cred.Response.AttestationObject = attestation
+	cred.Response.Transports = []string{"internal"}
+	return cred, nil
+}
+
+// Assert answers navigator.credentials.get() for options as if it was called from
+// origin.
+func (a *Authenticator) Assert(options *RequestOptions, origin string) (*AssertionCredential, error) {
+	if len(options.AllowCredentials) > 0 {
+		allowed := false
+		for _, cred := range options.AllowCredentials {
+			if string(cred.ID) == string(a.CredentialID) {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return nil, errors.New("credential not allowed")
+		}
+	}
+
+	a.SignCount++
+	authData := a.authenticatorData(options.RPID, 0)
+
+	clientData, err := a.clientData("webauthn.get", options.Challenge, origin)
+	if err != nil {
+		return nil, err
+	}
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	cred := &AssertionCredential{
+		ID:    base64.RawURLEncoding.EncodeToString(a.CredentialID),
+		RawID: a.CredentialID,
+		Type:  "public-key",
+	}
+	cred.Response.ClientDataJSON = clientData
+	cred.Response.AuthenticatorData = authData
+	cred.Response.Signature = signature
+	cred.Response.UserHandle = a.UserHandle
+	return cred, nil
+}
+
+func (a *Authenticator) authenticatorData(rpID string, flags byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	data := append([]byte(nil), rpIDHash[:]...)
+	data = append(data, flags|flagUserPresent|flagUserVerified)
+	return binary.BigEndian.AppendUint32(data, a.SignCount)
+}
+
+func (a *Authenticator) clientData(ceremony string, challenge []byte, origin string) ([]byte, error) {
+	return json.Marshal(clientData{
+		Type:      ceremony,
+		Challenge: base64.RawURLEncoding.EncodeToString(challenge),
+		Origin:    origin,
+	})
+}
@@ -0,0 +1,229 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// This is the subset of CBOR (RFC 8949) that WebAuthn needs: attestation objects
+// and COSE keys only use definite-length integers, byte and text strings, arrays
+// and maps. Decoded maps have int64 or string keys.
+
+var errCBORTruncated = errors.New("cbor: unexpected end of data")
+
+// decodeCBOR decodes one data item and returns it along with the remaining bytes.
+func decodeCBOR(data []byte) (interface{}, []byte, error) {
+	return decodeItem(data, 0)
+}
+
+func decodeItem(data []byte, depth int) (interface{}, []byte, error) {
+	if depth > 16 {
+		return nil, nil, errors.New("cbor: nesting too deep")
+	}
+	if len(data) == 0 {
+		return nil, nil, errCBORTruncated
+	}
+
+	major := data[0] >> 5
+	info := data[0] & 0x1f
+	data = data[1:]
+
+	if major == 7 {
+		return decodeSimple(info, data)
+	}
+
+	n, data, err := decodeArgument(info, data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case 0:
+		if n > math.MaxInt64 {
+			return nil, nil, errors.New("cbor: integer overflow")
+		}
+		return int64(n), data, nil
+	case 1:
+		if n > math.MaxInt64 {
+			return nil, nil, errors.New("cbor: integer overflow")
+		}
+		return -1 - int64(n), data, nil
+	case 2, 3:
+		if uint64(len(data)) < n {
+			return nil, nil, errCBORTruncated
+		}
+		if major == 2 {
+			return append([]byte(nil), data[:n]...), data[n:], nil
+		}
+		return string(data[:n]), data[n:], nil
+	case 4:
+		if n > uint64(len(data)) {
+			return nil, nil, errCBORTruncated
+		}
+		items := make([]interface{}, 0, n)
+		for i := uint64(0); i < n; i++ {
+			var item interface{}
+			item, data, err = decodeItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, data, nil
+	case 5:
+		if n > uint64(len(data)) {
+			return nil, nil, errCBORTruncated
+		}
+		items := make(map[interface{}]interface{}, n)
+		for i := uint64(0); i < n; i++ {
+			var key, value interface{}
+			key, data, err = decodeItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errors.New("cbor: unsupported map key type")
+			}
+			value, data, err = decodeItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items[key] = value
+		}
+		return items, data, nil
+	case 6:
+		// Tags carry no meaning for WebAuthn, only the tagged item matters.
+		return decodeItem(data, depth+1)
+	}
+	return nil, nil, fmt.Errorf("cbor: unsupported major type %d", major)
+}
+
+func decodeArgument(info byte, data []byte) (uint64, []byte, error) {
+	switch {
+	case info < 24:
+		return uint64(info), data, nil
+	case info == 24:
+		if len(data) < 1 {
+			return 0, nil, errCBORTruncated
+		}
+		return uint64(data[0]), data[1:], nil
+	case info == 25:
+		if len(data) < 2 {
+			return 0, nil, errCBORTruncated
+		}
+		return uint64(binary.BigEndian.Uint16(data)), data[2:], nil
+	case info == 26:
+		if len(data) < 4 {
+			return 0, nil, errCBORTruncated
+		}
+		return uint64(binary.BigEndian.Uint32(data)), data[4:], nil
+	case info == 27:
+		if len(data) < 8 {
+			return 0, nil, errCBORTruncated
+		}
+		return binary.BigEndian.Uint64(data), data[8:], nil
+	}
+	return 0, nil, errors.New("cbor: indefinite lengths are not supported")
+}
+
+func decodeSimple(info byte, data []byte) (interface{}, []byte, error) {
+	switch info {
+	case 20:
+		return false, data, nil
+	case 21:
+		return true, data, nil
+	case 22, 23:
+		return nil, data, nil
+	case 26:
+		if len(data) < 4 {
+			return nil, nil, errCBORTruncated
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data))), data[4:], nil
+	case 27:
+		if len(data) < 8 {
+			return nil, nil, errCBORTruncated
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(data)), data[8:], nil
+	}
+	return nil, nil, fmt.Errorf("cbor: unsupported simple value %d", info)
+}
+
+// encodeCBOR encodes integers, strings, byte strings, booleans, arrays and maps
+// with int or string keys. Map keys are sorted so the output is deterministic.
+func encodeCBOR(value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case int:
+		return encodeInt(int64(v)), nil
+	case int64:
+		return encodeInt(v), nil
+	case []byte:
+		return append(encodeHead(2, uint64(len(v))), v...), nil
+	case string:
+		return append(encodeHead(3, uint64(len(v))), v...), nil
+	case bool:
+		if v {
+			return []byte{0xf5}, nil
+		}
+		return []byte{0xf4}, nil
+	case []interface{}:
+		out := encodeHead(4, uint64(len(v)))
+		for _, item := range v {
+			encoded, err := encodeCBOR(item)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, encoded...)
+		}
+		return out, nil
+	case map[interface{}]interface{}:
+		type entry struct{ key, value []byte }
+		entries := make([]entry, 0, len(v))
+		for key, item := range v {
+			k, err := encodeCBOR(key)
+			if err != nil {
+				return nil, err
+			}
+			i, err := encodeCBOR(item)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry{k, i})
+		}
+		sort.Slice(entries, func(i, j int) bool { return string(entries[i].key) < string(entries[j].key) })
+
+		out := encodeHead(5, uint64(len(v)))
+		for _, e := range entries {
+			out = append(out, e.key...)
+			out = append(out, e.value...)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("cbor: cannot encode %T", value)
+}
+
+func encodeInt(v int64) []byte {
+	if v < 0 {
+		return encodeHead(1, uint64(-1-v))
+	}
+	return encodeHead(0, uint64(v))
+}
+
+func encodeHead(major byte, n uint64) []byte {
+	major <<= 5
+	switch {
+	case n < 24:
+		return []byte{major | byte(n)}
+	case n <= math.MaxUint8:
+		return []byte{major | 24, byte(n)}
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16([]byte{major | 25}, uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32([]byte{major | 26}, uint32(n))
+	}
+	return binary.BigEndian.AppendUint64([]byte{major | 27}, n)
+}
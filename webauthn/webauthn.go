@@ -0,0 +1,413 @@
+// Package webauthn implements the relying party side of WebAuthn registration
+// and authentication ceremonies (https://www.w3.org/TR/webauthn-2/).
+//
+// Only "none" attestation is accepted: the relying party asks browsers not to
+// reveal authenticator make and model, so there is no attestation statement to
+// verify.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidSignature       = errors.New("webauthn: invalid signature")
+	ErrChallengeMismatch      = errors.New("webauthn: challenge mismatch")
+	ErrOriginMismatch         = errors.New("webauthn: origin not allowed")
+	ErrRPIDMismatch           = errors.New("webauthn: relying party ID mismatch")
+	ErrUserNotPresent         = errors.New("webauthn: user presence not asserted")
+	ErrUserNotVerified        = errors.New("webauthn: user verification required")
+	ErrSignCountRegression    = errors.New("webauthn: signature counter did not increase, the authenticator may be cloned")
+	ErrUnsupportedAttestation = errors.New("webauthn: unsupported attestation format")
+)
+
+// Authenticator data flags.
+const (
+	flagUserPresent    = 0x01
+	flagUserVerified   = 0x04
+	flagBackupEligible = 0x08
+	flagBackedUp       = 0x10
+	flagAttestedData   = 0x40
+	flagExtensionData  = 0x80
+)
+
+const challengeSize = 32
+
+// UserVerification values for options.
+const (
+	VerificationRequired    = "required"
+	VerificationPreferred   = "preferred"
+	VerificationDiscouraged = "discouraged"
+)
+
+// RelyingParty identifies the site credentials are scoped to. ID is a registrable
+// domain such as "example.com" and Origins are the exact origins ceremonies may
+// run on, e.g. "https://login.example.com".
+type RelyingParty struct {
+	ID      string
+	Name    string
+	Origins []string
+	Timeout time.Duration
+}
+
+// Base64URL is binary data that is unpadded base64url in JSON, the encoding used
+// by PublicKeyCredential.toJSON() and the parse*OptionsFromJSON() browser APIs.
+type Base64URL []byte
+
+func (b Base64URL) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+func (b *Base64URL) UnmarshalJSON(data []byte) error {
+	var s *string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	if s == nil {
+		*b = nil
+		return nil
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(*s, "="))
+	if err != nil {
+		return err
+	}
+	*b = decoded
+	return nil
+}
+
+// User is the account a credential is created for. ID is the opaque user handle
+// returned by discoverable credentials during login.
+type User struct {
+	ID          Base64URL `json:"id"`
+	Name        string    `json:"name"`
+	DisplayName string    `json:"displayName"`
+}
+
+type CredentialDescriptor struct {
+	Type       string    `json:"type"`
+	ID         Base64URL `json:"id"`
+	Transports []string  `json:"transports,omitempty"`
+}
+
+type CredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int64  `json:"alg"`
+}
+
+type AuthenticatorSelection struct {
+	ResidentKey        string `json:"residentKey"`
+	RequireResidentKey bool   `json:"requireResidentKey"`
+	UserVerification   string `json:"userVerification"`
+}
+
+type RelyingPartyEntity struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// CreationOptions is PublicKeyCredentialCreationOptions as JSON.
+type CreationOptions struct {
+	RP                     RelyingPartyEntity     `json:"rp"`
+	User                   User                   `json:"user"`
+	Challenge              Base64URL              `json:"challenge"`
+	PubKeyCredParams       []CredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout,omitempty"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// RequestOptions is PublicKeyCredentialRequestOptions as JSON.
+type RequestOptions struct {
+	Challenge        Base64URL              `json:"challenge"`
+	Timeout          int64                  `json:"timeout,omitempty"`
+	RPID             string                 `json:"rpId"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+// RegistrationCredential is the JSON form of the credential returned by
+// navigator.credentials.create().
+type RegistrationCredential struct {
+	ID       string    `json:"id"`
+	RawID    Base64URL `json:"rawId"`
+	Type     string    `json:"type"`
+	Response struct {
+		ClientDataJSON    Base64URL `json:"clientDataJSON"`
+		AttestationObject Base64URL `json:"attestationObject"`
+		Transports        []string  `json:"transports"`
+	} `json:"response"`
+}
+
+// AssertionCredential is the JSON form of the credential returned by
+// navigator.credentials.get().
+type AssertionCredential struct {
+	ID       string    `json:"id"`
+	RawID    Base64URL `json:"rawId"`
+	Type     string    `json:"type"`
+	Response struct {
+		ClientDataJSON    Base64URL `json:"clientDataJSON"`
+		AuthenticatorData Base64URL `json:"authenticatorData"`
+		Signature         Base64URL `json:"signature"`
+		UserHandle        Base64URL `json:"userHandle"`
+	} `json:"response"`
+}
+
+// Credential is a newly registered credential, ready to be stored.
+type Credential struct {
+	ID             []byte
+	PublicKey      []byte
+	Algorithm      int64
+	SignCount      uint32
+	AAGUID         []byte
+	Transports     []string
+	UserVerified   bool
+	BackupEligible bool
+	BackedUp       bool
+}
+
+// Assertion is the outcome of a successful authentication ceremony.
+type Assertion struct {
+	SignCount    uint32
+	UserVerified bool
+	BackedUp     bool
+}
+
+// NewChallenge returns a random challenge for one ceremony.
+func NewChallenge() ([]byte, error) {
+	challenge := make([]byte, challengeSize)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// CreationOptions builds the options for registering a credential for user.
+// Existing credentials are excluded so an authenticator is not registered twice.
+// Passkeys are created as discoverable credentials so they can be used without
+// entering a username.
+func (rp *RelyingParty) CreationOptions(user User, challenge []byte, exclude []CredentialDescriptor) *CreationOptions {
+	params := make([]CredentialParameter, 0, len(SupportedAlgorithms))
+	for _, alg := range SupportedAlgorithms {
+		params = append(params, CredentialParameter{Type: "public-key", Alg: alg})
+	}
+	if exclude == nil {
+		exclude = []CredentialDescriptor{}
+	}
+
+	return &CreationOptions{
+		RP:                 RelyingPartyEntity{ID: rp.ID, Name: rp.Name},
+		User:               user,
+		Challenge:          challenge,
+		PubKeyCredParams:   params,
+		Timeout:            rp.Timeout.Milliseconds(),
+		ExcludeCredentials: exclude,
+		AuthenticatorSelection: AuthenticatorSelection{
+			ResidentKey:        "required",
+			RequireResidentKey: true,
+			UserVerification:   VerificationPreferred,
+		},
+		Attestation: "none",
+	}
+}
+
+// RequestOptions builds the options for an authentication ceremony. An empty
+// allow list lets the user pick any discoverable credential for this site.
+func (rp *RelyingParty) RequestOptions(challenge []byte, allow []CredentialDescriptor, userVerification string) *RequestOptions {
+	if allow == nil {
+		allow = []CredentialDescriptor{}
+	}
+	return &RequestOptions{
+		Challenge:        challenge,
+		Timeout:          rp.Timeout.Milliseconds(),
+		RPID:             rp.ID,
+		AllowCredentials: allow,
+		UserVerification: userVerification,
+	}
+}
+
+// VerifyRegistration checks the response to a registration ceremony started with
+// challenge and returns the new credential.
+func (rp *RelyingParty) VerifyRegistration(cred *RegistrationCredential, challenge []byte, requireUV bool) (*Credential, error) {
+	if err := rp.verifyClientData(cred.Response.ClientDataJSON, "webauthn.create", challenge); err != nil {
+		return nil, err
+	}
+
+	value, rest, err := decodeCBOR(cred.Response.AttestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("webauthn: invalid attestation object: %w", err)
+	}
+	attestation, ok := value.(map[interface{}]interface{})
+	if !ok || len(rest) != 0 {
+		return nil, errors.New("webauthn: invalid attestation object")
+	}
+	format, _ := attestation["fmt"].(string)
+	statement, _ := attestation["attStmt"].(map[interface{}]interface{})
+	if format != "none" || len(statement) != 0 {
+		return nil, ErrUnsupportedAttestation
+	}
+	raw, _ := attestation["authData"].([]byte)
+
+	data, err := rp.parseAuthenticatorData(raw, requireUV)
+	if err != nil {
+		return nil, err
+	}
+	if data.flags&flagAttestedData == 0 {
+		return nil, errors.New("webauthn: missing attested credential data")
+	}
+	if len(cred.RawID) != 0 && !bytes.Equal(cred.RawID, data.credentialID) {
+		return nil, errors.New("webauthn: credential ID mismatch")
+	}
+
+	key, err := ParsePublicKey(data.publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("webauthn: %w", err)
+	}
+
+	return &Credential{
+		ID:             data.credentialID,
+		PublicKey:      data.publicKey,
+		Algorithm:      key.Algorithm,
+		SignCount:      data.signCount,
+		AAGUID:         data.aaguid,
+		Transports:     cred.Response.Transports,
+		UserVerified:   data.flags&flagUserVerified != 0,
+		BackupEligible: data.flags&flagBackupEligible != 0,
+		BackedUp:       data.flags&flagBackedUp != 0,
+	}, nil
+}
+
+// VerifyAssertion checks the response to an authentication ceremony started with
+// challenge against the stored public key and signature counter. A counter that
+// does not increase means the credential was probably cloned and is rejected.
+// Authenticators that do not implement counters always report zero.
+func (rp *RelyingParty) VerifyAssertion(cred *AssertionCredential, challenge, publicKey []byte, signCount uint32, requireUV bool) (*Assertion, error) {
+	if err := rp.verifyClientData(cred.Response.ClientDataJSON, "webauthn.get", challenge); err != nil {
+		return nil, err
+	}
+
+	data, err := rp.parseAuthenticatorData(cred.Response.AuthenticatorData, requireUV)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ParsePublicKey(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("webauthn: %w", err)
+	}
+	clientDataHash := sha256.Sum256(cred.Response.ClientDataJSON)
+	signed := append(append([]byte(nil), cred.Response.AuthenticatorData...), clientDataHash[:]...)
+	if err := key.Verify(signed, cred.Response.Signature); err != nil {
+		return nil, err
+	}
+
+	if (data.signCount != 0 || signCount != 0) && data.signCount <= signCount {
+		return nil, ErrSignCountRegression
+	}
+
+	return &Assertion{
+		SignCount:    data.signCount,
+		UserVerified: data.flags&flagUserVerified != 0,
+		BackedUp:     data.flags&flagBackedUp != 0,
+	}, nil
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+func (rp *RelyingParty) verifyClientData(raw []byte, ceremony string, challenge []byte) error {
+	var data clientData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return fmt.Errorf("webauthn: invalid client data: %w", err)
+	}
+	if data.Type != ceremony {
+		return fmt.Errorf("webauthn: unexpected client data type %q", data.Type)
+	}
+
+	received, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(data.Challenge, "="))
+	if err != nil || subtle.ConstantTimeCompare(received, challenge) != 1 {
+		return ErrChallengeMismatch
+	}
+
+	for _, origin := range rp.Origins {
+		if data.Origin == origin {
+			return nil
+		}
+	}
+	return ErrOriginMismatch
+}
+
+type authenticatorData struct {
+	flags        byte
+	signCount    uint32
+	aaguid       []byte
+	credentialID []byte
+	publicKey    []byte
+}
+
+func (rp *RelyingParty) parseAuthenticatorData(raw []byte, requireUV bool) (*authenticatorData, error) {
+	if len(raw) < 37 {
+		return nil, errors.New("webauthn: authenticator data too short")
+	}
+
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if subtle.ConstantTimeCompare(raw[:32], rpIDHash[:]) != 1 {
+		return nil, ErrRPIDMismatch
+	}
+
+	data := &authenticatorData{
+		flags:     raw[32],
+		signCount: binary.BigEndian.Uint32(raw[33:37]),
+	}
+	if data.flags&flagUserPresent == 0 {
+		return nil, ErrUserNotPresent
+	}
+	if requireUV && data.flags&flagUserVerified == 0 {
+		return nil, ErrUserNotVerified
+	}
+
+	rest := raw[37:]
+	if data.flags&flagAttestedData != 0 {
+		if len(rest) < 18 {
+			return nil, errors.New("webauthn: attested credential data too short")
+		}
+		data.aaguid = append([]byte(nil), rest[:16]...)
+		length := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if length == 0 || length > 1023 || len(rest) < length {
+			return nil, errors.New("webauthn: invalid credential ID")
+		}
+		data.credentialID = append([]byte(nil), rest[:length]...)
+		rest = rest[length:]
+
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, fmt.Errorf("webauthn: invalid credential public key: %w", err)
+		}
+		data.publicKey = append([]byte(nil), rest[:len(rest)-len(after)]...)
+		rest = after
+	}
+	if data.flags&flagExtensionData != 0 {
+		var err error
+		if _, rest, err = decodeCBOR(rest); err != nil {
+			return nil, fmt.Errorf("webauthn: invalid extension data: %w", err)
+		}
+	}
+	if len(rest) != 0 {
+		return nil, errors.New("webauthn: trailing authenticator data")
+	}
+	return data, nil
+}
@@ -0,0 +1,119 @@
+package webauthn
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testRP = &RelyingParty{
+	ID:      "localhost",
+	Name:    "Pragma",
+	Origins: []string{"http://localhost:3000"},
+	Timeout: 5 * time.Minute,
+}
+
+const testOrigin = "http://localhost:3000"
+
+func register(t *testing.T, authenticator *Authenticator) *Credential {
+	challenge, err := NewChallenge()
+	assert.NoError(t, err)
+
+	options := testRP.CreationOptions(User{ID: []byte("user-1"), Name: "test@example.com"}, challenge, nil)
+	response, err := authenticator.Register(options, testOrigin)
+	assert.NoError(t, err)
+
+	cred, err := testRP.VerifyRegistration(response, challenge, true)
+	assert.NoError(t, err)
+	return cred
+}
+
+func TestRegistrationAndAssertion(t *testing.T) {
+	authenticator, err := NewAuthenticator()
+	assert.NoError(t, err)
+
+	cred := register(t, authenticator)
+	assert.Equal(t, authenticator.CredentialID, cred.ID)
+	assert.Equal(t, AlgES256, cred.Algorithm)
+	assert.True(t, cred.UserVerified)
+
+	challenge, err := NewChallenge()
+	assert.NoError(t, err)
+	options := testRP.RequestOptions(challenge, nil, VerificationRequired)
+	response, err := authenticator.Assert(options, testOrigin)
+	assert.NoError(t, err)
+
+	// The response survives the JSON round trip through the browser
+	body, err := json.Marshal(response)
+	assert.NoError(t, err)
+	var decoded AssertionCredential
+	assert.NoError(t, json.Unmarshal(body, &decoded))
+
+	assertion, err := testRP.VerifyAssertion(&decoded, challenge, cred.PublicKey, cred.SignCount, true)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1), assertion.SignCount)
+	assert.Equal(t, []byte("user-1"), []byte(decoded.Response.UserHandle))
+}
+
+func TestAssertionRejected(t *testing.T) {
+	authenticator, err := NewAuthenticator()
+	assert.NoError(t, err)
+	cred := register(t, authenticator)
+
+	challenge, err := NewChallenge()
+	assert.NoError(t, err)
+	options := testRP.RequestOptions(challenge, nil, VerificationRequired)
+	response, err := authenticator.Assert(options, testOrigin)
+	assert.NoError(t, err)
+
+	other, err := NewChallenge()
+	assert.NoError(t, err)
+	_, err = testRP.VerifyAssertion(response, other, cred.PublicKey, cred.SignCount, true)
+	assert.ErrorIs(t, err, ErrChallengeMismatch)
+
+	// A cloned authenticator replays a counter that was already seen
+	_, err = testRP.VerifyAssertion(response, challenge, cred.PublicKey, 5, true)
+	assert.ErrorIs(t, err, ErrSignCountRegression)
+
+	phishing, err := authenticator.Assert(options, "https://evil.example")
+	assert.NoError(t, err)
+	_, err = testRP.VerifyAssertion(phishing, challenge, cred.PublicKey, cred.SignCount, true)
+	assert.ErrorIs(t, err, ErrOriginMismatch)
+
+	tampered, err := authenticator.Assert(options, testOrigin)
+	assert.NoError(t, err)
+	tampered.Response.Signature[len(tampered.Response.Signature)-1] ^= 0xff
+	_, err = testRP.VerifyAssertion(tampered, challenge, cred.PublicKey, cred.SignCount, true)
+	assert.Error(t, err)
+
+	otherRP := *testRP
+	otherRP.ID = "example.com"
+	_, err = otherRP.VerifyAssertion(response, challenge, cred.PublicKey, cred.SignCount, true)
+	assert.ErrorIs(t, err, ErrRPIDMismatch)
+}
+
+func TestCBORRoundTrip(t *testing.T) {
+	value := map[interface{}]interface{}{
+		1:      2,
+		-1:     []byte{1, 2, 3},
+		"list": []interface{}{"a", 300, -70000},
+		"ok":   true,
+	}
+	encoded, err := encodeCBOR(value)
+	assert.NoError(t, err)
+
+	decoded, rest, err := decodeCBOR(encoded)
+	assert.NoError(t, err)
+	assert.Empty(t, rest)
+	assert.Equal(t, map[interface{}]interface{}{
+		int64(1):  int64(2),
+		int64(-1): []byte{1, 2, 3},
+		"list":    []interface{}{"a", int64(300), int64(-70000)},
+		"ok":      true,
+	}, decoded)
+
+	_, _, err = decodeCBOR(encoded[:len(encoded)-1])
+	assert.Error(t, err)
+}